@@ -0,0 +1,349 @@
+package pgbarrel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// A SchemaRegistry assigns IDs to Avro schemas, as does the Confluent Schema
+// Registry. Registering a schema that is already registered returns its ID.
+type SchemaRegistry interface {
+	Register(subject, schema string) (int, error)
+}
+
+// A MemorySchemaRegistry is a SchemaRegistry that keeps schemas in memory.
+type MemorySchemaRegistry struct {
+	mutex    sync.Mutex
+	schemas  []string
+	subjects map[string][]int
+}
+
+func NewMemorySchemaRegistry() *MemorySchemaRegistry {
+	return &MemorySchemaRegistry{subjects: make(map[string][]int)}
+}
+
+func (r *MemorySchemaRegistry) Register(subject, schema string) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	id := 0
+	for i, s := range r.schemas {
+		if s == schema {
+			id = i + 1
+		}
+	}
+	if id == 0 {
+		r.schemas = append(r.schemas, schema)
+		id = len(r.schemas)
+	}
+
+	for _, version := range r.subjects[subject] {
+		if version == id {
+			return id, nil
+		}
+	}
+	r.subjects[subject] = append(r.subjects[subject], id)
+	return id, nil
+}
+
+// Schema returns the schema of id.
+func (r *MemorySchemaRegistry) Schema(id int) (string, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if id < 1 || id > len(r.schemas) {
+		return "", false
+	}
+	return r.schemas[id-1], true
+}
+
+// Versions returns the IDs of the schemas of subject, oldest first.
+func (r *MemorySchemaRegistry) Versions(subject string) []int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]int(nil), r.subjects[subject]...)
+}
+
+type httpSchemaRegistry struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPSchemaRegistry returns a client of the Confluent Schema Registry at
+// url. When client is nil, http.DefaultClient is used.
+func NewHTTPSchemaRegistry(url string, client *http.Client) SchemaRegistry {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &httpSchemaRegistry{url: strings.TrimRight(url, "/"), client: client}
+}
+
+func (r *httpSchemaRegistry) Register(subject, schema string) (int, error) {
+	body, err := json.Marshal(map[string]string{"schema": schema})
+	if err != nil {
+		return 0, err
+	}
+
+	response, err := r.client.Post(r.url+"/subjects/"+url.PathEscape(subject)+"/versions",
+		"application/vnd.schemaregistry.v1+json", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	var result struct {
+		ID      int    `json:"id"`
+		Message string `json:"message"`
+	}
+	if err = json.NewDecoder(response.Body).Decode(&result); err != nil || response.StatusCode != http.StatusOK {
+		return 0, errors.Errorf("Schema registry answered %d for %q: %s", response.StatusCode, subject, result.Message)
+	}
+	return result.ID, nil
+}
+
+type AvroOptions struct {
+	// Registry assigns the ID of each schema.
+	Registry SchemaRegistry
+
+	// Name is the namespace of every schema, "pgbarrel" by default. The
+	// schemas of a target are registered under the subject
+	// Name.schema.table-value, matching the default topics of
+	// NewKafkaSink.
+	Name string
+}
+
+type avroSchema struct {
+	id      int
+	columns map[string]string
+	names   []string
+	types   []string
+}
+
+type avroEncoder struct {
+	options AvroOptions
+	xid     string
+	schemas map[string]*avroSchema
+}
+
+// NewAvroEncoder returns an Encoder of Avro records framed for the Confluent
+// Schema Registry: a zero byte, the schema ID as a big-endian uint32, and the
+// binary encoding of a record like
+//
+//	{"type":"record","name":"Envelope","namespace":"pgbarrel.public.t",
+//	 "fields":[
+//	  {"name":"before","type":["null",{"type":"record","name":"Value",
+//	   "fields":[{"name":"id","type":["null","int"],"default":null}]}],
+//	   "default":null},
+//	  {"name":"after","type":["null","Value"],"default":null},
+//	  {"name":"op","type":"string"},
+//	  {"name":"lsn","type":"string"},
+//	  {"name":"xid","type":["null","long"],"default":null}]}
+//
+// The op is that of NewDebeziumEncoder. Values of boolean, integer, floating
+// point and bytea columns have the matching Avro type; the rest are strings.
+// A target has a new schema whenever its columns or their types change.
+// BEGIN and COMMIT have no message.
+func NewAvroEncoder(options AvroOptions) Encoder {
+	if options.Name == "" {
+		options.Name = "pgbarrel"
+	}
+	return &avroEncoder{options: options, schemas: make(map[string]*avroSchema)}
+}
+
+func (e *avroEncoder) Encode(op *ReplicationOperation) ([]byte, error) {
+	if op.Operation == `BEGIN` {
+		e.xid = op.Target
+	}
+
+	code, ok := debeziumOperations[op.Operation]
+	if !ok {
+		return nil, nil
+	}
+
+	schema, err := e.schema(op)
+	if err != nil {
+		return nil, err
+	}
+
+	b := []byte{0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(b[1:], uint32(schema.id))
+
+	for _, row := range [][2][]string{{op.OldColumns, op.OldValues}, {op.NewColumns, op.NewValues}} {
+		if len(row[0]) == 0 {
+			b = avroAppendLong(b, 0)
+			continue
+		}
+		b = avroAppendLong(b, 1)
+
+		values := make(map[string]string, len(row[0]))
+		for i := range row[0] {
+			if i < len(row[1]) {
+				values[row[0][i]] = row[1][i]
+			}
+		}
+		for i, name := range schema.names {
+			if b, err = avroAppendValue(b, schema.types[i], values[name]); err != nil {
+				return nil, errors.Wrapf(err, "Invalid value of %s.%s", op.Target, name)
+			}
+		}
+	}
+
+	b = avroAppendString(b, code)
+	b = avroAppendString(b, op.Position)
+	if xid, err := strconv.ParseInt(e.xid, 10, 64); err == nil && op.Operation != `READ` {
+		b = avroAppendLong(avroAppendLong(b, 1), xid)
+	} else {
+		b = avroAppendLong(b, 0)
+	}
+	return b, nil
+}
+
+// schema returns the schema of op, registering a new one when the columns of
+// its target change.
+func (e *avroEncoder) schema(op *ReplicationOperation) (*avroSchema, error) {
+	var names, types []string
+	seen := make(map[string]string)
+	add := func(columns, typs []string) {
+		for i := range columns {
+			if _, ok := seen[columns[i]]; !ok {
+				var typ string
+				if i < len(typs) {
+					typ = typs[i]
+				}
+				seen[columns[i]] = typ
+				names = append(names, columns[i])
+				types = append(types, typ)
+			}
+		}
+	}
+	add(op.NewColumns, op.NewTypes)
+	add(op.OldColumns, op.OldTypes)
+
+	// The old row of UPDATE and DELETE may have only the key, so a schema
+	// changes only with the new row or a column it lacks.
+	if current, ok := e.schemas[op.Target]; ok {
+		same := len(op.NewColumns) == 0 || len(op.NewColumns) == len(current.names)
+		for name, typ := range seen {
+			if t, ok := current.columns[name]; !ok || t != typ {
+				same = false
+			}
+		}
+		if same {
+			return current, nil
+		}
+	}
+
+	schemaName, tableName := pgSplitTarget(op.Target)
+	namespace := avroName(e.options.Name) + "." + avroName(schemaName) + "." + avroName(tableName)
+
+	id, err := e.options.Registry.Register(e.options.Name+"."+schemaName+"."+tableName+"-value", avroEnvelope(namespace, names, types))
+	if err != nil {
+		return nil, err
+	}
+
+	schema := &avroSchema{id: id, columns: seen, names: names, types: types}
+	e.schemas[op.Target] = schema
+	return schema, nil
+}
+
+// avroEnvelope returns the schema of the records of NewAvroEncoder.
+func avroEnvelope(namespace string, names, types []string) string {
+	var fields []string
+	for i := range names {
+		fields = append(fields, `{"name":`+strconv.Quote(avroName(pgUnquoteIdentifier(names[i])))+
+			`,"type":["null","`+avroType(types[i])+`"],"default":null}`)
+	}
+
+	return `{"type":"record","name":"Envelope","namespace":` + strconv.Quote(namespace) +
+		`,"fields":[` +
+		`{"name":"before","type":["null",{"type":"record","name":"Value","fields":[` + strings.Join(fields, ",") + `]}],"default":null},` +
+		`{"name":"after","type":["null","Value"],"default":null},` +
+		`{"name":"op","type":"string"},` +
+		`{"name":"lsn","type":"string"},` +
+		`{"name":"xid","type":["null","long"],"default":null}]}`
+}
+
+// avroName replaces the characters of name that Avro does not allow.
+func avroName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if !(c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || (i > 0 && '0' <= c && c <= '9')) {
+			b[i] = '_'
+		}
+	}
+	if len(b) == 0 {
+		return "_"
+	}
+	return string(b)
+}
+
+// avroType returns the Avro type of values of the PostgreSQL type typ.
+func avroType(typ string) string {
+	switch typ {
+	case `boolean`:
+		return "boolean"
+	case `smallint`, `integer`:
+		return "int"
+	case `bigint`, `oid`:
+		return "long"
+	case `real`:
+		return "float"
+	case `double precision`:
+		return "double"
+	case `bytea`:
+		return "bytes"
+	}
+	return "string"
+}
+
+// avroAppendValue appends a constant of the PostgreSQL type typ as the union
+// of null and its Avro type.
+func avroAppendValue(b []byte, typ, constant string) ([]byte, error) {
+	value, null := pgUnquoteConstant(constant)
+	if null || constant == `` {
+		return avroAppendLong(b, 0), nil
+	}
+	b = avroAppendLong(b, 1)
+
+	switch avroType(typ) {
+	case "boolean":
+		if value == `true` {
+			return append(b, 1), nil
+		}
+		return append(b, 0), nil
+	case "int", "long":
+		n, err := strconv.ParseInt(value, 10, 64)
+		return avroAppendLong(b, n), err
+	case "float":
+		f, err := strconv.ParseFloat(value, 32)
+		return binary.LittleEndian.AppendUint32(b, math.Float32bits(float32(f))), err
+	case "double":
+		f, err := strconv.ParseFloat(value, 64)
+		return binary.LittleEndian.AppendUint64(b, math.Float64bits(f)), err
+	case "bytes":
+		data, err := hex.DecodeString(strings.TrimPrefix(value, `\x`))
+		b = avroAppendLong(b, int64(len(data)))
+		return append(b, data...), err
+	}
+	return avroAppendString(b, value), nil
+}
+
+// avroAppendLong appends n as a zig-zag varint.
+func avroAppendLong(b []byte, n int64) []byte {
+	return binary.AppendUvarint(b, uint64(n<<1)^uint64(n>>63))
+}
+
+func avroAppendString(b []byte, s string) []byte {
+	b = avroAppendLong(b, int64(len(s)))
+	return append(b, s...)
+}
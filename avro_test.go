@@ -0,0 +1,148 @@
+package pgbarrel
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAvroEncoder(t *testing.T) {
+	registry := NewMemorySchemaRegistry()
+	e := NewAvroEncoder(AvroOptions{Registry: registry})
+
+	for _, tt := range []struct {
+		op       ReplicationOperation
+		expected string
+	}{
+		{ReplicationOperation{Position: `0/10`, Operation: `BEGIN`, Target: `553`}, ``},
+		{ReplicationOperation{Position: `0/10`, Operation: `INSERT`, Target: `public.t`,
+			NewColumns: []string{`id`, `v`}, NewValues: []string{`1`, `'a'`}, NewTypes: []string{`integer`, `text`}},
+			"\x00\x00\x00\x00\x01" + "\x00" + "\x02" + "\x02\x02" + "\x02\x02a" + "\x02c" + "\x080/10" + "\x02\xd2\x08"},
+		{ReplicationOperation{Position: `0/18`, Operation: `UPDATE`, Target: `public.t`,
+			OldColumns: []string{`id`}, OldValues: []string{`1`}, OldTypes: []string{`integer`},
+			NewColumns: []string{`id`, `v`}, NewValues: []string{`-1`, `null`}, NewTypes: []string{`integer`, `text`}},
+			"\x00\x00\x00\x00\x01" + "\x02" + "\x02\x02" + "\x00" + "\x02" + "\x02\x01" + "\x00" + "\x02u" + "\x080/18" + "\x02\xd2\x08"},
+		{ReplicationOperation{Position: `0/20`, Operation: `TRUNCATE`, Target: `public.t`},
+			"\x00\x00\x00\x00\x01" + "\x00" + "\x00" + "\x02t" + "\x080/20" + "\x02\xd2\x08"},
+		{ReplicationOperation{Position: `0/28`, Operation: `COMMIT`, Target: `553`}, ``},
+		{ReplicationOperation{Operation: `READ`, Target: `public.b`,
+			NewColumns: []string{`ok`, `f`, `d`, `bin`},
+			NewValues:  []string{`true`, `1.5`, `'NaN'`, `'\x0102'`},
+			NewTypes:   []string{`boolean`, `real`, `double precision`, `bytea`}},
+			"\x00\x00\x00\x00\x02" + "\x00" + "\x02" + "\x02\x01" + "\x02\x00\x00\xc0\x3f" +
+				"\x02\x01\x00\x00\x00\x00\x00\xf8\x7f" + "\x02\x04\x01\x02" + "\x02r" + "\x00" + "\x00"},
+	} {
+		message, err := e.Encode(&tt.op)
+		require.NoError(t, err)
+		assert.Equal(t, tt.expected, string(message), "%v", &tt.op)
+	}
+
+	schema, ok := registry.Schema(1)
+	require.True(t, ok)
+	assert.Equal(t, `{"type":"record","name":"Envelope","namespace":"pgbarrel.public.t","fields":[`+
+		`{"name":"before","type":["null",{"type":"record","name":"Value","fields":[`+
+		`{"name":"id","type":["null","int"],"default":null},{"name":"v","type":["null","string"],"default":null}]}],"default":null},`+
+		`{"name":"after","type":["null","Value"],"default":null},`+
+		`{"name":"op","type":"string"},{"name":"lsn","type":"string"},`+
+		`{"name":"xid","type":["null","long"],"default":null}]}`, schema)
+	assert.True(t, json.Valid([]byte(schema)))
+
+	t.Run("Invalid", func(t *testing.T) {
+		_, err := e.Encode(&ReplicationOperation{Operation: `INSERT`, Target: `public.t`,
+			NewColumns: []string{`id`, `v`}, NewValues: []string{`'x'`, `'a'`}, NewTypes: []string{`integer`, `text`}})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "public.t.id")
+	})
+}
+
+func TestAvroEncoderSchemas(t *testing.T) {
+	registry := NewMemorySchemaRegistry()
+	e := NewAvroEncoder(AvroOptions{Registry: registry, Name: `app`})
+
+	encode := func(op ReplicationOperation) byte {
+		message, err := e.Encode(&op)
+		require.NoError(t, err)
+		return message[4]
+	}
+
+	insert := func(columns, types []string) ReplicationOperation {
+		return ReplicationOperation{Operation: `INSERT`, Target: `public."My Table"`,
+			NewColumns: columns, NewValues: make([]string, len(columns)), NewTypes: types}
+	}
+
+	assert.Equal(t, byte(1), encode(insert([]string{`id`, `v`}, []string{`integer`, `text`})))
+	assert.Equal(t, byte(1), encode(ReplicationOperation{Operation: `DELETE`, Target: `public."My Table"`,
+		OldColumns: []string{`id`}, OldValues: []string{`1`}, OldTypes: []string{`integer`}}),
+		"Expected the key of a DELETE to use the same schema")
+
+	assert.Equal(t, byte(2), encode(insert([]string{`id`, `v`, `w`}, []string{`integer`, `text`, `text`})),
+		"Expected a new schema with a new column")
+	assert.Equal(t, byte(3), encode(insert([]string{`id`, `v`, `w`}, []string{`bigint`, `text`, `text`})),
+		"Expected a new schema with a new type")
+	assert.Equal(t, byte(1), encode(insert([]string{`id`, `v`}, []string{`integer`, `text`})),
+		"Expected the first schema when columns are dropped")
+
+	assert.Equal(t, []int{1, 2, 3}, registry.Versions(`app.public.My Table-value`))
+
+	schema, _ := registry.Schema(1)
+	assert.Contains(t, schema, `"namespace":"app.public.My_Table"`)
+}
+
+func TestMemorySchemaRegistry(t *testing.T) {
+	registry := NewMemorySchemaRegistry()
+
+	for _, tt := range []struct {
+		subject, schema string
+		id              int
+	}{
+		{`a`, `"string"`, 1},
+		{`a`, `"string"`, 1},
+		{`b`, `"string"`, 1},
+		{`a`, `"long"`, 2},
+	} {
+		id, err := registry.Register(tt.subject, tt.schema)
+		require.NoError(t, err)
+		assert.Equal(t, tt.id, id)
+	}
+
+	assert.Equal(t, []int{1, 2}, registry.Versions(`a`))
+	assert.Equal(t, []int{1}, registry.Versions(`b`))
+
+	_, ok := registry.Schema(3)
+	assert.False(t, ok)
+}
+
+func TestHTTPSchemaRegistry(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		switch {
+		case r.URL.EscapedPath() != `/subjects/public.My%20Table-value/versions`:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error_code":40401,"message":"Subject not found"}`))
+		case string(body) == `{"schema":"\"string\""}`:
+			assert.Equal(t, "application/vnd.schemaregistry.v1+json", r.Header.Get("Content-Type"))
+			w.Write([]byte(`{"id":7}`))
+		default:
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{"error_code":42201,"message":"Invalid schema"}`))
+		}
+	}))
+	defer server.Close()
+
+	registry := NewHTTPSchemaRegistry(server.URL+"/", nil)
+
+	id, err := registry.Register(`public.My Table-value`, `"string"`)
+	require.NoError(t, err)
+	assert.Equal(t, 7, id)
+
+	_, err = registry.Register(`public.My Table-value`, `{`)
+	assert.EqualError(t, err, `Schema registry answered 422 for "public.My Table-value": Invalid schema`)
+
+	_, err = registry.Register(`other`, `"string"`)
+	assert.EqualError(t, err, `Schema registry answered 404 for "other": Subject not found`)
+}
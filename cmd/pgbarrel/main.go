@@ -0,0 +1,263 @@
+// Command pgbarrel streams changes out of a PostgreSQL logical replication
+// slot and manages those slots.
+//
+//	pgbarrel run -config FILE [-resync TABLE,...]
+//	pgbarrel verify -config FILE [-repair FILE]
+//	pgbarrel slot create|drop|list -conn CONN [-slot NAME] [-plugin PLUGIN]
+//	pgbarrel status -conn CONN [-slot NAME]
+//	pgbarrel decode [-plugin PLUGIN] < messages
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/cbandy/pgbarrel"
+	_ "github.com/mattn/go-sqlite3" // the driver of "sqlite" targets
+)
+
+const usage = `Usage:
+  pgbarrel run -config FILE [-resync TABLE,...]
+  pgbarrel verify -config FILE [-repair FILE]
+  pgbarrel slot create|drop|list -conn CONN [-slot NAME] [-plugin PLUGIN]
+  pgbarrel status -conn CONN [-slot NAME]
+  pgbarrel decode [-plugin PLUGIN] < messages
+`
+
+type usageError string
+
+func (e usageError) Error() string { return string(e) }
+
+func main() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	err := command(ctx, os.Args[1:], os.Stdin, os.Stdout)
+
+	switch err.(type) {
+	case nil:
+	case usageError:
+		fmt.Fprintf(os.Stderr, "pgbarrel: %v\n%s", err, usage)
+		os.Exit(2)
+	default:
+		if err != context.Canceled {
+			fmt.Fprintf(os.Stderr, "pgbarrel: %v\n", err)
+			os.Exit(1)
+		}
+	}
+}
+
+func command(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer) error {
+	if len(args) == 0 {
+		return usageError("missing command")
+	}
+
+	switch args[0] {
+	case "run":
+		return runCommand(ctx, args[1:])
+	case "verify":
+		return verifyCommand(ctx, args[1:], stdout)
+	case "slot":
+		return slotCommand(args[1:], stdout)
+	case "status":
+		return statusCommand(args[1:], stdout)
+	case "decode":
+		return decodeCommand(args[1:], stdin, stdout)
+	}
+
+	return usageError(fmt.Sprintf("unknown command %q", args[0]))
+}
+
+func flags(name string) *flag.FlagSet {
+	f := flag.NewFlagSet(name, flag.ContinueOnError)
+	f.SetOutput(io.Discard)
+	return f
+}
+
+func parse(f *flag.FlagSet, args []string) error {
+	if err := f.Parse(args); err != nil {
+		return usageError(err.Error())
+	}
+	return nil
+}
+
+func runCommand(ctx context.Context, args []string) error {
+	f := flags("run")
+	file := f.String("config", "", "configuration file")
+	resync := f.String("resync", "", "tables to copy again, separated by commas")
+	if err := parse(f, args); err != nil {
+		return err
+	}
+	if *file == "" {
+		return usageError("missing -config")
+	}
+
+	cfg, err := pgbarrel.LoadConfig(*file)
+	if err != nil {
+		return err
+	}
+	if *resync != "" {
+		cfg.Resync.Tables = append(cfg.Resync.Tables, strings.Split(*resync, ",")...)
+	}
+
+	p, err := cfg.Build()
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+
+	return p.Run(ctx)
+}
+
+func verifyCommand(ctx context.Context, args []string, stdout io.Writer) error {
+	f := flags("verify")
+	file := f.String("config", "", "configuration file")
+	repairFile := f.String("repair", "", "file to write the operations that repair the target")
+	if err := parse(f, args); err != nil {
+		return err
+	}
+	if *file == "" {
+		return usageError("missing -config")
+	}
+
+	cfg, err := pgbarrel.LoadConfig(*file)
+	if err != nil {
+		return err
+	}
+
+	var repair pgbarrel.Sink
+	if *repairFile != "" {
+		w, err := os.Create(*repairFile)
+		if err != nil {
+			return err
+		}
+		defer w.Close()
+		repair = pgbarrel.NewTextSink(w)
+	}
+
+	report, err := cfg.Verify(ctx, repair)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "snapshot_lsn=%s applied_lsn=%s\n", report.Position, report.Applied)
+	var differ int
+	for _, t := range report.Tables {
+		if !t.OK() {
+			differ++
+		}
+		fmt.Fprintf(stdout, "table=%s ok=%v source_rows=%d target_rows=%d chunks=%d mismatched_chunks=%d extra_rows=%d",
+			t.Table, t.OK(), t.SourceRows, t.TargetRows, t.Chunks, len(t.Mismatches), t.Extra)
+		if len(t.MissingColumns) > 0 {
+			fmt.Fprintf(stdout, " missing_columns=%s", strings.Join(t.MissingColumns, ","))
+		}
+		fmt.Fprintln(stdout)
+		for _, m := range t.Mismatches {
+			fmt.Fprintf(stdout, "table=%s first_key=%s last_key=%s missing_rows=%d different_rows=%d\n",
+				t.Table, m.First, m.Last, m.Missing, m.Different)
+		}
+	}
+	if differ > 0 {
+		return fmt.Errorf("%d of %d tables differ", differ, len(report.Tables))
+	}
+	return nil
+}
+
+func slotCommand(args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return usageError("missing slot command")
+	}
+
+	f := flags("slot " + args[0])
+	conn := f.String("conn", "", "connection string")
+	slot := f.String("slot", "pgbarrel", "replication slot")
+	plugin := f.String("plugin", "test_decoding", "logical decoding output plugin")
+	if err := parse(f, args[1:]); err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "create":
+		return pgbarrel.CreatePostgreSQLSlot(*conn, *slot, *plugin)
+	case "drop":
+		return pgbarrel.DropPostgreSQLSlot(*conn, *slot)
+	case "list":
+		slots, err := pgbarrel.ListPostgreSQLSlots(*conn)
+		if err != nil {
+			return err
+		}
+		for _, s := range slots {
+			fmt.Fprintf(stdout, "%s\t%s\t%s\tactive=%v\n", s.Name, s.Plugin, s.Database, s.Active)
+		}
+		return nil
+	}
+
+	return usageError(fmt.Sprintf("unknown slot command %q", args[0]))
+}
+
+func statusCommand(args []string, stdout io.Writer) error {
+	f := flags("status")
+	conn := f.String("conn", "", "connection string")
+	slot := f.String("slot", "", "replication slot; all when empty")
+	if err := parse(f, args); err != nil {
+		return err
+	}
+
+	slots, err := pgbarrel.ListPostgreSQLSlots(*conn)
+	if err != nil {
+		return err
+	}
+
+	var found bool
+	for _, s := range slots {
+		if *slot == "" || s.Name == *slot {
+			found = true
+			fmt.Fprintf(stdout, "slot=%s active=%v restart_lsn=%s applied_lsn=%s lag_bytes=%d\n",
+				s.Name, s.Active, s.RestartPosition, s.AppliedPosition, s.LagBytes)
+		}
+	}
+	if !found && *slot != "" {
+		return fmt.Errorf("replication slot %q does not exist", *slot)
+	}
+	return nil
+}
+
+func decodeCommand(args []string, stdin io.Reader, stdout io.Writer) error {
+	f := flags("decode")
+	plugin := f.String("plugin", "test_decoding", "logical decoding output plugin")
+	if err := parse(f, args); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(stdin)
+	scanner.Buffer(nil, 1<<30)
+
+	var op pgbarrel.ReplicationOperation
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		if err := pgbarrel.Decode(*plugin, scanner.Bytes(), &op); err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		if _, err := io.WriteString(stdout, op.String()+"\n"); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	input := strings.Join([]string{
+		`BEGIN 553`,
+		`table public.contents: INSERT: id[integer]:1 value[text]:'a'`,
+		`table public.contents: UPDATE: old-key: id[integer]:1 new-tuple: id[integer]:11 value[text]:'m'`,
+		``,
+		`table public.contents: DELETE: id[integer]:11`,
+		`COMMIT 553`,
+	}, "\n")
+
+	var output bytes.Buffer
+	if err := command(context.Background(), []string{"decode"}, strings.NewReader(input), &output); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := strings.Join([]string{
+		`BEGIN 553`,
+		`INSERT public.contents new: id[integer]:1 value[text]:'a'`,
+		`UPDATE public.contents old: id[integer]:1 new: id[integer]:11 value[text]:'m'`,
+		`DELETE public.contents old: id[integer]:11`,
+		`COMMIT 553`,
+	}, "\n") + "\n"
+
+	if output.String() != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, output.String())
+	}
+}
+
+func TestCommandUsage(t *testing.T) {
+	for _, args := range [][]string{
+		{},
+		{"bogus"},
+		{"run"},
+		{"verify"},
+		{"slot"},
+		{"slot", "bogus"},
+		{"decode", "-bogus"},
+	} {
+		err := command(context.Background(), args, nil, nil)
+		if _, ok := err.(usageError); !ok {
+			t.Errorf("Expected %q to be a usage error, got %v", args, err)
+		}
+	}
+
+	err := command(context.Background(), []string{"decode", "-plugin", "bogus"}, strings.NewReader("BEGIN 1"), nil)
+	if err == nil || !strings.Contains(err.Error(), "bogus") {
+		t.Errorf("Expected an unknown plugin to fail, got %v", err)
+	}
+}
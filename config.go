@@ -0,0 +1,1047 @@
+package pgbarrel
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+// Config describes a complete Pipeline. It is read from TOML, e.g.
+//
+//	[source]
+//	conn = "host=db dbname=app password=${PGPASSWORD}"
+//	slot = "pgbarrel"
+//	plugin = "test_decoding"
+//
+//	[tables]
+//	include = ["public.*"]
+//	exclude = ["public.audit"]
+//
+//	[filter]
+//	"public.orders" = "tenant_id = 42"
+//
+//	[mask]
+//	key = "${MASK_KEY}"
+//	columns."public.users" = { email = "hmac", name = "fake", phone = "null" }
+//
+//	[ddl]
+//	capture = "pgbarrel"
+//	policy = "apply"
+//
+//	[drift]
+//	conn = "host=replica dbname=app"
+//	policy = "stop"
+//
+//	[log]
+//	level = "info"
+//	format = "json"
+//
+//	[tracing]
+//	endpoint = "http://collector:4318/v1/traces"
+//
+//	[metrics]
+//	listen = ":9187"
+//	stall = "30s"
+//
+//	[resync]
+//	tables = ["public.orders"]
+//
+//	[target]
+//	type = "stdout"
+//
+// Strings may refer to environment variables as ${NAME}. Unknown keys, values
+// of the wrong type and undefined variables are errors.
+type Config struct {
+	Source struct {
+		Conn, Slot, Plugin, Options string
+
+		// StatusInterval and WaitTimeout are the timing of standby status
+		// updates; see SetStandbyTiming.
+		StatusInterval, WaitTimeout time.Duration
+	}
+
+	Tables TableFilter
+
+	// Filter holds a predicate for each target; see RowFilter. The rows
+	// that leave or enter the filter are found by target.keys, which "sql"
+	// and "sqlite" targets must set for each of these tables.
+	Filter map[string]string
+
+	Mask struct {
+		// Key is the secret of the "hmac" and "fake" masks.
+		Key string
+		// Columns holds a mask for each column of each target: "null",
+		// "fixed('value')", "hmac", "fake" or "truncate(n)". A mask that
+		// does not fit the type of its column stops the Pipeline; see Mask.
+		Columns map[string]map[string]string
+	}
+
+	DDL struct {
+		// Capture is the schema of InstallPostgreSQLDDLCapture. DDL is not
+		// captured when it is empty.
+		Capture string
+		// Policy is "apply" to pass DDL on, "skip" to drop it, or "stop"
+		// to stop the Pipeline at it. An "sql" target of PostgreSQL
+		// replays DDL passed on.
+		Policy string
+	}
+
+	Drift struct {
+		// Conn is the target database to check for schema drift. Drift is
+		// not checked when it is empty.
+		Conn string
+		// Policy is "stop", "skip" or "add"; see SchemaDriftPolicy.
+		Policy string
+	}
+
+	Log struct {
+		// Level is "debug", "info", "warn" or "error". Events are written
+		// to stderr at and above it.
+		Level string
+		// Format is "text" or "json".
+		Format string
+	}
+
+	Tracing struct {
+		// Endpoint is the OTLP/HTTP URL of an OpenTelemetry collector to
+		// send a trace of each transaction to. Nothing is traced when it
+		// is empty.
+		Endpoint string
+		// Service is the service.name of the traces. It defaults to
+		// "pgbarrel".
+		Service string
+	}
+
+	Metrics struct {
+		// Listen is the address to serve Metrics on at /metrics, with
+		// the endpoints of NewHealthHandler. Nothing is served when it is
+		// empty.
+		Listen string
+		// Stall is how long the receive loop may stall before /healthz
+		// fails. It defaults to 30 seconds.
+		Stall time.Duration
+	}
+
+	Resync struct {
+		// Tables are copied again, one after another, once the Pipeline
+		// runs; see NewPostgreSQLResync. A table whose resync did not
+		// finish is copied again first. That is looked for only when
+		// Tables is not empty, so keep a table in Tables until its resync
+		// has finished.
+		Tables []string
+		// Schema holds the watermark table, created when Tables is not
+		// empty. It defaults to "pgbarrel".
+		Schema string
+		// ChunkSize is the number of rows copied at a time. It defaults
+		// to 1000.
+		ChunkSize int
+		// Keys names the key columns of tables without a primary key.
+		Keys map[string][]string
+	}
+
+	Target struct {
+		Type string
+
+		settings *tomlTable
+	}
+
+	file     string
+	log      Logger
+	filter   *RowFilter
+	masks    ColumnMasks
+	openSink func() (Sink, error)
+}
+
+// A ConfigError reports a problem at a line and column of a configuration.
+type ConfigError struct {
+	File         string
+	Line, Column int
+	Message      string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Column, e.Message)
+}
+
+type configSink func(d *configDecoder, settings *tomlTable) (func() (Sink, error), error)
+
+// configSinks builds the Sink of each target type. A builder validates its
+// settings when the configuration is loaded and returns a function that
+// opens the Sink when the Pipeline is built.
+var configSinks = map[string]configSink{
+	"stdout": func(d *configDecoder, settings *tomlTable) (func() (Sink, error), error) {
+		return func() (Sink, error) { return NewTextSink(os.Stdout), nil }, d.fields(settings, "target", nil)
+	},
+	"jsonl": func(d *configDecoder, settings *tomlTable) (func() (Sink, error), error) {
+		var options JSONLinesOptions
+		var compression string
+		fields := map[string]func(*tomlValue) error{
+			"dir":          d.string(&options.Dir),
+			"prefix":       d.string(&options.Prefix),
+			"max_bytes":    d.int64(&options.MaxBytes),
+			"max_age":      d.duration(&options.MaxAge),
+			"compression":  d.string(&compression),
+			"transactions": d.bool(&options.Transactions),
+		}
+		encoder := d.encoder(fields)
+		err := d.fields(settings, "target", fields)
+		if err == nil {
+			_, err = encoder()
+		}
+		if err == nil && options.Dir == "" {
+			err = d.errorf(settings.tomlPosition, "missing target.dir")
+		}
+		if err == nil && compression != "" {
+			c, ok := JSONLinesCompressions[compression]
+			if !ok {
+				err = d.errorf(settings.values["compression"].tomlPosition, "unknown compression %q", compression)
+			}
+			options.Compression = &c
+		}
+		return func() (Sink, error) {
+			options := options
+			options.Encoder, _ = encoder()
+			return NewJSONLinesSink(options)
+		}, err
+	},
+	"copy": func(d *configDecoder, settings *tomlTable) (func() (Sink, error), error) {
+		var file string
+		err := d.fields(settings, "target", map[string]func(*tomlValue) error{
+			"file": d.string(&file),
+		})
+		if err == nil && file == "" {
+			err = d.errorf(settings.tomlPosition, "missing target.file")
+		}
+		return func() (Sink, error) {
+			f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+			if err != nil {
+				return nil, err
+			}
+			return configFileSink{NewCopySink(f), f}, nil
+		}, err
+	},
+	"sql": func(d *configDecoder, settings *tomlTable) (func() (Sink, error), error) {
+		driver, dialect := "", "postgresql"
+		return d.sqlTarget(settings, &driver, &dialect, map[string]func(*tomlValue) error{
+			"driver":  d.string(&driver),
+			"dialect": d.string(&dialect),
+		})
+	},
+	"sqlite": func(d *configDecoder, settings *tomlTable) (func() (Sink, error), error) {
+		driver, dialect := "sqlite3", "sqlite"
+		return d.sqlTarget(settings, &driver, &dialect, map[string]func(*tomlValue) error{
+			"driver": d.string(&driver),
+		})
+	},
+	"parquet": func(d *configDecoder, settings *tomlTable) (func() (Sink, error), error) {
+		var options ParquetOptions
+		err := d.fields(settings, "target", map[string]func(*tomlValue) error{
+			"dir":      d.string(&options.Dir),
+			"max_rows": d.int(&options.MaxRows),
+			"max_age":  d.duration(&options.MaxAge),
+		})
+		if err == nil && options.Dir == "" {
+			err = d.errorf(settings.tomlPosition, "missing target.dir")
+		}
+		return func() (Sink, error) { return NewParquetSink(options), nil }, err
+	},
+	"kafka": func(d *configDecoder, settings *tomlTable) (func() (Sink, error), error) {
+		var options KafkaOptions
+		var acks int
+		fields := map[string]func(*tomlValue) error{
+			"brokers":      d.strings(&options.Brokers),
+			"client_id":    d.string(&options.ClientID),
+			"topic_prefix": d.string(&options.TopicPrefix),
+			"topics":       d.stringMap("target.topics", &options.Topics, make(map[string]tomlPosition)),
+			"keys":         d.stringsMap("target.keys", &options.Keys),
+			"acks":         d.int(&acks),
+			"timeout":      d.duration(&options.Timeout),
+			"retries":      d.int(&options.Retries),
+			"linger":       d.duration(&options.Linger),
+			"batch_bytes":  d.int(&options.BatchBytes),
+		}
+		encoder := d.encoder(fields)
+		err := d.fields(settings, "target", fields)
+		if err == nil && len(options.Brokers) == 0 {
+			err = d.errorf(settings.tomlPosition, "missing target.brokers")
+		}
+		if err == nil && acks != 0 && acks != 1 && acks != -1 {
+			err = d.errorf(settings.values["acks"].tomlPosition, "acks must be 1 or -1")
+		}
+		if err == nil {
+			_, err = encoder()
+		}
+		options.Acks = int16(acks)
+		return func() (Sink, error) {
+			options := options
+			options.Encoder, _ = encoder()
+			return NewKafkaSink(options)
+		}, err
+	},
+	"webhook": func(d *configDecoder, settings *tomlTable) (func() (Sink, error), error) {
+		var options WebhookOptions
+		var secret string
+		var timeout time.Duration
+		fields := map[string]func(*tomlValue) error{
+			"urls":        d.stringsMap("target.urls", &options.URLs),
+			"secret":      d.string(&secret),
+			"batch_size":  d.int(&options.BatchSize),
+			"max_wait":    d.duration(&options.MaxWait),
+			"retries":     d.int(&options.Retries),
+			"backoff":     d.duration(&options.Backoff),
+			"timeout":     d.duration(&timeout),
+			"dead_letter": d.string(&options.DeadLetter),
+		}
+		encoder := d.encoder(fields)
+		err := d.fields(settings, "target", fields)
+		if err == nil && len(options.URLs) == 0 {
+			err = d.errorf(settings.tomlPosition, "missing target.urls")
+		}
+		if err == nil {
+			_, err = encoder()
+		}
+		options.Secret = []byte(secret)
+		if timeout > 0 {
+			options.Client = &http.Client{Timeout: timeout}
+		}
+		return func() (Sink, error) {
+			options := options
+			options.Encoder, _ = encoder()
+			return NewWebhookSink(options), nil
+		}, err
+	},
+	"grpc": func(d *configDecoder, settings *tomlTable) (func() (Sink, error), error) {
+		var listen, certFile, keyFile string
+		var subscribers []string
+		buffer := 1000
+		fields := map[string]func(*tomlValue) error{
+			"listen":      d.string(&listen),
+			"cert_file":   d.string(&certFile),
+			"key_file":    d.string(&keyFile),
+			"buffer":      d.int(&buffer),
+			"subscribers": d.strings(&subscribers),
+		}
+		err := d.fields(settings, "target", fields)
+		if err == nil && listen == "" {
+			err = d.errorf(settings.tomlPosition, "missing target.listen")
+		}
+		if err == nil && (certFile == "") != (keyFile == "") {
+			err = d.errorf(settings.tomlPosition, "target.cert_file and target.key_file go together")
+		}
+		if err == nil && buffer < 1 {
+			err = d.errorf(settings.values["buffer"].tomlPosition, "buffer must be positive")
+		}
+		return func() (Sink, error) {
+			return ListenGRPC(listen, certFile, keyFile, NewChangeHub(buffer, subscribers...))
+		}, err
+	},
+}
+
+// configDialects are the dialects of the "sql" target.
+var configDialects = map[string]Dialect{
+	"postgresql": PostgreSQLDialect{},
+	"sqlite":     SQLiteDialect{},
+}
+
+// sqlTarget builds a target of NewSQLSink from the driver, dialect and
+// fields given, and the settings they share: dsn, or file for SQLite, and
+// keys.
+func (d *configDecoder) sqlTarget(settings *tomlTable, driver, dialect *string, fields map[string]func(*tomlValue) error) (func() (Sink, error), error) {
+	var options SQLOptions
+	var dsn string
+	source := "dsn"
+	if *dialect == "sqlite" {
+		source = "file"
+	}
+	fields[source] = d.string(&dsn)
+	fields["keys"] = d.stringsMap("target.keys", &options.Keys)
+
+	err := d.fields(settings, "target", fields)
+	if err == nil && *driver == "" {
+		err = d.errorf(settings.tomlPosition, "missing target.driver")
+	}
+	if err == nil && dsn == "" {
+		err = d.errorf(settings.tomlPosition, "missing target.%s", source)
+	}
+	if _, ok := configDialects[*dialect]; err == nil && !ok {
+		err = d.errorf(settings.tomlPosition, "unknown dialect %q", *dialect)
+	}
+
+	return func() (Sink, error) {
+		// the driver must be linked into the program
+		db, err := sql.Open(*driver, dsn)
+		if err != nil {
+			return nil, err
+		}
+		sink, err := NewSQLSink(db, configDialects[*dialect], options)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		return configFileSink{sink, db}, nil
+	}, err
+}
+
+// configFileSink closes the file or database of a Sink when the Pipeline
+// closes.
+type configFileSink struct {
+	Sink
+	io.Closer
+}
+
+func (s configFileSink) SetLogger(l Logger) {
+	if sink, ok := s.Sink.(interface{ SetLogger(Logger) }); ok {
+		sink.SetLogger(l)
+	}
+}
+
+// Ping reports whether the target of the Sink is reachable, when it can tell.
+func (s configFileSink) Ping(ctx context.Context) error {
+	if sink, ok := s.Sink.(interface{ Ping(context.Context) error }); ok {
+		return sink.Ping(ctx)
+	}
+	return nil
+}
+
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(path, data)
+}
+
+// ParseConfig reads a configuration from data. Errors are reported as
+// *ConfigError with file as their File.
+func ParseConfig(file string, data []byte) (*Config, error) {
+	d := configDecoder{file: file}
+
+	root, err := parseTOML(string(data))
+	if err != nil {
+		if e, ok := err.(*tomlError); ok {
+			return nil, d.errorf(e.tomlPosition, "%s", e.message)
+		}
+		return nil, err
+	}
+
+	c := Config{file: file}
+	c.Source.Plugin = "test_decoding"
+	c.DDL.Policy = "apply"
+	c.Drift.Policy = "stop"
+	c.Log.Level, c.Log.Format = "info", "text"
+	c.Tracing.Service = "pgbarrel"
+	c.Metrics.Stall = 30 * time.Second
+	c.Resync.Schema, c.Resync.ChunkSize = "pgbarrel", 1000
+	c.Target.Type = "stdout"
+
+	var positions = make(map[string]tomlPosition)
+	remember := func(name string, decode func(*tomlValue) error) func(*tomlValue) error {
+		return func(v *tomlValue) error {
+			positions[name] = v.tomlPosition
+			return decode(v)
+		}
+	}
+
+	err = d.fields(root, "", map[string]func(*tomlValue) error{
+		"source": d.table("source", map[string]func(*tomlValue) error{
+			"conn":            d.string(&c.Source.Conn),
+			"slot":            d.string(&c.Source.Slot),
+			"plugin":          remember("source.plugin", d.string(&c.Source.Plugin)),
+			"options":         d.string(&c.Source.Options),
+			"status_interval": d.duration(&c.Source.StatusInterval),
+			"wait_timeout":    d.duration(&c.Source.WaitTimeout),
+		}),
+		"tables": d.table("tables", map[string]func(*tomlValue) error{
+			"include": d.strings(&c.Tables.Include),
+			"exclude": d.strings(&c.Tables.Exclude),
+		}),
+		"filter": d.stringMap("filter", &c.Filter, positions),
+		"mask": d.table("mask", map[string]func(*tomlValue) error{
+			"key": d.string(&c.Mask.Key),
+			"columns": func(v *tomlValue) error {
+				targets, err := d.tableOf(v, "mask.columns")
+				if err != nil {
+					return err
+				}
+				c.Mask.Columns = make(map[string]map[string]string)
+				for _, target := range targets.keys {
+					columns := make(map[string]string)
+					if err = d.stringMap("mask.columns."+target, &columns, positions)(targets.values[target]); err != nil {
+						return err
+					}
+					c.Mask.Columns[target] = columns
+				}
+				return nil
+			},
+		}),
+		"ddl": d.table("ddl", map[string]func(*tomlValue) error{
+			"capture": d.string(&c.DDL.Capture),
+			"policy":  remember("ddl.policy", d.string(&c.DDL.Policy)),
+		}),
+		"drift": d.table("drift", map[string]func(*tomlValue) error{
+			"conn":   d.string(&c.Drift.Conn),
+			"policy": remember("drift.policy", d.string(&c.Drift.Policy)),
+		}),
+		"log": d.table("log", map[string]func(*tomlValue) error{
+			"level":  remember("log.level", d.string(&c.Log.Level)),
+			"format": remember("log.format", d.string(&c.Log.Format)),
+		}),
+		"tracing": d.table("tracing", map[string]func(*tomlValue) error{
+			"endpoint": d.string(&c.Tracing.Endpoint),
+			"service":  d.string(&c.Tracing.Service),
+		}),
+		"metrics": d.table("metrics", map[string]func(*tomlValue) error{
+			"listen": d.string(&c.Metrics.Listen),
+			"stall":  d.duration(&c.Metrics.Stall),
+		}),
+		"resync": d.table("resync", map[string]func(*tomlValue) error{
+			"tables":     d.strings(&c.Resync.Tables),
+			"schema":     d.string(&c.Resync.Schema),
+			"chunk_size": remember("resync.chunk_size", d.int(&c.Resync.ChunkSize)),
+			"keys":       d.stringsMap("resync.keys", &c.Resync.Keys),
+		}),
+		"target": func(v *tomlValue) error {
+			settings, err := d.tableOf(v, "target")
+			if err != nil {
+				return err
+			}
+			// the remaining keys belong to the type
+			c.Target.settings = newTOMLTable(settings.tomlPosition)
+			for _, key := range settings.keys {
+				if key != "type" {
+					c.Target.settings.set(key, settings.values[key])
+				} else if err = d.string(&c.Target.Type)(settings.values[key]); err != nil {
+					return err
+				} else {
+					positions["target.type"] = settings.values[key].tomlPosition
+				}
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Source.Conn == "" {
+		return nil, d.errorf(root.tomlPosition, "missing source.conn")
+	}
+	if c.Source.Slot == "" {
+		return nil, d.errorf(root.tomlPosition, "missing source.slot")
+	}
+	if _, ok := pgDecoders[c.Source.Plugin]; !ok {
+		return nil, d.errorf(positions["source.plugin"], "unknown logical decoding output plugin %q", c.Source.Plugin)
+	}
+
+	for target, expression := range c.Filter {
+		if _, err := CompilePredicate(expression); err != nil {
+			return nil, d.errorf(positions["filter."+target], "%v", err)
+		}
+	}
+	if c.filter, err = NewRowFilter(c.Filter); err != nil {
+		return nil, err
+	}
+
+	c.masks = make(ColumnMasks)
+	for target, columns := range c.Mask.Columns {
+		c.masks[target] = make(map[string]Mask)
+		for column, spec := range columns {
+			mask, err := configMask(spec, []byte(c.Mask.Key))
+			if err != nil {
+				return nil, d.errorf(positions["mask.columns."+target+"."+column], "%v", err)
+			}
+			c.masks[target][column] = mask
+		}
+	}
+
+	switch c.DDL.Policy {
+	case "apply", "skip", "stop":
+	default:
+		return nil, d.errorf(positions["ddl.policy"], "unknown DDL policy %q", c.DDL.Policy)
+	}
+	if _, ok := configDriftPolicies[c.Drift.Policy]; !ok {
+		return nil, d.errorf(positions["drift.policy"], "unknown drift policy %q", c.Drift.Policy)
+	}
+
+	if c.Resync.ChunkSize < 1 {
+		return nil, d.errorf(positions["resync.chunk_size"], "chunk_size must be positive")
+	}
+
+	if _, err = NewSlogLogger(ioutil.Discard, c.Log.Level, "text"); err != nil {
+		return nil, d.errorf(positions["log.level"], "unknown log level %q", c.Log.Level)
+	}
+	if c.log, err = NewSlogLogger(os.Stderr, c.Log.Level, c.Log.Format); err != nil {
+		return nil, d.errorf(positions["log.format"], "unknown log format %q", c.Log.Format)
+	}
+
+	build, ok := configSinks[c.Target.Type]
+	if !ok {
+		return nil, d.errorf(positions["target.type"], "unknown target type %q", c.Target.Type)
+	}
+	if c.Target.settings == nil {
+		c.Target.settings = newTOMLTable(root.tomlPosition)
+	}
+	if c.openSink, err = build(&d, c.Target.settings); err != nil {
+		return nil, err
+	}
+
+	if keys, ok := c.Target.settings.values["keys"]; ok {
+		if err = d.stringsMap("target.keys", &c.filter.Keys)(keys); err != nil {
+			return nil, err
+		}
+	}
+	if c.Target.Type == "sql" || c.Target.Type == "sqlite" {
+		for target := range c.Filter {
+			if len(c.filter.Keys[target]) == 0 {
+				return nil, d.errorf(positions["filter."+target], "filter of %s needs target.keys to upsert and delete its rows", target)
+			}
+		}
+	}
+
+	return &c, nil
+}
+
+var configDriftPolicies = map[string]SchemaDriftPolicy{
+	"stop": DriftStop,
+	"skip": DriftSkipColumn,
+	"add":  DriftAddColumn,
+}
+
+var configMaskRegexp = regexp.MustCompile(`^(\w+)(?:\((.*)\))?$`)
+
+func configMask(spec string, key []byte) (Mask, error) {
+	match := configMaskRegexp.FindStringSubmatch(strings.TrimSpace(spec))
+	if match == nil {
+		return nil, fmt.Errorf("invalid mask %q", spec)
+	}
+
+	name, argument := match[1], match[2]
+	switch name {
+	case "null":
+		return MaskNull(), nil
+	case "fixed":
+		if _, constant := pgParseConstant([]byte(argument)); constant != nil && len(constant) == len(argument) {
+			value, _ := pgUnquoteConstant(argument)
+			return MaskFixed(value), nil
+		}
+		return nil, fmt.Errorf("mask %q needs a constant, e.g. fixed('value')", spec)
+	case "truncate":
+		n, err := strconv.Atoi(argument)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("mask %q needs a length, e.g. truncate(3)", spec)
+		}
+		return MaskTruncate(n), nil
+	case "hmac", "fake":
+		if len(key) == 0 {
+			return nil, fmt.Errorf("mask %q needs mask.key", spec)
+		}
+		if name == "hmac" {
+			return MaskHMAC(key), nil
+		}
+		return MaskFake(key), nil
+	}
+
+	return nil, fmt.Errorf("unknown mask %q", spec)
+}
+
+// Build connects to the source, and any other databases, and returns a
+// Pipeline ready to Run. Close the Pipeline when it is done.
+func (c *Config) Build() (*Pipeline, error) {
+	var closers []io.Closer
+	fail := func(err error) (*Pipeline, error) {
+		for _, closer := range closers {
+			closer.Close()
+		}
+		return nil, err
+	}
+
+	r, err := NewPostgreSQLReceiver(c.Source.Conn, c.Source.Slot, c.Source.Plugin, c.Source.Options)
+	if err != nil {
+		return fail(err)
+	}
+	closers = append(closers, r)
+	r.SetStandbyTiming(c.Source.StatusInterval, c.Source.WaitTimeout)
+
+	var transforms []Transformer
+	if c.DDL.Capture != "" {
+		transforms = append(transforms, NewPostgreSQLDDLCapture(c.DDL.Capture))
+	}
+
+	var resync *pgResync
+	tables := c.Resync.Tables
+	if len(tables) > 0 {
+		cfg, err := pgx.ParseConnectionString(c.Source.Conn)
+		if err != nil {
+			return fail(err)
+		}
+		conn, err := pgx.Connect(cfg)
+		if err != nil {
+			return fail(err)
+		}
+		closers = append(closers, conn)
+		if err = InstallPostgreSQLResync(conn, c.Resync.Schema); err != nil {
+			return fail(err)
+		}
+
+		// a resync that stopped between watermarks lost the changes it
+		// held, so its table is copied again first
+		incomplete, err := PostgreSQLResyncIncomplete(context.Background(), conn, c.Resync.Schema)
+		if err != nil {
+			return fail(err)
+		}
+		if incomplete != "" {
+			orDiscard(c.log).Warn("Resuming resync that did not finish", "table", incomplete)
+			tables = append([]string{incomplete}, configWithout(tables, incomplete)...)
+		}
+
+		resync = NewPostgreSQLResync(conn, c.Resync.Schema, ResyncOptions{ChunkSize: c.Resync.ChunkSize, Keys: c.Resync.Keys})
+		resync.SetLogger(c.log)
+		transforms = append(transforms, resync)
+	}
+	if len(c.Tables.Include) > 0 || len(c.Tables.Exclude) > 0 {
+		transforms = append(transforms, c.Tables)
+	}
+	if len(c.Filter) > 0 {
+		transforms = append(transforms, c.filter)
+	}
+	if len(c.masks) > 0 {
+		transforms = append(transforms, c.masks)
+	}
+
+	switch c.DDL.Policy {
+	case "skip":
+		transforms = append(transforms, DDLApproval(func(context.Context, *ReplicationOperation) (bool, error) {
+			return false, nil
+		}))
+	case "stop":
+		transforms = append(transforms, DDLApproval(func(ctx context.Context, op *ReplicationOperation) (bool, error) {
+			command, _ := DDLCommand(op)
+			return false, fmt.Errorf("DDL at %s needs approval: %s", op.Position, command)
+		}))
+	}
+
+	if c.Drift.Conn != "" {
+		cfg, err := pgx.ParseConnectionString(c.Drift.Conn)
+		if err != nil {
+			return fail(err)
+		}
+		conn, err := pgx.Connect(cfg)
+		if err != nil {
+			return fail(err)
+		}
+		closers = append(closers, conn)
+		transforms = append(transforms, NewPostgreSQLSchemaCheck(conn, configDriftPolicies[c.Drift.Policy]))
+	}
+
+	sink, err := c.openSink()
+	if err != nil {
+		return fail(err)
+	}
+	if closer, ok := sink.(io.Closer); ok {
+		closers = append(closers, closer)
+	}
+
+	p := NewPipeline(r, sink, transforms...).SetLogger(c.log)
+	if c.Tracing.Endpoint != "" {
+		exporter := NewOTLPExporter(c.Tracing.Endpoint, c.Tracing.Service, nil)
+		closers = append(closers, exporter)
+		p.SetTracer(NewTracer(exporter))
+	}
+	if c.Metrics.Listen != "" {
+		server, err := ListenMetrics(c.Metrics.Listen, NewMetrics(), c.Metrics.Stall)
+		if err != nil {
+			return fail(err)
+		}
+		closers = append(closers, server)
+		p.SetMetrics(server.Metrics)
+	}
+	if resync != nil {
+		p.background = append(p.background, func(ctx context.Context) error {
+			for _, table := range tables {
+				if err := resync.Resync(ctx, table); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	p.closers = closers
+	return p, nil
+}
+
+// configWithout returns tables without table.
+func configWithout(tables []string, table string) []string {
+	var without []string
+	for _, t := range tables {
+		if t != table {
+			without = append(without, t)
+		}
+	}
+	return without
+}
+
+// Verify compares the tables of the source with those of an "sql" or
+// "sqlite" target; see Verify. Operations that repair the target are written
+// to repair when it is not nil. Row filters and masks are not applied, so
+// tables with either differ.
+func (c *Config) Verify(ctx context.Context, repair Sink) (*VerifyReport, error) {
+	cfg, err := pgx.ParseConnectionString(c.Source.Conn)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := pgx.Connect(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	sink, err := c.openSink()
+	if err != nil {
+		return nil, err
+	}
+	if closer, ok := sink.(io.Closer); ok {
+		defer closer.Close()
+	}
+	if file, ok := sink.(configFileSink); ok {
+		sink = file.Sink
+	}
+	target, ok := sink.(*sqlSink)
+	if !ok {
+		return nil, fmt.Errorf("cannot verify a target of type %q", c.Target.Type)
+	}
+
+	internal := []string{c.Resync.Schema}
+	if c.DDL.Capture != "" {
+		internal = append(internal, c.DDL.Capture)
+	}
+	report, err := Verify(ctx, conn, target.db, target.dialect, VerifyOptions{
+		Tables:   c.Tables,
+		Internal: internal,
+		Keys:     target.options.Keys,
+		Repair:   repair,
+	})
+	if err == nil {
+		report.Applied, err = target.Position()
+	}
+	return report, err
+}
+
+type configDecoder struct {
+	file string
+}
+
+// encoder adds the fields of an Encoder to fields: format, one of "json",
+// "debezium" or "avro", the name and database of the source for "debezium",
+// and the name and schema registry URL for "avro". The returned function
+// builds the Encoder after fields are decoded.
+func (d *configDecoder) encoder(fields map[string]func(*tomlValue) error) func() (Encoder, error) {
+	var format string
+	var position tomlPosition
+	var debezium DebeziumOptions
+	var registry string
+
+	fields["format"] = func(v *tomlValue) error {
+		position = v.tomlPosition
+		return d.string(&format)(v)
+	}
+	fields["name"] = d.string(&debezium.Name)
+	fields["database"] = d.string(&debezium.Database)
+	fields["registry"] = d.string(&registry)
+
+	return func() (Encoder, error) {
+		switch format {
+		case "", "json":
+			return NewJSONEncoder(), nil
+		case "debezium":
+			return NewDebeziumEncoder(debezium), nil
+		case "avro":
+			if registry == "" {
+				return nil, d.errorf(position, "format \"avro\" needs a registry")
+			}
+			return NewAvroEncoder(AvroOptions{
+				Registry: NewHTTPSchemaRegistry(registry, nil),
+				Name:     debezium.Name,
+			}), nil
+		}
+		return nil, d.errorf(position, "unknown format %q", format)
+	}
+}
+
+func (d *configDecoder) errorf(pos tomlPosition, format string, args ...interface{}) error {
+	return &ConfigError{File: d.file, Line: pos.line, Column: pos.column, Message: fmt.Sprintf(format, args...)}
+}
+
+// fields decodes each key of table with its function in fields. Keys without
+// a function are errors.
+func (d *configDecoder) fields(table *tomlTable, name string, fields map[string]func(*tomlValue) error) error {
+	for _, key := range table.keys {
+		decode, ok := fields[key]
+		if !ok {
+			if name == "" {
+				return d.errorf(table.values[key].tomlPosition, "unknown key %q", key)
+			}
+			return d.errorf(table.values[key].tomlPosition, "unknown key %q in %s", key, name)
+		}
+		if err := decode(table.values[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *configDecoder) tableOf(v *tomlValue, name string) (*tomlTable, error) {
+	table, ok := v.value.(*tomlTable)
+	if !ok {
+		return nil, d.errorf(v.tomlPosition, "%s must be a table", name)
+	}
+	return table, nil
+}
+
+func (d *configDecoder) table(name string, fields map[string]func(*tomlValue) error) func(*tomlValue) error {
+	return func(v *tomlValue) error {
+		table, err := d.tableOf(v, name)
+		if err == nil {
+			err = d.fields(table, name, fields)
+		}
+		return err
+	}
+}
+
+var configVariableRegexp = regexp.MustCompile(`\$\{(\w+)\}`)
+
+func (d *configDecoder) expand(v *tomlValue) (string, error) {
+	s, ok := v.value.(string)
+	if !ok {
+		return "", d.errorf(v.tomlPosition, "expected a string")
+	}
+
+	var err error
+	s = configVariableRegexp.ReplaceAllStringFunc(s, func(match string) string {
+		name := match[2 : len(match)-1]
+		value, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = d.errorf(v.tomlPosition, "environment variable %s is not set", name)
+		}
+		return value
+	})
+	return s, err
+}
+
+func (d *configDecoder) string(dest *string) func(*tomlValue) error {
+	return func(v *tomlValue) (err error) {
+		*dest, err = d.expand(v)
+		return
+	}
+}
+
+func (d *configDecoder) strings(dest *[]string) func(*tomlValue) error {
+	return func(v *tomlValue) error {
+		values, ok := v.value.([]*tomlValue)
+		if !ok {
+			return d.errorf(v.tomlPosition, "expected an array of strings")
+		}
+		*dest = make([]string, len(values))
+		for i := range values {
+			s, err := d.expand(values[i])
+			if err != nil {
+				return err
+			}
+			(*dest)[i] = s
+		}
+		return nil
+	}
+}
+
+func (d *configDecoder) int(dest *int) func(*tomlValue) error {
+	return func(v *tomlValue) error {
+		n, ok := v.value.(int64)
+		if !ok {
+			return d.errorf(v.tomlPosition, "expected an integer")
+		}
+		*dest = int(n)
+		return nil
+	}
+}
+
+func (d *configDecoder) int64(dest *int64) func(*tomlValue) error {
+	return func(v *tomlValue) error {
+		n, ok := v.value.(int64)
+		if !ok {
+			return d.errorf(v.tomlPosition, "expected an integer")
+		}
+		*dest = n
+		return nil
+	}
+}
+
+func (d *configDecoder) duration(dest *time.Duration) func(*tomlValue) error {
+	return func(v *tomlValue) error {
+		s, err := d.expand(v)
+		if err == nil {
+			if *dest, err = time.ParseDuration(s); err != nil {
+				err = d.errorf(v.tomlPosition, "expected a duration, e.g. \"5m\"")
+			}
+		}
+		return err
+	}
+}
+
+func (d *configDecoder) bool(dest *bool) func(*tomlValue) error {
+	return func(v *tomlValue) error {
+		b, ok := v.value.(bool)
+		if !ok {
+			return d.errorf(v.tomlPosition, "expected true or false")
+		}
+		*dest = b
+		return nil
+	}
+}
+
+// stringsMap decodes a table of arrays of strings.
+func (d *configDecoder) stringsMap(name string, dest *map[string][]string) func(*tomlValue) error {
+	return func(v *tomlValue) error {
+		table, err := d.tableOf(v, name)
+		if err != nil {
+			return err
+		}
+		*dest = make(map[string][]string, len(table.keys))
+		for _, key := range table.keys {
+			var values []string
+			if err = d.strings(&values)(table.values[key]); err != nil {
+				return err
+			}
+			(*dest)[key] = values
+		}
+		return nil
+	}
+}
+
+// stringMap decodes a table of strings, remembering the position of each.
+func (d *configDecoder) stringMap(name string, dest *map[string]string, positions map[string]tomlPosition) func(*tomlValue) error {
+	return func(v *tomlValue) error {
+		table, err := d.tableOf(v, name)
+		if err != nil {
+			return err
+		}
+		*dest = make(map[string]string, len(table.keys))
+		for _, key := range table.keys {
+			s, err := d.expand(table.values[key])
+			if err != nil {
+				return err
+			}
+			(*dest)[key] = s
+			positions[name+"."+key] = table.values[key].tomlPosition
+		}
+		return nil
+	}
+}
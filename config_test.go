@@ -0,0 +1,196 @@
+package pgbarrel
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseConfig(t *testing.T) {
+	os.Setenv("PGBARREL_TEST_PASSWORD", "secret")
+	defer os.Unsetenv("PGBARREL_TEST_PASSWORD")
+
+	c, err := ParseConfig("test.toml", []byte(`
+[source]
+conn = "host=db password=${PGBARREL_TEST_PASSWORD}"
+slot = "barrel"
+status_interval = "5s"
+
+[tables]
+include = ["public.*"]
+exclude = ["public.audit"]
+
+[filter]
+"public.orders" = "tenant_id = 42"
+
+[mask]
+key = "k"
+columns."public.users" = { email = "hmac", name = "fixed('x')", phone = "truncate(3)" }
+
+[ddl]
+policy = "skip"
+
+[tracing]
+endpoint = "http://collector:4318/v1/traces"
+
+[metrics]
+listen = ":9187"
+stall = "1m"
+
+[resync]
+tables = ["public.orders"]
+keys."public.orders" = ["tenant_id", "id"]
+`))
+	require.NoError(t, err)
+
+	assert.Equal(t, "host=db password=secret", c.Source.Conn)
+	assert.Equal(t, "barrel", c.Source.Slot)
+	assert.Equal(t, 5*time.Second, c.Source.StatusInterval)
+	assert.Zero(t, c.Source.WaitTimeout)
+	assert.Equal(t, "test_decoding", c.Source.Plugin, "Expected a default plugin")
+	assert.Equal(t, []string{"public.*"}, c.Tables.Include)
+	assert.Equal(t, map[string]string{"public.orders": "tenant_id = 42"}, c.Filter)
+	assert.Equal(t, map[string]map[string]string{"public.users": {
+		"email": "hmac", "name": "fixed('x')", "phone": "truncate(3)",
+	}}, c.Mask.Columns)
+	assert.Equal(t, "skip", c.DDL.Policy)
+	assert.Equal(t, "http://collector:4318/v1/traces", c.Tracing.Endpoint)
+	assert.Equal(t, "pgbarrel", c.Tracing.Service, "Expected a default service")
+	assert.Equal(t, ":9187", c.Metrics.Listen)
+	assert.Equal(t, time.Minute, c.Metrics.Stall)
+	assert.Equal(t, []string{"public.orders"}, c.Resync.Tables)
+	assert.Equal(t, "pgbarrel", c.Resync.Schema, "Expected a default schema")
+	assert.Equal(t, 1000, c.Resync.ChunkSize, "Expected a default chunk size")
+	assert.Equal(t, map[string][]string{"public.orders": {"tenant_id", "id"}}, c.Resync.Keys)
+	assert.Equal(t, "stdout", c.Target.Type)
+
+	op := &ReplicationOperation{Operation: `INSERT`, Target: `public.users`,
+		NewColumns: []string{`name`, `phone`}, NewValues: []string{`'alice'`, `'5551234'`}, NewTypes: []string{`text`, `text`}}
+	require.NoError(t, c.masks.Apply(op))
+	assert.Equal(t, []string{`'x'`, `'555'`}, op.NewValues)
+
+	assert.True(t, c.Tables.Filter(&ReplicationOperation{Operation: `INSERT`, Target: `public.users`}))
+	assert.False(t, c.Tables.Filter(&ReplicationOperation{Operation: `INSERT`, Target: `public.audit`}))
+	assert.False(t, c.Tables.Filter(&ReplicationOperation{Operation: `INSERT`, Target: `other.users`}))
+	assert.True(t, c.Tables.Filter(&ReplicationOperation{Operation: `BEGIN`, Target: `553`}))
+	assert.True(t, c.Tables.Filter(&ReplicationOperation{Operation: `COMMIT`, Target: `553 (at 2017-05-01 12:00:00+00)`}))
+}
+
+func TestParseConfigFilterKeys(t *testing.T) {
+	c, err := ParseConfig("test.toml", []byte(`
+[source]
+conn = "c"
+slot = "s"
+
+[filter]
+"public.orders" = "tenant_id = 42"
+
+[target]
+type = "sqlite"
+file = "x"
+keys."public.orders" = ["id"]
+`))
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]string{"public.orders": {"id"}}, c.filter.Keys)
+}
+
+func TestConfigSQLiteTarget(t *testing.T) {
+	c, err := ParseConfig("test.toml", []byte(`
+[source]
+conn = "c"
+slot = "s"
+
+[target]
+type = "sqlite"
+file = "`+filepath.Join(t.TempDir(), `test.db`)+`"
+`))
+	require.NoError(t, err)
+
+	sink, err := c.openSink()
+	require.NoError(t, err, "Expected the sqlite3 driver to be linked")
+	defer sink.(configFileSink).Close()
+
+	position, err := sink.(configFileSink).Sink.(*sqlSink).Position()
+	require.NoError(t, err)
+	assert.Equal(t, ``, position)
+}
+
+func TestParseConfigError(t *testing.T) {
+	const source = "[source]\nconn = 'c'\nslot = 's'\n"
+
+	for _, tt := range []struct {
+		config, message string
+	}{
+		{source + "bogus = 1", "test.toml:4:1: unknown key \"bogus\" in source"},
+		{source + "[bogus]", "test.toml:4:1: unknown key \"bogus\""},
+		{source + "plugin = 1", "test.toml:4:1: expected a string"},
+		{source + "plugin = 'bogus'", "test.toml:4:1: unknown logical decoding output plugin \"bogus\""},
+		{source + "options = '${PGBARREL_TEST_MISSING}'", "test.toml:4:1: environment variable PGBARREL_TEST_MISSING is not set"},
+		{source + "[tables]\ninclude = 'public.*'", "test.toml:5:1: expected an array of strings"},
+		{source + "[filter]\n'public.t' = 'id ='", "test.toml:5:1: "},
+		{source + "[mask]\ncolumns.'public.t'.c = 'hmac'", "test.toml:5:1: mask \"hmac\" needs mask.key"},
+		{source + "[mask]\ncolumns.'public.t'.c = 'rot13'", "test.toml:5:1: unknown mask \"rot13\""},
+		{source + "[mask]\ncolumns.'public.t'.c = 'truncate(x)'", "test.toml:5:1: mask \"truncate(x)\" needs a length"},
+		{source + "[ddl]\npolicy = 'maybe'", "test.toml:5:1: unknown DDL policy \"maybe\""},
+		{source + "[drift]\npolicy = 'ignore'", "test.toml:5:1: unknown drift policy \"ignore\""},
+		{source + "[log]\nlevel = 'loud'", "test.toml:5:1: unknown log level \"loud\""},
+		{source + "[log]\nformat = 'xml'", "test.toml:5:1: unknown log format \"xml\""},
+		{source + "[metrics]\nport = 9187", "test.toml:5:1: unknown key \"port\" in metrics"},
+		{source + "[resync]\nchunk_size = 0", "test.toml:5:1: chunk_size must be positive"},
+		{source + "[target]\ntype = 'bogus'", "test.toml:5:1: unknown target type \"bogus\""},
+		{source + "[target]\npath = '/tmp'", "test.toml:5:1: unknown key \"path\" in target"},
+		{source + "slot = 'again'", "test.toml:4:1: key \"slot\" is already defined at 3:1"},
+		{source + "[target]\ntype = 'jsonl'\ndir = '/tmp'\ncompression = 'lz4'", "test.toml:7:1: unknown compression \"lz4\""},
+		{source + "[target]\ntype = 'jsonl'\ndir = '/tmp'\nmax_age = '5'", "test.toml:7:1: expected a duration"},
+		{source + "[target]\ntype = 'jsonl'", "test.toml:4:1: missing target.dir"},
+		{source + "[target]\ntype = 'jsonl'\ndir = '/tmp'\nformat = 'xml'", "test.toml:7:1: unknown format \"xml\""},
+		{source + "[target]\ntype = 'jsonl'\ndir = '/tmp'\nformat = 'avro'", "test.toml:7:1: format \"avro\" needs a registry"},
+		{source + "[target]\ntype = 'kafka'\nbrokers = ['k:9092']\nkeys.'public.t' = 'id'", "test.toml:7:1: expected an array of strings"},
+		{source + "[target]\ntype = 'kafka'\nbrokers = ['k:9092']\nacks = 2", "test.toml:7:1: acks must be 1 or -1"},
+		{source + "[target]\ntype = 'kafka'", "test.toml:4:1: missing target.brokers"},
+		{source + "[target]\ntype = 'webhook'", "test.toml:4:1: missing target.urls"},
+		{source + "[target]\ntype = 'webhook'\nurls.'*' = ['http://x']\nbackoff = 1", "test.toml:7:1: expected a string"},
+		{source + "[target]\ntype = 'copy'", "test.toml:4:1: missing target.file"},
+		{source + "[target]\ntype = 'sqlite'\nkeys = ['id']", "test.toml:6:1: target.keys must be a table"},
+		{source + "[filter]\n'public.t' = 'id = 1'\n[target]\ntype = 'sqlite'\nfile = 'x'", "test.toml:5:1: filter of public.t needs target.keys"},
+		{source + "[target]\ntype = 'sqlite'", "test.toml:4:1: missing target.file"},
+		{source + "[target]\ntype = 'sql'\ndsn = 'x'", "test.toml:4:1: missing target.driver"},
+		{source + "[target]\ntype = 'sql'\ndriver = 'pgx'", "test.toml:4:1: missing target.dsn"},
+		{source + "[target]\ntype = 'sql'\ndriver = 'pgx'\ndsn = 'x'\ndialect = 'oracle'", "test.toml:4:1: unknown dialect \"oracle\""},
+		{source + "[target]\ntype = 'parquet'", "test.toml:4:1: missing target.dir"},
+		{source + "[target]\ntype = 'grpc'", "test.toml:4:1: missing target.listen"},
+		{source + "[target]\ntype = 'grpc'\nlisten = ':0'\ncert_file = 'c'", "test.toml:4:1: target.cert_file and target.key_file go together"},
+		{"[source]\nconn = 'c'", "test.toml:1:1: missing source.slot"},
+	} {
+		_, err := ParseConfig("test.toml", []byte(tt.config))
+		if assert.Error(t, err, "%q", tt.config) {
+			assert.IsType(t, &ConfigError{}, err)
+			assert.Contains(t, err.Error(), tt.message, "%q", tt.config)
+		}
+	}
+}
+
+type testLoggingSink struct {
+	testPingSink
+	log Logger
+}
+
+func (s *testLoggingSink) SetLogger(l Logger) { s.log = l }
+
+func TestConfigFileSink(t *testing.T) {
+	sink := &testLoggingSink{}
+	sink.err = errors.New("refused")
+	logger := &testLogger{}
+
+	NewPipeline(&testSource{}, configFileSink{sink, ioutil.NopCloser(nil)}).SetLogger(logger)
+	assert.Equal(t, logger, sink.log, "Expected the logger to reach the wrapped Sink")
+	assert.EqualError(t, configFileSink{sink, nil}.Ping(context.Background()), "refused")
+	assert.NoError(t, configFileSink{&testSink{}, nil}.Ping(context.Background()))
+}
@@ -0,0 +1,331 @@
+package pgbarrel
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+type copySink struct {
+	w   io.Writer
+	xid string
+}
+
+// NewCopySink returns a Sink that writes each operation to w as a row in the
+// text format of COPY, ready to be loaded into a table like
+//
+//	CREATE TABLE changes (
+//		lsn pg_lsn, xid bigint, operation text, target text,
+//		old_columns text[], old_types text[], old_values text[],
+//		new_columns text[], new_types text[], new_values text[]
+//	);
+//	COPY changes FROM 'changes.copy';
+//
+// Columns are unquoted and values are those of their constants, with NULL
+// values as NULL elements. An operation without a position, such as a row
+// copied again, has a NULL lsn. When w has a Sync method, as *os.File does,
+// it is called at each COMMIT. NewCopyReader reads the operations back.
+func NewCopySink(w io.Writer) Sink {
+	return &copySink{w: w}
+}
+
+func (s *copySink) Write(ctx context.Context, op *ReplicationOperation) error {
+	if op.Operation == `BEGIN` {
+		s.xid = op.Target
+	}
+
+	position, xid := `\N`, `\N`
+	if op.Position != "" {
+		position = op.Position
+	}
+	if _, err := strconv.ParseInt(s.xid, 10, 64); err == nil {
+		xid = s.xid
+	}
+
+	columns := func(names []string) string {
+		unquoted := make([]*string, len(names))
+		for i := range names {
+			name := pgUnquoteIdentifier(names[i])
+			unquoted[i] = &name
+		}
+		return copyEscape(pgArray(unquoted))
+	}
+	values := func(constants []string) string {
+		unquoted := make([]*string, len(constants))
+		for i := range constants {
+			if value, null := pgUnquoteConstant(constants[i]); !null {
+				unquoted[i] = &value
+			}
+		}
+		return copyEscape(pgArray(unquoted))
+	}
+	types := func(types []string) string {
+		elements := make([]*string, len(types))
+		for i := range types {
+			elements[i] = &types[i]
+		}
+		return copyEscape(pgArray(elements))
+	}
+
+	row := strings.Join([]string{
+		position, xid, copyEscape(op.Operation), copyEscape(op.Target),
+		columns(op.OldColumns), types(op.OldTypes), values(op.OldValues),
+		columns(op.NewColumns), types(op.NewTypes), values(op.NewValues),
+	}, "\t") + "\n"
+
+	if _, err := io.WriteString(s.w, row); err != nil {
+		return err
+	}
+	if syncer, ok := s.w.(interface{ Sync() error }); ok && op.Operation == `COMMIT` {
+		return syncer.Sync()
+	}
+	return nil
+}
+
+// A CopyReader reads the operations written by NewCopySink, or copied out of
+// a table of them with COPY TO. It is also a Source that sends each
+// operation once.
+type CopyReader struct {
+	r    *bufio.Reader
+	line int
+}
+
+func NewCopyReader(r io.Reader) *CopyReader {
+	return &CopyReader{r: bufio.NewReader(r)}
+}
+
+// Read returns the next operation or io.EOF.
+func (r *CopyReader) Read() (*ReplicationOperation, error) {
+	line, err := r.r.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.line++
+
+	fields := strings.Split(strings.TrimSuffix(line, "\n"), "\t")
+	if len(fields) != 10 {
+		return nil, errors.Errorf("Line %d: expected 10 fields, got %d", r.line, len(fields))
+	}
+
+	var values [10]*string
+	for i, field := range fields {
+		if values[i], err = copyUnescape(field); err != nil {
+			return nil, errors.Wrapf(err, "Line %d", r.line)
+		}
+	}
+	if values[2] == nil || values[3] == nil {
+		return nil, errors.Errorf("Line %d: unexpected NULL", r.line)
+	}
+
+	op := &ReplicationOperation{Operation: *values[2], Target: *values[3]}
+	if values[0] != nil {
+		op.Position = *values[0]
+	}
+	arrays := make([][]*string, 6)
+	for i := range arrays {
+		if values[4+i] != nil {
+			if arrays[i], err = pgParseArray(*values[4+i]); err != nil {
+				return nil, errors.Wrapf(err, "Line %d", r.line)
+			}
+		}
+	}
+
+	row := func(names, types, constants []*string) (n, t, v []string) {
+		for i := range names {
+			var typ string
+			if i < len(types) && types[i] != nil {
+				typ = *types[i]
+			}
+			var name string
+			if names[i] != nil {
+				name = *names[i]
+			}
+			n = append(n, pgQuoteIdentifier(name))
+			if i < len(types) {
+				t = append(t, typ)
+			}
+			if i < len(constants) {
+				v = append(v, pgConstant(typ, constants[i]))
+			}
+		}
+		return
+	}
+	op.OldColumns, op.OldTypes, op.OldValues = row(arrays[0], arrays[1], arrays[2])
+	op.NewColumns, op.NewTypes, op.NewValues = row(arrays[3], arrays[4], arrays[5])
+	return op, nil
+}
+
+func (r *CopyReader) Start(ctx context.Context, out chan<- *ReplicationOperation) error {
+	for {
+		op, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case out <- op:
+		}
+	}
+}
+
+func (r *CopyReader) Acknowledge(position string) error { return nil }
+
+// pgConstant returns value of type typ as a constant the way logical
+// decoding prints it: numbers and booleans bare, everything else quoted.
+func pgConstant(typ string, value *string) string {
+	switch {
+	case value == nil:
+		return `null`
+	case typ == `boolean` && (*value == `true` || *value == `false`):
+		return *value
+	case pgIsNumericType(typ) && json.Valid([]byte(*value)):
+		return *value
+	}
+	return pgQuoteLiteral(*value)
+}
+
+// pgArray returns elements as a one-dimensional array constant, with nil as
+// NULL.
+func pgArray(elements []*string) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, element := range elements {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		if element == nil {
+			b.WriteString(`NULL`)
+			continue
+		}
+		b.WriteByte('"')
+		for _, c := range []byte(*element) {
+			if c == '"' || c == '\\' {
+				b.WriteByte('\\')
+			}
+			b.WriteByte(c)
+		}
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// pgParseArray returns the elements of a one-dimensional array constant, with
+// nil as NULL.
+func pgParseArray(s string) ([]*string, error) {
+	if len(s) < 2 || s[0] != '{' || s[len(s)-1] != '}' {
+		return nil, errors.Errorf("Invalid array: %q", s)
+	}
+
+	var elements []*string
+	for i := 1; i < len(s)-1; {
+		var b strings.Builder
+		quoted := s[i] == '"'
+		if quoted {
+			for i++; i < len(s)-1 && s[i] != '"'; i++ {
+				if s[i] == '\\' {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			i++
+		} else {
+			for ; i < len(s)-1 && s[i] != ','; i++ {
+				if s[i] == '\\' {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+		}
+
+		if element := b.String(); !quoted && strings.EqualFold(strings.TrimSpace(element), `NULL`) {
+			elements = append(elements, nil)
+		} else {
+			elements = append(elements, &element)
+		}
+
+		if i < len(s)-1 {
+			if s[i] != ',' {
+				return nil, errors.Errorf("Invalid array: %q", s)
+			}
+			i++
+		}
+	}
+	return elements, nil
+}
+
+// copyEscape escapes s for the text format of COPY.
+func copyEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`, "\t", `\t`).Replace(s)
+}
+
+// copyUnescape returns the value of a field in the text format of COPY, or
+// nil for \N.
+func copyUnescape(field string) (*string, error) {
+	if field == `\N` {
+		return nil, nil
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] != '\\' {
+			b.WriteByte(field[i])
+			continue
+		}
+		if i++; i == len(field) {
+			return nil, errors.Errorf("Invalid escape at the end of %q", field)
+		}
+
+		switch c := field[i]; c {
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'v':
+			b.WriteByte('\v')
+		case 'x':
+			j := i + 1
+			for j < len(field) && j < i+3 && strings.IndexByte("0123456789abcdefABCDEF", field[j]) >= 0 {
+				j++
+			}
+			if j == i+1 {
+				b.WriteByte('x')
+				continue
+			}
+			n, _ := strconv.ParseUint(field[i+1:j], 16, 8)
+			b.WriteByte(byte(n))
+			i = j - 1
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			j := i
+			for j < len(field) && j < i+3 && '0' <= field[j] && field[j] <= '7' {
+				j++
+			}
+			n, _ := strconv.ParseUint(field[i:j], 8, 8)
+			b.WriteByte(byte(n))
+			i = j - 1
+		default:
+			b.WriteByte(c)
+		}
+	}
+	s := b.String()
+	return &s, nil
+}
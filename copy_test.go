@@ -0,0 +1,94 @@
+package pgbarrel
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCopySink(t *testing.T) {
+	ops := []*ReplicationOperation{
+		{Position: `0/16B3748`, Operation: `BEGIN`, Target: `553`},
+		{Position: `0/16B3748`, Operation: `UPDATE`, Target: `public."My Table"`,
+			OldColumns: []string{`id`}, OldValues: []string{`1`}, OldTypes: []string{`integer`},
+			NewColumns: []string{`id`, `"Note"`, `ok`, `n`},
+			NewValues:  []string{`2`, "'a\\b\t\"c\"\nd''s'", `true`, `null`},
+			NewTypes:   []string{`integer`, `text`, `boolean`, `numeric`}},
+		{Position: `0/16B3750`, Operation: `DELETE`, Target: `public.t`,
+			OldColumns: []string{`id`}, OldValues: []string{`'NaN'`}, OldTypes: []string{`numeric`}},
+		{Position: `0/16B3758`, Operation: `TRUNCATE`, Target: `public.t`},
+		{Position: `0/16B3760`, Operation: `COMMIT`, Target: `553`},
+		{Operation: `READ`, Target: `public.t`,
+			NewColumns: []string{`id`}, NewValues: []string{`3`}, NewTypes: []string{`integer`}},
+	}
+
+	var b bytes.Buffer
+	sink := NewCopySink(&b)
+	for _, op := range ops {
+		require.NoError(t, sink.Write(context.Background(), op))
+	}
+
+	lines := strings.Split(b.String(), "\n")
+	assert.Equal(t, "0/16B3748\t553\tBEGIN\t553\t{}\t{}\t{}\t{}\t{}\t{}", lines[0])
+	assert.Equal(t, "0/16B3748\t553\tUPDATE\tpublic.\"My Table\""+
+		"\t{\"id\"}\t{\"integer\"}\t{\"1\"}"+
+		"\t{\"id\",\"Note\",\"ok\",\"n\"}\t{\"integer\",\"text\",\"boolean\",\"numeric\"}"+
+		"\t{\"2\",\"a\\\\\\\\b\\t\\\\\"c\\\\\"\\nd's\",\"true\",NULL}", lines[1])
+	assert.Equal(t, "\\N\t553\tREAD\tpublic.t\t{}\t{}\t{}\t{\"id\"}\t{\"integer\"}\t{\"3\"}", lines[5],
+		"Expected a NULL lsn without a position")
+	assert.Len(t, lines, len(ops)+1)
+
+	r := NewCopyReader(&b)
+	for _, expected := range ops {
+		op, err := r.Read()
+		require.NoError(t, err)
+		assert.Equal(t, expected.String(), op.String())
+	}
+	_, err := r.Read()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestCopyReader(t *testing.T) {
+	// as COPY TO writes a table of changes
+	r := NewCopyReader(strings.NewReader(
+		"0/10\t\\N\tINSERT\tpublic.t\t\\N\t\\N\t\\N\t{id,v}\t{integer,\"character varying\"}\t{1,\"x\\\\\\\\y\"}\n" +
+			"0/18\t\\N\tINSERT\tpublic.t\t{}\t{}\t{}\t{id,v}\t{integer,text}\t{NULL,\\101\\x42}"))
+
+	op, err := r.Read()
+	require.NoError(t, err)
+	assert.Equal(t, `0/10 INSERT public.t new: id[integer]:1 v[character varying]:'x\y'`, op.String())
+
+	op, err = r.Read()
+	require.NoError(t, err)
+	assert.Equal(t, `0/18 INSERT public.t new: id[integer]:null v[text]:'AB'`, op.String())
+
+	_, err = r.Read()
+	assert.Equal(t, io.EOF, err)
+
+	for _, tt := range []struct{ input, message string }{
+		{"0/10\tINSERT\n", "Line 1: expected 10 fields, got 2"},
+		{"0/10\t\\N\t\\N\tpublic.t\t{}\t{}\t{}\t{}\t{}\t{}\n", "Line 1: unexpected NULL"},
+		{"0/10\t\\N\tINSERT\tpublic.t\t{}\t{}\t{}\t(1)\t{}\t{}\n", "Line 1: Invalid array: \"(1)\""},
+	} {
+		_, err := NewCopyReader(strings.NewReader(tt.input)).Read()
+		assert.EqualError(t, err, tt.message)
+	}
+}
+
+func TestCopyReaderSource(t *testing.T) {
+	var b bytes.Buffer
+	sink := NewCopySink(&b)
+	for _, op := range testHubTransaction(`0/10`, `0/18`, `public.t`) {
+		require.NoError(t, sink.Write(context.Background(), op))
+	}
+
+	var replayed bytes.Buffer
+	p := NewPipeline(NewCopyReader(&b), NewTextSink(&replayed))
+	require.NoError(t, p.Run(context.Background()))
+	assert.Equal(t, "0/10 BEGIN \n0/10 INSERT public.t\n0/18 COMMIT \n", replayed.String())
+}
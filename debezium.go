@@ -0,0 +1,133 @@
+package pgbarrel
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+type DebeziumOptions struct {
+	// Name is the logical name of the source server, "pgbarrel" by default.
+	Name string
+	// Database is the name of the source database.
+	Database string
+}
+
+type debeziumEncoder struct {
+	options DebeziumOptions
+	now     func() time.Time
+	xid     string
+}
+
+// NewDebeziumEncoder returns an Encoder of the change event envelope of
+// Debezium's PostgreSQL connector, as written by its JSON converter without
+// schemas:
+//
+//	{"before":{"id":1},"after":{"id":2,"v":"a"},
+//	 "source":{"version":"pgbarrel","connector":"postgresql","name":"pgbarrel",
+//	  "ts_ms":1500000000000,"snapshot":"false","db":"app","schema":"public",
+//	  "table":"t","txId":553,"lsn":23803720,"xmin":null},
+//	 "op":"u","ts_ms":1500000000000,"transaction":null}
+//
+// The op is "c", "u", "d" or "t" for INSERT, UPDATE, DELETE and TRUNCATE,
+// and "r" for rows read by a snapshot (READ). BEGIN and COMMIT have no
+// message. Values are encoded as by NewJSONEncoder rather than as Debezium's
+// logical types, and ts_ms is the time the event is encoded. The encoder is a
+// CommitEncoder: source.ts_ms is the time the transaction committed when its
+// COMMIT has one, as with include-timestamp, and the encode time otherwise.
+func NewDebeziumEncoder(options DebeziumOptions) Encoder {
+	if options.Name == "" {
+		options.Name = "pgbarrel"
+	}
+	return &debeziumEncoder{options: options, now: time.Now}
+}
+
+var debeziumOperations = map[string]string{
+	`INSERT`: `c`, `UPDATE`: `u`, `DELETE`: `d`, `TRUNCATE`: `t`, `READ`: `r`,
+}
+
+type debeziumSource struct {
+	Version   string          `json:"version"`
+	Connector string          `json:"connector"`
+	Name      string          `json:"name"`
+	TsMs      int64           `json:"ts_ms"`
+	Snapshot  string          `json:"snapshot"`
+	DB        string          `json:"db"`
+	Schema    string          `json:"schema"`
+	Table     string          `json:"table"`
+	TxID      json.RawMessage `json:"txId"`
+	LSN       *uint64         `json:"lsn"`
+	Xmin      *uint64         `json:"xmin"`
+}
+
+type debeziumEnvelope struct {
+	Before      json.RawMessage `json:"before"`
+	After       json.RawMessage `json:"after"`
+	Source      debeziumSource  `json:"source"`
+	Op          string          `json:"op"`
+	TsMs        int64           `json:"ts_ms"`
+	Transaction json.RawMessage `json:"transaction"`
+}
+
+func (e *debeziumEncoder) Encode(op *ReplicationOperation) ([]byte, error) {
+	if op.Operation == `BEGIN` {
+		e.xid = op.Target
+	}
+
+	code, ok := debeziumOperations[op.Operation]
+	if !ok {
+		return nil, nil
+	}
+
+	ms := e.now().UnixNano() / int64(time.Millisecond)
+	envelope := debeziumEnvelope{
+		Before:      json.RawMessage(`null`),
+		After:       json.RawMessage(`null`),
+		Op:          code,
+		TsMs:        ms,
+		Transaction: json.RawMessage(`null`),
+		Source: debeziumSource{
+			Version:   "pgbarrel",
+			Connector: "postgresql",
+			Name:      e.options.Name,
+			TsMs:      ms,
+			Snapshot:  strconv.FormatBool(op.Operation == `READ`),
+			DB:        e.options.Database,
+			TxID:      jsonXID(e.xid),
+		},
+	}
+	envelope.Source.Schema, envelope.Source.Table = pgSplitTarget(op.Target)
+
+	if envelope.Source.TxID == nil || op.Operation == `READ` {
+		envelope.Source.TxID = json.RawMessage(`null`)
+	}
+	if lsn, err := pgx.ParseLSN(op.Position); err == nil {
+		envelope.Source.LSN = &lsn
+	}
+
+	if len(op.OldColumns) > 0 {
+		envelope.Before = jsonColumns(op.OldColumns, op.OldValues, op.OldTypes)
+	}
+	if len(op.NewColumns) > 0 {
+		envelope.After = jsonColumns(op.NewColumns, op.NewValues, op.NewTypes)
+	}
+
+	return json.Marshal(envelope)
+}
+
+// Commit sets source.ts_ms of message to the time of commit.
+func (e *debeziumEncoder) Commit(message []byte, commit *ReplicationOperation) ([]byte, error) {
+	t, ok := pgCommitTime(commit.Target)
+	if !ok {
+		return message, nil
+	}
+
+	var envelope debeziumEnvelope
+	if err := json.Unmarshal(message, &envelope); err != nil {
+		return nil, err
+	}
+	envelope.Source.TsMs = t.UnixNano() / int64(time.Millisecond)
+	return json.Marshal(envelope)
+}
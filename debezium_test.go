@@ -0,0 +1,72 @@
+package pgbarrel
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDebeziumEncoder(t *testing.T) {
+	e := NewDebeziumEncoder(DebeziumOptions{Database: `app`}).(*debeziumEncoder)
+	e.now = func() time.Time { return time.Unix(1500000000, 0) }
+
+	const source = `"source":{"version":"pgbarrel","connector":"postgresql","name":"pgbarrel","ts_ms":1500000000000,`
+
+	for _, tt := range []struct {
+		op       ReplicationOperation
+		expected string
+	}{
+		{ReplicationOperation{Position: `0/16B3748`, Operation: `BEGIN`, Target: `553`}, ``},
+		{ReplicationOperation{Position: `0/16B3748`, Operation: `INSERT`, Target: `public."My Table"`,
+			NewColumns: []string{`id`, `v`}, NewValues: []string{`1`, `'a'`}, NewTypes: []string{`integer`, `text`}},
+			`{"before":null,"after":{"id":1,"v":"a"},` + source +
+				`"snapshot":"false","db":"app","schema":"public","table":"My Table","txId":553,"lsn":23803720,"xmin":null},` +
+				`"op":"c","ts_ms":1500000000000,"transaction":null}`},
+		{ReplicationOperation{Position: `0/16B3750`, Operation: `UPDATE`, Target: `public.t`,
+			OldColumns: []string{`id`}, OldValues: []string{`1`}, OldTypes: []string{`integer`},
+			NewColumns: []string{`id`}, NewValues: []string{`2`}, NewTypes: []string{`integer`}},
+			`{"before":{"id":1},"after":{"id":2},` + source +
+				`"snapshot":"false","db":"app","schema":"public","table":"t","txId":553,"lsn":23803728,"xmin":null},` +
+				`"op":"u","ts_ms":1500000000000,"transaction":null}`},
+		{ReplicationOperation{Position: `0/16B3758`, Operation: `DELETE`, Target: `public.t`,
+			OldColumns: []string{`id`}, OldValues: []string{`2`}, OldTypes: []string{`integer`}},
+			`{"before":{"id":2},"after":null,` + source +
+				`"snapshot":"false","db":"app","schema":"public","table":"t","txId":553,"lsn":23803736,"xmin":null},` +
+				`"op":"d","ts_ms":1500000000000,"transaction":null}`},
+		{ReplicationOperation{Position: `0/16B3760`, Operation: `TRUNCATE`, Target: `public.t`},
+			`{"before":null,"after":null,` + source +
+				`"snapshot":"false","db":"app","schema":"public","table":"t","txId":553,"lsn":23803744,"xmin":null},` +
+				`"op":"t","ts_ms":1500000000000,"transaction":null}`},
+		{ReplicationOperation{Position: `0/16B3768`, Operation: `COMMIT`, Target: `553`}, ``},
+		{ReplicationOperation{Operation: `READ`, Target: `public.t`,
+			NewColumns: []string{`id`}, NewValues: []string{`3`}, NewTypes: []string{`integer`}},
+			`{"before":null,"after":{"id":3},` + source +
+				`"snapshot":"true","db":"app","schema":"public","table":"t","txId":null,"lsn":null,"xmin":null},` +
+				`"op":"r","ts_ms":1500000000000,"transaction":null}`},
+	} {
+		message, err := e.Encode(&tt.op)
+		require.NoError(t, err)
+		assert.Equal(t, tt.expected, string(message), "%v", &tt.op)
+	}
+}
+
+func TestDebeziumEncoderCommit(t *testing.T) {
+	e := NewDebeziumEncoder(DebeziumOptions{}).(*debeziumEncoder)
+	e.now = func() time.Time { return time.Unix(1500000000, 0) }
+
+	message, err := e.Encode(&ReplicationOperation{Position: `0/16B3748`, Operation: `DELETE`, Target: `public.t`,
+		OldColumns: []string{`id`}, OldValues: []string{`2`}, OldTypes: []string{`integer`}})
+	require.NoError(t, err)
+
+	unchanged, err := e.Commit(message, &ReplicationOperation{Position: `0/16B3768`, Operation: `COMMIT`, Target: `553`})
+	require.NoError(t, err)
+	assert.Equal(t, string(message), string(unchanged), "Expected the encode time without a commit time")
+
+	committed, err := e.Commit(message, &ReplicationOperation{Position: `0/16B3768`, Operation: `COMMIT`, Target: `553 (at 2017-05-01 12:00:00.25+00)`})
+	require.NoError(t, err)
+	assert.Equal(t, `{"before":{"id":2},"after":null,"source":{"version":"pgbarrel","connector":"postgresql","name":"pgbarrel",`+
+		`"ts_ms":1493640000250,"snapshot":"false","db":"","schema":"public","table":"t","txId":null,"lsn":23803720,"xmin":null},`+
+		`"op":"d","ts_ms":1500000000000,"transaction":null}`, string(committed))
+}
@@ -0,0 +1,151 @@
+package pgbarrel
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+)
+
+// An Encoder turns operations into messages for a Sink. It receives every
+// operation in order, BEGIN and COMMIT included, and returns nil for those
+// without a message.
+type Encoder interface {
+	Encode(op *ReplicationOperation) ([]byte, error)
+}
+
+// A CommitEncoder is an Encoder whose messages hold the time their
+// transaction committed, which is known only at its COMMIT. A Sink passes each
+// message of a transaction to Commit with that COMMIT before sending it.
+type CommitEncoder interface {
+	Encoder
+	Commit(message []byte, commit *ReplicationOperation) ([]byte, error)
+}
+
+type jsonEncoder struct{ xid string }
+
+// NewJSONEncoder returns an Encoder of one JSON object for each operation,
+// e.g.
+//
+//	{"position":"0/16B3748","xid":553,"operation":"UPDATE","target":"public.t",
+//	 "old":{"id":1},"new":{"id":2,"v":"a"},"types":{"id":"integer","v":"text"}}
+//
+// Values are JSON numbers, booleans and strings according to their type.
+func NewJSONEncoder() Encoder { return &jsonEncoder{} }
+
+func (e *jsonEncoder) Encode(op *ReplicationOperation) ([]byte, error) {
+	if op.Operation == `BEGIN` {
+		e.xid = op.Target
+	}
+	return json.Marshal(jsonOperation{op, e.xid})
+}
+
+type jsonOperation struct {
+	op  *ReplicationOperation
+	xid string
+}
+
+func (o jsonOperation) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+
+	field := func(name string, value []byte) {
+		if b.Len() == 0 {
+			b.WriteByte('{')
+		} else {
+			b.WriteByte(',')
+		}
+		b.WriteString(strconv.Quote(name))
+		b.WriteByte(':')
+		b.Write(value)
+	}
+	str := func(s string) []byte { v, _ := json.Marshal(s); return v }
+
+	field("position", str(o.op.Position))
+	if xid := jsonXID(o.xid); xid != nil {
+		field("xid", xid)
+	}
+	field("operation", str(o.op.Operation))
+	if o.op.Operation != `BEGIN` && o.op.Operation != `COMMIT` {
+		field("target", str(o.op.Target))
+	}
+	if len(o.op.OldColumns) > 0 {
+		field("old", jsonColumns(o.op.OldColumns, o.op.OldValues, o.op.OldTypes))
+	}
+	if len(o.op.NewColumns) > 0 {
+		field("new", jsonColumns(o.op.NewColumns, o.op.NewValues, o.op.NewTypes))
+	}
+	if len(o.op.OldTypes) > 0 || len(o.op.NewTypes) > 0 {
+		var columns, types []string
+		seen := make(map[string]bool)
+		add := func(names, typs []string) {
+			for i := range names {
+				if !seen[names[i]] && i < len(typs) {
+					seen[names[i]] = true
+					columns = append(columns, names[i])
+					types = append(types, string(str(typs[i])))
+				}
+			}
+		}
+		add(o.op.NewColumns, o.op.NewTypes)
+		add(o.op.OldColumns, o.op.OldTypes)
+		field("types", jsonObject(columns, types))
+	}
+
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// jsonXID returns the transaction ID of BEGIN as a JSON number.
+func jsonXID(xid string) json.RawMessage {
+	if _, err := strconv.ParseUint(xid, 10, 64); err != nil {
+		return nil
+	}
+	return json.RawMessage(xid)
+}
+
+// jsonColumns returns columns as a JSON object of typed values.
+func jsonColumns(names, values, types []string) []byte {
+	encoded := make([]string, len(names))
+	for i := range names {
+		var value, typ string
+		if i < len(values) {
+			value = values[i]
+		}
+		if i < len(types) {
+			typ = types[i]
+		}
+		encoded[i] = string(pgJSONValue(typ, value))
+	}
+	return jsonObject(names, encoded)
+}
+
+func jsonObject(names, values []string) []byte {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		name, _ := json.Marshal(pgUnquoteIdentifier(names[i]))
+		b.Write(name)
+		b.WriteByte(':')
+		b.WriteString(values[i])
+	}
+	b.WriteByte('}')
+	return b.Bytes()
+}
+
+// pgJSONValue returns a constant of type typ as JSON: numbers and booleans as
+// themselves, NULL as null and everything else as a string.
+func pgJSONValue(typ, constant string) json.RawMessage {
+	value, null := pgUnquoteConstant(constant)
+	switch {
+	case null || constant == ``:
+		return json.RawMessage(`null`)
+	case typ == `boolean` && (value == `true` || value == `false`):
+		return json.RawMessage(value)
+	case pgIsNumericType(typ) && constant == value && json.Valid([]byte(value)):
+		return json.RawMessage(value)
+	}
+	encoded, _ := json.Marshal(value)
+	return encoded
+}
@@ -0,0 +1,48 @@
+package pgbarrel
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPostgreSQLJSONValue(t *testing.T) {
+	for _, tt := range []struct {
+		typ, constant, expected string
+	}{
+		{`integer`, `1`, `1`},
+		{`numeric(10,2)`, `-1.50`, `-1.50`},
+		{`numeric`, `NaN`, `"NaN"`},
+		{`double precision`, `1e+30`, `1e+30`},
+		{`boolean`, `true`, `true`},
+		{`text`, `'it''s'`, `"it's"`},
+		{`text`, `null`, `null`},
+		{`integer`, `null`, `null`},
+		{`jsonb`, `'{"a": 1}'`, `"{\"a\": 1}"`},
+		{``, `'x'`, `"x"`},
+	} {
+		assert.Equal(t, tt.expected, string(pgJSONValue(tt.typ, tt.constant)), "%s %s", tt.typ, tt.constant)
+	}
+}
+
+func TestJSONEncoder(t *testing.T) {
+	e := NewJSONEncoder()
+
+	for _, tt := range []struct {
+		op       ReplicationOperation
+		expected string
+	}{
+		{ReplicationOperation{Position: `0/10`, Operation: `BEGIN`, Target: `553`},
+			`{"position":"0/10","xid":553,"operation":"BEGIN"}`},
+		{ReplicationOperation{Position: `0/10`, Operation: `TRUNCATE`, Target: `public.t`},
+			`{"position":"0/10","xid":553,"operation":"TRUNCATE","target":"public.t"}`},
+		{ReplicationOperation{Position: `0/10`, Operation: `INSERT`, Target: `public.t`,
+			NewColumns: []string{`"B"`, `a`}, NewValues: []string{`null`, `1`}},
+			`{"position":"0/10","xid":553,"operation":"INSERT","target":"public.t","new":{"B":null,"a":"1"}}`},
+	} {
+		message, err := e.Encode(&tt.op)
+		require.NoError(t, err)
+		assert.Equal(t, tt.expected, string(message))
+	}
+}
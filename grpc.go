@@ -0,0 +1,295 @@
+package pgbarrel
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// gRPC status codes
+const (
+	grpcOK              = 0
+	grpcInvalidArgument = 3
+	grpcFailedPrecond   = 9
+	grpcUnimplemented   = 12
+	grpcUnavailable     = 14
+)
+
+type grpcError struct {
+	code    int
+	message string
+}
+
+func (e *grpcError) Error() string { return e.message }
+
+// NewGRPCHandler serves the ChangeStream service of changestream.proto from
+// hub over HTTP/2:
+//
+//	rpc Subscribe(SubscribeRequest) returns (stream Change);
+//	rpc Ack(stream AckRequest) returns (AckResponse);
+//
+// Serve it with TLS or with unencrypted HTTP/2 enabled; gRPC does not run on
+// HTTP/1. Messages must not be compressed.
+func NewGRPCHandler(hub *ChangeHub) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/pgbarrel.ChangeStream/Subscribe", grpcHandler(func(w *grpcWriter, r *bufio.Reader) error {
+		message, err := grpcRead(r)
+		if err != nil {
+			return err
+		}
+
+		var request pbSubscribeRequest
+		if err = request.decode(message); err != nil {
+			return &grpcError{grpcInvalidArgument, err.Error()}
+		}
+
+		err = hub.Subscribe(w.request.Context(), request.subscriber, request.tables, request.from, func(op *ReplicationOperation) error {
+			return w.write(pbEncodeChange(op))
+		})
+		if err == nil {
+			return &grpcError{grpcUnavailable, ErrHubClosed.Error()}
+		}
+		return &grpcError{grpcFailedPrecond, err.Error()}
+	}))
+	mux.Handle("/pgbarrel.ChangeStream/Ack", grpcHandler(func(w *grpcWriter, r *bufio.Reader) error {
+		for {
+			message, err := grpcRead(r)
+			if err == io.EOF {
+				return w.write(nil) // AckResponse
+			}
+			if err != nil {
+				return err
+			}
+
+			var request pbAckRequest
+			if err = request.decode(message); err != nil {
+				return &grpcError{grpcInvalidArgument, err.Error()}
+			}
+			if err = hub.Ack(request.subscriber, request.position); err != nil {
+				return &grpcError{grpcInvalidArgument, err.Error()}
+			}
+		}
+	}))
+	return mux
+}
+
+// A GRPCServer is a ChangeHub that serves itself with NewGRPCHandler.
+// Closing it stops the server and the hub.
+type GRPCServer struct {
+	*ChangeHub
+	server *http.Server
+}
+
+// ListenGRPC serves hub on addr with TLS when certFile and keyFile are set,
+// or with unencrypted HTTP/2 otherwise, which needs Go 1.24.
+func ListenGRPC(addr, certFile, keyFile string, hub *ChangeHub) (*GRPCServer, error) {
+	s := &GRPCServer{ChangeHub: hub, server: &http.Server{Handler: NewGRPCHandler(hub)}}
+	if certFile == "" && !grpcUnencrypted(s.server) {
+		return nil, fmt.Errorf("unencrypted gRPC needs Go 1.24; set a certificate and key")
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if certFile == "" {
+		go s.server.Serve(listener)
+	} else {
+		go s.server.ServeTLS(listener, certFile, keyFile)
+	}
+	return s, nil
+}
+
+func (s *GRPCServer) Close() error {
+	// subscriptions end when the hub closes
+	s.ChangeHub.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.server.Shutdown(ctx)
+}
+
+type grpcWriter struct {
+	http.ResponseWriter
+	request *http.Request
+}
+
+// write sends one length-prefixed message.
+func (w *grpcWriter) write(message []byte) error {
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	if _, err := w.Write(append(frame, message...)); err != nil {
+		return err
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+func grpcHandler(serve func(w *grpcWriter, r *bufio.Reader) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			http.Error(w, "gRPC only", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/grpc+proto")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.WriteHeader(http.StatusOK)
+
+		err := serve(&grpcWriter{ResponseWriter: w, request: r}, bufio.NewReader(r.Body))
+
+		code, message := grpcOK, ""
+		switch e := err.(type) {
+		case nil:
+		case *grpcError:
+			code, message = e.code, e.message
+		default:
+			code, message = grpcUnavailable, err.Error()
+		}
+		w.Header().Set("Grpc-Status", fmt.Sprint(code))
+		w.Header().Set("Grpc-Message", url.PathEscape(message))
+	})
+}
+
+// grpcRead reads one length-prefixed message.
+func grpcRead(r io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, &grpcError{grpcInvalidArgument, "truncated message"}
+		}
+		return nil, err
+	}
+	if prefix[0] != 0 {
+		return nil, &grpcError{grpcUnimplemented, "compressed messages are not supported"}
+	}
+
+	message := make([]byte, binary.BigEndian.Uint32(prefix[1:]))
+	if _, err := io.ReadFull(r, message); err != nil {
+		return nil, &grpcError{grpcInvalidArgument, "truncated message"}
+	}
+	return message, nil
+}
+
+// The messages of changestream.proto.
+
+type pbSubscribeRequest struct {
+	subscriber string
+	tables     []string
+	from       string
+}
+
+func (m *pbSubscribeRequest) decode(b []byte) error {
+	return pbDecode(b, func(field int, value []byte) {
+		switch field {
+		case 1:
+			m.subscriber = string(value)
+		case 2:
+			m.tables = append(m.tables, string(value))
+		case 3:
+			m.from = string(value)
+		}
+	})
+}
+
+type pbAckRequest struct {
+	subscriber, position string
+}
+
+func (m *pbAckRequest) decode(b []byte) error {
+	return pbDecode(b, func(field int, value []byte) {
+		switch field {
+		case 1:
+			m.subscriber = string(value)
+		case 2:
+			m.position = string(value)
+		}
+	})
+}
+
+func pbEncodeChange(op *ReplicationOperation) []byte {
+	var b []byte
+	b = pbAppendString(b, 1, op.Position)
+	b = pbAppendString(b, 2, op.Operation)
+	b = pbAppendString(b, 3, op.Target)
+
+	columns := func(b []byte, field int, names, values, types []string) []byte {
+		for i := range names {
+			var column []byte
+			column = pbAppendString(column, 1, names[i])
+			if i < len(types) {
+				column = pbAppendString(column, 2, types[i])
+			}
+			if i < len(values) {
+				column = pbAppendString(column, 3, values[i])
+			}
+			b = pbAppendBytes(b, field, column)
+		}
+		return b
+	}
+	b = columns(b, 4, op.OldColumns, op.OldValues, op.OldTypes)
+	b = columns(b, 5, op.NewColumns, op.NewValues, op.NewTypes)
+	return b
+}
+
+func pbAppendBytes(b []byte, field int, value []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+func pbAppendString(b []byte, field int, value string) []byte {
+	if value == "" {
+		return b
+	}
+	return pbAppendBytes(b, field, []byte(value))
+}
+
+// pbDecode calls fn with each length-delimited field of a message and skips
+// the others.
+func pbDecode(b []byte, fn func(field int, value []byte)) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return fmt.Errorf("invalid protobuf message")
+		}
+		b = b[n:]
+
+		switch key & 7 {
+		case 0: // varint
+			if _, n = binary.Uvarint(b); n <= 0 {
+				return fmt.Errorf("invalid protobuf message")
+			}
+			b = b[n:]
+		case 1: // 64-bit
+			if len(b) < 8 {
+				return fmt.Errorf("invalid protobuf message")
+			}
+			b = b[8:]
+		case 2: // length-delimited
+			length, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < length {
+				return fmt.Errorf("invalid protobuf message")
+			}
+			fn(int(key>>3), b[n:n+int(length)])
+			b = b[n+int(length):]
+		case 5: // 32-bit
+			if len(b) < 4 {
+				return fmt.Errorf("invalid protobuf message")
+			}
+			b = b[4:]
+		default:
+			return fmt.Errorf("invalid protobuf message")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build go1.24
+
+package pgbarrel
+
+import "net/http"
+
+// grpcUnencrypted lets server speak HTTP/2 without TLS.
+func grpcUnencrypted(server *http.Server) bool {
+	server.Protocols = new(http.Protocols)
+	server.Protocols.SetUnencryptedHTTP2(true)
+	return true
+}
@@ -0,0 +1,9 @@
+//go:build !go1.24
+
+package pgbarrel
+
+import "net/http"
+
+// grpcUnencrypted reports that server cannot speak HTTP/2 without TLS before
+// Go 1.24.
+func grpcUnencrypted(server *http.Server) bool { return false }
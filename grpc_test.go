@@ -0,0 +1,137 @@
+package pgbarrel
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testGRPCFrame(message []byte) []byte {
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	return append(frame, message...)
+}
+
+func testGRPCCall(ctx context.Context, server *httptest.Server, method string, body io.Reader) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, server.URL+"/pgbarrel.ChangeStream/"+method, body)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/grpc")
+	request.Header.Set("TE", "trailers")
+	return server.Client().Do(request)
+}
+
+func TestGRPCHandler(t *testing.T) {
+	hub := NewChangeHub(10, `a`)
+	defer hub.Close()
+
+	var durable []string
+	hub.OnDurable(func(position string) { durable = append(durable, position) })
+
+	server := httptest.NewUnstartedServer(NewGRPCHandler(hub))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, op := range []*ReplicationOperation{
+		{Position: `0/10`, Operation: `BEGIN`, Target: `1`},
+		{Position: `0/10`, Operation: `INSERT`, Target: `public.t`,
+			NewColumns: []string{`id`}, NewValues: []string{`1`}, NewTypes: []string{`integer`}},
+		{Position: `0/18`, Operation: `COMMIT`, Target: `1`},
+	} {
+		require.NoError(t, hub.Write(ctx, op))
+	}
+
+	var request []byte
+	request = pbAppendString(request, 1, `a`)
+	request = pbAppendString(request, 2, `public.*`)
+
+	response, err := testGRPCCall(ctx, server, "Subscribe", bytes.NewReader(testGRPCFrame(request)))
+	require.NoError(t, err)
+	defer response.Body.Close()
+	assert.Equal(t, 2, response.ProtoMajor)
+	assert.Equal(t, "application/grpc+proto", response.Header.Get("Content-Type"))
+
+	body := bufio.NewReader(response.Body)
+	var changes []map[int][]string
+	for i := 0; i < 3; i++ {
+		message, err := grpcRead(body)
+		require.NoError(t, err)
+
+		change := make(map[int][]string)
+		require.NoError(t, pbDecode(message, func(field int, value []byte) {
+			if field == 5 {
+				require.NoError(t, pbDecode(value, func(field int, value []byte) {
+					change[50+field] = append(change[50+field], string(value))
+				}))
+			} else {
+				change[field] = append(change[field], string(value))
+			}
+		}))
+		changes = append(changes, change)
+	}
+	assert.Equal(t, []map[int][]string{
+		{1: {`0/10`}, 2: {`BEGIN`}, 3: {`1`}},
+		{1: {`0/10`}, 2: {`INSERT`}, 3: {`public.t`}, 51: {`id`}, 52: {`integer`}, 53: {`1`}},
+		{1: {`0/18`}, 2: {`COMMIT`}, 3: {`1`}},
+	}, changes)
+
+	t.Run("Ack", func(t *testing.T) {
+		reader, writer := io.Pipe()
+		go func() {
+			var ack []byte
+			ack = pbAppendString(ack, 1, `a`)
+			ack = pbAppendString(ack, 2, `0/18`)
+			writer.Write(testGRPCFrame(ack))
+			writer.Close()
+		}()
+
+		response, err := testGRPCCall(ctx, server, "Ack", reader)
+		require.NoError(t, err)
+		defer response.Body.Close()
+
+		message, err := grpcRead(response.Body)
+		require.NoError(t, err)
+		assert.Empty(t, message)
+
+		_, err = io.ReadAll(response.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "0", response.Trailer.Get("Grpc-Status"))
+		assert.Equal(t, []string{`0/18`}, durable)
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		var ack []byte
+		ack = pbAppendString(ack, 1, `unknown`)
+		ack = pbAppendString(ack, 2, `0/18`)
+
+		response, err := testGRPCCall(ctx, server, "Ack", bytes.NewReader(testGRPCFrame(ack)))
+		require.NoError(t, err)
+		_, err = io.ReadAll(response.Body)
+		require.NoError(t, err)
+		response.Body.Close()
+
+		assert.Equal(t, "3", response.Trailer.Get("Grpc-Status"))
+		assert.Equal(t, `Unknown%20subscriber:%20%22unknown%22`, response.Trailer.Get("Grpc-Message"))
+
+		response, err = testGRPCCall(ctx, server, "Subscribe", bytes.NewReader([]byte{1, 0, 0, 0, 0}))
+		require.NoError(t, err)
+		_, err = io.ReadAll(response.Body)
+		require.NoError(t, err)
+		response.Body.Close()
+
+		assert.Equal(t, "12", response.Trailer.Get("Grpc-Status"))
+	})
+}
@@ -0,0 +1,146 @@
+package pgbarrel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx"
+	"github.com/pkg/errors"
+)
+
+// Status describes a running Pipeline.
+type Status struct {
+	Slot      string `json:"slot,omitempty"`
+	Plugin    string `json:"plugin,omitempty"`
+	Streaming bool   `json:"streaming"`
+
+	Received string `json:"received_lsn"`
+	Applied  string `json:"applied_lsn"`
+	Server   string `json:"server_lsn"`
+
+	LagBytes       uint64  `json:"lag_bytes"`
+	ServerLagBytes uint64  `json:"server_lag_bytes"`
+	LagSeconds     float64 `json:"lag_seconds"`
+
+	LastError string `json:"last_error,omitempty"`
+}
+
+// source records the slot and plugin a receiver streams.
+func (m *Metrics) source(slot, plugin string) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.slot, m.plugin = slot, plugin
+}
+
+// stream records whether the replication stream is running.
+func (m *Metrics) stream(running bool) {
+	if m == nil {
+		return
+	}
+	var value int32
+	if running {
+		value = 1
+	}
+	atomic.StoreInt32(&m.streaming, value)
+}
+
+// alive records that the receive loop is turning.
+func (m *Metrics) alive() {
+	if m != nil {
+		atomic.StoreInt64(&m.looped, m.now().UnixNano())
+	}
+}
+
+// fail records the error that stopped a Pipeline.
+func (m *Metrics) fail(err error) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.lastError = err.Error()
+}
+
+// Status returns the slot, positions and last error of the Pipeline.
+func (m *Metrics) Status() Status {
+	if m == nil {
+		return Status{}
+	}
+	lag := m.Lag()
+	status := Status{
+		Streaming:      atomic.LoadInt32(&m.streaming) != 0,
+		Received:       pgx.FormatLSN(atomic.LoadUint64(&m.received)),
+		Applied:        pgx.FormatLSN(atomic.LoadUint64(&m.applied)),
+		Server:         pgx.FormatLSN(atomic.LoadUint64(&m.serverEnd)),
+		LagBytes:       lag.Received,
+		ServerLagBytes: lag.Server,
+		LagSeconds:     lag.Commit.Seconds(),
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	status.Slot, status.Plugin, status.LastError = m.slot, m.plugin, m.lastError
+	return status
+}
+
+// Healthy returns an error when the receive loop has not turned within
+// stall. It is healthy before the loop starts.
+func (m *Metrics) Healthy(stall time.Duration) error {
+	if m == nil {
+		return nil
+	}
+	looped := atomic.LoadInt64(&m.looped)
+	if since := m.now().Sub(time.Unix(0, looped)); looped != 0 && since > stall {
+		return errors.Errorf("Receive loop stalled for %v", since.Round(time.Millisecond))
+	}
+	return nil
+}
+
+// Ready returns an error until the replication stream is running, or when
+// the target does not answer a ping.
+func (m *Metrics) Ready(ctx context.Context) error {
+	if m == nil || atomic.LoadInt32(&m.streaming) == 0 {
+		return errors.New("Replication stream is not running")
+	}
+	if m.ping != nil {
+		if err := m.ping(ctx); err != nil {
+			return errors.Wrap(err, "Target is unreachable")
+		}
+	}
+	return nil
+}
+
+// NewHealthHandler serves /healthz, failing when the receive loop has
+// stalled for longer than stall, /readyz, ready once the stream is running
+// and the target is reachable, and the Status of m as JSON on /status.
+func NewHealthHandler(m *Metrics, stall time.Duration) http.Handler {
+	respond := func(w http.ResponseWriter, err error) {
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		respond(w, m.Healthy(stall))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		defer cancel()
+		respond(w, m.Ready(ctx))
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(m.Status())
+	})
+	return mux
+}
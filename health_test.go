@@ -0,0 +1,89 @@
+package pgbarrel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testPingSink struct {
+	testSink
+	err error
+}
+
+func (s *testPingSink) Ping(ctx context.Context) error { return s.err }
+
+func TestHealthHandler(t *testing.T) {
+	start := time.Date(2017, 5, 1, 12, 0, 0, 0, time.UTC)
+	m := NewMetrics()
+	m.now = func() time.Time { return start }
+
+	sink := &testPingSink{}
+	NewPipeline(&testSource{}, sink).SetMetrics(m)
+	handler := NewHealthHandler(m, 10*time.Second)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, get("/healthz").Code, "Expected healthy before the loop starts")
+	w := get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), "not running")
+
+	m.source("barrel", "test_decoding")
+	m.stream(true)
+	m.alive()
+	m.message(10, 0x20)
+	m.acknowledge(`0/18`)
+
+	assert.Equal(t, http.StatusOK, get("/healthz").Code)
+	assert.Equal(t, http.StatusOK, get("/readyz").Code)
+
+	sink.err = errors.New("refused")
+	w = get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), "Target is unreachable: refused")
+
+	m.now = func() time.Time { return start.Add(11 * time.Second) }
+	w = get("/healthz")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), "stalled for 11s")
+
+	m.fail(errors.New("boom"))
+	w = get("/status")
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var status Status
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Equal(t, Status{
+		Slot: "barrel", Plugin: "test_decoding", Streaming: true,
+		Received: "0/20", Applied: "0/18", Server: "0/0",
+		LagBytes: 8, LastError: "boom",
+	}, status)
+}
+
+func TestPipelineStatusError(t *testing.T) {
+	expected := errors.New(`boom`)
+	source := &testSource{ops: testTransaction(`0/10`, &ReplicationOperation{Operation: `INSERT`})}
+	m := NewMetrics()
+
+	err := NewPipeline(source, &testSink{write: func(*ReplicationOperation) error { return expected }}).SetMetrics(m).Run(context.Background())
+	assert.Equal(t, expected, err)
+	assert.Equal(t, "boom", m.Status().LastError)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	m = NewMetrics()
+	assert.Equal(t, context.Canceled, NewPipeline(&testSource{}, &testSink{}).SetMetrics(m).Run(ctx))
+	assert.Empty(t, m.Status().LastError, "Expected no error when canceled")
+}
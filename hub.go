@@ -0,0 +1,244 @@
+package pgbarrel
+
+import (
+	"context"
+	"sync"
+
+	"github.com/jackc/pgx"
+	"github.com/pkg/errors"
+)
+
+// ErrHubClosed is returned by a ChangeHub after Close.
+var ErrHubClosed = errors.New("Change hub closed")
+
+type hubTransaction struct {
+	sequence uint64
+	commit   uint64
+	ops      []*ReplicationOperation
+}
+
+// A ChangeHub is a Sink that shares one stream of transactions with many
+// subscribers. Each subscriber has a cursor, the last position it
+// acknowledged, and transactions are durable once every subscriber has
+// acknowledged them. Transactions are held in memory until then.
+type ChangeHub struct {
+	max     int
+	durable func(position string)
+
+	mutex    sync.Mutex
+	changed  chan struct{}
+	closed   bool
+	log      []hubTransaction
+	sequence uint64
+	current  []*ReplicationOperation
+	cursors  map[string]uint64
+	trimmed  uint64
+}
+
+// NewChangeHub returns a ChangeHub that holds at most max transactions.
+// Write waits while it is full. Subscribers are known by name and their
+// cursors remain, holding transactions, until they Unsubscribe.
+func NewChangeHub(max int, subscribers ...string) *ChangeHub {
+	h := &ChangeHub{max: max, changed: make(chan struct{}), cursors: make(map[string]uint64)}
+	for _, name := range subscribers {
+		h.cursors[name] = 0
+	}
+	return h
+}
+
+// notify wakes everything waiting for the hub to change; the mutex is held.
+func (h *ChangeHub) notify() {
+	close(h.changed)
+	h.changed = make(chan struct{})
+}
+
+func (h *ChangeHub) OnDurable(durable func(position string)) { h.durable = durable }
+
+func (h *ChangeHub) Write(ctx context.Context, op *ReplicationOperation) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if op.Operation == `BEGIN` {
+		h.current = h.current[:0:0]
+	}
+	h.current = append(h.current, op)
+	if op.Operation != `COMMIT` {
+		return nil
+	}
+
+	commit, err := pgx.ParseLSN(op.Position)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid position: %q", op.Position)
+	}
+
+	for len(h.log) >= h.max && !h.closed {
+		changed := h.changed
+		h.mutex.Unlock()
+		select {
+		case <-ctx.Done():
+			h.mutex.Lock()
+			return ctx.Err()
+		case <-changed:
+		}
+		h.mutex.Lock()
+	}
+	if h.closed {
+		return ErrHubClosed
+	}
+
+	h.sequence++
+	h.log = append(h.log, hubTransaction{sequence: h.sequence, commit: commit, ops: h.current})
+	h.current = nil
+	h.notify()
+	return nil
+}
+
+// Flush does nothing: transactions become durable as subscribers acknowledge
+// them.
+func (h *ChangeHub) Flush(ctx context.Context) error { return nil }
+
+// Close stops every subscription and Write.
+func (h *ChangeHub) Close() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if !h.closed {
+		h.closed = true
+		h.notify()
+	}
+	return nil
+}
+
+// Subscribe calls send with the operations of every transaction that
+// commits after from, or after the cursor of name when from is empty, until
+// ctx is done or send fails. Only operations on targets matching tables, as
+// by TableFilter, are sent; BEGIN and COMMIT always are.
+func (h *ChangeHub) Subscribe(ctx context.Context, name string, tables []string, from string, send func(*ReplicationOperation) error) error {
+	var position uint64
+	if from != "" {
+		var err error
+		if position, err = pgx.ParseLSN(from); err != nil {
+			return errors.Wrapf(err, "Invalid position: %q", from)
+		}
+	}
+
+	h.mutex.Lock()
+	cursor, known := h.cursors[name]
+	if from == "" {
+		position = cursor
+	}
+	if position < h.trimmed && (known || from != "") {
+		h.mutex.Unlock()
+		return errors.Errorf("Position %s is no longer held", pgx.FormatLSN(position))
+	}
+	if !known {
+		h.cursors[name] = position
+		if position < h.trimmed {
+			h.cursors[name] = h.trimmed
+		}
+	}
+	h.mutex.Unlock()
+
+	filter := TableFilter{Include: tables}
+	var next uint64
+
+	for {
+		h.mutex.Lock()
+		if h.closed {
+			h.mutex.Unlock()
+			return nil
+		}
+
+		var pending []hubTransaction
+		for _, tx := range h.log {
+			if tx.sequence > next && tx.commit > position {
+				pending = append(pending, tx)
+			}
+		}
+		changed := h.changed
+		h.mutex.Unlock()
+
+		for _, tx := range pending {
+			for _, op := range tx.ops {
+				if op.Operation != `BEGIN` && op.Operation != `COMMIT` && !filter.Filter(op) {
+					continue
+				}
+				if err := send(op); err != nil {
+					return err
+				}
+			}
+			next = tx.sequence
+		}
+
+		if len(pending) == 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-changed:
+			}
+		}
+	}
+}
+
+// Ack moves the cursor of name to position. Transactions acknowledged by
+// every subscriber are released and reported durable.
+func (h *ChangeHub) Ack(name, position string) error {
+	lsn, err := pgx.ParseLSN(position)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid position: %q", position)
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if cursor, ok := h.cursors[name]; !ok {
+		return errors.Errorf("Unknown subscriber: %q", name)
+	} else if lsn > cursor {
+		h.cursors[name] = lsn
+	}
+	h.release()
+	return nil
+}
+
+// Unsubscribe forgets the cursor of name so it no longer holds transactions.
+func (h *ChangeHub) Unsubscribe(name string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	delete(h.cursors, name)
+	h.release()
+}
+
+// release drops the transactions every subscriber has acknowledged; the
+// mutex is held.
+func (h *ChangeHub) release() {
+	if len(h.cursors) == 0 {
+		return
+	}
+
+	min := ^uint64(0)
+	for _, cursor := range h.cursors {
+		if cursor < min {
+			min = cursor
+		}
+	}
+
+	var n int
+	var position string
+	for n < len(h.log) && h.log[n].commit <= min {
+		position = h.log[n].ops[len(h.log[n].ops)-1].Position
+		n++
+	}
+	if min > h.trimmed {
+		h.trimmed = min
+	}
+	if n == 0 {
+		return
+	}
+
+	h.log = append(h.log[:0:0], h.log[n:]...)
+	h.notify()
+	if h.durable != nil {
+		h.durable(position)
+	}
+}
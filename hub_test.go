@@ -0,0 +1,128 @@
+package pgbarrel
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testHubTransaction(begin, commit string, targets ...string) []*ReplicationOperation {
+	ops := []*ReplicationOperation{{Position: begin, Operation: `BEGIN`}}
+	for _, target := range targets {
+		ops = append(ops, &ReplicationOperation{Position: begin, Operation: `INSERT`, Target: target})
+	}
+	return append(ops, &ReplicationOperation{Position: commit, Operation: `COMMIT`})
+}
+
+// testHubSubscriber collects what a subscription receives.
+func testHubSubscriber(t *testing.T, hub *ChangeHub, name string, tables []string, from string) (<-chan string, <-chan error, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	received := make(chan string, 100)
+	done := make(chan error, 1)
+
+	go func() {
+		done <- hub.Subscribe(ctx, name, tables, from, func(op *ReplicationOperation) error {
+			received <- op.Position + ` ` + op.Operation + ` ` + op.Target
+			return nil
+		})
+	}()
+	t.Cleanup(cancel)
+	return received, done, cancel
+}
+
+func testReceive(t *testing.T, received <-chan string, n int) []string {
+	var result []string
+	for i := 0; i < n; i++ {
+		select {
+		case s := <-received:
+			result = append(result, s)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected %d operations, got %q", n, result)
+		}
+	}
+	return result
+}
+
+func TestChangeHub(t *testing.T) {
+	ctx := context.Background()
+	hub := NewChangeHub(2, `a`, `b`)
+	defer hub.Close()
+
+	var durable []string
+	hub.OnDurable(func(position string) { durable = append(durable, position) })
+
+	write := func(ops []*ReplicationOperation) {
+		for _, op := range ops {
+			require.NoError(t, hub.Write(ctx, op))
+		}
+	}
+
+	write(testHubTransaction(`0/10`, `0/18`, `public.t`, `other.t`))
+
+	a, _, _ := testHubSubscriber(t, hub, `a`, []string{`public.*`}, ``)
+	assert.Equal(t, []string{`0/10 BEGIN `, `0/10 INSERT public.t`, `0/18 COMMIT `}, testReceive(t, a, 3))
+
+	write(testHubTransaction(`0/20`, `0/28`, `public.u`))
+	assert.Equal(t, []string{`0/20 BEGIN `, `0/20 INSERT public.u`, `0/28 COMMIT `}, testReceive(t, a, 3))
+
+	require.NoError(t, hub.Ack(`a`, `0/28`))
+	assert.Empty(t, durable, "Expected subscriber b to hold every transaction")
+
+	// the hub is full until b acknowledges
+	written := make(chan error, 1)
+	go func() {
+		for _, op := range testHubTransaction(`0/30`, `0/38`, `public.t`) {
+			if err := hub.Write(ctx, op); err != nil {
+				written <- err
+				return
+			}
+		}
+		written <- nil
+	}()
+
+	select {
+	case <-written:
+		t.Fatal("Expected Write to wait for space")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	require.NoError(t, hub.Ack(`b`, `0/18`))
+	assert.Equal(t, []string{`0/18`}, durable)
+	require.NoError(t, <-written)
+
+	b, _, _ := testHubSubscriber(t, hub, `b`, nil, ``)
+	assert.Equal(t, []string{
+		`0/20 BEGIN `, `0/20 INSERT public.u`, `0/28 COMMIT `,
+		`0/30 BEGIN `, `0/30 INSERT public.t`, `0/38 COMMIT `,
+	}, testReceive(t, b, 6))
+	assert.Equal(t, []string{`0/30 BEGIN `, `0/30 INSERT public.t`, `0/38 COMMIT `}, testReceive(t, a, 3))
+
+	require.NoError(t, hub.Ack(`b`, `0/38`))
+	assert.Equal(t, []string{`0/18`, `0/28`}, durable, "Expected the minimum of a and b")
+
+	hub.Unsubscribe(`a`)
+	assert.Equal(t, []string{`0/18`, `0/28`, `0/38`}, durable)
+
+	t.Run("From", func(t *testing.T) {
+		_, done, _ := testHubSubscriber(t, hub, `c`, nil, `0/20`)
+		assert.EqualError(t, <-done, `Position 0/20 is no longer held`)
+
+		assert.EqualError(t, hub.Ack(`d`, `0/40`), `Unknown subscriber: "d"`)
+
+		write(testHubTransaction(`0/40`, `0/48`, `public.t`))
+		write(testHubTransaction(`0/50`, `0/58`, `public.t`))
+
+		e, _, _ := testHubSubscriber(t, hub, `e`, nil, `0/48`)
+		assert.Equal(t, []string{`0/50 BEGIN `, `0/50 INSERT public.t`, `0/58 COMMIT `}, testReceive(t, e, 3))
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		_, done, _ := testHubSubscriber(t, hub, `b`, nil, ``)
+		require.NoError(t, hub.Close())
+		assert.NoError(t, <-done)
+		assert.Equal(t, ErrHubClosed, hub.Write(ctx, &ReplicationOperation{Position: `0/60`, Operation: `COMMIT`}))
+	})
+}
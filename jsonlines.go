@@ -0,0 +1,349 @@
+package pgbarrel
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// JSONLinesCompression compresses the files of a JSON Lines sink.
+type JSONLinesCompression struct {
+	// Extension is appended to the name of each file, e.g. ".gz".
+	Extension string
+	Writer    func(io.Writer) (io.WriteCloser, error)
+}
+
+// JSONLinesCompressions are the compressions a configuration may name. Add
+// others before loading the configuration.
+var JSONLinesCompressions = map[string]JSONLinesCompression{
+	"gzip": {Extension: ".gz", Writer: func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil }},
+	"zstd": {Extension: ".zst", Writer: func(w io.Writer) (io.WriteCloser, error) { return newZstdWriter(w), nil }},
+}
+
+type JSONLinesOptions struct {
+	// Dir holds the files and their manifest.
+	Dir string
+	// Prefix begins the name of each file; the default is "changes".
+	Prefix string
+
+	// A file is closed and another opened after the first COMMIT that takes
+	// it past MaxBytes, uncompressed, or once it is MaxAge old and no
+	// transaction is open. Nothing is durable until its file is closed, so
+	// MaxAge bounds how long the source keeps changes already written. Zero
+	// MaxBytes means no limit; zero MaxAge means one minute and negative
+	// means no limit, when only Flush closes a file.
+	MaxBytes int64
+	MaxAge   time.Duration
+
+	// Compression is nil to write plain text.
+	Compression *JSONLinesCompression
+
+	// Encoder writes each operation; the default is NewJSONEncoder.
+	Encoder Encoder
+
+	// Transactions writes each transaction as one object holding the
+	// messages of its operations.
+	Transactions bool
+}
+
+// A JSONLinesFile is an entry of the manifest of a JSON Lines sink.
+type JSONLinesFile struct {
+	File string `json:"file"`
+	// First and Last are the positions of the first operation and the last
+	// COMMIT the file holds.
+	First      string `json:"first"`
+	Last       string `json:"last"`
+	Operations int    `json:"operations"`
+}
+
+const jsonLinesManifest = "manifest.jsonl"
+
+// ReadJSONLinesManifest returns the files written to dir, oldest first.
+// Streaming may resume after the Last position of the last file.
+func ReadJSONLinesManifest(dir string) ([]JSONLinesFile, error) {
+	f, err := os.Open(filepath.Join(dir, jsonLinesManifest))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var files []JSONLinesFile
+	for decoder := json.NewDecoder(f); decoder.More(); {
+		var file JSONLinesFile
+		if err = decoder.Decode(&file); err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+type jsonLinesSink struct {
+	options JSONLinesOptions
+	durable func(position string)
+	now     func() time.Time
+
+	mutex    sync.Mutex
+	manifest *os.File
+	sequence int
+
+	file       *os.File
+	buffer     *bufio.Writer
+	compressor io.WriteCloser
+	entry      JSONLinesFile
+	opened     time.Time
+	size       int64
+	timer      *time.Timer
+	err        error // of closing a file by age
+
+	xid           string
+	inTransaction bool // between BEGIN and COMMIT
+	transaction   []json.RawMessage
+	positions     []string // of the transaction, held for a CommitEncoder
+}
+
+// NewJSONLinesSink returns a BufferedSink that writes the message of each
+// operation on its own line to files in options.Dir. Transactions are durable
+// once their file is closed and recorded in the manifest. A file may end with
+// part of a transaction that is repeated by the next file.
+func NewJSONLinesSink(options JSONLinesOptions) (*jsonLinesSink, error) {
+	if options.Prefix == "" {
+		options.Prefix = "changes"
+	}
+	if options.Encoder == nil {
+		options.Encoder = NewJSONEncoder()
+	}
+	if options.MaxAge == 0 {
+		options.MaxAge = time.Minute
+	}
+
+	files, err := ReadJSONLinesManifest(options.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := os.OpenFile(filepath.Join(options.Dir, jsonLinesManifest), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	return &jsonLinesSink{options: options, now: time.Now, manifest: manifest, sequence: len(files)}, nil
+}
+
+func (s *jsonLinesSink) OnDurable(durable func(position string)) { s.durable = durable }
+
+func (s *jsonLinesSink) Write(ctx context.Context, op *ReplicationOperation) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+
+	if op.Operation == `BEGIN` {
+		s.xid, s.inTransaction = op.Target, true
+		s.transaction, s.positions = s.transaction[:0], s.positions[:0]
+	}
+
+	line, err := s.options.Encoder.Encode(op)
+	if err != nil {
+		return err
+	}
+
+	// a CommitEncoder sees the lines of a transaction again at its COMMIT
+	encoder, stamp := s.options.Encoder.(CommitEncoder)
+	if stamp && op.Operation == `COMMIT` {
+		for i := range s.transaction {
+			if s.transaction[i], err = encoder.Commit(s.transaction[i], op); err != nil {
+				return err
+			}
+		}
+	}
+
+	if s.options.Transactions {
+		switch op.Operation {
+		case `BEGIN`:
+			return nil
+		case `COMMIT`:
+			line, err = json.Marshal(jsonTransaction{op.Position, jsonXID(s.xid), s.transaction})
+			if err != nil {
+				return err
+			}
+		default:
+			if line != nil {
+				s.transaction = append(s.transaction, line)
+			}
+			return nil
+		}
+	} else if stamp && s.inTransaction {
+		switch op.Operation {
+		case `BEGIN`:
+		case `COMMIT`:
+			for i := range s.transaction {
+				if err = s.write(s.positions[i], s.transaction[i]); err != nil {
+					return err
+				}
+			}
+		default:
+			if line != nil {
+				s.transaction = append(s.transaction, line)
+				s.positions = append(s.positions, op.Position)
+			}
+			return nil
+		}
+	}
+
+	if line != nil {
+		if err = s.write(op.Position, line); err != nil {
+			return err
+		}
+	}
+
+	if op.Operation == `COMMIT` {
+		s.inTransaction = false
+		s.entry.Last = op.Position
+		if (s.options.MaxBytes > 0 && s.size >= s.options.MaxBytes) ||
+			(s.options.MaxAge > 0 && s.now().Sub(s.opened) >= s.options.MaxAge) {
+			return s.rotate()
+		}
+	}
+	return nil
+}
+
+func (s *jsonLinesSink) write(position string, line []byte) error {
+	if s.file == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	if s.entry.First == "" {
+		s.entry.First = position
+	}
+
+	line = append(line, '\n')
+	if _, err := s.compressor.Write(line); err != nil {
+		return err
+	}
+	s.entry.Operations++
+	s.size += int64(len(line))
+	return nil
+}
+
+func (s *jsonLinesSink) open() error {
+	s.sequence++
+	s.entry = JSONLinesFile{File: fmt.Sprintf("%s-%06d.jsonl", s.options.Prefix, s.sequence)}
+	if s.options.Compression != nil {
+		s.entry.File += s.options.Compression.Extension
+	}
+
+	// a file not in the manifest was never durable
+	file, err := os.OpenFile(filepath.Join(s.options.Dir, s.entry.File), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+
+	s.file, s.buffer = file, bufio.NewWriter(file)
+	s.compressor = nopWriteCloser{s.buffer}
+	if s.options.Compression != nil {
+		if s.compressor, err = s.options.Compression.Writer(s.buffer); err != nil {
+			file.Close()
+			s.file = nil
+			return err
+		}
+	}
+
+	s.opened, s.size = s.now(), 0
+	if s.options.MaxAge > 0 {
+		s.timer = time.AfterFunc(s.options.MaxAge, s.expire)
+	}
+	return nil
+}
+
+// expire closes the current file when it is old enough and no transaction
+// is open; otherwise the next COMMIT does.
+func (s *jsonLinesSink) expire() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.err == nil && !s.inTransaction && s.file != nil && s.now().Sub(s.opened) >= s.options.MaxAge {
+		s.err = s.rotate()
+	}
+}
+
+// rotate closes the current file and records it in the manifest.
+func (s *jsonLinesSink) rotate() error {
+	if s.file == nil {
+		return nil
+	}
+
+	file := s.file
+	s.file = nil
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+
+	err := s.compressor.Close()
+	if err == nil {
+		err = s.buffer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if e := file.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+
+	entry, err := json.Marshal(s.entry)
+	if err == nil {
+		_, err = s.manifest.Write(append(entry, '\n'))
+	}
+	if err == nil {
+		err = s.manifest.Sync()
+	}
+	if err == nil && s.durable != nil && s.entry.Last != "" {
+		s.durable(s.entry.Last)
+	}
+	return err
+}
+
+// Flush closes the current file so everything written is durable.
+func (s *jsonLinesSink) Flush(ctx context.Context) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	return s.rotate()
+}
+
+func (s *jsonLinesSink) Close() error {
+	err := s.Flush(context.Background())
+	if e := s.manifest.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+type jsonTransaction struct {
+	Position   string            `json:"position"`
+	XID        json.RawMessage   `json:"xid,omitempty"`
+	Operations []json.RawMessage `json:"operations"`
+}
@@ -0,0 +1,179 @@
+package pgbarrel
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readJSONLines(t *testing.T, path string) string {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		r, err = gzip.NewReader(f)
+		require.NoError(t, err)
+	}
+
+	b, err := io.ReadAll(r)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestJSONLinesSink(t *testing.T) {
+	dir := t.TempDir()
+
+	sink, err := NewJSONLinesSink(JSONLinesOptions{Dir: dir, MaxBytes: 250, Compression: &JSONLinesCompression{
+		Extension: ".gz", Writer: JSONLinesCompressions["gzip"].Writer,
+	}})
+	require.NoError(t, err)
+
+	var durable []string
+	sink.OnDurable(func(position string) { durable = append(durable, position) })
+
+	ctx := context.Background()
+	for _, op := range []*ReplicationOperation{
+		{Position: `0/10`, Operation: `BEGIN`, Target: `553`},
+		{Position: `0/10`, Operation: `UPDATE`, Target: `public.t`,
+			OldColumns: []string{`id`}, OldValues: []string{`1`}, OldTypes: []string{`integer`},
+			NewColumns: []string{`id`, `"Note"`}, NewValues: []string{`2`, `'a'`}, NewTypes: []string{`integer`, `text`}},
+		{Position: `0/18`, Operation: `COMMIT`, Target: `553`},
+		{Position: `0/20`, Operation: `BEGIN`, Target: `554`},
+		{Position: `0/20`, Operation: `DELETE`, Target: `public.t`,
+			OldColumns: []string{`id`}, OldValues: []string{`2`}, OldTypes: []string{`integer`}},
+		{Position: `0/28`, Operation: `COMMIT`, Target: `554`},
+	} {
+		require.NoError(t, sink.Write(ctx, op))
+	}
+
+	assert.Equal(t, []string{`0/18`}, durable, "Expected the first file to be rotated by size")
+	require.NoError(t, sink.Close())
+	assert.Equal(t, []string{`0/18`, `0/28`}, durable)
+
+	files, err := ReadJSONLinesManifest(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []JSONLinesFile{
+		{File: `changes-000001.jsonl.gz`, First: `0/10`, Last: `0/18`, Operations: 3},
+		{File: `changes-000002.jsonl.gz`, First: `0/20`, Last: `0/28`, Operations: 3},
+	}, files)
+
+	assert.Equal(t, strings.Join([]string{
+		`{"position":"0/10","xid":553,"operation":"BEGIN"}`,
+		`{"position":"0/10","xid":553,"operation":"UPDATE","target":"public.t","old":{"id":1},"new":{"id":2,"Note":"a"},"types":{"id":"integer","Note":"text"}}`,
+		`{"position":"0/18","xid":553,"operation":"COMMIT"}`,
+	}, "\n")+"\n", readJSONLines(t, filepath.Join(dir, files[0].File)))
+
+	// resume after the files in the manifest
+	sink, err = NewJSONLinesSink(JSONLinesOptions{Dir: dir, Transactions: true})
+	require.NoError(t, err)
+
+	now := time.Unix(0, 0)
+	sink.now = func() time.Time { return now }
+	sink.options.MaxAge = time.Minute
+
+	for _, op := range []*ReplicationOperation{
+		{Position: `0/30`, Operation: `BEGIN`, Target: `555`},
+		{Position: `0/30`, Operation: `INSERT`, Target: `public.t`,
+			NewColumns: []string{`id`, `ok`}, NewValues: []string{`3`, `false`}, NewTypes: []string{`integer`, `boolean`}},
+		{Position: `0/38`, Operation: `COMMIT`, Target: `555`},
+	} {
+		require.NoError(t, sink.Write(ctx, op))
+	}
+	assert.Len(t, durable, 2, "Expected the file to be open until MaxAge")
+
+	now = now.Add(time.Minute)
+	require.NoError(t, sink.Write(ctx, &ReplicationOperation{Position: `0/40`, Operation: `BEGIN`, Target: `556`}))
+	require.NoError(t, sink.Write(ctx, &ReplicationOperation{Position: `0/48`, Operation: `COMMIT`, Target: `556`}))
+	assert.Len(t, durable, 2, "Expected OnDurable to apply to the first sink only")
+	require.NoError(t, sink.Close())
+
+	files, err = ReadJSONLinesManifest(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 3)
+	assert.Equal(t, JSONLinesFile{File: `changes-000003.jsonl`, First: `0/38`, Last: `0/48`, Operations: 2}, files[2])
+
+	assert.Equal(t, strings.Join([]string{
+		`{"position":"0/38","xid":555,"operations":[{"position":"0/30","xid":555,"operation":"INSERT","target":"public.t","new":{"id":3,"ok":false},"types":{"id":"integer","ok":"boolean"}}]}`,
+		`{"position":"0/48","xid":556,"operations":[]}`,
+	}, "\n")+"\n", readJSONLines(t, filepath.Join(dir, files[2].File)))
+}
+
+func TestJSONLinesSinkCommitEncoder(t *testing.T) {
+	dir := t.TempDir()
+
+	encoder := NewDebeziumEncoder(DebeziumOptions{}).(*debeziumEncoder)
+	encoder.now = func() time.Time { return time.Unix(1500000000, 0) }
+	sink, err := NewJSONLinesSink(JSONLinesOptions{Dir: dir, Encoder: encoder})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	for _, op := range []*ReplicationOperation{
+		{Position: `0/10`, Operation: `BEGIN`, Target: `553`},
+		{Position: `0/10`, Operation: `INSERT`, Target: `public.t`,
+			NewColumns: []string{`id`}, NewValues: []string{`1`}, NewTypes: []string{`integer`}},
+		{Position: `0/18`, Operation: `INSERT`, Target: `public.t`,
+			NewColumns: []string{`id`}, NewValues: []string{`2`}, NewTypes: []string{`integer`}},
+	} {
+		require.NoError(t, sink.Write(ctx, op))
+	}
+	assert.Nil(t, sink.file, "Expected the transaction to wait for its COMMIT")
+
+	require.NoError(t, sink.Write(ctx, &ReplicationOperation{Position: `0/20`, Operation: `COMMIT`, Target: `553 (at 2017-05-01 12:00:00+00)`}))
+	require.NoError(t, sink.Flush(ctx))
+
+	lines := strings.Split(strings.TrimSpace(readJSONLines(t, filepath.Join(dir, `changes-000001.jsonl`))), "\n")
+	require.Len(t, lines, 2)
+	for _, line := range lines {
+		assert.Contains(t, line, `"name":"pgbarrel","ts_ms":1493640000000,`)
+		assert.Contains(t, line, `"op":"c","ts_ms":1500000000000,`)
+	}
+}
+
+func TestJSONLinesSinkAge(t *testing.T) {
+	dir := t.TempDir()
+
+	sink, err := NewJSONLinesSink(JSONLinesOptions{Dir: dir, MaxAge: 20 * time.Millisecond})
+	require.NoError(t, err)
+	defer sink.Close()
+
+	var mutex sync.Mutex
+	var durable []string
+	sink.OnDurable(func(position string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		durable = append(durable, position)
+	})
+	durables := func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]string(nil), durable...)
+	}
+
+	ctx := context.Background()
+	require.NoError(t, sink.Write(ctx, &ReplicationOperation{Position: `0/10`, Operation: `BEGIN`, Target: `553`}))
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, durables(), "Expected an open transaction to keep its file open")
+
+	require.NoError(t, sink.Write(ctx, &ReplicationOperation{Position: `0/18`, Operation: `COMMIT`, Target: `553`}))
+	assert.Equal(t, []string{`0/18`}, durables(), "Expected the COMMIT to close an old file")
+
+	require.NoError(t, sink.Write(ctx, &ReplicationOperation{Position: `0/20`, Operation: `BEGIN`, Target: `554`}))
+	require.NoError(t, sink.Write(ctx, &ReplicationOperation{Position: `0/28`, Operation: `COMMIT`, Target: `554`}))
+	assert.Eventually(t, func() bool { return len(durables()) == 2 }, time.Second, 5*time.Millisecond,
+		"Expected the file to be closed by age without another COMMIT")
+
+	files, err := ReadJSONLinesManifest(dir)
+	require.NoError(t, err)
+	assert.Len(t, files, 2)
+}
@@ -0,0 +1,781 @@
+package pgbarrel
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type KafkaOptions struct {
+	// Brokers are the "host:port" addresses used to discover the cluster.
+	Brokers []string
+	// ClientID identifies the producer to brokers, "pgbarrel" by default.
+	ClientID string
+
+	// Topics assigns a topic to each target. Other targets are sent to
+	// TopicPrefix.schema.table, with TopicPrefix "pgbarrel" by default.
+	Topics      map[string]string
+	TopicPrefix string
+
+	// Keys are the primary key columns of each target. Messages are keyed by
+	// these columns so that changes to a row stay in order on one partition.
+	// Messages of other targets have no key and go to partition 0.
+	Keys map[string][]string
+
+	// Encoder writes the value of each message; the default is NewJSONEncoder.
+	Encoder Encoder
+
+	// Acks is 1 to wait for the leader of a partition only. Otherwise every
+	// in-sync replica must have a message before the broker acknowledges it.
+	Acks int16
+	// Timeout limits each request, 30 seconds by default.
+	Timeout time.Duration
+	// Retries is how many times to send messages again when a partition has
+	// moved, 3 by default.
+	Retries int
+
+	// Transactions are sent once Linger has passed since the first that was
+	// not, or at a COMMIT once BatchBytes of messages are waiting. When both
+	// are zero, each transaction is sent at its COMMIT; when only Linger is
+	// zero, it is one second.
+	Linger     time.Duration
+	BatchBytes int
+}
+
+type kafkaPartition struct {
+	topic string
+	index int32
+}
+
+type kafkaRecord struct {
+	key, value []byte
+	timestamp  int64
+}
+
+type kafkaSink struct {
+	options KafkaOptions
+	durable func(position string)
+	now     func() time.Time
+
+	mutex       sync.Mutex
+	correlation int32
+	conns       map[string]*kafkaConn
+	brokers     map[int32]string
+	partitions  map[string]int32
+	leaders     map[kafkaPartition]int32
+
+	pending      map[kafkaPartition][]kafkaRecord
+	pendingBytes int
+	pendingSince time.Time
+	commit       string
+	timer        *time.Timer
+	err          error // of sending after Linger
+
+	inTransaction bool // between BEGIN and COMMIT
+
+	// records of the transaction being written, for a CommitEncoder
+	transaction []kafkaPlace
+}
+
+type kafkaPlace struct {
+	partition kafkaPartition
+	index     int
+}
+
+// NewKafkaSink returns a BufferedSink that produces a message to Kafka for
+// every operation on a table. A transaction is durable once the broker has
+// acknowledged all of its messages. Retries may produce a message twice.
+//
+// It speaks the Kafka protocol directly: Metadata v1 to find the leader of
+// each partition and Produce v3 with uncompressed record batches. Keys are
+// JSON objects of the key columns, partitioned as by the Java client.
+func NewKafkaSink(options KafkaOptions) (*kafkaSink, error) {
+	if len(options.Brokers) == 0 {
+		return nil, errors.New("Missing Kafka brokers")
+	}
+	if options.ClientID == "" {
+		options.ClientID = "pgbarrel"
+	}
+	if options.TopicPrefix == "" {
+		options.TopicPrefix = "pgbarrel"
+	}
+	if options.Encoder == nil {
+		options.Encoder = NewJSONEncoder()
+	}
+	if options.Acks != 1 {
+		options.Acks = -1
+	}
+	if options.Timeout == 0 {
+		options.Timeout = 30 * time.Second
+	}
+	if options.Retries == 0 {
+		options.Retries = 3
+	}
+	if options.Linger == 0 && options.BatchBytes > 0 {
+		options.Linger = time.Second
+	}
+
+	return &kafkaSink{
+		options:    options,
+		now:        time.Now,
+		conns:      make(map[string]*kafkaConn),
+		brokers:    make(map[int32]string),
+		partitions: make(map[string]int32),
+		leaders:    make(map[kafkaPartition]int32),
+		pending:    make(map[kafkaPartition][]kafkaRecord),
+	}, nil
+}
+
+func (s *kafkaSink) OnDurable(durable func(position string)) { s.durable = durable }
+
+// Topic returns the topic of target.
+func (s *kafkaSink) Topic(target string) string {
+	if topic, ok := s.options.Topics[target]; ok {
+		return topic
+	}
+	schema, table := pgSplitTarget(target)
+	if schema == "" {
+		return s.options.TopicPrefix + "." + table
+	}
+	return s.options.TopicPrefix + "." + schema + "." + table
+}
+
+// key returns the key columns of op as a JSON object, or nil.
+func (s *kafkaSink) key(op *ReplicationOperation) []byte {
+	columns, ok := s.options.Keys[op.Target]
+	if !ok || op.Operation == `TRUNCATE` {
+		return nil
+	}
+
+	names, values, types := op.NewColumns, op.NewValues, op.NewTypes
+	if len(names) == 0 {
+		names, values, types = op.OldColumns, op.OldValues, op.OldTypes
+	}
+
+	var keyValues, keyTypes []string
+	for _, column := range columns {
+		var value, typ string
+		for i := range names {
+			if names[i] == column {
+				if i < len(values) {
+					value = values[i]
+				}
+				if i < len(types) {
+					typ = types[i]
+				}
+			}
+		}
+		keyValues, keyTypes = append(keyValues, value), append(keyTypes, typ)
+	}
+	return jsonColumns(columns, keyValues, keyTypes)
+}
+
+func (s *kafkaSink) Write(ctx context.Context, op *ReplicationOperation) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+
+	// the encoder sees every operation
+	value, err := s.options.Encoder.Encode(op)
+	if err != nil {
+		return err
+	}
+
+	switch op.Operation {
+	case `BEGIN`:
+		s.transaction = s.transaction[:0]
+		s.inTransaction = true
+		return nil
+
+	case `COMMIT`:
+		if err = s.committed(op); err != nil {
+			return err
+		}
+		s.commit, s.inTransaction = op.Position, false
+		if (s.options.Linger == 0 && s.options.BatchBytes == 0) ||
+			(s.options.BatchBytes > 0 && s.pendingBytes >= s.options.BatchBytes) ||
+			(s.options.Linger > 0 && s.now().Sub(s.pendingSince) >= s.options.Linger) {
+			return s.send(ctx)
+		}
+		return nil
+	}
+
+	if value == nil {
+		return nil
+	}
+
+	topic := s.Topic(op.Target)
+	count, err := s.partitionCount(ctx, topic)
+	if err != nil {
+		return err
+	}
+
+	record := kafkaRecord{key: s.key(op), value: value, timestamp: s.now().UnixNano() / int64(time.Millisecond)}
+	partition := kafkaPartition{topic: topic}
+	if record.key != nil {
+		partition.index = (kafkaMurmur2(record.key) & 0x7fffffff) % count
+	}
+
+	if len(s.pending) == 0 {
+		s.pendingSince = s.now()
+		if s.options.Linger > 0 {
+			s.timer = time.AfterFunc(s.options.Linger, s.expire)
+		}
+	}
+	if _, ok := s.options.Encoder.(CommitEncoder); ok {
+		s.transaction = append(s.transaction, kafkaPlace{partition, len(s.pending[partition])})
+	}
+	s.pending[partition] = append(s.pending[partition], record)
+	s.pendingBytes += len(record.key) + len(record.value)
+	return nil
+}
+
+// expire sends the waiting transactions after Linger unless a transaction is
+// open; its COMMIT sends them instead.
+func (s *kafkaSink) expire() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.inTransaction || len(s.pending) == 0 || s.err != nil {
+		return
+	}
+	s.err = s.send(context.Background())
+}
+
+// committed passes the records of the transaction ending at commit to a
+// CommitEncoder.
+func (s *kafkaSink) committed(commit *ReplicationOperation) error {
+	encoder, ok := s.options.Encoder.(CommitEncoder)
+	if !ok {
+		return nil
+	}
+	for _, place := range s.transaction {
+		record := &s.pending[place.partition][place.index]
+		value, err := encoder.Commit(record.value, commit)
+		if err != nil {
+			return err
+		}
+		s.pendingBytes += len(value) - len(record.value)
+		record.value = value
+	}
+	s.transaction = s.transaction[:0]
+	return nil
+}
+
+// Flush sends every transaction that is waiting.
+func (s *kafkaSink) Flush(ctx context.Context) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+	return s.send(ctx)
+}
+
+func (s *kafkaSink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var err error
+	for address, conn := range s.conns {
+		if e := conn.Close(); err == nil {
+			err = e
+		}
+		delete(s.conns, address)
+	}
+	return err
+}
+
+// Ping reports whether a broker answers a request for metadata. It dials a
+// connection of its own, so it does not wait for messages being sent.
+func (s *kafkaSink) Ping(ctx context.Context) error {
+	timeout := s.options.Timeout
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+		timeout = time.Until(deadline)
+	}
+
+	var body kafkaEncoder
+	body.int32(0) // no topics
+
+	var err error
+	for _, address := range s.options.Brokers {
+		dialer := net.Dialer{Timeout: timeout}
+		var c net.Conn
+		if c, err = dialer.DialContext(ctx, "tcp", address); err != nil {
+			continue
+		}
+		conn := &kafkaConn{Conn: c, reader: bufio.NewReader(c)}
+		_, err = conn.roundTrip(timeout, 3, 1, 0, s.options.ClientID, body.Bytes())
+		conn.Close()
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// send produces every pending message and waits for the brokers to
+// acknowledge them.
+func (s *kafkaSink) send(ctx context.Context) error {
+	for attempt := 0; len(s.pending) > 0; attempt++ {
+		if attempt > 0 {
+			if attempt > s.options.Retries {
+				return errors.Errorf("Kafka partitions not available after %d retries", s.options.Retries)
+			}
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Duration(attempt) * 100 * time.Millisecond):
+			}
+
+			var topics []string
+			for partition := range s.pending {
+				topics = append(topics, partition.topic)
+			}
+			if err := s.metadata(ctx, topics); err != nil {
+				return err
+			}
+		}
+
+		// one request for each leader
+		requests := make(map[int32][]kafkaPartition)
+		for partition := range s.pending {
+			leader, ok := s.leaders[partition]
+			if !ok {
+				leader = -1
+			}
+			requests[leader] = append(requests[leader], partition)
+		}
+
+		for leader, partitions := range requests {
+			address, ok := s.brokers[leader]
+			if !ok {
+				continue // retry after metadata
+			}
+
+			acknowledged, err := s.produce(ctx, address, partitions)
+			if err != nil {
+				return err
+			}
+			for _, partition := range acknowledged {
+				s.pendingBytes -= s.size(s.pending[partition])
+				delete(s.pending, partition)
+			}
+		}
+	}
+
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.pendingBytes = 0
+	s.transaction = s.transaction[:0]
+	if s.durable != nil && s.commit != "" {
+		s.durable(s.commit)
+	}
+	return nil
+}
+
+func (s *kafkaSink) size(records []kafkaRecord) (n int) {
+	for _, record := range records {
+		n += len(record.key) + len(record.value)
+	}
+	return
+}
+
+// Kafka error codes that are resolved by refreshing metadata.
+var kafkaRetriable = map[int16]bool{
+	3:  true, // UNKNOWN_TOPIC_OR_PARTITION
+	5:  true, // LEADER_NOT_AVAILABLE
+	6:  true, // NOT_LEADER_FOR_PARTITION
+	7:  true, // REQUEST_TIMED_OUT
+	19: true, // NOT_ENOUGH_REPLICAS
+	20: true, // NOT_ENOUGH_REPLICAS_AFTER_APPEND
+}
+
+// produce sends the records of partitions to the broker at address and
+// returns the partitions it acknowledged.
+func (s *kafkaSink) produce(ctx context.Context, address string, partitions []kafkaPartition) ([]kafkaPartition, error) {
+	sort.Slice(partitions, func(i, j int) bool {
+		if partitions[i].topic != partitions[j].topic {
+			return partitions[i].topic < partitions[j].topic
+		}
+		return partitions[i].index < partitions[j].index
+	})
+
+	var topics []string
+	byTopic := make(map[string][]kafkaPartition)
+	for _, partition := range partitions {
+		if _, ok := byTopic[partition.topic]; !ok {
+			topics = append(topics, partition.topic)
+		}
+		byTopic[partition.topic] = append(byTopic[partition.topic], partition)
+	}
+
+	var body kafkaEncoder
+	body.int16(-1) // transactional_id
+	body.int16(s.options.Acks)
+	body.int32(int32(s.options.Timeout / time.Millisecond))
+	body.int32(int32(len(topics)))
+	for _, topic := range topics {
+		body.string(topic)
+		body.int32(int32(len(byTopic[topic])))
+		for _, partition := range byTopic[topic] {
+			body.int32(partition.index)
+			body.bytes(kafkaRecordBatch(s.pending[partition]))
+		}
+	}
+
+	response, err := s.request(ctx, address, 0, 3, body.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	var acknowledged []kafkaPartition
+	for i, n := 0, response.int32(); i < int(n) && response.err == nil; i++ {
+		topic := response.string()
+		for j, m := 0, response.int32(); j < int(m) && response.err == nil; j++ {
+			partition := kafkaPartition{topic: topic, index: response.int32()}
+			code := response.int16()
+			response.int64() // base_offset
+			response.int64() // log_append_time
+
+			switch {
+			case code == 0:
+				acknowledged = append(acknowledged, partition)
+			case kafkaRetriable[code]:
+				delete(s.leaders, partition)
+			default:
+				return nil, errors.Errorf("Kafka error %d producing to %s[%d]", code, partition.topic, partition.index)
+			}
+		}
+	}
+	return acknowledged, response.err
+}
+
+func (s *kafkaSink) partitionCount(ctx context.Context, topic string) (int32, error) {
+	for attempt := 0; ; attempt++ {
+		if count, ok := s.partitions[topic]; ok {
+			return count, nil
+		}
+		if attempt > s.options.Retries {
+			return 0, errors.Errorf("Kafka topic not available: %q", topic)
+		}
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return 0, ctx.Err()
+			case <-time.After(time.Duration(attempt) * 100 * time.Millisecond):
+			}
+		}
+		if err := s.metadata(ctx, []string{topic}); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// metadata learns the brokers of the cluster and the leaders of topics from
+// the first broker that answers.
+func (s *kafkaSink) metadata(ctx context.Context, topics []string) error {
+	var body kafkaEncoder
+	body.int32(int32(len(topics)))
+	for _, topic := range topics {
+		body.string(topic)
+	}
+
+	var response *kafkaDecoder
+	var err error
+	addresses := append([]string{}, s.options.Brokers...)
+	for _, address := range s.brokers {
+		addresses = append(addresses, address)
+	}
+	for _, address := range addresses {
+		if response, err = s.request(ctx, address, 3, 1, body.Bytes()); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	for i, n := 0, response.int32(); i < int(n) && response.err == nil; i++ {
+		id, host, port := response.int32(), response.string(), response.int32()
+		response.string() // rack
+		s.brokers[id] = net.JoinHostPort(host, fmt.Sprint(port))
+	}
+	response.int32() // controller_id
+
+	for i, n := 0, response.int32(); i < int(n) && response.err == nil; i++ {
+		code, topic := response.int16(), response.string()
+		response.int8() // is_internal
+
+		var count int32
+		for j, m := 0, response.int32(); j < int(m) && response.err == nil; j++ {
+			partitionCode, index, leader := response.int16(), response.int32(), response.int32()
+			response.int32s() // replicas
+			response.int32s() // isr
+
+			partition := kafkaPartition{topic: topic, index: index}
+			if partitionCode == 0 && leader >= 0 {
+				s.leaders[partition] = leader
+			} else {
+				delete(s.leaders, partition)
+			}
+			count++
+		}
+
+		switch {
+		case code == 0 && count > 0:
+			s.partitions[topic] = count
+		case code == 0 || kafkaRetriable[code]:
+			// the topic may be being created
+		default:
+			return errors.Errorf("Kafka error %d in metadata of %q", code, topic)
+		}
+	}
+	return response.err
+}
+
+func (s *kafkaSink) request(ctx context.Context, address string, key, version int16, body []byte) (*kafkaDecoder, error) {
+	conn, ok := s.conns[address]
+	if !ok {
+		dialer := net.Dialer{Timeout: s.options.Timeout}
+		c, err := dialer.DialContext(ctx, "tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		conn = &kafkaConn{Conn: c, reader: bufio.NewReader(c)}
+		s.conns[address] = conn
+	}
+
+	s.correlation++
+	response, err := conn.roundTrip(s.options.Timeout, key, version, s.correlation, s.options.ClientID, body)
+	if err != nil {
+		conn.Close()
+		delete(s.conns, address)
+	}
+	return response, err
+}
+
+type kafkaConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *kafkaConn) roundTrip(timeout time.Duration, key, version int16, correlation int32, client string, body []byte) (*kafkaDecoder, error) {
+	var header kafkaEncoder
+	header.int32(0) // size
+	header.int16(key)
+	header.int16(version)
+	header.int32(correlation)
+	header.string(client)
+
+	request := append(header.Bytes(), body...)
+	binary.BigEndian.PutUint32(request, uint32(len(request)-4))
+
+	if err := c.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	if _, err := c.Write(request); err != nil {
+		return nil, err
+	}
+
+	var size [4]byte
+	if _, err := io.ReadFull(c.reader, size[:]); err != nil {
+		return nil, err
+	}
+	response := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(c.reader, response); err != nil {
+		return nil, err
+	}
+
+	d := &kafkaDecoder{b: response}
+	if id := d.int32(); d.err == nil && id != correlation {
+		return nil, errors.Errorf("Kafka response %d does not match request %d", id, correlation)
+	}
+	return d, d.err
+}
+
+var kafkaCastagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// kafkaRecordBatch encodes records as a record batch of magic 2.
+func kafkaRecordBatch(records []kafkaRecord) []byte {
+	first, max := records[0].timestamp, records[0].timestamp
+	for _, record := range records {
+		if record.timestamp < first {
+			first = record.timestamp
+		}
+		if record.timestamp > max {
+			max = record.timestamp
+		}
+	}
+
+	var b kafkaEncoder
+	b.int64(0)  // base_offset
+	b.int32(0)  // batch_length
+	b.int32(-1) // partition_leader_epoch
+	b.int8(2)   // magic
+	b.int32(0)  // crc
+	b.int16(0)  // attributes
+	b.int32(int32(len(records) - 1))
+	b.int64(first)
+	b.int64(max)
+	b.int64(-1) // producer_id
+	b.int16(-1) // producer_epoch
+	b.int32(-1) // base_sequence
+	b.int32(int32(len(records)))
+
+	for i, record := range records {
+		var r kafkaEncoder
+		r.int8(0) // attributes
+		r.varint(record.timestamp - first)
+		r.varint(int64(i))
+		if record.key == nil {
+			r.varint(-1)
+		} else {
+			r.varint(int64(len(record.key)))
+			r.Write(record.key)
+		}
+		r.varint(int64(len(record.value)))
+		r.Write(record.value)
+		r.varint(0) // headers
+
+		b.varint(int64(r.Len()))
+		b.Write(r.Bytes())
+	}
+
+	batch := b.Bytes()
+	binary.BigEndian.PutUint32(batch[8:], uint32(len(batch)-12))
+	binary.BigEndian.PutUint32(batch[17:], crc32.Checksum(batch[21:], kafkaCastagnoli))
+	return batch
+}
+
+// kafkaMurmur2 is the hash of the default partitioner of the Java client.
+func kafkaMurmur2(data []byte) int32 {
+	const m = 0x5bd1e995
+	h := uint32(0x9747b28c) ^ uint32(len(data))
+
+	n := len(data) &^ 3
+	for i := 0; i < n; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> 24
+		k *= m
+		h *= m
+		h ^= k
+	}
+
+	switch len(data) & 3 {
+	case 3:
+		h ^= uint32(data[n+2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(data[n+1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(data[n])
+		h *= m
+	}
+
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
+
+type kafkaEncoder struct{ bytes.Buffer }
+
+func (e *kafkaEncoder) int8(v int8)   { e.WriteByte(byte(v)) }
+func (e *kafkaEncoder) int16(v int16) { binary.Write(e, binary.BigEndian, v) }
+func (e *kafkaEncoder) int32(v int32) { binary.Write(e, binary.BigEndian, v) }
+func (e *kafkaEncoder) int64(v int64) { binary.Write(e, binary.BigEndian, v) }
+
+func (e *kafkaEncoder) string(v string) {
+	e.int16(int16(len(v)))
+	e.WriteString(v)
+}
+
+func (e *kafkaEncoder) bytes(v []byte) {
+	e.int32(int32(len(v)))
+	e.Write(v)
+}
+
+func (e *kafkaEncoder) varint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	e.Write(b[:binary.PutVarint(b[:], v)])
+}
+
+type kafkaDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *kafkaDecoder) next(n int) []byte {
+	if d.err == nil && len(d.b) < n {
+		d.err = io.ErrUnexpectedEOF
+	}
+	if d.err != nil {
+		return make([]byte, n)
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *kafkaDecoder) int8() int8   { return int8(d.next(1)[0]) }
+func (d *kafkaDecoder) int16() int16 { return int16(binary.BigEndian.Uint16(d.next(2))) }
+func (d *kafkaDecoder) int32() int32 { return int32(binary.BigEndian.Uint32(d.next(4))) }
+func (d *kafkaDecoder) int64() int64 { return int64(binary.BigEndian.Uint64(d.next(8))) }
+
+// string decodes a string or nullable string.
+func (d *kafkaDecoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.next(int(n)))
+}
+
+func (d *kafkaDecoder) bytes() []byte {
+	n := d.int32()
+	if n < 0 {
+		return nil
+	}
+	return d.next(int(n))
+}
+
+func (d *kafkaDecoder) int32s() []int32 {
+	var v []int32
+	for i, n := 0, d.int32(); i < int(n) && d.err == nil; i++ {
+		v = append(v, d.int32())
+	}
+	return v
+}
+
+func (d *kafkaDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
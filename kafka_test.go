@@ -0,0 +1,360 @@
+package pgbarrel
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKafkaMurmur2(t *testing.T) {
+	for input, expected := range map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+		"abc": 479470107,
+	} {
+		assert.Equal(t, expected, kafkaMurmur2([]byte(input)), input)
+	}
+}
+
+// testKafkaBroker is a single broker that answers Metadata v1 and Produce v3.
+type testKafkaBroker struct {
+	listener   net.Listener
+	partitions int32
+
+	mutex    sync.Mutex
+	messages map[kafkaPartition][]kafkaRecord
+	errors   []int16 // returned by the next produce requests
+	requests []int16
+}
+
+func newTestKafkaBroker(t *testing.T, partitions int32) *testKafkaBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	b := &testKafkaBroker{listener: listener, partitions: partitions, messages: make(map[kafkaPartition][]kafkaRecord)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(t, conn)
+		}
+	}()
+	return b
+}
+
+func (b *testKafkaBroker) serve(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(reader, size[:]); err != nil {
+			return
+		}
+		request := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(reader, request); err != nil {
+			return
+		}
+
+		d := &kafkaDecoder{b: request}
+		key, version, correlation := d.int16(), d.int16(), d.int32()
+		d.string() // client_id
+
+		var response kafkaEncoder
+		response.int32(0)
+		response.int32(correlation)
+
+		b.mutex.Lock()
+		b.requests = append(b.requests, key)
+		switch {
+		case key == 3 && version == 1:
+			b.metadata(d, &response)
+		case key == 0 && version == 3:
+			b.produce(t, d, &response)
+		default:
+			t.Errorf("Unexpected request %d v%d", key, version)
+		}
+		b.mutex.Unlock()
+
+		assert.NoError(t, d.err)
+		assert.Empty(t, d.b, "Expected the whole request to be read")
+
+		out := response.Bytes()
+		binary.BigEndian.PutUint32(out, uint32(len(out)-4))
+		if _, err := conn.Write(out); err != nil {
+			return
+		}
+	}
+}
+
+func (b *testKafkaBroker) metadata(d *kafkaDecoder, response *kafkaEncoder) {
+	var topics []string
+	for i, n := 0, d.int32(); i < int(n); i++ {
+		topics = append(topics, d.string())
+	}
+
+	host, port, _ := net.SplitHostPort(b.listener.Addr().String())
+	number, _ := strconv.Atoi(port)
+
+	response.int32(1)
+	response.int32(7)
+	response.string(host)
+	response.int32(int32(number))
+	response.int16(-1) // rack
+	response.int32(7)  // controller
+
+	response.int32(int32(len(topics)))
+	for _, topic := range topics {
+		response.int16(0)
+		response.string(topic)
+		response.int8(0)
+		response.int32(b.partitions)
+		for i := int32(0); i < b.partitions; i++ {
+			response.int16(0)
+			response.int32(i)
+			response.int32(7)
+			response.int32(1)
+			response.int32(7)
+			response.int32(1)
+			response.int32(7)
+		}
+	}
+}
+
+func (b *testKafkaBroker) produce(t *testing.T, d *kafkaDecoder, response *kafkaEncoder) {
+	d.string() // transactional_id
+	assert.Equal(t, int16(-1), d.int16(), "Expected acks from all replicas")
+	d.int32() // timeout
+
+	var code int16
+	if len(b.errors) > 0 {
+		code, b.errors = b.errors[0], b.errors[1:]
+	}
+
+	n := d.int32()
+	response.int32(n)
+	for i := 0; i < int(n); i++ {
+		topic := d.string()
+		response.string(topic)
+
+		m := d.int32()
+		response.int32(m)
+		for j := 0; j < int(m); j++ {
+			partition := kafkaPartition{topic: topic, index: d.int32()}
+			records := testKafkaRecords(t, d.bytes())
+			if code == 0 {
+				b.messages[partition] = append(b.messages[partition], records...)
+			}
+
+			response.int32(partition.index)
+			response.int16(code)
+			response.int64(0)
+			response.int64(-1)
+		}
+	}
+	response.int32(0) // throttle_time_ms
+}
+
+func testKafkaRecords(t *testing.T, batch []byte) []kafkaRecord {
+	d := &kafkaDecoder{b: batch}
+	d.int64() // base_offset
+	assert.Equal(t, int32(len(batch)-12), d.int32(), "batch_length")
+	d.int32() // partition_leader_epoch
+	assert.Equal(t, int8(2), d.int8(), "magic")
+	assert.Equal(t, crc32.Checksum(batch[21:], kafkaCastagnoli), uint32(d.int32()), "crc")
+	assert.Equal(t, int16(0), d.int16(), "attributes")
+	d.int32() // last_offset_delta
+	first := d.int64()
+	d.int64() // max_timestamp
+	d.int64() // producer_id
+	d.int16() // producer_epoch
+	d.int32() // base_sequence
+
+	var records []kafkaRecord
+	for i, n := 0, d.int32(); i < int(n); i++ {
+		d.varint() // length
+		d.int8()   // attributes
+		record := kafkaRecord{timestamp: first + d.varint()}
+		assert.Equal(t, int64(i), d.varint(), "offset_delta")
+		if n := d.varint(); n >= 0 {
+			record.key = d.next(int(n))
+		}
+		record.value = d.next(int(d.varint()))
+		assert.Equal(t, int64(0), d.varint(), "headers")
+		records = append(records, record)
+	}
+	require.NoError(t, d.err)
+	return records
+}
+
+// values returns the messages of partition with key, or all when key is nil.
+func (b *testKafkaBroker) values(topic string, partition int32, key []byte) []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	var values []string
+	for _, record := range b.messages[kafkaPartition{topic, partition}] {
+		if key == nil || string(record.key) == string(key) {
+			values = append(values, string(record.key)+" "+string(record.value))
+		}
+	}
+	return values
+}
+
+func TestKafkaSink(t *testing.T) {
+	broker := newTestKafkaBroker(t, 4)
+	ctx := context.Background()
+
+	sink, err := NewKafkaSink(KafkaOptions{
+		Brokers: []string{broker.listener.Addr().String()},
+		Topics:  map[string]string{`public.other`: `others`},
+		Keys:    map[string][]string{`public.t`: {`id`}},
+		Encoder: testEncoder{},
+	})
+	require.NoError(t, err)
+	defer sink.Close()
+
+	var durable []string
+	sink.OnDurable(func(position string) { durable = append(durable, position) })
+
+	insert := func(position, target, id string) *ReplicationOperation {
+		return &ReplicationOperation{Position: position, Operation: `INSERT`, Target: target,
+			NewColumns: []string{`id`, `v`}, NewValues: []string{id, `'` + position + `'`}, NewTypes: []string{`integer`, `text`}}
+	}
+	write := func(ops ...*ReplicationOperation) error {
+		for _, op := range ops {
+			if err := sink.Write(ctx, op); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	require.NoError(t, write(
+		&ReplicationOperation{Position: `0/10`, Operation: `BEGIN`, Target: `1`},
+		insert(`0/10`, `public.t`, `1`),
+		insert(`0/11`, `public.t`, `2`),
+		&ReplicationOperation{Position: `0/12`, Operation: `DELETE`, Target: `public.t`,
+			OldColumns: []string{`id`}, OldValues: []string{`1`}, OldTypes: []string{`integer`}},
+		insert(`0/13`, `public.other`, `3`),
+		&ReplicationOperation{Position: `0/14`, Operation: `COMMIT`, Target: `1`},
+	))
+	assert.Equal(t, []string{`0/14`}, durable)
+
+	one := (kafkaMurmur2([]byte(`{"id":1}`)) & 0x7fffffff) % 4
+	two := (kafkaMurmur2([]byte(`{"id":2}`)) & 0x7fffffff) % 4
+	assert.Equal(t, []string{`{"id":1} INSERT 0/10`, `{"id":1} DELETE 0/12`}, broker.values(`pgbarrel.public.t`, one, []byte(`{"id":1}`)))
+	assert.Equal(t, []string{`{"id":2} INSERT 0/11`}, broker.values(`pgbarrel.public.t`, two, []byte(`{"id":2}`)))
+	assert.Equal(t, []string{` INSERT 0/13`}, broker.values(`others`, 0, nil))
+
+	t.Run("Retry", func(t *testing.T) {
+		broker.mutex.Lock()
+		broker.errors = []int16{6}
+		broker.mutex.Unlock()
+
+		require.NoError(t, write(
+			&ReplicationOperation{Position: `0/20`, Operation: `BEGIN`, Target: `2`},
+			insert(`0/20`, `public.other`, `4`),
+			&ReplicationOperation{Position: `0/21`, Operation: `COMMIT`, Target: `2`},
+		))
+		assert.Equal(t, []string{`0/14`, `0/21`}, durable)
+		assert.Equal(t, []string{` INSERT 0/13`, ` INSERT 0/20`}, broker.values(`others`, 0, nil))
+	})
+
+	t.Run("Linger", func(t *testing.T) {
+		sink.options.Linger = time.Hour
+
+		require.NoError(t, write(
+			&ReplicationOperation{Position: `0/30`, Operation: `BEGIN`, Target: `3`},
+			insert(`0/30`, `public.other`, `5`),
+			&ReplicationOperation{Position: `0/31`, Operation: `COMMIT`, Target: `3`},
+		))
+		assert.Len(t, durable, 2, "Expected the transaction to wait")
+		assert.Len(t, broker.values(`others`, 0, nil), 2)
+
+		require.NoError(t, sink.Flush(ctx))
+		assert.Equal(t, []string{`0/14`, `0/21`, `0/31`}, durable)
+		assert.Len(t, broker.values(`others`, 0, nil), 3)
+	})
+
+	t.Run("Expire", func(t *testing.T) {
+		sink.options.Linger = 10 * time.Millisecond
+
+		require.NoError(t, write(
+			&ReplicationOperation{Position: `0/38`, Operation: `BEGIN`, Target: `3`},
+			insert(`0/38`, `public.other`, `5`),
+			&ReplicationOperation{Position: `0/39`, Operation: `COMMIT`, Target: `3`},
+		))
+		assert.Eventually(t, func() bool {
+			sink.mutex.Lock()
+			defer sink.mutex.Unlock()
+			return len(durable) == 4
+		}, time.Second, time.Millisecond, "Expected the transaction to be sent without another COMMIT")
+		assert.Equal(t, `0/39`, durable[3])
+		durable = durable[:3]
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		sink.options.Linger = 0
+		broker.mutex.Lock()
+		broker.errors = []int16{10} // MESSAGE_TOO_LARGE
+		broker.mutex.Unlock()
+
+		err := write(
+			&ReplicationOperation{Position: `0/40`, Operation: `BEGIN`, Target: `4`},
+			insert(`0/40`, `public.other`, `6`),
+			&ReplicationOperation{Position: `0/41`, Operation: `COMMIT`, Target: `4`},
+		)
+		assert.EqualError(t, err, `Kafka error 10 producing to others[0]`)
+		assert.Len(t, durable, 3, "Expected no acknowledgement")
+	})
+}
+
+// testEncoder encodes the operation and the value of v for brevity.
+type testEncoder struct{}
+
+func (testEncoder) Encode(op *ReplicationOperation) ([]byte, error) {
+	if op.Target == `` || op.Operation == `BEGIN` || op.Operation == `COMMIT` {
+		return nil, nil
+	}
+	value := op.Position
+	for i := range op.NewColumns {
+		if op.NewColumns[i] == `v` {
+			value, _ = pgUnquoteConstant(op.NewValues[i])
+		}
+	}
+	return []byte(op.Operation + ` ` + value), nil
+}
+
+func TestKafkaSinkPing(t *testing.T) {
+	broker := newTestKafkaBroker(t, 1)
+	sink, err := NewKafkaSink(KafkaOptions{Brokers: []string{broker.listener.Addr().String()}})
+	require.NoError(t, err)
+
+	// as while send retries
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, sink.Ping(ctx), "Expected a ping not to wait for sending")
+
+	broker.listener.Close()
+	assert.Error(t, sink.Ping(ctx))
+}
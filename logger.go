@@ -0,0 +1,54 @@
+package pgbarrel
+
+import (
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// A Logger records events with fields given as alternating keys and values,
+// e.g. "slot", "pgbarrel", "lsn", "0/16B3748". Most events have some of
+// slot, lsn, xid, table and error. A *slog.Logger is a Logger.
+type Logger interface {
+	Debug(msg string, fields ...interface{})
+	Info(msg string, fields ...interface{})
+	Warn(msg string, fields ...interface{})
+	Error(msg string, fields ...interface{})
+}
+
+var _ Logger = (*slog.Logger)(nil)
+
+type discardLogger struct{}
+
+func (discardLogger) Debug(string, ...interface{}) {}
+func (discardLogger) Info(string, ...interface{})  {}
+func (discardLogger) Warn(string, ...interface{})  {}
+func (discardLogger) Error(string, ...interface{}) {}
+
+// orDiscard returns l, or a Logger that records nothing when l is nil.
+func orDiscard(l Logger) Logger {
+	if l == nil {
+		return discardLogger{}
+	}
+	return l
+}
+
+// NewSlogLogger returns a Logger that writes events at level and above to w
+// in format, "text" or "json", of log/slog.
+func NewSlogLogger(w io.Writer, level, format string) (Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, errors.Errorf("Unknown log level: %q", level)
+	}
+
+	options := &slog.HandlerOptions{Level: l}
+	switch strings.ToLower(format) {
+	case "text", "":
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	}
+	return nil, errors.Errorf("Unknown log format: %q", format)
+}
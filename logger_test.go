@@ -0,0 +1,60 @@
+package pgbarrel
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testLogger records each event as "LEVEL message key=value ...".
+type testLogger struct{ events []string }
+
+func (l *testLogger) record(level, msg string, fields []interface{}) {
+	event := level + " " + msg
+	for i := 0; i+1 < len(fields); i += 2 {
+		event += fmt.Sprintf(" %v=%v", fields[i], fields[i+1])
+	}
+	l.events = append(l.events, event)
+}
+
+func (l *testLogger) Debug(msg string, fields ...interface{}) { l.record("DEBUG", msg, fields) }
+func (l *testLogger) Info(msg string, fields ...interface{})  { l.record("INFO", msg, fields) }
+func (l *testLogger) Warn(msg string, fields ...interface{})  { l.record("WARN", msg, fields) }
+func (l *testLogger) Error(msg string, fields ...interface{}) { l.record("ERROR", msg, fields) }
+
+func TestNewSlogLogger(t *testing.T) {
+	var b bytes.Buffer
+
+	l, err := NewSlogLogger(&b, "info", "text")
+	require.NoError(t, err)
+	l.Debug("hidden")
+	l.Info("Started replication", "slot", "barrel", "lsn", "0/10")
+	assert.Regexp(t, `^time=\S+ level=INFO msg="Started replication" slot=barrel lsn=0/10\n$`, b.String())
+
+	b.Reset()
+	l, err = NewSlogLogger(&b, "DEBUG", "json")
+	require.NoError(t, err)
+	l.Debug("Applied transaction", "xid", "553")
+	assert.True(t, strings.HasSuffix(b.String(), `"level":"DEBUG","msg":"Applied transaction","xid":"553"}`+"\n"), b.String())
+
+	_, err = NewSlogLogger(&b, "loud", "text")
+	assert.EqualError(t, err, `Unknown log level: "loud"`)
+	_, err = NewSlogLogger(&b, "info", "xml")
+	assert.EqualError(t, err, `Unknown log format: "xml"`)
+
+	assert.NotPanics(t, func() { orDiscard(nil).Error("nothing", "error", err) })
+}
+
+func TestPipelineLogger(t *testing.T) {
+	source := &testSource{ops: testTransaction(`0/10`, &ReplicationOperation{Operation: `INSERT`})}
+	sink := &testSink{write: func(*ReplicationOperation) error { return fmt.Errorf("boom") }}
+	logger := &testLogger{}
+
+	assert.EqualError(t, NewPipeline(source, sink).SetLogger(logger).Run(context.Background()), "boom")
+	assert.Equal(t, []string{`ERROR Pipeline failed error=boom`}, logger.events)
+}
@@ -0,0 +1,288 @@
+package pgbarrel
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// A Mask replaces the value of a column. It receives the type of the column
+// and its value as a constant, e.g. `'alice@example.com'`, and returns the
+// constant to use instead. It returns an error when it cannot produce a value
+// of that type. Masks leave NULL as NULL.
+type Mask func(typ, value string) (string, error)
+
+// ColumnMasks assigns masks to the columns of each target, e.g.
+// ColumnMasks{"public.users": {"email": MaskHMAC(key)}}.
+type ColumnMasks map[string]map[string]Mask
+
+// Apply masks the old and new values of op in place.
+func (m ColumnMasks) Apply(op *ReplicationOperation) error {
+	masks, ok := m[op.Target]
+	if !ok {
+		return nil
+	}
+
+	apply := func(columns, values, types []string) error {
+		for i := range columns {
+			if mask, ok := masks[columns[i]]; ok && i < len(values) {
+				var typ string
+				if i < len(types) {
+					typ = types[i]
+				}
+				if _, null := pgUnquoteConstant(values[i]); !null {
+					value, err := mask(typ, values[i])
+					if err != nil {
+						return errors.Wrapf(err, "Unable to mask %s of %s", columns[i], op.Target)
+					}
+					values[i] = value
+				}
+			}
+		}
+		return nil
+	}
+
+	if err := apply(op.OldColumns, op.OldValues, op.OldTypes); err != nil {
+		return err
+	}
+	return apply(op.NewColumns, op.NewValues, op.NewTypes)
+}
+
+// MaskNull replaces every value with NULL.
+func MaskNull() Mask {
+	return func(string, string) (string, error) { return `null`, nil }
+}
+
+// MaskFixed replaces every value with the same value. It fails for numbers,
+// booleans, uuids, dates and times when value is not one of them.
+func MaskFixed(value string) Mask {
+	return func(typ, _ string) (string, error) {
+		if !maskValid(typ, value) {
+			return ``, errors.Errorf("Fixed value %q is not a valid %s", value, typ)
+		}
+		if pgIsNumericType(typ) {
+			return value, nil
+		}
+		return pgQuoteLiteral(value), nil
+	}
+}
+
+// MaskHMAC replaces every value with a keyed hash of itself, so equal values
+// remain equal and joins between masked columns still work. Text becomes the
+// hexadecimal SHA-256 HMAC; numbers, uuids, dates and times become values of
+// their type derived from it, as with MaskFake. It fails for other types.
+func MaskHMAC(key []byte) Mask {
+	fake := MaskFake(key)
+
+	return func(typ, value string) (string, error) {
+		if pgIsNumericType(typ) || typ == `uuid` || maskIsDateTime(typ) {
+			return fake(typ, value)
+		}
+		if !maskIsText(typ) {
+			return ``, errors.Errorf("Unable to hash a value of %s", typ)
+		}
+
+		text, _ := pgUnquoteConstant(value)
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(text))
+		return pgQuoteLiteral(hex.EncodeToString(mac.Sum(nil))), nil
+	}
+}
+
+// MaskFake replaces every letter and digit with another of the same kind,
+// keeping punctuation, case and length, e.g. `alice@example.com` could become
+// `qmzra@wbtkdfo.jxe`. The replacement is keyed, so equal values remain equal.
+// Integers stay within the range of their type, and dates and times become
+// other valid ones in the same year and time zone. It fails for types other
+// than text, numbers, uuid, bytea, dates and times.
+func MaskFake(key []byte) Mask {
+	return func(typ, value string) (string, error) {
+		numeric := pgIsNumericType(typ)
+		hexadecimal := typ == `uuid` || typ == `bytea`
+		if !numeric && !hexadecimal && !maskIsDateTime(typ) && !maskIsText(typ) {
+			return ``, errors.Errorf("Unable to fake a value of %s", typ)
+		}
+
+		text, _ := pgUnquoteConstant(value)
+
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(text))
+		seed := mac.Sum(nil)
+
+		var block []byte
+		var counter uint32
+		next := func(n int) int {
+			if len(block) == 0 {
+				counter++
+				mac := hmac.New(sha256.New, seed)
+				binary.Write(mac, binary.BigEndian, counter)
+				block = mac.Sum(nil)
+			}
+			b := block[0]
+			block = block[1:]
+			return int(b) % n
+		}
+
+		if maskIsDateTime(typ) {
+			return pgQuoteLiteral(maskDateTime(text, next)), nil
+		}
+
+		leading := numeric
+		result := make([]rune, 0, utf8.RuneCountInString(text))
+
+		for _, c := range text {
+			switch {
+			case '0' <= c && c <= '9':
+				if leading && c != '0' {
+					c = '1' + rune(next(9))
+				} else {
+					c = '0' + rune(next(10))
+				}
+				leading = false
+			case hexadecimal && 'a' <= c && c <= 'f':
+				c = 'a' + rune(next(6))
+			case hexadecimal && 'A' <= c && c <= 'F':
+				c = 'A' + rune(next(6))
+			case hexadecimal, numeric:
+			case unicode.IsLower(c):
+				c = 'a' + rune(next(26))
+			case unicode.IsUpper(c):
+				c = 'A' + rune(next(26))
+			}
+			result = append(result, c)
+		}
+
+		if numeric {
+			return maskInteger(typ, string(result)), nil
+		}
+		return pgQuoteLiteral(string(result)), nil
+	}
+}
+
+var (
+	maskDatePattern = regexp.MustCompile(`^[0-9]+-[0-9]{2}-[0-9]{2}`)
+	maskTimePattern = regexp.MustCompile(`[0-9]{2}:[0-9]{2}:[0-9]{2}(\.[0-9]+)?`)
+
+	maskBooleanPattern = regexp.MustCompile(`^(?i:t|f|true|false|y|n|yes|no|on|off|1|0)$`)
+	maskNumberPattern  = regexp.MustCompile(`^[+-]?([0-9]+\.?[0-9]*|\.[0-9]+)([eE][+-]?[0-9]+)?$|^(?i:[+-]?infinity|nan)$`)
+	maskUUIDPattern    = regexp.MustCompile(`^[0-9a-fA-F]{8}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{12}$`)
+)
+
+func maskIsDateTime(typ string) bool {
+	return typ == `date` || strings.HasPrefix(typ, `time`)
+}
+
+// maskIsText reports whether typ holds any text. An unknown type, "", is
+// taken as text.
+func maskIsText(typ string) bool {
+	switch typ {
+	case ``, `text`, `character varying`, `character`, `varchar`, `bpchar`, `name`, `citext`:
+		return true
+	}
+	return strings.HasPrefix(typ, `character varying(`) || strings.HasPrefix(typ, `character(`)
+}
+
+// maskValid reports whether text is a value of typ, as far as a mask can
+// tell. Values of types other than numbers, booleans, uuids, dates and times
+// are taken to be valid.
+func maskValid(typ, text string) bool {
+	switch {
+	case typ == `smallint`, typ == `integer`, typ == `bigint`:
+		_, err := strconv.ParseInt(text, 10, map[string]int{`smallint`: 16, `integer`: 32, `bigint`: 64}[typ])
+		return err == nil
+	case typ == `oid`:
+		_, err := strconv.ParseUint(text, 10, 32)
+		return err == nil
+	case pgIsNumericType(typ):
+		return maskNumberPattern.MatchString(text)
+	case typ == `boolean`:
+		return maskBooleanPattern.MatchString(strings.TrimSpace(text))
+	case typ == `uuid`:
+		return maskUUIDPattern.MatchString(text)
+	case typ == `date`:
+		return maskDatePattern.MatchString(text)
+	case strings.HasPrefix(typ, `timestamp`):
+		return maskDatePattern.MatchString(text) && maskTimePattern.MatchString(text)
+	case strings.HasPrefix(typ, `time`):
+		return maskTimePattern.MatchString(text)
+	}
+	return true
+}
+
+// maskDateTime replaces the month and day and the time of day in text, such
+// as `2020-01-02 03:04:05.5+02`, keeping its year, precision and time zone.
+// Special values, such as `infinity`, are kept.
+func maskDateTime(text string, next func(int) int) string {
+	if m := maskDatePattern.FindStringIndex(text); m != nil {
+		year := text[:m[1]-len(`-01-02`)]
+		text = year + fmt.Sprintf(`-%02d-%02d`, 1+next(12), 1+next(28)) + text[m[1]:]
+	}
+	if m := maskTimePattern.FindStringIndex(text); m != nil {
+		clock := []byte(fmt.Sprintf(`%02d:%02d:%02d`, next(24), next(60), next(60)))
+		for _, c := range text[m[0]+len(clock) : m[1]] {
+			if c == '.' {
+				clock = append(clock, '.')
+			} else {
+				clock = append(clock, byte('0'+next(10)))
+			}
+		}
+		text = text[:m[0]] + string(clock) + text[m[1]:]
+	}
+	return text
+}
+
+// maskInteger wraps number into the range of typ when it is an integer type.
+func maskInteger(typ, number string) string {
+	var max uint64
+	switch typ {
+	case `smallint`:
+		max = 1<<15 - 1
+	case `integer`:
+		max = 1<<31 - 1
+	case `bigint`:
+		max = 1<<63 - 1
+	case `oid`:
+		max = 1<<32 - 1
+	default:
+		return number
+	}
+
+	sign, digits := ``, number
+	if strings.HasPrefix(digits, `-`) {
+		sign, digits = `-`, digits[1:]
+	}
+	if n, err := strconv.ParseUint(digits, 10, 64); err == nil && n > max {
+		return sign + strconv.FormatUint(n%(max+1), 10)
+	}
+	return number
+}
+
+// MaskTruncate keeps only the first n characters of every value. It fails for
+// types other than text.
+func MaskTruncate(n int) Mask {
+	return func(typ, value string) (string, error) {
+		if !maskIsText(typ) {
+			return ``, errors.Errorf("Unable to truncate a value of %s", typ)
+		}
+		text, _ := pgUnquoteConstant(value)
+
+		var count int
+		for i := range text {
+			if count == n {
+				text = text[:i]
+				break
+			}
+			count++
+		}
+		return pgQuoteLiteral(text), nil
+	}
+}
@@ -0,0 +1,202 @@
+package pgbarrel
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMasks(t *testing.T) {
+	key := []byte(`secret`)
+
+	for _, tt := range []struct {
+		name    string
+		mask    Mask
+		typ     string
+		value   string
+		pattern string
+	}{
+		{`null`, MaskNull(), `text`, `'alice'`, `^null$`},
+
+		{`fixed text`, MaskFixed(`redacted`), `text`, `'alice'`, `^'redacted'$`},
+		{`fixed quote`, MaskFixed(`o'brien`), `text`, `'alice'`, `^'o''brien'$`},
+		{`fixed number`, MaskFixed(`0`), `integer`, `42`, `^0$`},
+
+		{`hmac text`, MaskHMAC(key), `text`, `'alice'`, `^'[0-9a-f]{64}'$`},
+		{`hmac number`, MaskHMAC(key), `bigint`, `4155550123`, `^[1-9][0-9]{9}$`},
+
+		{`fake email`, MaskFake(key), `text`, `'alice@example.com'`, `^'[a-z]{5}@[a-z]{7}\.[a-z]{3}'$`},
+		{`fake phone`, MaskFake(key), `text`, `'+1 (415) 555-0123'`, `^'\+[0-9] \([0-9]{3}\) [0-9]{3}-[0-9]{4}'$`},
+		{`fake name`, MaskFake(key), `character varying`, `'Alice O''Brien'`, `^'[A-Z][a-z]{4} [A-Z]''[A-Z][a-z]{4}'$`},
+		{`fake number`, MaskFake(key), `numeric`, `-12.5e3`, `^-[1-9][0-9]\.[0-9]e[0-9]$`},
+		{`fake smallint`, MaskFake(key), `smallint`, `32767`, `^[0-9]+$`},
+		{`fake integer`, MaskFake(key), `integer`, `-2147483648`, `^-[0-9]+$`},
+		{`fake bigint`, MaskFake(key), `bigint`, `9223372036854775807`, `^[0-9]+$`},
+		{`fake date`, MaskFake(key), `date`, `'2020-01-02'`, `^'2020-[01][0-9]-[0-2][0-9]'$`},
+		{`fake timestamp`, MaskFake(key), `timestamp with time zone`, `'2020-01-02 03:04:05.25+05:30'`,
+			`^'2020-[01][0-9]-[0-2][0-9] [0-2][0-9]:[0-5][0-9]:[0-5][0-9]\.[0-9]{2}\+05:30'$`},
+		{`fake time`, MaskFake(key), `time without time zone`, `'23:59:59'`, `^'[0-2][0-9]:[0-5][0-9]:[0-5][0-9]'$`},
+		{`fake infinity`, MaskFake(key), `timestamp without time zone`, `'infinity'`, `^'infinity'$`},
+		{`hmac date`, MaskHMAC(key), `date`, `'2020-01-02'`, `^'2020-[01][0-9]-[0-2][0-9]'$`},
+		{`fake uuid`, MaskFake(key), `uuid`, `'a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11'`, `^'[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}'$`},
+
+		{`truncate text`, MaskTruncate(3), `text`, `'alice'`, `^'ali'$`},
+		{`truncate short`, MaskTruncate(3), `text`, `'al'`, `^'al'$`},
+		{`truncate runes`, MaskTruncate(2), `text`, `'äöü'`, `^'äö'$`},
+		{`truncate quote`, MaskTruncate(2), `text`, `'a''b'`, `^'a'''$`},
+	} {
+		result, err := tt.mask(tt.typ, tt.value)
+		if err != nil {
+			t.Errorf("Expected %s of `%s` to succeed, got %v", tt.name, tt.value, err)
+			continue
+		}
+
+		if !regexp.MustCompile(tt.pattern).MatchString(result) {
+			t.Errorf("Expected %s of `%s` to match `%s`, got `%s`", tt.name, tt.value, tt.pattern, result)
+		}
+		if again, _ := tt.mask(tt.typ, tt.value); again != result {
+			t.Errorf("Expected %s of `%s` to be stable, got `%s` and `%s`", tt.name, tt.value, result, again)
+		}
+	}
+}
+
+func TestMasksInvalidType(t *testing.T) {
+	key := []byte(`secret`)
+
+	for _, tt := range []struct {
+		name  string
+		mask  Mask
+		typ   string
+		value string
+	}{
+		{`hmac boolean`, MaskHMAC(key), `boolean`, `true`},
+		{`hmac interval`, MaskHMAC(key), `interval`, `'1 day'`},
+		{`fake boolean`, MaskFake(key), `boolean`, `false`},
+		{`fake interval`, MaskFake(key), `interval`, `'1 day'`},
+		{`fake json`, MaskFake(key), `json`, `'{"a": true}'`},
+		{`fixed boolean`, MaskFixed(`x`), `boolean`, `true`},
+		{`fixed integer`, MaskFixed(`x`), `integer`, `1`},
+		{`fixed smallint`, MaskFixed(`40000`), `smallint`, `1`},
+		{`fixed uuid`, MaskFixed(`x`), `uuid`, `'a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11'`},
+		{`fixed date`, MaskFixed(`x`), `date`, `'2020-01-02'`},
+		{`truncate numeric`, MaskTruncate(1), `numeric`, `-1`},
+		{`truncate date`, MaskTruncate(4), `date`, `'2020-01-02'`},
+		{`truncate uuid`, MaskTruncate(4), `uuid`, `'a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11'`},
+	} {
+		if result, err := tt.mask(tt.typ, tt.value); err == nil {
+			t.Errorf("Expected %s of `%s` to fail, got `%s`", tt.name, tt.value, result)
+		}
+	}
+
+	for _, tt := range []struct {
+		mask  Mask
+		typ   string
+		value string
+	}{
+		{MaskFixed(`t`), `boolean`, `'t'`},
+		{MaskFixed(`-2147483648`), `integer`, `-2147483648`},
+		{MaskFixed(`1 day`), `interval`, `'1 day'`},
+		{MaskFixed(`2020-01-02`), `date`, `'2020-01-02'`},
+		{MaskNull(), `boolean`, `null`},
+	} {
+		if result, err := tt.mask(tt.typ, tt.value); err != nil || result != tt.value {
+			t.Errorf("Expected `%s` of %s, got `%s` and %v", tt.value, tt.typ, result, err)
+		}
+	}
+}
+
+func TestMaskFakeValid(t *testing.T) {
+	fake := MaskFake([]byte(`secret`))
+
+	for i := 0; i < 200; i++ {
+		if v, _ := fake(`smallint`, strconv.Itoa(32567+i)); !testIsInt(v, 16) {
+			t.Errorf("Expected a smallint, got `%s`", v)
+		}
+		if v, _ := fake(`bigint`, strconv.Itoa(-9223372036854775608-i)); !testIsInt(v, 64) {
+			t.Errorf("Expected a bigint, got `%s`", v)
+		}
+
+		date := fmt.Sprintf(`'2020-12-%02d 23:59:%02d'`, 1+i%31, i%60)
+		masked, _ := fake(`timestamp without time zone`, date)
+		v, _ := pgUnquoteConstant(masked)
+		if _, err := time.Parse(`2006-01-02 15:04:05`, v); err != nil {
+			t.Errorf("Expected a timestamp, got %v", err)
+		}
+	}
+}
+
+func testIsInt(s string, bits int) bool {
+	_, err := strconv.ParseInt(s, 10, bits)
+	return err == nil
+}
+
+func TestMasksKeyed(t *testing.T) {
+	for _, mask := range []func([]byte) Mask{MaskHMAC, MaskFake} {
+		a, b := mask([]byte(`a`)), mask([]byte(`b`))
+		alice, _ := a(`text`, `'alice'`)
+
+		if other, _ := b(`text`, `'alice'`); alice == other {
+			t.Errorf("Expected different keys to produce different values")
+		}
+		if other, _ := a(`text`, `'alicf'`); alice == other {
+			t.Errorf("Expected different values to produce different values")
+		}
+	}
+}
+
+func TestColumnMasksApply(t *testing.T) {
+	masks := ColumnMasks{`public.users`: {
+		`email`: MaskFixed(`nobody@example.com`),
+		`name`:  MaskNull(),
+	}}
+
+	for _, tt := range []struct{ input, expected ReplicationOperation }{
+		{
+			ReplicationOperation{Operation: `INSERT`, Target: `public.other`,
+				NewColumns: []string{`email`}, NewValues: []string{`'alice@example.com'`}, NewTypes: []string{`text`}},
+			ReplicationOperation{Operation: `INSERT`, Target: `public.other`,
+				NewColumns: []string{`email`}, NewValues: []string{`'alice@example.com'`}, NewTypes: []string{`text`}},
+		},
+		{
+			ReplicationOperation{Operation: `UPDATE`, Target: `public.users`,
+				OldColumns: []string{`email`}, OldValues: []string{`'alice@example.com'`}, OldTypes: []string{`text`},
+				NewColumns: []string{`id`, `email`, `name`, `note`}, NewValues: []string{`1`, `'bob@example.com'`, `'Bob'`, `'hi'`},
+				NewTypes: []string{`integer`, `text`, `text`, `text`}},
+			ReplicationOperation{Operation: `UPDATE`, Target: `public.users`,
+				OldColumns: []string{`email`}, OldValues: []string{`'nobody@example.com'`}, OldTypes: []string{`text`},
+				NewColumns: []string{`id`, `email`, `name`, `note`}, NewValues: []string{`1`, `'nobody@example.com'`, `null`, `'hi'`},
+				NewTypes: []string{`integer`, `text`, `text`, `text`}},
+		},
+		{
+			ReplicationOperation{Operation: `INSERT`, Target: `public.users`,
+				NewColumns: []string{`id`, `email`}, NewValues: []string{`2`, `null`}, NewTypes: []string{`integer`, `text`}},
+			ReplicationOperation{Operation: `INSERT`, Target: `public.users`,
+				NewColumns: []string{`id`, `email`}, NewValues: []string{`2`, `null`}, NewTypes: []string{`integer`, `text`}},
+		},
+	} {
+		op := tt.input
+		op.OldValues = append([]string(nil), op.OldValues...)
+		op.NewValues = append([]string(nil), op.NewValues...)
+
+		if err := masks.Apply(&op); err != nil {
+			t.Errorf("Expected %v to be masked, got %v", tt.input, err)
+		} else if !reflect.DeepEqual(op, tt.expected) {
+			t.Errorf("Expected %v to be %v, got %v", tt.input, tt.expected, op)
+		}
+	}
+}
+
+func TestColumnMasksApplyError(t *testing.T) {
+	masks := ColumnMasks{`public.users`: {`active`: MaskTruncate(1)}}
+
+	op := ReplicationOperation{Operation: `INSERT`, Target: `public.users`,
+		NewColumns: []string{`active`}, NewValues: []string{`true`}, NewTypes: []string{`boolean`}}
+	if err := masks.Apply(&op); err == nil {
+		t.Errorf("Expected truncate of a boolean to fail")
+	} else if expected := "Unable to mask active of public.users: Unable to truncate a value of boolean"; err.Error() != expected {
+		t.Errorf("Expected %q, got %q", expected, err.Error())
+	}
+}
@@ -0,0 +1,363 @@
+package pgbarrel
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+// metricsCommits is how many commits received but not applied are kept for
+// their lag; older ones are forgotten.
+const metricsCommits = 10000
+
+// metricsBuckets are the upper bounds, in seconds, of apply latency.
+var metricsBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics counts the work of a receiver and a Pipeline, and serves it in the
+// Prometheus text format. A nil *Metrics counts nothing, reports a zero Lag
+// and Status, writes no metrics and is never ready.
+type Metrics struct {
+	messages    uint64
+	bytes       uint64
+	parseErrors uint64
+	standbys    uint64
+	reconnects  uint64
+	received    uint64
+	applied     uint64
+	serverEnd   uint64
+	lastCommit  int64
+	looped      int64
+	streaming   int32
+
+	mutex      sync.Mutex
+	operations map[[2]string]uint64
+	latency    map[string]*metricsHistogram
+
+	// commits received but not yet applied, in order
+	commits       []metricsCommit
+	receiveLag    time.Duration
+	applyLag      time.Duration
+	appliedAt     time.Time
+	appliedCommit time.Time
+
+	slot, plugin string
+	lastError    string
+	ping         func(context.Context) error
+
+	now func() time.Time
+}
+
+type metricsCommit struct {
+	lsn  uint64
+	time time.Time
+}
+
+// A Lag is how far behind its source a Pipeline is.
+type Lag struct {
+	// Commit is the time between the commit of the last transaction applied
+	// and when it was applied. It is zero without commit timestamps, e.g.
+	// test_decoding without include-timestamp.
+	Commit time.Duration
+	// Committed is the commit time of the last transaction applied.
+	Committed time.Time
+	// Applied is when the last transaction was applied.
+	Applied time.Time
+
+	// Received is the bytes of WAL received but not applied.
+	Received uint64
+	// Server is the bytes of WAL on the server, as of its last keepalive,
+	// that are not applied.
+	Server uint64
+}
+
+type metricsHistogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		operations: make(map[[2]string]uint64),
+		latency:    make(map[string]*metricsHistogram),
+		now:        time.Now,
+	}
+}
+
+// message counts a replication message of size bytes that starts at lsn.
+func (m *Metrics) message(size int, lsn uint64) {
+	if m != nil {
+		atomic.AddUint64(&m.messages, 1)
+		atomic.AddUint64(&m.bytes, uint64(size))
+		atomic.StoreUint64(&m.received, lsn)
+	}
+}
+
+// commit records the commit time of the transaction that ends at lsn.
+func (m *Metrics) commit(lsn uint64, committed time.Time) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// those received again after a reconnect replace the first
+	n := len(m.commits)
+	for n > 0 && m.commits[n-1].lsn >= lsn {
+		n--
+	}
+	m.commits = append(m.commits[:n], metricsCommit{lsn: lsn, time: committed})
+	if len(m.commits) > metricsCommits {
+		m.commits = m.commits[len(m.commits)-metricsCommits:]
+	}
+	m.receiveLag = m.now().Sub(committed)
+}
+
+// server records the end of WAL on the server.
+func (m *Metrics) server(lsn uint64) {
+	if m != nil && lsn != 0 {
+		atomic.StoreUint64(&m.serverEnd, lsn)
+	}
+}
+
+func (m *Metrics) parseError() {
+	if m != nil {
+		atomic.AddUint64(&m.parseErrors, 1)
+	}
+}
+
+func (m *Metrics) standby() {
+	if m != nil {
+		atomic.AddUint64(&m.standbys, 1)
+	}
+}
+
+func (m *Metrics) reconnect() {
+	if m != nil {
+		atomic.AddUint64(&m.reconnects, 1)
+	}
+}
+
+// apply counts op, written to a Sink in elapsed.
+func (m *Metrics) apply(op *ReplicationOperation, elapsed time.Duration) {
+	if m == nil {
+		return
+	}
+
+	target := op.Target
+	if op.Operation == `BEGIN` || op.Operation == `COMMIT` {
+		// the target is a transaction ID
+		target = ``
+		if op.Operation == `COMMIT` {
+			atomic.StoreInt64(&m.lastCommit, m.now().UnixNano())
+		}
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.operations[[2]string{op.Operation, target}]++
+
+	h, ok := m.latency[op.Operation]
+	if !ok {
+		h = &metricsHistogram{counts: make([]uint64, len(metricsBuckets))}
+		m.latency[op.Operation] = h
+	}
+	seconds := elapsed.Seconds()
+	for i, bound := range metricsBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// acknowledge records position as applied, and the lag of the transactions
+// it ends.
+func (m *Metrics) acknowledge(position string) {
+	if m == nil {
+		return
+	}
+	lsn, err := pgx.ParseLSN(position)
+	if err != nil {
+		return
+	}
+	for applied := atomic.LoadUint64(&m.applied); lsn > applied; applied = atomic.LoadUint64(&m.applied) {
+		if atomic.CompareAndSwapUint64(&m.applied, applied, lsn) {
+			break
+		}
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.appliedAt = m.now()
+	var n int
+	for n < len(m.commits) && m.commits[n].lsn <= lsn {
+		m.appliedCommit = m.commits[n].time
+		m.applyLag = m.appliedAt.Sub(m.appliedCommit)
+		n++
+	}
+	m.commits = m.commits[n:]
+}
+
+// Lag returns how far behind its source the Pipeline is.
+func (m *Metrics) Lag() Lag {
+	if m == nil {
+		return Lag{}
+	}
+	received, applied, server := atomic.LoadUint64(&m.received), atomic.LoadUint64(&m.applied), atomic.LoadUint64(&m.serverEnd)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	lag := Lag{Commit: m.applyLag, Committed: m.appliedCommit, Applied: m.appliedAt}
+	if received > applied {
+		lag.Received = received - applied
+	}
+	if server > applied {
+		lag.Server = server - applied
+	}
+	return lag
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteTo(w)
+}
+
+// WriteTo writes the metrics to w in the Prometheus text format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	if m == nil {
+		return 0, nil
+	}
+	var b strings.Builder
+
+	family := func(name, typ, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+	sample := func(name string, value interface{}, labels ...string) {
+		b.WriteString(name)
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i == 0 {
+				b.WriteByte('{')
+			} else {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(&b, "%s=\"%s\"", labels[i], metricsEscape(labels[i+1]))
+		}
+		if len(labels) > 0 {
+			b.WriteByte('}')
+		}
+		fmt.Fprintf(&b, " %v\n", value)
+	}
+	single := func(name, typ, help string, value interface{}) {
+		family(name, typ, help)
+		sample(name, value)
+	}
+
+	single("pgbarrel_messages_received_total", "counter", "Replication messages received.", atomic.LoadUint64(&m.messages))
+	single("pgbarrel_bytes_received_total", "counter", "Bytes of WAL data received.", atomic.LoadUint64(&m.bytes))
+	single("pgbarrel_parse_errors_total", "counter", "Messages the output plugin decoder failed to parse.", atomic.LoadUint64(&m.parseErrors))
+	single("pgbarrel_standby_status_sent_total", "counter", "Standby status updates sent to the server.", atomic.LoadUint64(&m.standbys))
+	single("pgbarrel_reconnects_total", "counter", "Times streaming was restarted.", atomic.LoadUint64(&m.reconnects))
+
+	lag := m.Lag()
+	single("pgbarrel_received_lsn", "gauge", "LSN of the last message received.", atomic.LoadUint64(&m.received))
+	single("pgbarrel_applied_lsn", "gauge", "LSN of the last transaction applied.", atomic.LoadUint64(&m.applied))
+	single("pgbarrel_server_lsn", "gauge", "LSN of the end of WAL on the server.", atomic.LoadUint64(&m.serverEnd))
+	single("pgbarrel_lag_bytes", "gauge", "Bytes of WAL received but not applied.", lag.Received)
+	single("pgbarrel_server_lag_bytes", "gauge", "Bytes of WAL on the server not applied.", lag.Server)
+
+	m.mutex.Lock()
+	receiveLag := m.receiveLag
+	m.mutex.Unlock()
+	if !lag.Committed.IsZero() {
+		single("pgbarrel_receive_lag_seconds", "gauge", "Seconds from the commit of the last transaction received to its receipt.", receiveLag.Seconds())
+		single("pgbarrel_apply_lag_seconds", "gauge", "Seconds from the commit of the last transaction applied to when it was applied.", lag.Commit.Seconds())
+		single("pgbarrel_applied_commit_timestamp_seconds", "gauge", "Commit time of the last transaction applied.", float64(lag.Committed.UnixNano())/1e9)
+	}
+
+	if last := atomic.LoadInt64(&m.lastCommit); last != 0 {
+		single("pgbarrel_seconds_since_last_commit", "gauge", "Seconds since the last COMMIT was written.",
+			m.now().Sub(time.Unix(0, last)).Seconds())
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	keys := make([][2]string, 0, len(m.operations))
+	for key := range m.operations {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][0] < keys[j][0] || keys[i][0] == keys[j][0] && keys[i][1] < keys[j][1]
+	})
+	family("pgbarrel_operations_total", "counter", "Operations written, by kind and table.")
+	for _, key := range keys {
+		sample("pgbarrel_operations_total", m.operations[key], "operation", key[0], "table", key[1])
+	}
+
+	operations := make([]string, 0, len(m.latency))
+	for operation := range m.latency {
+		operations = append(operations, operation)
+	}
+	sort.Strings(operations)
+	family("pgbarrel_apply_duration_seconds", "histogram", "Time to write an operation, by kind.")
+	for _, operation := range operations {
+		h := m.latency[operation]
+		for i, bound := range metricsBuckets {
+			sample("pgbarrel_apply_duration_seconds_bucket", h.counts[i], "operation", operation, "le", fmt.Sprint(bound))
+		}
+		sample("pgbarrel_apply_duration_seconds_bucket", h.count, "operation", operation, "le", "+Inf")
+		sample("pgbarrel_apply_duration_seconds_sum", h.sum, "operation", operation)
+		sample("pgbarrel_apply_duration_seconds_count", h.count, "operation", operation)
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func metricsEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// A MetricsServer serves Metrics on /metrics, and the endpoints of
+// NewHealthHandler. Closing it stops the server.
+type MetricsServer struct {
+	*Metrics
+	server *http.Server
+}
+
+// ListenMetrics serves m on addr. Its receive loop is unhealthy once it has
+// stalled for longer than stall.
+func ListenMetrics(addr string, m *Metrics, stall time.Duration) (*MetricsServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	mux.Handle("/", NewHealthHandler(m, stall))
+
+	s := &MetricsServer{Metrics: m, server: &http.Server{Handler: mux}}
+	go s.server.Serve(listener)
+	return s, nil
+}
+
+func (s *MetricsServer) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.server.Shutdown(ctx)
+}
@@ -0,0 +1,168 @@
+package pgbarrel
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	m := NewMetrics()
+	m.now = func() time.Time { return time.Unix(100, 0) }
+
+	source := &testSource{ops: testTransaction(`0/10`,
+		&ReplicationOperation{Operation: `INSERT`, Target: `public.t`},
+		&ReplicationOperation{Operation: `INSERT`, Target: `public."a""b"`},
+		&ReplicationOperation{Operation: `DELETE`, Target: `public.t`})}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sink := &testSink{}
+	sink.write = func(*ReplicationOperation) error {
+		if len(sink.ops) == len(source.ops) {
+			cancel()
+		}
+		return nil
+	}
+	assert.Equal(t, context.Canceled, NewPipeline(source, sink).SetMetrics(m).Run(ctx))
+
+	m.message(20, 0x30)
+	m.message(10, 0x38)
+	m.parseError()
+	m.standby()
+	m.reconnect()
+	m.now = func() time.Time { return time.Unix(102, 500000000) }
+
+	var b bytes.Buffer
+	_, err := m.WriteTo(&b)
+	require.NoError(t, err)
+	text := b.String()
+
+	for _, line := range []string{
+		"# TYPE pgbarrel_messages_received_total counter\npgbarrel_messages_received_total 2\n",
+		"pgbarrel_bytes_received_total 30\n",
+		"pgbarrel_parse_errors_total 1\n",
+		"pgbarrel_standby_status_sent_total 1\n",
+		"pgbarrel_reconnects_total 1\n",
+		"pgbarrel_received_lsn 56\n",
+		"pgbarrel_applied_lsn 16\n",
+		"pgbarrel_lag_bytes 40\n",
+		"pgbarrel_seconds_since_last_commit 2.5\n",
+		"# TYPE pgbarrel_operations_total counter\n" +
+			"pgbarrel_operations_total{operation=\"BEGIN\",table=\"\"} 1\n" +
+			"pgbarrel_operations_total{operation=\"COMMIT\",table=\"\"} 1\n" +
+			"pgbarrel_operations_total{operation=\"DELETE\",table=\"public.t\"} 1\n" +
+			"pgbarrel_operations_total{operation=\"INSERT\",table=\"public.\\\"a\\\"\\\"b\\\"\"} 1\n" +
+			"pgbarrel_operations_total{operation=\"INSERT\",table=\"public.t\"} 1\n",
+		"# TYPE pgbarrel_apply_duration_seconds histogram\n",
+		"pgbarrel_apply_duration_seconds_bucket{operation=\"INSERT\",le=\"10\"} 2\n",
+		"pgbarrel_apply_duration_seconds_bucket{operation=\"INSERT\",le=\"+Inf\"} 2\n",
+		"pgbarrel_apply_duration_seconds_count{operation=\"INSERT\"} 2\n",
+	} {
+		assert.Contains(t, text, line)
+	}
+
+	t.Run("Nil", func(t *testing.T) {
+		var m *Metrics
+		assert.NotPanics(t, func() {
+			m.message(1, 1)
+			m.apply(&ReplicationOperation{Operation: `COMMIT`}, time.Second)
+			m.acknowledge(`0/10`)
+		})
+	})
+}
+
+func TestMetricsHandler(t *testing.T) {
+	m := NewMetrics()
+	m.message(7, 1)
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/plain; version=0.0.4", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), "pgbarrel_bytes_received_total 7\n")
+	assert.NotContains(t, w.Body.String(), "pgbarrel_seconds_since_last_commit", "Expected no age before a COMMIT")
+}
+
+func TestMetricsNil(t *testing.T) {
+	var m *Metrics
+	m.message(7, 1)
+	m.commit(1, time.Now())
+
+	assert.Equal(t, Lag{}, m.Lag())
+	assert.Equal(t, Status{}, m.Status())
+	assert.NoError(t, m.Healthy(time.Second))
+	assert.Error(t, m.Ready(context.Background()))
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, "", w.Body.String())
+
+	assert.NotPanics(t, func() { NewPipeline(nil, &testPingSink{}).SetMetrics(nil) })
+}
+
+func TestMetricsLag(t *testing.T) {
+	m := NewMetrics()
+	assert.Equal(t, Lag{}, m.Lag())
+
+	committed := time.Date(2017, 5, 1, 12, 0, 0, 0, time.UTC)
+	m.now = func() time.Time { return committed.Add(time.Second) }
+	m.message(10, 0x18)
+	m.commit(0x18, committed)
+	m.message(10, 0x28)
+	m.commit(0x28, committed.Add(500*time.Millisecond))
+	m.server(0x40)
+
+	assert.Equal(t, Lag{Received: 0x28, Server: 0x40}, m.Lag(), "Expected no commit lag before applying")
+
+	m.now = func() time.Time { return committed.Add(3 * time.Second) }
+	m.acknowledge(`0/18`)
+	assert.Equal(t, Lag{
+		Commit: 3 * time.Second, Committed: committed, Applied: committed.Add(3 * time.Second),
+		Received: 0x10, Server: 0x28,
+	}, m.Lag())
+
+	m.now = func() time.Time { return committed.Add(5 * time.Second) }
+	m.acknowledge(`0/30`)
+	assert.Equal(t, Lag{
+		Commit: 4500 * time.Millisecond, Committed: committed.Add(500 * time.Millisecond), Applied: committed.Add(5 * time.Second),
+		Server: 0x10,
+	}, m.Lag())
+
+	var b bytes.Buffer
+	_, err := m.WriteTo(&b)
+	require.NoError(t, err)
+	for _, line := range []string{
+		"pgbarrel_server_lsn 64\n",
+		"pgbarrel_server_lag_bytes 16\n",
+		"pgbarrel_receive_lag_seconds 0.5\n",
+		"pgbarrel_apply_lag_seconds 4.5\n",
+		"pgbarrel_applied_commit_timestamp_seconds 1.4936400005e+09\n",
+	} {
+		assert.Contains(t, b.String(), line)
+	}
+}
+
+func TestMetricsCommits(t *testing.T) {
+	m := NewMetrics()
+	committed := time.Date(2017, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	m.commit(0x18, committed)
+	m.commit(0x28, committed)
+	m.commit(0x18, committed.Add(time.Second))
+	assert.Equal(t, []metricsCommit{{0x18, committed.Add(time.Second)}}, m.commits, "Expected commits received again to replace the first")
+
+	for lsn := uint64(0x20); len(m.commits) < metricsCommits; lsn++ {
+		m.commit(lsn, committed)
+	}
+	m.commit(0x100000, committed)
+	assert.Len(t, m.commits, metricsCommits, "Expected commits never applied to be forgotten")
+	assert.Equal(t, uint64(0x20), m.commits[0].lsn)
+}
@@ -1,8 +1,43 @@
 package pgbarrel
 
+import "bytes"
+
 type ReplicationOperation struct {
 	Position              string
 	Operation, Target     string
 	OldColumns, OldValues []string
 	NewColumns, NewValues []string
+	OldTypes, NewTypes    []string
+}
+
+// String formats op on one line, e.g.
+// `0/16B3748 UPDATE public.t old: id[integer]:1 new: id[integer]:2 v[text]:'a'`.
+func (op *ReplicationOperation) String() string {
+	var b bytes.Buffer
+
+	if op.Position != "" {
+		b.WriteString(op.Position + " ")
+	}
+	b.WriteString(op.Operation + " " + op.Target)
+
+	columns := func(label string, names, values, types []string) {
+		if len(names) == 0 {
+			return
+		}
+		b.WriteString(" " + label + ":")
+		for i := range names {
+			b.WriteString(" " + names[i])
+			if i < len(types) {
+				b.WriteString("[" + types[i] + "]")
+			}
+			if i < len(values) {
+				b.WriteString(":" + values[i])
+			}
+		}
+	}
+
+	columns("old", op.OldColumns, op.OldValues, op.OldTypes)
+	columns("new", op.NewColumns, op.NewValues, op.NewTypes)
+
+	return b.String()
 }
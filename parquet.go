@@ -0,0 +1,658 @@
+package pgbarrel
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx"
+	"github.com/pkg/errors"
+)
+
+type ParquetOptions struct {
+	// Dir holds a directory for each target and hour of commit, e.g.
+	// Dir/public.t/2017-05-01/12/0000000016B3748-0000000016B3990.parquet,
+	// named by the first and last COMMIT the file holds.
+	Dir string
+
+	// Files are written after the first COMMIT that buffers MaxRows, 100000
+	// by default, or once the oldest buffered row is MaxAge old. Nothing is
+	// durable until it is written, so MaxAge bounds how long the source keeps
+	// changes already buffered. Zero MaxAge means one minute and negative
+	// means no limit, when only MaxRows and Flush write files.
+	MaxRows int
+	MaxAge  time.Duration
+}
+
+type parquetRow struct {
+	op, position string
+	xid          *int64
+	commit       *time.Time
+	columns      []string
+	values       []string
+}
+
+// A parquetBuffer holds the rows of one target and hour.
+type parquetBuffer struct {
+	target, dir string
+	columns     []string
+	types       map[string]string
+	rows        []parquetRow
+	first, last uint64
+}
+
+type parquetSink struct {
+	options ParquetOptions
+	durable func(position string)
+	now     func() time.Time
+
+	mutex    sync.Mutex
+	buffers  map[string]*parquetBuffer
+	rows     int
+	oldest   time.Time
+	xid      *int64
+	pending  []*ReplicationOperation
+	position string
+	timer    *time.Timer
+	err      error // of writing files by age
+}
+
+// NewParquetSink returns a BufferedSink that writes the rows of each target
+// to Parquet files. Every column is optional and typed from its PostgreSQL
+// type; the columns _op, _lsn, _xid and _commit_ts follow. UPDATE and
+// INSERT write the new row, DELETE the old row, and TRUNCATE a row of only
+// metadata. Transactions are durable once the files holding them are
+// renamed into place.
+func NewParquetSink(options ParquetOptions) *parquetSink {
+	if options.MaxRows < 1 {
+		options.MaxRows = 100000
+	}
+	if options.MaxAge == 0 {
+		options.MaxAge = time.Minute
+	}
+	return &parquetSink{options: options, now: time.Now, buffers: make(map[string]*parquetBuffer)}
+}
+
+func (s *parquetSink) OnDurable(durable func(position string)) { s.durable = durable }
+
+func (s *parquetSink) Write(ctx context.Context, op *ReplicationOperation) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+
+	switch op.Operation {
+	case `BEGIN`:
+		s.xid, s.pending = nil, s.pending[:0]
+		if xid, err := strconv.ParseInt(op.Target, 10, 64); err == nil {
+			s.xid = &xid
+		}
+		return nil
+	case `COMMIT`:
+		if err := s.commit(op); err != nil {
+			return err
+		}
+		if s.rows >= s.options.MaxRows ||
+			(s.options.MaxAge > 0 && s.rows > 0 && s.now().Sub(s.oldest) >= s.options.MaxAge) {
+			return s.flush()
+		}
+		return nil
+	case `INSERT`, `UPDATE`, `DELETE`, `TRUNCATE`, `READ`:
+		s.pending = append(s.pending, op)
+	}
+	return nil
+}
+
+// commit moves the rows of a transaction into their buffers.
+func (s *parquetSink) commit(op *ReplicationOperation) error {
+	lsn, err := pgx.ParseLSN(op.Position)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid position: %q", op.Position)
+	}
+
+	var at *time.Time
+	hour := s.now().UTC()
+	if t, ok := pgCommitTime(op.Target); ok {
+		at, hour = &t, t.UTC()
+	}
+
+	for _, change := range s.pending {
+		row := parquetRow{op: change.Operation, position: change.Position, xid: s.xid, commit: at}
+		types := change.NewTypes
+		switch change.Operation {
+		case `INSERT`, `UPDATE`, `READ`:
+			row.columns, row.values = change.NewColumns, change.NewValues
+		case `DELETE`:
+			row.columns, row.values, types = change.OldColumns, change.OldValues, change.OldTypes
+		}
+
+		schema, table := pgSplitTarget(change.Target)
+		dir := filepath.Join(s.options.Dir, schema+"."+table, hour.Format("2006-01-02"), hour.Format("15"))
+		buffer, err := s.buffer(change.Target, dir, row.columns, types)
+		if err != nil {
+			return err
+		}
+
+		if len(buffer.rows) == 0 {
+			buffer.first = lsn
+		}
+		if s.rows == 0 {
+			s.oldest = s.now()
+			if s.options.MaxAge > 0 {
+				s.timer = time.AfterFunc(s.options.MaxAge, s.expire)
+			}
+		}
+		buffer.rows = append(buffer.rows, row)
+		buffer.last = lsn
+		s.rows++
+	}
+
+	s.pending = s.pending[:0]
+	s.position = op.Position
+	return nil
+}
+
+// buffer returns the buffer of target in dir that can hold columns of types.
+// A buffer is written first when a column is new or its type changed.
+func (s *parquetSink) buffer(target, dir string, columns, types []string) (*parquetBuffer, error) {
+	key := target + "\x00" + dir
+	buffer, ok := s.buffers[key]
+	if ok {
+		for i, name := range columns {
+			if typ, known := buffer.types[name]; !known || (i < len(types) && typ != types[i]) {
+				if err := s.write(buffer); err != nil {
+					return nil, err
+				}
+				ok = false
+				break
+			}
+		}
+	}
+	if !ok {
+		buffer = &parquetBuffer{target: target, dir: dir, types: make(map[string]string)}
+		s.buffers[key] = buffer
+	}
+
+	for i, name := range columns {
+		if _, ok := buffer.types[name]; !ok {
+			buffer.columns = append(buffer.columns, name)
+			buffer.types[name] = ""
+			if i < len(types) {
+				buffer.types[name] = types[i]
+			}
+		}
+	}
+	return buffer, nil
+}
+
+// expire writes every buffered row once the oldest is old enough. Rows of a
+// transaction still open are not buffered yet.
+func (s *parquetSink) expire() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.err == nil && s.rows > 0 && s.now().Sub(s.oldest) >= s.options.MaxAge {
+		s.err = s.flush()
+	}
+}
+
+// Flush writes every buffered row so the last COMMIT is durable.
+func (s *parquetSink) Flush(ctx context.Context) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+	return s.flush()
+}
+
+func (s *parquetSink) flush() error {
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	for key, buffer := range s.buffers {
+		if err := s.write(buffer); err != nil {
+			return err
+		}
+		delete(s.buffers, key)
+	}
+	s.rows = 0
+	if s.durable != nil && s.position != "" {
+		s.durable(s.position)
+	}
+	return nil
+}
+
+func (s *parquetSink) Close() error { return s.Flush(context.Background()) }
+
+// write writes the rows of buffer to a temporary file and renames it into
+// place.
+func (s *parquetSink) write(buffer *parquetBuffer) error {
+	if len(buffer.rows) == 0 {
+		return nil
+	}
+
+	columns, err := parquetColumns(buffer)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(buffer.dir, 0777); err != nil {
+		return err
+	}
+	// a change of columns may split one transaction across files
+	name := filepath.Join(buffer.dir, fmt.Sprintf("%016X-%016X.parquet", buffer.first, buffer.last))
+	for n := 1; fileExists(name); n++ {
+		name = filepath.Join(buffer.dir, fmt.Sprintf("%016X-%016X-%d.parquet", buffer.first, buffer.last, n))
+	}
+	temporary := filepath.Join(buffer.dir, "."+filepath.Base(name)+".tmp")
+
+	file, err := os.OpenFile(temporary, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(parquetFile(columns, len(buffer.rows)))
+	if err == nil {
+		err = file.Sync()
+	}
+	if e := file.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(temporary, name)
+	}
+	if err == nil {
+		err = syncDir(buffer.dir)
+	}
+	if err != nil {
+		os.Remove(temporary)
+		return err
+	}
+
+	s.rows -= len(buffer.rows)
+	buffer.rows = nil
+	return nil
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if e := d.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// pgParseTimestamp parses the output of a timestamp, with or without a time
+// zone.
+func pgParseTimestamp(s string, zone bool) (time.Time, error) {
+	switch s {
+	case `infinity`:
+		return time.Unix(math.MaxInt64/1000000, 0), nil
+	case `-infinity`:
+		return time.Unix(math.MinInt64/1000000, 0), nil
+	}
+	if !zone {
+		return time.Parse("2006-01-02 15:04:05.999999999", s)
+	}
+
+	t, err := time.Parse("2006-01-02 15:04:05.999999999-07", s)
+	if err != nil {
+		t, err = time.Parse("2006-01-02 15:04:05.999999999-07:00", s)
+	}
+	if err != nil {
+		t, err = time.Parse("2006-01-02 15:04:05.999999999-07:00:00", s)
+	}
+	return t, err
+}
+
+// Parquet physical and converted types.
+const (
+	parquetBoolean   = 0
+	parquetInt32     = 1
+	parquetInt64     = 2
+	parquetFloat     = 4
+	parquetDouble    = 5
+	parquetByteArray = 6
+
+	parquetUTF8            = 0
+	parquetDate            = 6
+	parquetTimestampMicros = 10
+	parquetJSON            = 19
+	parquetNone            = -1
+)
+
+type parquetColumn struct {
+	name      string
+	physical  int32
+	converted int32
+	defined   []bool
+	values    []byte
+	count     int
+}
+
+// parquetType returns the types of columns of the PostgreSQL type typ.
+func parquetType(typ string) (physical, converted int32) {
+	switch typ {
+	case `boolean`:
+		return parquetBoolean, parquetNone
+	case `smallint`, `integer`:
+		return parquetInt32, parquetNone
+	case `bigint`, `oid`:
+		return parquetInt64, parquetNone
+	case `real`:
+		return parquetFloat, parquetNone
+	case `double precision`:
+		return parquetDouble, parquetNone
+	case `date`:
+		return parquetInt32, parquetDate
+	case `timestamp without time zone`, `timestamp with time zone`:
+		return parquetInt64, parquetTimestampMicros
+	case `bytea`:
+		return parquetByteArray, parquetNone
+	case `json`, `jsonb`:
+		return parquetByteArray, parquetJSON
+	}
+	return parquetByteArray, parquetUTF8
+}
+
+// append appends one value in the PLAIN encoding, or nil for null.
+func (c *parquetColumn) append(value *string, typ string) error {
+	c.defined = append(c.defined, value != nil)
+	if value == nil {
+		return nil
+	}
+
+	var err error
+	switch {
+	case c.physical == parquetBoolean:
+		if c.count%8 == 0 {
+			c.values = append(c.values, 0)
+		}
+		if *value == `true` {
+			c.values[len(c.values)-1] |= 1 << uint(c.count%8)
+		}
+	case c.converted == parquetDate:
+		var t time.Time
+		if t, err = time.Parse("2006-01-02", *value); err == nil {
+			c.values = binary.LittleEndian.AppendUint32(c.values, uint32(int32(t.Unix()/86400)))
+		}
+	case c.converted == parquetTimestampMicros:
+		var t time.Time
+		if t, err = pgParseTimestamp(*value, typ == `timestamp with time zone`); err == nil {
+			c.values = binary.LittleEndian.AppendUint64(c.values, uint64(t.Unix()*1e6+int64(t.Nanosecond()/1e3)))
+		}
+	case c.physical == parquetInt32:
+		var n int64
+		if n, err = strconv.ParseInt(*value, 10, 32); err == nil {
+			c.values = binary.LittleEndian.AppendUint32(c.values, uint32(int32(n)))
+		}
+	case c.physical == parquetInt64:
+		var n int64
+		if n, err = strconv.ParseInt(*value, 10, 64); err == nil {
+			c.values = binary.LittleEndian.AppendUint64(c.values, uint64(n))
+		}
+	case c.physical == parquetFloat:
+		var f float64
+		if f, err = strconv.ParseFloat(*value, 32); err == nil {
+			c.values = binary.LittleEndian.AppendUint32(c.values, math.Float32bits(float32(f)))
+		}
+	case c.physical == parquetDouble:
+		var f float64
+		if f, err = strconv.ParseFloat(*value, 64); err == nil {
+			c.values = binary.LittleEndian.AppendUint64(c.values, math.Float64bits(f))
+		}
+	case typ == `bytea`:
+		var data []byte
+		if data, err = hex.DecodeString(strings.TrimPrefix(*value, `\x`)); err == nil {
+			c.values = binary.LittleEndian.AppendUint32(c.values, uint32(len(data)))
+			c.values = append(c.values, data...)
+		}
+	default:
+		c.values = binary.LittleEndian.AppendUint32(c.values, uint32(len(*value)))
+		c.values = append(c.values, *value...)
+	}
+	c.count++
+	return err
+}
+
+// parquetColumns returns the columns of the rows of buffer.
+func parquetColumns(buffer *parquetBuffer) ([]*parquetColumn, error) {
+	var columns []*parquetColumn
+	for _, name := range buffer.columns {
+		physical, converted := parquetType(buffer.types[name])
+		columns = append(columns, &parquetColumn{name: pgUnquoteIdentifier(name), physical: physical, converted: converted})
+	}
+	meta := []*parquetColumn{
+		{name: "_op", physical: parquetByteArray, converted: parquetUTF8},
+		{name: "_lsn", physical: parquetByteArray, converted: parquetUTF8},
+		{name: "_xid", physical: parquetInt64, converted: parquetNone},
+		{name: "_commit_ts", physical: parquetInt64, converted: parquetTimestampMicros},
+	}
+
+	for _, row := range buffer.rows {
+		values := make(map[string]*string, len(row.columns))
+		for i, name := range row.columns {
+			if i < len(row.values) {
+				if value, null := pgUnquoteConstant(row.values[i]); !null && row.values[i] != `` {
+					values[name] = &value
+				}
+			}
+		}
+		for i, name := range buffer.columns {
+			if err := columns[i].append(values[name], buffer.types[name]); err != nil {
+				return nil, errors.Wrapf(err, "Invalid value of %s.%s", buffer.target, name)
+			}
+		}
+
+		var xid, commit *string
+		if row.xid != nil {
+			s := strconv.FormatInt(*row.xid, 10)
+			xid = &s
+		}
+		if row.commit != nil {
+			s := row.commit.Format("2006-01-02 15:04:05.999999999-07:00")
+			commit = &s
+		}
+		meta[0].append(&row.op, ``)
+		meta[1].append(&row.position, ``)
+		meta[2].append(xid, ``)
+		meta[3].append(commit, `timestamp with time zone`)
+	}
+	return append(columns, meta...), nil
+}
+
+// parquetFile returns a file of one row group holding columns, each in one
+// uncompressed data page.
+func parquetFile(columns []*parquetColumn, rows int) []byte {
+	b := []byte("PAR1")
+	offsets := make([]int, len(columns))
+	sizes := make([]int, len(columns))
+
+	for i, c := range columns {
+		// definition levels are one bit-packed run with a length prefix
+		levels := binary.AppendUvarint(nil, uint64((rows+7)/8)<<1|1)
+		for j := 0; j < rows; j += 8 {
+			var packed byte
+			for k := j; k < j+8 && k < rows; k++ {
+				if c.defined[k] {
+					packed |= 1 << uint(k-j)
+				}
+			}
+			levels = append(levels, packed)
+		}
+		data := binary.LittleEndian.AppendUint32(nil, uint32(len(levels)))
+		data = append(append(data, levels...), c.values...)
+
+		var header thriftWriter
+		header.i32(1, 0) // DATA_PAGE
+		header.i32(2, int32(len(data)))
+		header.i32(3, int32(len(data)))
+		header.begin(5)
+		header.i32(1, int32(rows))
+		header.i32(2, 0) // PLAIN
+		header.i32(3, 3) // RLE
+		header.i32(4, 3) // RLE
+		header.end()
+		header.end()
+
+		offsets[i] = len(b)
+		b = append(append(b, header.b...), data...)
+		sizes[i] = len(b) - offsets[i]
+	}
+
+	var meta thriftWriter
+	meta.i32(1, 1)
+	meta.list(2, thriftStruct, len(columns)+1)
+	meta.element()
+	meta.binary(4, "schema")
+	meta.i32(5, int32(len(columns)))
+	meta.end()
+	for _, c := range columns {
+		meta.element()
+		meta.i32(1, c.physical)
+		meta.i32(3, 1) // OPTIONAL
+		meta.binary(4, c.name)
+		if c.converted != parquetNone {
+			meta.i32(6, c.converted)
+		}
+		meta.end()
+	}
+	meta.i64(3, int64(rows))
+	meta.list(4, thriftStruct, 1)
+	meta.element()
+	meta.list(1, thriftStruct, len(columns))
+	total := 0
+	for i, c := range columns {
+		meta.element()
+		meta.i64(2, int64(offsets[i]))
+		meta.begin(3)
+		meta.i32(1, c.physical)
+		meta.list(2, thriftI32, 2)
+		meta.b = thriftAppendInt(meta.b, 0) // PLAIN
+		meta.b = thriftAppendInt(meta.b, 3) // RLE
+		meta.list(3, thriftBinary, 1)
+		meta.b = thriftAppendBinary(meta.b, c.name)
+		meta.i32(4, 0) // UNCOMPRESSED
+		meta.i64(5, int64(rows))
+		meta.i64(6, int64(sizes[i]))
+		meta.i64(7, int64(sizes[i]))
+		meta.i64(9, int64(offsets[i]))
+		meta.end()
+		meta.end()
+		total += sizes[i]
+	}
+	meta.i64(2, int64(total))
+	meta.i64(3, int64(rows))
+	meta.end()
+	meta.binary(6, "pgbarrel")
+	meta.end()
+
+	b = append(b, meta.b...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(meta.b)))
+	return append(b, "PAR1"...)
+}
+
+// Types of the Thrift compact protocol.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// A thriftWriter writes a struct in the Thrift compact protocol.
+type thriftWriter struct {
+	b    []byte
+	last []int16
+}
+
+func (w *thriftWriter) field(id int16, typ byte) {
+	if len(w.last) == 0 {
+		w.last = []int16{0}
+	}
+	last := &w.last[len(w.last)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		w.b = append(w.b, byte(delta)<<4|typ)
+	} else {
+		w.b = thriftAppendInt(append(w.b, typ), int64(id))
+	}
+	*last = id
+}
+
+func (w *thriftWriter) i32(id int16, v int32) {
+	w.field(id, thriftI32)
+	w.b = thriftAppendInt(w.b, int64(v))
+}
+
+func (w *thriftWriter) i64(id int16, v int64) {
+	w.field(id, thriftI64)
+	w.b = thriftAppendInt(w.b, v)
+}
+
+func (w *thriftWriter) binary(id int16, s string) {
+	w.field(id, thriftBinary)
+	w.b = thriftAppendBinary(w.b, s)
+}
+
+// list begins a list of n elements of typ.
+func (w *thriftWriter) list(id int16, typ byte, n int) {
+	w.field(id, thriftList)
+	if n < 15 {
+		w.b = append(w.b, byte(n)<<4|typ)
+	} else {
+		w.b = binary.AppendUvarint(append(w.b, 0xF0|typ), uint64(n))
+	}
+}
+
+// begin begins a struct field; element begins a struct in a list. Each ends
+// with end.
+func (w *thriftWriter) begin(id int16) {
+	w.field(id, thriftStruct)
+	w.element()
+}
+
+func (w *thriftWriter) element() {
+	if len(w.last) == 0 {
+		w.last = []int16{0}
+	}
+	w.last = append(w.last, 0)
+}
+
+func (w *thriftWriter) end() {
+	w.b = append(w.b, 0)
+	if len(w.last) > 0 {
+		w.last = w.last[:len(w.last)-1]
+	}
+}
+
+// thriftAppendInt appends n as a zig-zag varint.
+func thriftAppendInt(b []byte, n int64) []byte {
+	return binary.AppendUvarint(b, uint64(n<<1)^uint64(n>>63))
+}
+
+func thriftAppendBinary(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
@@ -0,0 +1,309 @@
+package pgbarrel
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testThriftRead decodes a struct of the Thrift compact protocol into a map
+// of field IDs to int64, string, []interface{} and map values.
+func testThriftRead(t *testing.T, b []byte) (map[int16]interface{}, int) {
+	var n int
+	varint := func() uint64 {
+		v, size := binary.Uvarint(b[n:])
+		require.True(t, size > 0)
+		n += size
+		return v
+	}
+	zigzag := func() int64 {
+		v := varint()
+		return int64(v>>1) ^ -int64(v&1)
+	}
+
+	var value func(typ byte) interface{}
+	var structure func() map[int16]interface{}
+
+	value = func(typ byte) interface{} {
+		switch typ {
+		case thriftI32, thriftI64:
+			return zigzag()
+		case thriftBinary:
+			size := int(varint())
+			n += size
+			return string(b[n-size : n])
+		case thriftList:
+			header := b[n]
+			n++
+			size := int(header >> 4)
+			if size == 15 {
+				size = int(varint())
+			}
+			list := make([]interface{}, size)
+			for i := range list {
+				list[i] = value(header & 0x0F)
+			}
+			return list
+		case thriftStruct:
+			return structure()
+		}
+		t.Fatalf("Unexpected Thrift type %d", typ)
+		return nil
+	}
+	structure = func() map[int16]interface{} {
+		fields := make(map[int16]interface{})
+		var id int16
+		for {
+			header := b[n]
+			n++
+			if header == 0 {
+				return fields
+			}
+			if delta := int16(header >> 4); delta > 0 {
+				id += delta
+			} else {
+				id = int16(zigzag())
+			}
+			fields[id] = value(header & 0x0F)
+		}
+	}
+
+	return structure(), n
+}
+
+// testReadParquet returns the names and rows of a Parquet file written by
+// parquetFile.
+func testReadParquet(t *testing.T, name string) ([]string, [][]interface{}) {
+	b, err := ioutil.ReadFile(name)
+	require.NoError(t, err)
+	require.Equal(t, "PAR1", string(b[:4]))
+	require.Equal(t, "PAR1", string(b[len(b)-4:]))
+
+	size := int(binary.LittleEndian.Uint32(b[len(b)-8:]))
+	meta, n := testThriftRead(t, b[len(b)-8-size:len(b)-8])
+	require.Equal(t, size, n)
+
+	rows := int(meta[3].(int64))
+	schema := meta[2].([]interface{})
+	chunks := meta[4].([]interface{})[0].(map[int16]interface{})[1].([]interface{})
+	require.Len(t, chunks, len(schema)-1)
+
+	names := make([]string, len(chunks))
+	result := make([][]interface{}, rows)
+	for i := range result {
+		result[i] = make([]interface{}, len(chunks))
+	}
+
+	for i, chunk := range chunks {
+		element := schema[i+1].(map[int16]interface{})
+		names[i] = element[4].(string)
+		column := chunk.(map[int16]interface{})[3].(map[int16]interface{})
+		assert.Equal(t, element[1], column[1])
+		assert.Equal(t, []interface{}{names[i]}, column[3])
+
+		offset := int(column[9].(int64))
+		header, n := testThriftRead(t, b[offset:])
+		data := b[offset+n : offset+n+int(header[3].(int64))]
+		assert.Equal(t, int64(rows), header[5].(map[int16]interface{})[1])
+
+		length := int(binary.LittleEndian.Uint32(data))
+		levels, values := data[5:4+length], data[4+length:]
+		converted, _ := element[6].(int64)
+
+		var count int
+		for row := 0; row < rows; row++ {
+			if levels[row/8]&(1<<uint(row%8)) == 0 {
+				continue
+			}
+			var v interface{}
+			switch element[1].(int64) {
+			case parquetBoolean:
+				v = values[count/8]&(1<<uint(count%8)) != 0
+			case parquetInt32:
+				v = int32(binary.LittleEndian.Uint32(values))
+				values = values[4:]
+			case parquetInt64:
+				v = int64(binary.LittleEndian.Uint64(values))
+				if converted == parquetTimestampMicros {
+					v = time.Unix(0, v.(int64)*1000).UTC()
+				}
+				values = values[8:]
+			case parquetFloat:
+				v = math.Float32frombits(binary.LittleEndian.Uint32(values))
+				values = values[4:]
+			case parquetDouble:
+				v = math.Float64frombits(binary.LittleEndian.Uint64(values))
+				values = values[8:]
+			case parquetByteArray:
+				length := int(binary.LittleEndian.Uint32(values))
+				v = string(values[4 : 4+length])
+				values = values[4+length:]
+			}
+			result[row][i] = v
+			count++
+		}
+	}
+	return names, result
+}
+
+func testParquetFiles(t *testing.T, dir string) []string {
+	var files []string
+	require.NoError(t, filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			files = append(files, path[len(dir)+1:])
+		}
+		return err
+	}))
+	sort.Strings(files)
+	return files
+}
+
+func TestParquetSink(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "pgbarrel")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s := NewParquetSink(ParquetOptions{Dir: dir, MaxRows: 3})
+	s.now = func() time.Time { return time.Date(2017, 5, 1, 9, 30, 0, 0, time.UTC) }
+
+	var durable []string
+	s.OnDurable(func(position string) { durable = append(durable, position) })
+
+	for _, op := range []*ReplicationOperation{
+		{Position: `0/10`, Operation: `BEGIN`, Target: `553`},
+		{Position: `0/10`, Operation: `INSERT`, Target: `public.t`,
+			NewColumns: []string{`id`, `"Name"`, `ok`, `at`, `bin`},
+			NewValues:  []string{`1`, `'a'`, `true`, `'2017-05-01 12:00:00.5+00'`, `'\x0102'`},
+			NewTypes:   []string{`integer`, `text`, `boolean`, `timestamp with time zone`, `bytea`}},
+		{Position: `0/10`, Operation: `UPDATE`, Target: `public.t`,
+			NewColumns: []string{`id`, `"Name"`, `ok`, `at`, `bin`},
+			NewValues:  []string{`1`, `null`, `false`, `null`, `null`},
+			NewTypes:   []string{`integer`, `text`, `boolean`, `timestamp with time zone`, `bytea`}},
+		{Position: `0/18`, Operation: `COMMIT`, Target: `553 (at 2017-05-01 12:00:01+00)`},
+	} {
+		require.NoError(t, s.Write(ctx, op))
+	}
+	assert.Empty(t, testParquetFiles(t, dir), "Expected rows to be buffered")
+
+	for _, op := range []*ReplicationOperation{
+		{Position: `0/20`, Operation: `BEGIN`, Target: `554`},
+		{Position: `0/20`, Operation: `DELETE`, Target: `public.t`,
+			OldColumns: []string{`id`}, OldValues: []string{`1`}, OldTypes: []string{`integer`}},
+		{Position: `0/20`, Operation: `INSERT`, Target: `public.u`,
+			NewColumns: []string{`f`}, NewValues: []string{`1.5`}, NewTypes: []string{`double precision`}},
+		{Position: `0/28`, Operation: `COMMIT`, Target: `554`},
+	} {
+		require.NoError(t, s.Write(ctx, op))
+	}
+	assert.Equal(t, []string{`0/28`}, durable)
+
+	assert.Equal(t, []string{
+		"public.t/2017-05-01/09/0000000000000028-0000000000000028.parquet",
+		"public.t/2017-05-01/12/0000000000000018-0000000000000018.parquet",
+		"public.u/2017-05-01/09/0000000000000028-0000000000000028.parquet",
+	}, testParquetFiles(t, dir))
+
+	names, rows := testReadParquet(t, filepath.Join(dir, "public.t/2017-05-01/12/0000000000000018-0000000000000018.parquet"))
+	assert.Equal(t, []string{`id`, `Name`, `ok`, `at`, `bin`, `_op`, `_lsn`, `_xid`, `_commit_ts`}, names)
+	assert.Equal(t, [][]interface{}{
+		{int32(1), `a`, true, time.Date(2017, 5, 1, 12, 0, 0, 5e8, time.UTC), "\x01\x02",
+			`INSERT`, `0/10`, int64(553), time.Date(2017, 5, 1, 12, 0, 1, 0, time.UTC)},
+		{int32(1), nil, false, nil, nil,
+			`UPDATE`, `0/10`, int64(553), time.Date(2017, 5, 1, 12, 0, 1, 0, time.UTC)},
+	}, rows)
+
+	names, rows = testReadParquet(t, filepath.Join(dir, "public.t/2017-05-01/09/0000000000000028-0000000000000028.parquet"))
+	assert.Equal(t, []string{`id`, `_op`, `_lsn`, `_xid`, `_commit_ts`}, names)
+	assert.Equal(t, [][]interface{}{{int32(1), `DELETE`, `0/20`, int64(554), nil}}, rows)
+
+	_, rows = testReadParquet(t, filepath.Join(dir, "public.u/2017-05-01/09/0000000000000028-0000000000000028.parquet"))
+	assert.Equal(t, [][]interface{}{{1.5, `INSERT`, `0/20`, int64(554), nil}}, rows)
+
+	t.Run("Columns", func(t *testing.T) {
+		for _, op := range []*ReplicationOperation{
+			{Position: `0/30`, Operation: `BEGIN`, Target: `555`},
+			{Position: `0/30`, Operation: `INSERT`, Target: `public.v`,
+				NewColumns: []string{`id`}, NewValues: []string{`1`}, NewTypes: []string{`integer`}},
+			{Position: `0/30`, Operation: `INSERT`, Target: `public.v`,
+				NewColumns: []string{`id`}, NewValues: []string{`2`}, NewTypes: []string{`bigint`}},
+			{Position: `0/38`, Operation: `COMMIT`, Target: `555`},
+		} {
+			require.NoError(t, s.Write(ctx, op))
+		}
+		require.NoError(t, s.Flush(ctx))
+		assert.Equal(t, []string{`0/28`, `0/38`}, durable)
+
+		var files []string
+		for _, file := range testParquetFiles(t, dir) {
+			if filepath.Dir(filepath.Dir(filepath.Dir(file))) == "public.v" {
+				files = append(files, filepath.Base(file))
+			}
+		}
+		assert.Equal(t, []string{
+			"0000000000000038-0000000000000038-1.parquet",
+			"0000000000000038-0000000000000038.parquet",
+		}, files, "Expected a file for each type of id")
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		for _, op := range []*ReplicationOperation{
+			{Position: `0/40`, Operation: `BEGIN`, Target: `556`},
+			{Position: `0/40`, Operation: `INSERT`, Target: `public.w`,
+				NewColumns: []string{`id`}, NewValues: []string{`'x'`}, NewTypes: []string{`integer`}},
+			{Position: `0/48`, Operation: `COMMIT`, Target: `556`},
+		} {
+			require.NoError(t, s.Write(ctx, op))
+		}
+		err := s.Flush(ctx)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "public.w.id")
+		assert.Equal(t, []string{`0/28`, `0/38`}, durable)
+	})
+}
+
+func TestParquetSinkAge(t *testing.T) {
+	dir := t.TempDir()
+
+	s := NewParquetSink(ParquetOptions{Dir: dir, MaxAge: 20 * time.Millisecond})
+	assert.Equal(t, time.Minute, NewParquetSink(ParquetOptions{}).options.MaxAge, "Expected a default age")
+
+	var mutex sync.Mutex
+	var durable []string
+	s.OnDurable(func(position string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		durable = append(durable, position)
+	})
+	durables := func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]string(nil), durable...)
+	}
+
+	ctx := context.Background()
+	for _, op := range []*ReplicationOperation{
+		{Position: `0/10`, Operation: `BEGIN`, Target: `553`},
+		{Position: `0/10`, Operation: `INSERT`, Target: `public.t`,
+			NewColumns: []string{`id`}, NewValues: []string{`1`}, NewTypes: []string{`integer`}},
+		{Position: `0/18`, Operation: `COMMIT`, Target: `553`},
+	} {
+		require.NoError(t, s.Write(ctx, op))
+	}
+	assert.Empty(t, durables(), "Expected rows to be buffered")
+
+	assert.Eventually(t, func() bool { return len(durables()) == 1 }, time.Second, 5*time.Millisecond,
+		"Expected the rows to be written by age without another COMMIT")
+	assert.Equal(t, []string{`0/18`}, durables())
+	assert.Len(t, testParquetFiles(t, dir), 1)
+}
@@ -0,0 +1,270 @@
+package pgbarrel
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// A Source produces operations until ctx is done or it fails. The receiver
+// returned by NewPostgreSQLReceiver is a Source.
+type Source interface {
+	Start(ctx context.Context, out chan<- *ReplicationOperation) error
+	Acknowledge(position string) error
+}
+
+// A Sink writes operations, including BEGIN and COMMIT, to a target. Unless
+// it is a BufferedSink, an operation is durable once Write returns.
+type Sink interface {
+	Write(ctx context.Context, op *ReplicationOperation) error
+}
+
+// A BufferedSink holds operations after Write returns. It calls the function
+// passed to OnDurable with the position of each COMMIT once that transaction
+// is durable, and makes everything written so far durable during Flush.
+type BufferedSink interface {
+	Sink
+	OnDurable(func(position string))
+	Flush(ctx context.Context) error
+}
+
+// A Transformer changes the operations passing through a Pipeline. It calls
+// emit for each operation that should continue: never to drop op, once with
+// op or a replacement to change it, or more than once to split it.
+type Transformer interface {
+	Transform(ctx context.Context, op *ReplicationOperation, emit func(*ReplicationOperation) error) error
+}
+
+// TransformerFunc adapts a function to the Transformer interface.
+type TransformerFunc func(ctx context.Context, op *ReplicationOperation, emit func(*ReplicationOperation) error) error
+
+func (f TransformerFunc) Transform(ctx context.Context, op *ReplicationOperation, emit func(*ReplicationOperation) error) error {
+	return f(ctx, op, emit)
+}
+
+func (f *RowFilter) Transform(ctx context.Context, op *ReplicationOperation, emit func(*ReplicationOperation) error) error {
+	pass, before := f.filter(op)
+	if before != nil {
+		if err := emit(before); err != nil {
+			return err
+		}
+	}
+	if pass {
+		return emit(op)
+	}
+	return nil
+}
+
+func (f TableFilter) Transform(ctx context.Context, op *ReplicationOperation, emit func(*ReplicationOperation) error) error {
+	if f.Filter(op) {
+		return emit(op)
+	}
+	return nil
+}
+
+func (m ColumnMasks) Transform(ctx context.Context, op *ReplicationOperation, emit func(*ReplicationOperation) error) error {
+	if err := m.Apply(op); err != nil {
+		return err
+	}
+	return emit(op)
+}
+
+// A Pipeline carries operations from a Source through Transformers, in order,
+// to a Sink. It acknowledges each COMMIT to the Source once the Sink reports
+// it durable.
+type Pipeline struct {
+	source     Source
+	transforms []Transformer
+	sink       Sink
+
+	metrics *Metrics
+	tracer  *Tracer
+	log     Logger
+	closers []io.Closer
+
+	// work done alongside the stream, such as copying tables again
+	background []func(context.Context) error
+}
+
+func NewPipeline(source Source, sink Sink, transforms ...Transformer) *Pipeline {
+	return &Pipeline{source: source, sink: sink, transforms: transforms}
+}
+
+// Then appends transforms to p.
+func (p *Pipeline) Then(transforms ...Transformer) *Pipeline {
+	p.transforms = append(p.transforms, transforms...)
+	return p
+}
+
+// SetMetrics counts the operations p writes, and how long the Sink takes, in
+// m. A Source with a SetMetrics method counts what it receives in m too, and
+// a Sink with a Ping method reports whether its target is reachable.
+func (p *Pipeline) SetMetrics(m *Metrics) *Pipeline {
+	p.metrics = m
+	if source, ok := p.source.(interface{ SetMetrics(*Metrics) }); ok {
+		source.SetMetrics(m)
+	}
+	if sink, ok := p.sink.(interface{ Ping(context.Context) error }); ok && m != nil {
+		m.ping = sink.Ping
+	}
+	return p
+}
+
+// SetTracer makes a trace of each transaction p writes with t. A Source with
+// a SetTracer method adds the time it spent receiving each transaction.
+func (p *Pipeline) SetTracer(t *Tracer) *Pipeline {
+	p.tracer = t
+	if source, ok := p.source.(interface{ SetTracer(*Tracer) }); ok {
+		source.SetTracer(t)
+	}
+	return p
+}
+
+// SetLogger records the failure of p in l. A Source or Sink with a SetLogger
+// method records its events in l too.
+func (p *Pipeline) SetLogger(l Logger) *Pipeline {
+	p.log = l
+	if source, ok := p.source.(interface{ SetLogger(Logger) }); ok {
+		source.SetLogger(l)
+	}
+	if sink, ok := p.sink.(interface{ SetLogger(Logger) }); ok {
+		sink.SetLogger(l)
+	}
+	return p
+}
+
+// Close releases the connections and files of a Pipeline built from a Config.
+func (p *Pipeline) Close() error {
+	var first error
+	for i := len(p.closers) - 1; i >= 0; i-- {
+		if err := p.closers[i].Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	p.closers = nil
+	return first
+}
+
+// Run carries operations until ctx is done or any stage fails. When ctx is
+// done, operations already received are written and a BufferedSink is flushed
+// before Run returns the error of ctx.
+func (p *Pipeline) Run(ctx context.Context) error {
+	err := p.run(ctx)
+	if err != nil && ctx.Err() == nil {
+		p.metrics.fail(err)
+		orDiscard(p.log).Error("Pipeline failed", "error", err)
+	}
+	return err
+}
+
+func (p *Pipeline) run(ctx context.Context) error {
+	var (
+		mutex sync.Mutex
+		first error
+	)
+
+	fail := func(err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if first == nil {
+			first = err
+		}
+	}
+	failure := func() error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return first
+	}
+
+	acknowledge := func(position string) {
+		if err := p.source.Acknowledge(position); err != nil {
+			fail(err)
+		} else {
+			p.metrics.acknowledge(position)
+		}
+	}
+
+	buffered, isBuffered := p.sink.(BufferedSink)
+	if isBuffered {
+		buffered.OnDurable(acknowledge)
+	}
+
+	// operations already received are written even after ctx is done
+	sourceCtx, cancel := context.WithCancel(ctx)
+	writeCtx := context.WithoutCancel(ctx)
+	defer cancel()
+
+	ops := make(chan *ReplicationOperation, 100)
+	done := make(chan error, 1)
+
+	go func() {
+		defer close(ops)
+		done <- p.source.Start(sourceCtx, ops)
+	}()
+
+	for _, work := range p.background {
+		go func(work func(context.Context) error) {
+			if err := work(sourceCtx); err != nil && sourceCtx.Err() == nil {
+				fail(err)
+				cancel()
+			}
+		}(work)
+	}
+
+	var emit func(int) func(*ReplicationOperation) error
+	emit = func(i int) func(*ReplicationOperation) error {
+		if i < len(p.transforms) {
+			return func(op *ReplicationOperation) error {
+				return p.transforms[i].Transform(ctx, op, emit(i+1))
+			}
+		}
+		return func(op *ReplicationOperation) error {
+			start := time.Now()
+			err := p.sink.Write(writeCtx, op)
+			p.tracer.apply(op, start, err)
+			if err != nil {
+				return err
+			}
+			p.metrics.apply(op, time.Since(start))
+			if !isBuffered && op.Operation == `COMMIT` {
+				acknowledge(op.Position)
+			}
+			return nil
+		}
+	}
+	head := emit(0)
+
+	// keep receiving after a failure so the source can stop
+	for op := range ops {
+		if failure() == nil {
+			start := time.Now()
+			err := head(op)
+			if err != nil {
+				fail(err)
+			}
+			if err = p.tracer.run(writeCtx, op, start, err); err != nil {
+				orDiscard(p.log).Warn("Failed to export spans", "lsn", op.Position, "error", err)
+			}
+		}
+		if failure() != nil {
+			cancel()
+		}
+	}
+
+	err := <-done
+	if first := failure(); first != nil {
+		return first
+	}
+
+	if isBuffered {
+		if err := buffered.Flush(writeCtx); err != nil {
+			return err
+		}
+	}
+	if first := failure(); first != nil {
+		return first
+	}
+
+	return err
+}
@@ -0,0 +1,195 @@
+package pgbarrel
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testSource struct {
+	ops []*ReplicationOperation
+
+	mutex sync.Mutex
+	acks  []string
+}
+
+func (s *testSource) Start(ctx context.Context, out chan<- *ReplicationOperation) error {
+	for _, op := range s.ops {
+		out <- op
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (s *testSource) Acknowledge(position string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.acks = append(s.acks, position)
+	return nil
+}
+
+func (s *testSource) acknowledged() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.acks...)
+}
+
+type testSink struct {
+	ops   []ReplicationOperation
+	write func(*ReplicationOperation) error
+}
+
+func (s *testSink) Write(ctx context.Context, op *ReplicationOperation) error {
+	s.ops = append(s.ops, *op)
+	if s.write != nil {
+		return s.write(op)
+	}
+	return nil
+}
+
+type testBufferedSink struct {
+	testSink
+	durable func(string)
+	pending []string
+	flushes int
+}
+
+func (s *testBufferedSink) OnDurable(f func(string)) { s.durable = f }
+
+func (s *testBufferedSink) Write(ctx context.Context, op *ReplicationOperation) error {
+	if op.Operation == `COMMIT` {
+		s.pending = append(s.pending, op.Position)
+	}
+	return s.testSink.Write(ctx, op)
+}
+
+func (s *testBufferedSink) Flush(ctx context.Context) error {
+	for _, position := range s.pending {
+		s.durable(position)
+	}
+	s.pending = nil
+	s.flushes++
+	return nil
+}
+
+func testTransaction(position string, ops ...*ReplicationOperation) []*ReplicationOperation {
+	result := []*ReplicationOperation{{Position: position, Operation: `BEGIN`}}
+	for _, op := range ops {
+		op.Position = position
+		result = append(result, op)
+	}
+	return append(result, &ReplicationOperation{Position: position, Operation: `COMMIT`})
+}
+
+func TestPipeline(t *testing.T) {
+	source := &testSource{}
+	source.ops = append(source.ops, testTransaction(`0/10`,
+		&ReplicationOperation{Operation: `INSERT`, Target: `a`},
+		&ReplicationOperation{Operation: `DELETE`, Target: `a`})...)
+	source.ops = append(source.ops, testTransaction(`0/20`,
+		&ReplicationOperation{Operation: `UPDATE`, Target: `b`})...)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sink := &testSink{}
+	sink.write = func(*ReplicationOperation) error {
+		if len(sink.ops) == 7 {
+			// every operation is written
+			cancel()
+		}
+		return nil
+	}
+
+	drop := TransformerFunc(func(ctx context.Context, op *ReplicationOperation, emit func(*ReplicationOperation) error) error {
+		if op.Operation == `DELETE` {
+			return nil
+		}
+		return emit(op)
+	})
+	change := TransformerFunc(func(ctx context.Context, op *ReplicationOperation, emit func(*ReplicationOperation) error) error {
+		op.Target = op.Target + op.Target
+		return emit(op)
+	})
+	split := TransformerFunc(func(ctx context.Context, op *ReplicationOperation, emit func(*ReplicationOperation) error) error {
+		if op.Operation == `UPDATE` {
+			if err := emit(&ReplicationOperation{Position: op.Position, Operation: `DELETE`, Target: op.Target}); err != nil {
+				return err
+			}
+			return emit(&ReplicationOperation{Position: op.Position, Operation: `INSERT`, Target: op.Target})
+		}
+		return emit(op)
+	})
+
+	err := NewPipeline(source, sink, drop).Then(change, split).Run(ctx)
+	assert.Equal(t, context.Canceled, err)
+
+	var written []string
+	for _, op := range sink.ops {
+		written = append(written, op.Position+` `+op.Operation+` `+op.Target)
+	}
+	assert.Equal(t, []string{
+		`0/10 BEGIN `, `0/10 INSERT aa`, `0/10 COMMIT `,
+		`0/20 BEGIN `, `0/20 DELETE bb`, `0/20 INSERT bb`, `0/20 COMMIT `,
+	}, written)
+	assert.Equal(t, []string{`0/10`, `0/20`}, source.acknowledged())
+}
+
+func TestPipelineError(t *testing.T) {
+	expected := errors.New(`boom`)
+	source := &testSource{ops: testTransaction(`0/10`,
+		&ReplicationOperation{Operation: `INSERT`},
+		&ReplicationOperation{Operation: `INSERT`})}
+
+	for _, pipeline := range []*Pipeline{
+		NewPipeline(source, &testSink{}, TransformerFunc(
+			func(ctx context.Context, op *ReplicationOperation, emit func(*ReplicationOperation) error) error {
+				if op.Operation == `INSERT` {
+					return expected
+				}
+				return emit(op)
+			})),
+		NewPipeline(source, &testSink{write: func(op *ReplicationOperation) error {
+			if op.Operation == `INSERT` {
+				return expected
+			}
+			return nil
+		}}),
+	} {
+		assert.Equal(t, expected, pipeline.Run(context.Background()))
+	}
+	assert.Empty(t, source.acknowledged())
+
+	background := NewPipeline(&testSource{}, &testSink{})
+	background.background = append(background.background, func(context.Context) error { return expected })
+	assert.Equal(t, expected, background.Run(context.Background()), "Expected background work to stop the Pipeline")
+}
+
+func TestPipelineBufferedSink(t *testing.T) {
+	source := &testSource{}
+	source.ops = append(source.ops, testTransaction(`0/10`)...)
+	source.ops = append(source.ops, testTransaction(`0/20`)...)
+	source.ops = append(source.ops, testTransaction(`0/30`)...)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sink := &testBufferedSink{}
+	sink.write = func(op *ReplicationOperation) error {
+		if op.Position == `0/20` && op.Operation == `COMMIT` {
+			// durable in the middle of the stream
+			assert.NoError(t, sink.Flush(ctx))
+		}
+		if len(sink.ops) == len(source.ops) {
+			cancel()
+		}
+		return nil
+	}
+
+	assert.Equal(t, context.Canceled, NewPipeline(source, sink).Run(ctx))
+	assert.Equal(t, 2, sink.flushes)
+	assert.Equal(t, []string{`0/10`, `0/20`, `0/30`}, source.acknowledged())
+}
@@ -0,0 +1,179 @@
+package pgbarrel
+
+import (
+	"context"
+
+	"github.com/jackc/pgx"
+)
+
+// Logical decoding does not include DDL. An event trigger installed by
+// InstallPostgreSQLDDLCapture records each DDL command into a table on the
+// source; the rows of that table then appear in the stream in commit order
+// with the DML around them, and pgDDLCapture turns them into DDL operations.
+//
+// PostgreSQL does not give event triggers the text of each command, so the
+// command recorded is the whole statement sent by the client. It is recorded
+// once, though the triggers fire for each command in it; when the statement
+// also holds DML, replaying it repeats that DML.
+
+const pgDDLCaptureTable = `ddl_log`
+
+type pgDDLCapture struct {
+	target string
+}
+
+// InstallPostgreSQLDDLCapture creates the capture table and event triggers in
+// schema. DDL on objects in schema itself is not recorded. Event triggers can
+// only be created by a superuser.
+func InstallPostgreSQLDDLCapture(conn *pgx.Conn, schema string) error {
+	quoted := pgx.Identifier{schema}.Sanitize()
+	literal := pgQuoteLiteral(schema)
+
+	for _, sql := range []string{
+		`CREATE SCHEMA IF NOT EXISTS ` + quoted,
+		`CREATE TABLE IF NOT EXISTS ` + quoted + `.` + pgDDLCaptureTable + ` (
+			id              bigserial PRIMARY KEY,
+			command_tag     text NOT NULL,
+			object_identity text,
+			command         text NOT NULL,
+			executed_at     timestamptz NOT NULL DEFAULT now()
+		)`,
+
+		// A statement is recorded once in a transaction, by the time it was
+		// received and its text.
+		`CREATE OR REPLACE FUNCTION ` + quoted + `.capture_statement() RETURNS boolean
+		LANGUAGE plpgsql AS $$
+		DECLARE
+			received text := statement_timestamp()::text || ' ' || current_query();
+		BEGIN
+			IF current_setting('pgbarrel.captured_statement', true) IS NOT DISTINCT FROM received THEN
+				RETURN false;
+			END IF;
+			PERFORM set_config('pgbarrel.captured_statement', received, true);
+			RETURN true;
+		END $$`,
+
+		`CREATE OR REPLACE FUNCTION ` + quoted + `.capture_ddl() RETURNS event_trigger
+		LANGUAGE plpgsql AS $$
+		BEGIN
+			IF EXISTS (SELECT FROM pg_event_trigger_ddl_commands() WHERE schema_name IS DISTINCT FROM ` + literal + `) THEN
+				IF ` + quoted + `.capture_statement() THEN
+					INSERT INTO ` + quoted + `.` + pgDDLCaptureTable + ` (command_tag, object_identity, command)
+					SELECT tg_tag, string_agg(object_identity, ', '), current_query() FROM pg_event_trigger_ddl_commands();
+				END IF;
+			END IF;
+		END $$`,
+
+		`CREATE OR REPLACE FUNCTION ` + quoted + `.capture_drop() RETURNS event_trigger
+		LANGUAGE plpgsql AS $$
+		BEGIN
+			IF EXISTS (SELECT FROM pg_event_trigger_dropped_objects() WHERE original AND schema_name IS DISTINCT FROM ` + literal + `) THEN
+				IF ` + quoted + `.capture_statement() THEN
+					INSERT INTO ` + quoted + `.` + pgDDLCaptureTable + ` (command_tag, object_identity, command)
+					SELECT tg_tag, string_agg(object_identity, ', '), current_query() FROM pg_event_trigger_dropped_objects() WHERE original;
+				END IF;
+			END IF;
+		END $$`,
+
+		`DROP EVENT TRIGGER IF EXISTS pgbarrel_capture_ddl`,
+		`DROP EVENT TRIGGER IF EXISTS pgbarrel_capture_drop`,
+		`CREATE EVENT TRIGGER pgbarrel_capture_ddl ON ddl_command_end EXECUTE PROCEDURE ` + quoted + `.capture_ddl()`,
+		`CREATE EVENT TRIGGER pgbarrel_capture_drop ON sql_drop EXECUTE PROCEDURE ` + quoted + `.capture_drop()`,
+	} {
+		if _, err := conn.Exec(sql); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// UninstallPostgreSQLDDLCapture removes the event triggers and everything in
+// schema created by InstallPostgreSQLDDLCapture.
+func UninstallPostgreSQLDDLCapture(conn *pgx.Conn, schema string) error {
+	quoted := pgx.Identifier{schema}.Sanitize()
+
+	for _, sql := range []string{
+		`DROP EVENT TRIGGER IF EXISTS pgbarrel_capture_ddl`,
+		`DROP EVENT TRIGGER IF EXISTS pgbarrel_capture_drop`,
+		`DROP FUNCTION IF EXISTS ` + quoted + `.capture_ddl()`,
+		`DROP FUNCTION IF EXISTS ` + quoted + `.capture_drop()`,
+		`DROP FUNCTION IF EXISTS ` + quoted + `.capture_statement()`,
+		`DROP TABLE IF EXISTS ` + quoted + `.` + pgDDLCaptureTable,
+	} {
+		if _, err := conn.Exec(sql); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// NewPostgreSQLDDLCapture returns a Transformer that turns each row inserted
+// into the capture table in schema into an operation with Operation "DDL",
+// Target the identities of the affected objects, and the command tag and
+// command as its new values. Other changes to the capture table are dropped.
+func NewPostgreSQLDDLCapture(schema string) *pgDDLCapture {
+	return &pgDDLCapture{target: pgQuoteIdentifier(schema) + `.` + pgDDLCaptureTable}
+}
+
+func (c *pgDDLCapture) Transform(ctx context.Context, op *ReplicationOperation, emit func(*ReplicationOperation) error) error {
+	if op.Target != c.target {
+		return emit(op)
+	}
+	if op.Operation != `INSERT` {
+		return nil
+	}
+
+	ddl := ReplicationOperation{
+		Position:   op.Position,
+		Operation:  `DDL`,
+		NewColumns: []string{`command_tag`, `command`},
+		NewValues:  []string{`null`, `null`},
+		NewTypes:   []string{`text`, `text`},
+	}
+
+	for i, column := range op.NewColumns {
+		switch column {
+		case `command_tag`:
+			ddl.NewValues[0] = op.NewValues[i]
+		case `command`:
+			ddl.NewValues[1] = op.NewValues[i]
+		case `object_identity`:
+			ddl.Target, _ = pgUnquoteConstant(op.NewValues[i])
+		}
+	}
+
+	return emit(&ddl)
+}
+
+// DDLCommand returns the command of a DDL operation.
+func DDLCommand(op *ReplicationOperation) (command string, ok bool) {
+	if op.Operation != `DDL` {
+		return ``, false
+	}
+	for i, column := range op.NewColumns {
+		if column == `command` {
+			command, null := pgUnquoteConstant(op.NewValues[i])
+			return command, !null
+		}
+	}
+	return ``, false
+}
+
+// A DDLApproval holds each DDL operation until approve decides it. Approved
+// operations continue, rejected ones are dropped. Everything after a held
+// operation waits with it, so DDL and DML stay in order.
+type DDLApproval func(ctx context.Context, op *ReplicationOperation) (bool, error)
+
+func (approve DDLApproval) Transform(ctx context.Context, op *ReplicationOperation, emit func(*ReplicationOperation) error) error {
+	if op.Operation != `DDL` {
+		return emit(op)
+	}
+
+	ok, err := approve(ctx, op)
+	if err != nil || !ok {
+		return err
+	}
+	return emit(op)
+}
@@ -0,0 +1,143 @@
+package pgbarrel
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPostgreSQLDDLCaptureTransform(t *testing.T) {
+	capture := NewPostgreSQLDDLCapture(`pgbarrel`)
+
+	var emitted []*ReplicationOperation
+	emit := func(op *ReplicationOperation) error {
+		emitted = append(emitted, op)
+		return nil
+	}
+
+	for _, op := range []*ReplicationOperation{
+		{Operation: `INSERT`, Target: `public.normal`},
+		{Position: `0/10`, Operation: `INSERT`, Target: `pgbarrel.ddl_log`,
+			NewColumns: []string{`id`, `command_tag`, `object_identity`, `command`, `executed_at`},
+			NewValues:  []string{`1`, `'ALTER TABLE'`, `'public.normal'`, `'ALTER TABLE normal ADD note text'`, `'2017-06-27 12:00:00+00'`},
+			NewTypes:   []string{`bigint`, `text`, `text`, `text`, `timestamp with time zone`}},
+		{Operation: `DELETE`, Target: `pgbarrel.ddl_log`, OldColumns: []string{`id`}, OldValues: []string{`1`}},
+	} {
+		assert.NoError(t, capture.Transform(context.Background(), op, emit))
+	}
+
+	require.Len(t, emitted, 2)
+	assert.Equal(t, `public.normal`, emitted[0].Target)
+	assert.Equal(t, ReplicationOperation{
+		Position: `0/10`, Operation: `DDL`, Target: `public.normal`,
+		NewColumns: []string{`command_tag`, `command`},
+		NewValues:  []string{`'ALTER TABLE'`, `'ALTER TABLE normal ADD note text'`},
+		NewTypes:   []string{`text`, `text`},
+	}, *emitted[1])
+
+	command, ok := DDLCommand(emitted[1])
+	assert.True(t, ok)
+	assert.Equal(t, `ALTER TABLE normal ADD note text`, command)
+
+	_, ok = DDLCommand(emitted[0])
+	assert.False(t, ok)
+}
+
+func TestDDLApproval(t *testing.T) {
+	var emitted []string
+	emit := func(op *ReplicationOperation) error {
+		emitted = append(emitted, op.Target)
+		return nil
+	}
+
+	expected := errors.New(`stop`)
+	approval := DDLApproval(func(ctx context.Context, op *ReplicationOperation) (bool, error) {
+		switch op.Target {
+		case `approved`:
+			return true, nil
+		case `failed`:
+			return false, expected
+		}
+		return false, nil
+	})
+
+	assert.NoError(t, approval.Transform(context.Background(), &ReplicationOperation{Operation: `INSERT`, Target: `dml`}, emit))
+	assert.NoError(t, approval.Transform(context.Background(), &ReplicationOperation{Operation: `DDL`, Target: `approved`}, emit))
+	assert.NoError(t, approval.Transform(context.Background(), &ReplicationOperation{Operation: `DDL`, Target: `rejected`}, emit))
+	assert.Equal(t, expected, approval.Transform(context.Background(), &ReplicationOperation{Operation: `DDL`, Target: `failed`}, emit))
+	assert.Equal(t, []string{`dml`, `approved`}, emitted)
+}
+
+func TestPostgreSQLDDLCapture(t *testing.T) {
+	s := new(pgserver)
+	s.start(t)
+	defer s.stop(t)
+
+	func() {
+		c := s.mustConnect(t, "postgres")
+		defer c.Close()
+		_, err := c.Exec(`CREATE DATABASE pgbarrel`)
+		require.NoError(t, err)
+	}()
+
+	c := s.mustConnect(t, "pgbarrel")
+	defer c.Close()
+
+	require.NoError(t, InstallPostgreSQLDDLCapture(c, "pgbarrel"))
+	for _, sql := range []string{
+		`CREATE TABLE normal (id int PRIMARY KEY, value text)`,
+		`SELECT pg_create_logical_replication_slot('pgbarrel_test', 'test_decoding')`,
+		`INSERT INTO normal (id, value) VALUES (1, 'a')`,
+		`ALTER TABLE normal ADD COLUMN note text`,
+		`INSERT INTO normal (id, value, note) VALUES (2, 'b', 'c')`,
+		`ALTER TABLE normal DROP COLUMN note`,
+		`CREATE INDEX a ON normal (value); CREATE INDEX b ON normal (id, value)`,
+		`DROP TABLE normal`,
+	} {
+		_, err := c.Exec(sql)
+		require.NoError(t, err, sql)
+	}
+
+	r, err := NewPostgreSQLReceiver("host="+s.directory+" dbname=pgbarrel", "pgbarrel_test", "test_decoding", "")
+	require.NoError(t, err)
+	defer r.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	sink := &testSink{}
+	assert.Equal(t, context.DeadlineExceeded,
+		NewPipeline(r, sink, NewPostgreSQLDDLCapture("pgbarrel")).Run(ctx))
+
+	var ops []string
+	for _, op := range sink.ops {
+		if op.Operation != `BEGIN` && op.Operation != `COMMIT` {
+			ops = append(ops, op.Operation+` `+op.Target)
+		}
+	}
+	assert.Equal(t, []string{
+		`INSERT public.normal`,
+		`DDL public.normal`,
+		`INSERT public.normal`,
+		`DDL public.normal.note`,
+		`DDL public.a`,
+		`DDL public.normal`,
+	}, ops)
+
+	var commands []string
+	for _, op := range sink.ops {
+		if command, ok := DDLCommand(&op); ok {
+			commands = append(commands, command)
+		}
+	}
+	assert.Equal(t, []string{
+		`ALTER TABLE normal ADD COLUMN note text`,
+		`ALTER TABLE normal DROP COLUMN note`,
+		`CREATE INDEX a ON normal (value); CREATE INDEX b ON normal (id, value)`,
+		`DROP TABLE normal`,
+	}, commands, "Expected each statement once")
+}
@@ -2,8 +2,11 @@ package pgbarrel
 
 import (
 	"bytes"
+	"strings"
 	"unicode"
 	"unicode/utf8"
+
+	"github.com/pkg/errors"
 )
 
 type pgDecode func([]byte, *ReplicationOperation) error
@@ -12,6 +15,15 @@ var pgDecoders = map[string]pgDecode{
 	"test_decoding": pgTestDecoding{}.Parse,
 }
 
+// Decode parses one message of a PostgreSQL logical decoding output plugin.
+func Decode(plugin string, message []byte, op *ReplicationOperation) error {
+	decode, ok := pgDecoders[plugin]
+	if !ok {
+		return errors.Errorf("Unknown PostgreSQL logical decoding output plugin: %q", plugin)
+	}
+	return decode(message, op)
+}
+
 func pgIsIdentifier(c rune) bool {
 	// https://www.postgresql.org/docs/current/static/sql-syntax-lexical.html#SQL-SYNTAX-IDENTIFIERS
 	return ('0' <= c && c <= '9') || (c == '$') || (c == '_') || unicode.IsLetter(c)
@@ -57,22 +69,29 @@ func pgParseConstant(src []byte) (remaining, constant []byte) {
 		}
 	}
 
-	if len(src) >= 4 &&
-		(src[0] == 'n' || src[0] == 'N') &&
-		(src[1] == 'u' || src[1] == 'U') &&
-		(src[2] == 'l' || src[2] == 'L') &&
-		(src[3] == 'l' || src[3] == 'L') {
-		return src[4:], src[:4]
+	for _, keyword := range []string{`null`, `true`, `false`} {
+		if pgHasKeyword(src, keyword) {
+			return src[len(keyword):], src[:len(keyword)]
+		}
 	}
 
-	if i = bytes.IndexFunc(src, pgIsNotNumeric); i < 0 {
+	if i = bytes.IndexFunc(src, pgIsNotNumeric); i < 0 && len(src) > 0 {
 		// all numeric
 		return src[:0], src
 	}
 
+	if i <= 0 {
+		// not a constant
+		return src, nil
+	}
+
 	return src[i:], src[:i]
 }
 
+func pgHasKeyword(src []byte, keyword string) bool {
+	return len(src) >= len(keyword) && bytes.EqualFold(src[:len(keyword)], []byte(keyword))
+}
+
 func pgParseIdentifier(src []byte) (remaining, identifier []byte) {
 	var c rune
 
@@ -133,3 +152,109 @@ func pgParseIdentifier(src []byte) (remaining, identifier []byte) {
 
 	return src, nil
 }
+
+func pgIsNumericType(typ string) bool {
+	switch typ {
+	case `smallint`, `integer`, `bigint`, `oid`, `real`, `double precision`, `numeric`:
+		return true
+	}
+	return strings.HasPrefix(typ, `numeric(`)
+}
+
+// pgUnquoteConstant returns the value of a constant found by pgParseConstant.
+func pgUnquoteConstant(constant string) (value string, null bool) {
+	if pgHasKeyword([]byte(constant), `null`) && len(constant) == 4 {
+		return ``, true
+	}
+	if len(constant) >= 2 && constant[0] == '\'' {
+		return strings.Replace(constant[1:len(constant)-1], `''`, `'`, -1), false
+	}
+	return constant, false
+}
+
+// pgQuoteLiteral returns value as a string constant.
+func pgQuoteLiteral(value string) string {
+	return `'` + strings.Replace(value, `'`, `''`, -1) + `'`
+}
+
+// pgQuoteIdentifier returns name quoted as by quote_ident(), the way logical
+// decoding prints it.
+func pgQuoteIdentifier(name string) string {
+	if _, ok := pgKeywords[name]; ok || len(name) == 0 {
+		return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+	}
+	for i, c := range name {
+		if !(('a' <= c && c <= 'z') || c == '_' || (i > 0 && (('0' <= c && c <= '9') || c == '$'))) {
+			return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+		}
+	}
+	return name
+}
+
+// pgSplitTargets returns the tables of a list such as
+// `public.a, public."b, c"`.
+func pgSplitTargets(list string) []string {
+	var targets []string
+	for src := []byte(list); len(src) > 0; {
+		remaining, target := pgParseIdentifier(src)
+		if len(target) == 0 {
+			break
+		}
+		targets = append(targets, string(target))
+		src = bytes.TrimPrefix(remaining, []byte(`, `))
+	}
+	return targets
+}
+
+// pgSplitTarget returns the schema and table of a target such as
+// `public."My Table"`, unquoted.
+func pgSplitTarget(target string) (schema, table string) {
+	remaining, first := pgParseIdentifier([]byte(target))
+	if len(remaining) == 0 {
+		for i := len(first) - 1; i >= 0; i-- {
+			if first[i] == '.' && bytes.Count(first[i+1:], []byte(`"`))%2 == 0 {
+				return pgUnquoteIdentifier(string(first[:i])), pgUnquoteIdentifier(string(first[i+1:]))
+			}
+		}
+	}
+	return ``, pgUnquoteIdentifier(target)
+}
+
+// pgUnquoteIdentifier returns the name of an identifier printed by
+// pgQuoteIdentifier.
+func pgUnquoteIdentifier(identifier string) string {
+	if len(identifier) >= 2 && identifier[0] == '"' {
+		return strings.Replace(identifier[1:len(identifier)-1], `""`, `"`, -1)
+	}
+	return identifier
+}
+
+// pgKeywords are the keywords that quote_ident() quotes: those that are not
+// unreserved.
+var pgKeywords = map[string]struct{}{}
+
+func init() {
+	for _, keyword := range strings.Fields(`
+		all analyse analyze and any array as asc asymmetric both case cast check
+		collate column constraint create current_catalog current_date current_role
+		current_time current_timestamp current_user default deferrable desc distinct
+		do else end except false fetch for foreign from grant group having in
+		initially intersect into lateral leading limit localtime localtimestamp not
+		null offset on only or order placing primary references returning select
+		session_user some symmetric table then to trailing true union unique user
+		using variadic when where window with
+
+		authorization binary collation concurrently cross current_schema freeze full
+		ilike inner is isnull join left like natural notnull outer overlaps right
+		similar tablesample verbose
+
+		between bigint bit boolean char character coalesce dec decimal exists
+		extract float greatest grouping inout int integer interval least national
+		nchar none nullif numeric out overlay position precision real row setof
+		smallint substring time timestamp treat trim values varchar xmlattributes
+		xmlconcat xmlelement xmlexists xmlforest xmlnamespaces xmlparse xmlpi xmlroot
+		xmlserialize xmltable
+	`) {
+		pgKeywords[keyword] = struct{}{}
+	}
+}
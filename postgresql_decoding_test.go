@@ -1,11 +1,16 @@
 package pgbarrel
 
-import "testing"
+import (
+	"reflect"
+	"testing"
+)
 
 func TestPostgreSQLParseConstant(t *testing.T) {
 	for _, tt := range []struct{ input, remaining, constant string }{
 		{`null`, ``, `null`},
 		{`NULL`, ``, `NULL`},
+		{`true`, ``, `true`},
+		{`FALSE`, ``, `FALSE`},
 
 		{`1`, ``, `1`},
 		{`12.34`, ``, `12.34`},
@@ -19,6 +24,8 @@ func TestPostgreSQLParseConstant(t *testing.T) {
 
 		{`null `, ` `, `null`},
 		{`NULL `, ` `, `NULL`},
+		{`true `, ` `, `true`},
+		{`FALSE  `, `  `, `FALSE`},
 
 		{`1 `, ` `, `1`},
 		{`12.34 `, ` `, `12.34`},
@@ -107,3 +114,42 @@ func TestPostgreSQLParseIdentifierError(t *testing.T) {
 		}
 	}
 }
+
+func TestPostgreSQLQuoteIdentifier(t *testing.T) {
+	for _, tt := range []struct{ input, expected string }{
+		{`a`, `a`},
+		{`abc_1$`, `abc_1$`},
+		{`_x`, `_x`},
+		{`A`, `"A"`},
+		{`1a`, `"1a"`},
+		{`a b`, `"a b"`},
+		{`ta"ble`, `"ta""ble"`},
+		{`from`, `"from"`},
+		{`integer`, `"integer"`},
+		{`name`, `name`},
+		{``, `""`},
+	} {
+		if result := pgQuoteIdentifier(tt.input); result != tt.expected {
+			t.Errorf("Expected `%s` to be `%s`, got `%s`", tt.input, tt.expected, result)
+		}
+	}
+}
+
+func TestPostgreSQLSplitTarget(t *testing.T) {
+	for _, tt := range []struct{ input, schema, table string }{
+		{`public.t`, `public`, `t`},
+		{`public."sp ace"`, `public`, `sp ace`},
+		{`"a.b"."c.d"`, `a.b`, `c.d`},
+		{`"ta""ble".x`, `ta"ble`, `x`},
+		{`t`, ``, `t`},
+	} {
+		if schema, table := pgSplitTarget(tt.input); schema != tt.schema || table != tt.table {
+			t.Errorf("Expected `%s` to be `%s` and `%s`, got `%s` and `%s`", tt.input, tt.schema, tt.table, schema, table)
+		}
+	}
+
+	targets := pgSplitTargets(`public.a, public."b, c", d`)
+	if !reflect.DeepEqual(targets, []string{`public.a`, `public."b, c"`, `d`}) {
+		t.Errorf("Expected three targets, got %q", targets)
+	}
+}
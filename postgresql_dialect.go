@@ -0,0 +1,63 @@
+package pgbarrel
+
+import (
+	"strconv"
+	"strings"
+)
+
+// PostgreSQLDialect applies operations to PostgreSQL, opened with any
+// driver that accepts values as text. Targets, columns and types are those
+// of the stream, and DDL is replayed as it was written on the source.
+type PostgreSQLDialect struct{}
+
+func (PostgreSQLDialect) QuoteIdentifier(name string) string { return pgQuoteIdentifier(name) }
+
+func (PostgreSQLDialect) Placeholder(n int) string { return `$` + strconv.Itoa(n) }
+
+func (d PostgreSQLDialect) Upsert(table string, columns, keys []string) string {
+	return sqlUpsert(d, table, columns, keys, `EXCLUDED`)
+}
+
+func (PostgreSQLDialect) Table(target string) string { return target }
+
+func (PostgreSQLDialect) Columns(table string) (string, []interface{}) {
+	return `SELECT attname FROM pg_attribute WHERE attrelid = to_regclass($1) AND attnum > 0 AND NOT attisdropped`, []interface{}{table}
+}
+
+func (PostgreSQLDialect) Type(typ string) string {
+	if typ == `` {
+		return `text`
+	}
+	return typ
+}
+
+func (PostgreSQLDialect) Value(typ, value string) (interface{}, error) { return value, nil }
+
+func (PostgreSQLDialect) DDL(command string) string { return command }
+
+// sqlUpsert returns an INSERT ... ON CONFLICT statement, as PostgreSQL and
+// SQLite write it, where excluded is the name of the row proposed.
+func sqlUpsert(d Dialect, table string, columns, keys []string, excluded string) string {
+	placeholders := make([]string, len(columns))
+	for i := range placeholders {
+		placeholders[i] = d.Placeholder(i + 1)
+	}
+
+	isKey := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		isKey[key] = true
+	}
+	var sets []string
+	for _, column := range columns {
+		if !isKey[column] {
+			sets = append(sets, column+` = `+excluded+`.`+column)
+		}
+	}
+
+	statement := `INSERT INTO ` + table + ` (` + strings.Join(columns, `, `) + `) VALUES (` +
+		strings.Join(placeholders, `, `) + `) ON CONFLICT (` + strings.Join(keys, `, `) + `) DO `
+	if len(sets) == 0 {
+		return statement + `NOTHING`
+	}
+	return statement + `UPDATE SET ` + strings.Join(sets, `, `)
+}
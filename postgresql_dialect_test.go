@@ -0,0 +1,32 @@
+package pgbarrel
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPostgreSQLDialect(t *testing.T) {
+	d := PostgreSQLDialect{}
+
+	assert.Equal(t, `"select"`, d.QuoteIdentifier(`select`))
+	assert.Equal(t, `id`, d.QuoteIdentifier(`id`))
+	assert.Equal(t, `$2`, d.Placeholder(2))
+
+	assert.Equal(t, `public."My Table"`, d.Table(`public."My Table"`))
+
+	query, args := d.Columns(`public."My Table"`)
+	assert.Contains(t, query, `to_regclass($1)`)
+	assert.Equal(t, []interface{}{`public."My Table"`}, args)
+
+	assert.Equal(t, `INSERT INTO public.t (a, b, c) VALUES ($1, $2, $3) ON CONFLICT (a, b) DO UPDATE SET c = EXCLUDED.c`,
+		d.Upsert(`public.t`, []string{`a`, `b`, `c`}, []string{`a`, `b`}))
+
+	assert.Equal(t, `numeric(5,2)`, d.Type(`numeric(5,2)`))
+	assert.Equal(t, `text`, d.Type(``))
+
+	value, err := d.Value(`bytea`, `\x0102`)
+	require.NoError(t, err)
+	assert.Equal(t, `\x0102`, value)
+}
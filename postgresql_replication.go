@@ -2,6 +2,9 @@ package pgbarrel
 
 import (
 	"context"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/jackc/pgx"
@@ -10,6 +13,8 @@ import (
 
 type pgReplicationConfig struct {
 	Slot, Plugin, Options string
+
+	StatusInterval, WaitTimeout time.Duration
 }
 
 type pgLogicalReceiver struct {
@@ -20,6 +25,12 @@ type pgLogicalReceiver struct {
 
 	posReceived uint64
 	posApplied  uint64
+
+	metrics *Metrics
+	tracer  *Tracer
+	log     Logger
+	started bool
+	xid     string
 }
 
 func NewPostgreSQLReceiver(conn string, slot, plugin, options string) (*pgLogicalReceiver, error) {
@@ -44,6 +55,7 @@ func NewPostgreSQLReceiver(conn string, slot, plugin, options string) (*pgLogica
 	recv.replCfg.Slot = slot
 	recv.replCfg.Plugin = plugin
 	recv.replCfg.Options = options
+	recv.log = discardLogger{}
 
 	return &recv, nil
 }
@@ -55,55 +67,226 @@ func (r *pgLogicalReceiver) Close() error {
 	return nil
 }
 
+// Acknowledge reports that operations up to and including position have been
+// applied. It is sent to the server with the next standby status, allowing the
+// server to recycle WAL before it.
+func (r *pgLogicalReceiver) Acknowledge(position string) error {
+	lsn, err := pgx.ParseLSN(position)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid position: %q", position)
+	}
+
+	for applied := atomic.LoadUint64(&r.posApplied); lsn > applied; applied = atomic.LoadUint64(&r.posApplied) {
+		if atomic.CompareAndSwapUint64(&r.posApplied, applied, lsn) {
+			break
+		}
+	}
+
+	return nil
+}
+
+// SetMetrics counts the messages r receives in m. Each Start after the first
+// counts as a reconnect. The commit time of each transaction, decoded with
+// include-timestamp, gives the lag of applying it.
+func (r *pgLogicalReceiver) SetMetrics(m *Metrics) {
+	r.metrics = m
+	m.source(r.replCfg.Slot, r.replCfg.Plugin)
+}
+
+// SetTracer records when r receives each transaction, and how long it takes
+// to decode, in t.
+func (r *pgLogicalReceiver) SetTracer(t *Tracer) {
+	r.tracer = t
+}
+
+// SetStandbyTiming sets how often r sends a standby status to the server, 10
+// seconds by default, and how long each wait for a message lasts, 1 second by
+// default. Zero keeps the default. The interval is shortened to half of the
+// wal_sender_timeout of the server, and the wait to the interval. A status
+// requested by the server is always sent at once.
+func (r *pgLogicalReceiver) SetStandbyTiming(interval, wait time.Duration) {
+	r.replCfg.StatusInterval, r.replCfg.WaitTimeout = interval, wait
+}
+
+// timing returns the standby status interval and wait timeout of r.
+func (r *pgLogicalReceiver) timing() (interval, wait time.Duration) {
+	interval, wait = r.replCfg.StatusInterval, r.replCfg.WaitTimeout
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	if wait <= 0 {
+		wait = time.Second
+	}
+
+	var setting string
+	err := r.conn.QueryRowEx(context.Background(), `SHOW wal_sender_timeout`, &pgx.QueryExOptions{SimpleProtocol: true}).Scan(&setting)
+	if err != nil {
+		r.log.Debug("Unable to read wal_sender_timeout", "slot", r.replCfg.Slot, "error", err)
+	} else if timeout, err := pgParseDuration(setting); err == nil && timeout > 0 && interval > timeout/2 {
+		r.log.Warn("Shortened the standby status interval to half of wal_sender_timeout", "slot", r.replCfg.Slot,
+			"status_interval", timeout/2, "wal_sender_timeout", timeout)
+		interval = timeout / 2
+	}
+
+	if wait > interval {
+		wait = interval
+	}
+	return interval, wait
+}
+
+// SetLogger records the stream, parse failures and standby status updates
+// of r in l.
+func (r *pgLogicalReceiver) SetLogger(l Logger) {
+	r.log = orDiscard(l)
+}
+
 func (r *pgLogicalReceiver) Start(ctx context.Context, out chan<- *ReplicationOperation) error {
+	slot, position := r.replCfg.Slot, pgx.FormatLSN(r.posReceived)
+	if r.started {
+		r.metrics.reconnect()
+		r.log.Warn("Restarting replication", "slot", slot, "lsn", position)
+	}
+	r.started = true
+
+	interval, wait := r.timing()
+
 	err := r.conn.StartReplication(r.replCfg.Slot, r.posReceived, -1, r.replCfg.Options)
+	if err != nil {
+		r.log.Error("Failed to start replication", "slot", slot, "lsn", position, "error", err)
+		return err
+	}
+	r.log.Info("Started replication", "slot", slot, "lsn", position, "plugin", r.replCfg.Plugin,
+		"status_interval", interval, "wait_timeout", wait)
+	r.metrics.stream(true)
+	defer r.metrics.stream(false)
 
-	const standby_timeout = 10 * time.Second
-	var standby_deadline = time.Now().Add(standby_timeout)
-	var standby_expired = time.Now().Add(-standby_timeout)
+	standby_deadline := time.Now().Add(interval)
+	standby := func() error {
+		status, err := pgx.NewStandbyStatus(atomic.LoadUint64(&r.posApplied))
+		if err == nil {
+			err = r.conn.SendStandbyStatus(status)
+		}
+		if err == nil {
+			r.metrics.standby()
+			r.log.Debug("Sent standby status", "slot", slot, "lsn", pgx.FormatLSN(status.WalFlushPosition))
+			standby_deadline = time.Now().Add(interval)
+		}
+		return err
+	}
+
+	// send op while the Pipeline is busy, keeping the server informed
+	send := func(op *ReplicationOperation) error {
+		for {
+			timer := time.NewTimer(time.Until(standby_deadline))
+			select {
+			case out <- op:
+				timer.Stop()
+				return nil
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-timer.C:
+				if err := standby(); err != nil {
+					return err
+				}
+			}
+		}
+	}
 
 	var message *pgx.ReplicationMessage
-	var standby *pgx.StandbyStatus
 
 	for err == nil {
-		message, err = r.conn.WaitForReplicationMessage(time.Second)
+		message, err = r.conn.WaitForReplicationMessage(wait)
+		r.metrics.alive()
 
 		select {
 		case <-ctx.Done():
+			r.log.Info("Stopped replication", "slot", slot, "lsn", pgx.FormatLSN(r.posReceived))
 			return ctx.Err()
 		default:
 		}
 
 		if err == nil && message != nil {
-			if message.ServerHeartbeat != nil && message.ServerHeartbeat.ReplyRequested != 0 {
-				standby_deadline = standby_expired
+			if message.ServerHeartbeat != nil {
+				r.metrics.server(message.ServerHeartbeat.ServerWalEnd)
+				if message.ServerHeartbeat.ReplyRequested != 0 {
+					r.log.Debug("Server requested a standby status", "slot", slot, "lsn", pgx.FormatLSN(message.ServerHeartbeat.ServerWalEnd))
+					err = standby()
+				}
 			}
 
 			if message.WalMessage != nil {
+				arrived := time.Now()
 				r.posReceived = message.WalMessage.WalStart
+				r.metrics.message(len(message.WalMessage.WalData), r.posReceived)
 
 				op := ReplicationOperation{
 					Position: pgx.FormatLSN(message.WalMessage.WalStart),
 				}
 
 				if err = r.decode(message.WalMessage.WalData, &op); err == nil {
-					out <- &op
+					r.tracer.receive(&op, arrived, time.Since(arrived), len(message.WalMessage.WalData))
+					if op.Operation == `BEGIN` {
+						r.xid = op.Target
+					}
+					if op.Operation != `BEGIN` && op.Operation != `COMMIT` {
+						r.log.Debug("Decoded operation", "slot", slot, "lsn", op.Position, "xid", r.xid, "operation", op.Operation, "table", op.Target)
+					}
+
+					if committed, ok := pgCommitTime(op.Target); ok && op.Operation == `COMMIT` {
+						r.metrics.commit(r.posReceived, committed)
+					}
+					if op.Operation == `TRUNCATE` {
+						// one operation for each table truncated together
+						for _, target := range pgSplitTargets(op.Target) {
+							if err = send(&ReplicationOperation{Position: op.Position, Operation: op.Operation, Target: target}); err != nil {
+								break
+							}
+						}
+					} else {
+						err = send(&op)
+					}
+				} else {
+					r.metrics.parseError()
+					r.log.Error("Failed to parse message", "slot", slot, "lsn", op.Position, "xid", r.xid,
+						"error", err, "message", string(message.WalMessage.WalData))
 				}
 			}
 		}
 
-		if err == nil || err == pgx.ErrNotificationTimeout {
+		if err == pgx.ErrNotificationTimeout {
 			err = nil
-
-			if time.Now().After(standby_deadline) {
-				if standby, err = pgx.NewStandbyStatus(r.posApplied); err == nil {
-					if err = r.conn.SendStandbyStatus(standby); err == nil {
-						standby_deadline = time.Now().Add(standby_timeout)
-					}
-				}
-			}
+		}
+		if err == nil && time.Now().After(standby_deadline) {
+			err = standby()
 		}
 	}
 
+	if err == ctx.Err() {
+		r.log.Info("Stopped replication", "slot", slot, "lsn", pgx.FormatLSN(r.posReceived))
+		return err
+	}
+	r.log.Error("Stopped replication", "slot", slot, "lsn", pgx.FormatLSN(r.posReceived), "error", err)
 	return err
 }
+
+// pgParseDuration parses a setting in units of time, e.g. "1min" or "500ms".
+// A number without a unit is milliseconds.
+func pgParseDuration(s string) (time.Duration, error) {
+	units := map[string]time.Duration{
+		"": time.Millisecond, "us": time.Microsecond, "ms": time.Millisecond,
+		"s": time.Second, "min": time.Minute, "h": time.Hour, "d": 24 * time.Hour,
+	}
+
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(c rune) bool { return (c < '0' || '9' < c) && c != '-' })
+	if i < 0 {
+		i = len(s)
+	}
+	n, err := strconv.ParseInt(s[:i], 10, 64)
+	unit, ok := units[strings.TrimSpace(s[i:])]
+	if err != nil || !ok {
+		return 0, errors.Errorf("Invalid duration: %q", s)
+	}
+	return time.Duration(n) * unit, nil
+}
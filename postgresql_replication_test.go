@@ -99,6 +99,16 @@ func TestPostgreSQLReceiver(t *testing.T) {
 	assert.NoError(t, err)
 	defer r.Close()
 
+	interval, wait := r.timing()
+	assert.Equal(t, 10*time.Second, interval)
+	assert.Equal(t, time.Second, wait)
+
+	r.SetStandbyTiming(2*time.Minute, 5*time.Minute)
+	interval, wait = r.timing()
+	assert.Equal(t, 30*time.Second, interval, "Expected half of the default wal_sender_timeout")
+	assert.Equal(t, 30*time.Second, wait)
+	r.SetStandbyTiming(0, 0)
+
 	c := s.mustConnect(t, "pgbarrel")
 	defer c.Close()
 
@@ -283,3 +293,43 @@ func TestPostgreSQLReceiver(t *testing.T) {
 		t.Log(*op)
 	}
 }
+
+func TestPostgreSQLParseDuration(t *testing.T) {
+	for _, tt := range []struct {
+		input    string
+		expected time.Duration
+	}{
+		{`0`, 0},
+		{`1min`, time.Minute},
+		{`60s`, time.Minute},
+		{`500ms`, 500 * time.Millisecond},
+		{`250`, 250 * time.Millisecond},
+		{`2h`, 2 * time.Hour},
+		{`1d`, 24 * time.Hour},
+		{`-1`, -time.Millisecond},
+	} {
+		d, err := pgParseDuration(tt.input)
+		assert.NoError(t, err, "%q", tt.input)
+		assert.Equal(t, tt.expected, d, "%q", tt.input)
+	}
+
+	for _, input := range []string{``, `min`, `1 fortnight`, `1.5s`} {
+		_, err := pgParseDuration(input)
+		assert.Error(t, err, "%q", input)
+	}
+}
+
+func TestPostgreSQLReceiverAcknowledge(t *testing.T) {
+	var r pgLogicalReceiver
+
+	assert.NoError(t, r.Acknowledge("0/16B3748"))
+	assert.Equal(t, uint64(0x16B3748), r.posApplied)
+
+	assert.NoError(t, r.Acknowledge("0/16B3740"))
+	assert.Equal(t, uint64(0x16B3748), r.posApplied, "Expected position to never decrease")
+
+	assert.NoError(t, r.Acknowledge("1/0"))
+	assert.Equal(t, uint64(0x100000000), r.posApplied)
+
+	assert.Error(t, r.Acknowledge("bogus"))
+}
@@ -0,0 +1,408 @@
+package pgbarrel
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgx"
+	"github.com/pkg/errors"
+)
+
+// A table is copied again while the stream goes on, in the manner of DBLog.
+// pgResync writes a low watermark into a table on the source, selects a chunk
+// of rows in key order, and writes a high watermark. The watermarks appear in
+// the stream in commit order. Changes to the table between them are held
+// back; at the high watermark the chunk is emitted as READ operations, then
+// the changes held. A row of the chunk whose key was inserted, updated or
+// deleted between the watermarks is left to those changes, and later changes
+// apply over the rows of the chunk, so the target converges without pausing
+// the stream.
+//
+// The changes held were part of transactions whose COMMITs have already gone
+// on, so they are lost if pgbarrel stops between watermarks. The table being
+// copied is recorded beside the watermark until its last chunk is emitted;
+// see PostgreSQLResyncIncomplete.
+
+const pgResyncTable = `watermark`
+
+type ResyncOptions struct {
+	// ChunkSize is the number of rows selected between watermarks. It
+	// defaults to 1000.
+	ChunkSize int
+	// Keys names the key columns of targets that have no primary key.
+	Keys map[string][]string
+}
+
+type pgResync struct {
+	conn    *pgx.Conn
+	table   string
+	target  string
+	options ResyncOptions
+	log     Logger
+
+	// one table at a time
+	running sync.Mutex
+
+	mutex  sync.Mutex
+	window *pgResyncWindow
+	flush  []*ReplicationOperation
+}
+
+// pgResyncWindow is one chunk of a table between watermarks.
+type pgResyncWindow struct {
+	target         string
+	low, high      string
+	truncate       bool
+	columns, types []string
+	keys           []int
+
+	// set before the high watermark is written
+	rows [][]*string
+
+	// after the low watermark
+	open    bool
+	held    []*ReplicationOperation
+	changed map[string]bool // keys, old and new, of the changes held
+
+	err  error
+	done chan struct{}
+}
+
+// InstallPostgreSQLResync creates the watermark table in schema.
+func InstallPostgreSQLResync(conn *pgx.Conn, schema string) error {
+	quoted := pgx.Identifier{schema}.Sanitize()
+
+	for _, sql := range []string{
+		`CREATE SCHEMA IF NOT EXISTS ` + quoted,
+		`CREATE TABLE IF NOT EXISTS ` + quoted + `.` + pgResyncTable + ` (
+			id   integer PRIMARY KEY CHECK (id = 1),
+			mark text NOT NULL
+		)`,
+		`ALTER TABLE ` + quoted + `.` + pgResyncTable + ` ADD COLUMN IF NOT EXISTS target text NOT NULL DEFAULT ''`,
+		`INSERT INTO ` + quoted + `.` + pgResyncTable + ` (id, mark) VALUES (1, '') ON CONFLICT (id) DO NOTHING`,
+	} {
+		if _, err := conn.Exec(sql); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// UninstallPostgreSQLResync removes the watermark table in schema.
+func UninstallPostgreSQLResync(conn *pgx.Conn, schema string) error {
+	_, err := conn.Exec(`DROP TABLE IF EXISTS ` + pgx.Identifier{schema}.Sanitize() + `.` + pgResyncTable)
+	return err
+}
+
+// PostgreSQLResyncIncomplete returns the table whose resync through the
+// watermark table in schema did not finish, or "" when there is none. Changes
+// to that table may have been lost, so it should be copied again.
+func PostgreSQLResyncIncomplete(ctx context.Context, conn *pgx.Conn, schema string) (string, error) {
+	table := pgx.Identifier{schema, pgResyncTable}.Sanitize()
+
+	// a table installed before targets were recorded has none
+	var installed bool
+	err := conn.QueryRowEx(ctx, `SELECT EXISTS (
+		SELECT 1 FROM pg_attribute WHERE attrelid = to_regclass($1) AND attname = 'target' AND NOT attisdropped
+	)`, nil, table).Scan(&installed)
+	if err != nil || !installed {
+		return "", err
+	}
+
+	var target string
+	err = conn.QueryRowEx(ctx, `SELECT target FROM `+table+` WHERE id = 1`, nil).Scan(&target)
+	if err == pgx.ErrNoRows {
+		return "", nil
+	}
+	return target, err
+}
+
+// NewPostgreSQLResync returns a Transformer that copies tables again through
+// conn, a connection to the source, with the watermark table in schema. It
+// must come before any Transformer that drops changes to that table, which
+// it drops itself. A Sink should write READ as an upsert, as the SQL sink
+// does for targets with keys.
+func NewPostgreSQLResync(conn *pgx.Conn, schema string, options ResyncOptions) *pgResync {
+	if options.ChunkSize <= 0 {
+		options.ChunkSize = 1000
+	}
+	return &pgResync{
+		conn:    conn,
+		table:   pgx.Identifier{schema}.Sanitize() + `.` + pgResyncTable,
+		target:  pgQuoteIdentifier(schema) + `.` + pgResyncTable,
+		options: options,
+		log:     discardLogger{},
+	}
+}
+
+func (r *pgResync) SetLogger(l Logger) {
+	r.log = orDiscard(l)
+}
+
+// Resync truncates target in the stream, then copies its rows in chunks. It
+// returns once every chunk has been emitted, so the Pipeline must be running.
+// When it fails or ctx is done, target is left incomplete and should be
+// copied again, as PostgreSQLResyncIncomplete reports.
+func (r *pgResync) Resync(ctx context.Context, target string) error {
+	r.running.Lock()
+	defer r.running.Unlock()
+
+	columns, types, keys, err := pgKeyedColumns(ctx, r.conn, target, r.options.Keys[target])
+	if err == nil {
+		err = r.record(ctx, target)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Unable to resync %s", target)
+	}
+	r.log.Info("Started resync", "table", target, "chunk_size", r.options.ChunkSize)
+
+	var last []*string
+	var total int
+	for chunk := 0; ; chunk++ {
+		w := &pgResyncWindow{
+			target: target, low: pgResyncMark(), high: pgResyncMark(), truncate: chunk == 0,
+			columns: columns, types: types, keys: keys,
+			changed: make(map[string]bool), done: make(chan struct{}),
+		}
+		r.mutex.Lock()
+		r.window = w
+		r.mutex.Unlock()
+
+		rows, err := r.chunk(ctx, w, last)
+		if err == nil {
+			r.mutex.Lock()
+			w.rows = rows
+			r.mutex.Unlock()
+			err = r.mark(ctx, w.high)
+		}
+		if err == nil {
+			select {
+			case <-w.done:
+				err = w.err
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+		}
+		if err != nil {
+			r.abandon(w)
+			r.log.Error("Failed to resync", "table", target, "rows", total, "error", err)
+			return err
+		}
+
+		total += len(rows)
+		r.log.Debug("Resynced chunk", "table", target, "chunk", chunk, "rows", len(rows))
+		if len(rows) < r.options.ChunkSize {
+			break
+		}
+		last = rows[len(rows)-1]
+	}
+
+	if err := r.record(ctx, ""); err != nil {
+		return errors.Wrapf(err, "Unable to finish resync of %s", target)
+	}
+	r.log.Info("Finished resync", "table", target, "rows", total)
+	return nil
+}
+
+// chunk writes the low watermark of w and selects the rows after last.
+func (r *pgResync) chunk(ctx context.Context, w *pgResyncWindow, last []*string) ([][]*string, error) {
+	if err := r.mark(ctx, w.low); err != nil {
+		return nil, err
+	}
+
+	var selects, orders, after []string
+	for _, column := range w.columns {
+		selects = append(selects, column+`::text`)
+	}
+	for _, i := range w.keys {
+		orders = append(orders, w.columns[i])
+		if last != nil {
+			after = append(after, pgConstant(w.types[i], last[i])+`::`+w.types[i])
+		}
+	}
+
+	sql := `SELECT ` + strings.Join(selects, `, `) + ` FROM ` + w.target
+	if last != nil {
+		sql += ` WHERE (` + strings.Join(orders, `, `) + `) > (` + strings.Join(after, `, `) + `)`
+	}
+	sql += ` ORDER BY ` + strings.Join(orders, `, `) + ` LIMIT ` + strconv.Itoa(r.options.ChunkSize)
+
+	rows, err := r.conn.QueryEx(ctx, sql, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var chunk [][]*string
+	for rows.Next() {
+		values, err := rows.Values()
+		if err != nil {
+			return nil, err
+		}
+		row := make([]*string, len(values))
+		for i, value := range values {
+			if text, ok := value.(string); ok {
+				row[i] = &text
+			}
+		}
+		chunk = append(chunk, row)
+	}
+	return chunk, rows.Err()
+}
+
+// mark writes a watermark.
+func (r *pgResync) mark(ctx context.Context, mark string) error {
+	return r.set(ctx, `mark`, mark)
+}
+
+// record writes the table being copied beside the watermark; "" means none.
+func (r *pgResync) record(ctx context.Context, target string) error {
+	return r.set(ctx, `target`, target)
+}
+
+func (r *pgResync) set(ctx context.Context, column, value string) error {
+	tag, err := r.conn.ExecEx(ctx, `UPDATE `+r.table+` SET `+column+` = $1 WHERE id = 1`, nil, value)
+	if err == nil && tag.RowsAffected() == 0 {
+		err = errors.Errorf("No watermark in %s; install it", r.table)
+	}
+	return err
+}
+
+// abandon stops w, releasing the changes it holds.
+func (r *pgResync) abandon(w *pgResyncWindow) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.window == w {
+		r.window = nil
+		r.flush = append(r.flush, w.held...)
+	}
+}
+
+func (r *pgResync) Transform(ctx context.Context, op *ReplicationOperation, emit func(*ReplicationOperation) error) error {
+	r.mutex.Lock()
+	flush := r.flush
+	r.flush = nil
+	w := r.window
+	held := w != nil && w.open && op.Target == w.target &&
+		(op.Operation == `INSERT` || op.Operation == `UPDATE` || op.Operation == `DELETE` || op.Operation == `TRUNCATE`)
+	if held {
+		w.held = append(w.held, op)
+		if len(op.OldColumns) > 0 {
+			w.changed[pgResyncKey(w, op.OldColumns, op.OldValues)] = true
+		}
+		if len(op.NewColumns) > 0 {
+			w.changed[pgResyncKey(w, op.NewColumns, op.NewValues)] = true
+		}
+	}
+	r.mutex.Unlock()
+
+	for _, op := range flush {
+		if err := emit(op); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case held:
+		return nil
+	case op.Target == r.target:
+		if w != nil && (op.Operation == `INSERT` || op.Operation == `UPDATE`) {
+			return r.watermark(op, w, emit)
+		}
+		return nil
+	}
+	return emit(op)
+}
+
+// watermark opens w at its low watermark, and emits its rows and the changes
+// it holds at its high watermark.
+func (r *pgResync) watermark(op *ReplicationOperation, w *pgResyncWindow, emit func(*ReplicationOperation) error) error {
+	var mark string
+	for i, column := range op.NewColumns {
+		if column == `mark` && i < len(op.NewValues) {
+			mark, _ = pgUnquoteConstant(op.NewValues[i])
+		}
+	}
+
+	r.mutex.Lock()
+	if r.window != w {
+		r.mutex.Unlock()
+		return nil
+	}
+	switch mark {
+	case w.low:
+		w.open = true
+		r.mutex.Unlock()
+		if w.truncate {
+			return emit(&ReplicationOperation{Position: op.Position, Operation: `TRUNCATE`, Target: w.target})
+		}
+		return nil
+
+	case w.high:
+		r.window = nil
+		rows, held := w.rows, w.held
+		r.mutex.Unlock()
+
+		w.err = r.emit(op.Position, w, rows, held, emit)
+		close(w.done)
+		return w.err
+	}
+	r.mutex.Unlock()
+	return nil
+}
+
+// emit emits the rows of w not changed since its low watermark as READ at
+// position, then the changes held.
+func (r *pgResync) emit(position string, w *pgResyncWindow, rows [][]*string, held []*ReplicationOperation, emit func(*ReplicationOperation) error) error {
+	for _, row := range rows {
+		read := &ReplicationOperation{Position: position, Operation: `READ`, Target: w.target,
+			NewColumns: w.columns, NewTypes: w.types, NewValues: make([]string, len(row))}
+		for i := range row {
+			read.NewValues[i] = pgConstant(w.types[i], row[i])
+		}
+		if w.changed[pgResyncKey(w, read.NewColumns, read.NewValues)] {
+			continue
+		}
+		if err := emit(read); err != nil {
+			return err
+		}
+	}
+	for _, op := range held {
+		if err := emit(op); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pgResyncKey returns the key columns of w among columns and their values as
+// one string.
+func pgResyncKey(w *pgResyncWindow, columns, values []string) string {
+	var b strings.Builder
+	for _, i := range w.keys {
+		for j, column := range columns {
+			if column == w.columns[i] && j < len(values) {
+				value, null := pgUnquoteConstant(values[j])
+				if null {
+					b.WriteString(`null`)
+				} else {
+					b.WriteString(pgQuoteLiteral(value))
+				}
+			}
+		}
+		b.WriteByte(',')
+	}
+	return b.String()
+}
+
+// pgResyncMark returns a new watermark.
+func pgResyncMark() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,178 @@
+package pgbarrel
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPostgreSQLResyncTransform(t *testing.T) {
+	r := NewPostgreSQLResync(nil, `pgbarrel`, ResyncOptions{})
+	assert.Equal(t, 1000, r.options.ChunkSize, "Expected a default chunk size")
+
+	one, two, three, five, six, a, b, c, d := `1`, `2`, `3`, `5`, `6`, `a`, `b`, `c`, `d`
+	w := &pgResyncWindow{
+		target: `public.t`, low: `low`, high: `high`, truncate: true,
+		columns: []string{`id`, `v`}, types: []string{`integer`, `text`}, keys: []int{0},
+		rows:    [][]*string{{&one, &a}, {&two, &b}, {&three, nil}, {&five, &c}, {&six, &d}},
+		changed: make(map[string]bool), done: make(chan struct{}),
+	}
+	r.window = w
+
+	var emitted []string
+	emit := func(op *ReplicationOperation) error {
+		emitted = append(emitted, op.String())
+		return nil
+	}
+	watermark := func(mark string) *ReplicationOperation {
+		return &ReplicationOperation{Position: `0/20`, Operation: `UPDATE`, Target: `pgbarrel.watermark`,
+			NewColumns: []string{`id`, `mark`}, NewValues: []string{`1`, `'` + mark + `'`}, NewTypes: []string{`integer`, `text`}}
+	}
+	row := func(operation, id, v string) *ReplicationOperation {
+		op := &ReplicationOperation{Position: `0/10`, Operation: operation, Target: `public.t`}
+		if operation == `DELETE` {
+			op.OldColumns, op.OldValues, op.OldTypes = []string{`id`}, []string{id}, []string{`integer`}
+		} else {
+			op.NewColumns, op.NewValues, op.NewTypes = []string{`id`, `v`}, []string{id, v}, []string{`integer`, `text`}
+		}
+		return op
+	}
+
+	moved := row(`UPDATE`, `7`, `'d'`)
+	moved.OldColumns, moved.OldValues, moved.OldTypes = []string{`id`}, []string{`6`}, []string{`integer`}
+
+	for _, op := range []*ReplicationOperation{
+		row(`INSERT`, `9`, `'before'`),
+		watermark(`other`),
+		watermark(`low`),
+		{Position: `0/10`, Operation: `INSERT`, Target: `public.u`},
+		row(`UPDATE`, `1`, `'x'`),
+		row(`INSERT`, `2`, `'y'`),
+		row(`DELETE`, `3`, ``),
+		moved,
+		watermark(`high`),
+		row(`INSERT`, `4`, `'after'`),
+	} {
+		require.NoError(t, r.Transform(context.Background(), op, emit))
+	}
+
+	assert.Equal(t, []string{
+		`0/10 INSERT public.t new: id[integer]:9 v[text]:'before'`,
+		`0/20 TRUNCATE public.t`,
+		`0/10 INSERT public.u`,
+		`0/20 READ public.t new: id[integer]:5 v[text]:'c'`,
+		`0/10 UPDATE public.t new: id[integer]:1 v[text]:'x'`,
+		`0/10 INSERT public.t new: id[integer]:2 v[text]:'y'`,
+		`0/10 DELETE public.t old: id[integer]:3`,
+		`0/10 UPDATE public.t old: id[integer]:6 new: id[integer]:7 v[text]:'d'`,
+		`0/10 INSERT public.t new: id[integer]:4 v[text]:'after'`,
+	}, emitted)
+
+	select {
+	case <-w.done:
+		assert.NoError(t, w.err)
+	default:
+		t.Fatal("Expected the window to be done")
+	}
+	assert.Nil(t, r.window)
+
+	t.Run("Abandon", func(t *testing.T) {
+		w := &pgResyncWindow{target: `public.t`, low: `low`, high: `high`,
+			columns: []string{`id`, `v`}, types: []string{`integer`, `text`}, keys: []int{0},
+			changed: make(map[string]bool), done: make(chan struct{})}
+		r.window = w
+		emitted = nil
+
+		require.NoError(t, r.Transform(context.Background(), watermark(`low`), emit))
+		require.NoError(t, r.Transform(context.Background(), row(`UPDATE`, `1`, `'held'`), emit))
+		assert.Empty(t, emitted, "Expected no TRUNCATE after the first chunk")
+
+		r.abandon(w)
+		require.NoError(t, r.Transform(context.Background(), &ReplicationOperation{Operation: `COMMIT`}, emit))
+		require.NoError(t, r.Transform(context.Background(), watermark(`high`), emit))
+		assert.Equal(t, []string{
+			`0/10 UPDATE public.t new: id[integer]:1 v[text]:'held'`,
+			`COMMIT `,
+		}, emitted)
+	})
+}
+
+func TestPostgreSQLResync(t *testing.T) {
+	s := new(pgserver)
+	s.start(t)
+	defer s.stop(t)
+
+	func() {
+		c := s.mustConnect(t, "postgres")
+		defer c.Close()
+		_, err := c.Exec(`CREATE DATABASE pgbarrel`)
+		require.NoError(t, err)
+	}()
+
+	c := s.mustConnect(t, "pgbarrel")
+	defer c.Close()
+
+	incomplete, err := PostgreSQLResyncIncomplete(context.Background(), c, "pgbarrel")
+	require.NoError(t, err)
+	assert.Equal(t, "", incomplete, "Expected no resync before install")
+
+	require.NoError(t, InstallPostgreSQLResync(c, "pgbarrel"))
+	require.NoError(t, InstallPostgreSQLResync(c, "pgbarrel"), "Expected install to be repeatable")
+	for _, sql := range []string{
+		`CREATE TABLE normal (id int PRIMARY KEY, value text)`,
+		`CREATE TABLE other (id int PRIMARY KEY)`,
+		`INSERT INTO normal SELECT n, 'v' || n FROM generate_series(1, 5) n`,
+		`SELECT pg_create_logical_replication_slot('pgbarrel_test', 'test_decoding')`,
+		`INSERT INTO other VALUES (1)`,
+	} {
+		_, err := c.Exec(sql)
+		require.NoError(t, err, sql)
+	}
+
+	r, err := NewPostgreSQLReceiver("host="+s.directory+" dbname=pgbarrel", "pgbarrel_test", "test_decoding", "")
+	require.NoError(t, err)
+	defer r.Close()
+
+	resync := NewPostgreSQLResync(s.mustConnect(t, "pgbarrel"), "pgbarrel", ResyncOptions{ChunkSize: 2})
+	defer resync.conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sink := &testSink{}
+	p := NewPipeline(r, sink, resync)
+	p.background = append(p.background, func(ctx context.Context) error {
+		defer cancel()
+		return resync.Resync(ctx, `public.normal`)
+	})
+	assert.Equal(t, context.Canceled, p.Run(ctx))
+
+	var ops []string
+	for _, op := range sink.ops {
+		if op.Operation != `BEGIN` && op.Operation != `COMMIT` {
+			ops = append(ops, op.Operation+` `+op.Target+` `+strings.Join(op.NewValues, ` `))
+		}
+	}
+	assert.Equal(t, []string{
+		`INSERT public.other 1`,
+		`TRUNCATE public.normal `,
+		`READ public.normal 1 'v1'`,
+		`READ public.normal 2 'v2'`,
+		`READ public.normal 3 'v3'`,
+		`READ public.normal 4 'v4'`,
+		`READ public.normal 5 'v5'`,
+	}, ops)
+
+	incomplete, err = PostgreSQLResyncIncomplete(context.Background(), c, "pgbarrel")
+	require.NoError(t, err)
+	assert.Equal(t, "", incomplete, "Expected a finished resync")
+
+	require.NoError(t, resync.record(context.Background(), `public.normal`))
+	incomplete, err = PostgreSQLResyncIncomplete(context.Background(), c, "pgbarrel")
+	require.NoError(t, err)
+	assert.Equal(t, "public.normal", incomplete)
+}
@@ -0,0 +1,340 @@
+package pgbarrel
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx"
+)
+
+type SchemaDriftKind int
+
+const (
+	// The target table does not exist.
+	DriftMissingTable SchemaDriftKind = iota
+	// A column in the stream does not exist on the target.
+	DriftMissingColumn
+	// A column on the target is NOT NULL without a default and is not in the
+	// stream.
+	DriftNotNullColumn
+	// A column in the stream has a type the target column cannot hold.
+	DriftTypeMismatch
+)
+
+// A SchemaDrift is one difference between an operation and its target table.
+type SchemaDrift struct {
+	Kind                   SchemaDriftKind
+	Target, Column         string
+	SourceType, TargetType string
+}
+
+func (d SchemaDrift) String() string {
+	switch d.Kind {
+	case DriftMissingTable:
+		return fmt.Sprintf("table %s is missing on the target", d.Target)
+	case DriftMissingColumn:
+		return fmt.Sprintf("column %s of %s (%s) is missing on the target", d.Column, d.Target, d.SourceType)
+	case DriftNotNullColumn:
+		return fmt.Sprintf("column %s of %s (%s) is NOT NULL on the target but not in the source", d.Column, d.Target, d.TargetType)
+	case DriftTypeMismatch:
+		return fmt.Sprintf("column %s of %s is %s in the source but %s on the target", d.Column, d.Target, d.SourceType, d.TargetType)
+	}
+	return fmt.Sprintf("unknown drift of %s", d.Target)
+}
+
+// A SchemaDriftError reports the drifts that stopped an operation.
+type SchemaDriftError struct {
+	Position string
+	Drifts   []SchemaDrift
+}
+
+func (e *SchemaDriftError) Error() string {
+	drifts := make([]string, len(e.Drifts))
+	for i := range e.Drifts {
+		drifts[i] = e.Drifts[i].String()
+	}
+	return fmt.Sprintf("Schema drift at %s: %s", e.Position, strings.Join(drifts, "; "))
+}
+
+type SchemaDriftPolicy int
+
+const (
+	// Stop at the first operation that drifts.
+	DriftStop SchemaDriftPolicy = iota
+	// Remove columns that are missing or mismatched from the operation.
+	DriftSkipColumn
+	// Add columns that are missing to the target table.
+	DriftAddColumn
+)
+
+type pgTargetColumn struct {
+	typ                 string
+	notNull, hasDefault bool
+}
+
+type pgSchemaCheck struct {
+	policy SchemaDriftPolicy
+	report func(SchemaDrift)
+	tables map[string]map[string]pgTargetColumn
+
+	// drifts of each table already found in a fresh catalog
+	drifts map[string]map[SchemaDrift]bool
+
+	load func(target string) (map[string]pgTargetColumn, error)
+	exec func(sql string) error
+}
+
+// NewPostgreSQLSchemaCheck returns a Transformer that compares each operation
+// with its target table in conn before it is applied. The catalog of the
+// target is cached and reloaded whenever an operation drifts from it in a
+// new way. Drifts that remain are handled according to policy; those the
+// policy cannot resolve stop the Pipeline with a *SchemaDriftError. Drifts
+// already found are remembered until the next DDL on their table.
+func NewPostgreSQLSchemaCheck(conn *pgx.Conn, policy SchemaDriftPolicy) *pgSchemaCheck {
+	return &pgSchemaCheck{
+		policy: policy,
+		tables: make(map[string]map[string]pgTargetColumn),
+		drifts: make(map[string]map[SchemaDrift]bool),
+
+		load: func(target string) (map[string]pgTargetColumn, error) {
+			rows, err := conn.Query(`
+				SELECT a.attname, format_type(a.atttypid, a.atttypmod), a.attnotnull, a.atthasdef
+				  FROM pg_attribute a
+				 WHERE a.attrelid = to_regclass($1) AND a.attnum > 0 AND NOT a.attisdropped`, target)
+			if err != nil {
+				return nil, err
+			}
+			defer rows.Close()
+
+			var columns map[string]pgTargetColumn
+			for rows.Next() {
+				var name string
+				var column pgTargetColumn
+
+				if err = rows.Scan(&name, &column.typ, &column.notNull, &column.hasDefault); err != nil {
+					return nil, err
+				}
+				if columns == nil {
+					columns = make(map[string]pgTargetColumn)
+				}
+				columns[pgQuoteIdentifier(name)] = column
+			}
+			return columns, rows.Err()
+		},
+
+		exec: func(sql string) error {
+			_, err := conn.Exec(sql)
+			return err
+		},
+	}
+}
+
+// OnDrift calls report with every drift found, including those the policy
+// resolves, once until the next DDL on its table.
+func (c *pgSchemaCheck) OnDrift(report func(SchemaDrift)) { c.report = report }
+
+func (c *pgSchemaCheck) Transform(ctx context.Context, op *ReplicationOperation, emit func(*ReplicationOperation) error) error {
+	switch op.Operation {
+	case `DDL`:
+		for _, target := range pgSplitTargets(op.Target) {
+			c.forget(target)
+		}
+		return emit(op)
+	case `INSERT`, `UPDATE`, `DELETE`, `READ`:
+	default:
+		return emit(op)
+	}
+
+	drifts, err := c.check(op, false)
+	if err == nil && !c.known(op.Target, drifts) {
+		// the cache may be stale
+		drifts, err = c.check(op, true)
+	}
+	if err != nil {
+		return err
+	}
+
+	known := c.drifts[op.Target]
+	if known == nil && len(drifts) > 0 {
+		known = make(map[SchemaDrift]bool)
+		c.drifts[op.Target] = known
+	}
+
+	var unresolved []SchemaDrift
+	for _, drift := range drifts {
+		if c.report != nil && !known[drift] {
+			c.report(drift)
+		}
+		known[drift] = true
+
+		switch {
+		case c.policy == DriftSkipColumn && (drift.Kind == DriftMissingColumn || drift.Kind == DriftTypeMismatch):
+			pgRemoveColumn(&op.OldColumns, &op.OldValues, &op.OldTypes, drift.Column)
+			pgRemoveColumn(&op.NewColumns, &op.NewValues, &op.NewTypes, drift.Column)
+
+		case c.policy == DriftAddColumn && drift.Kind == DriftMissingColumn:
+			if err = c.exec(`ALTER TABLE ` + op.Target + ` ADD COLUMN ` + drift.Column + ` ` + drift.SourceType); err != nil {
+				return err
+			}
+			c.forget(op.Target)
+
+		default:
+			unresolved = append(unresolved, drift)
+		}
+	}
+
+	if len(unresolved) > 0 {
+		return &SchemaDriftError{Position: op.Position, Drifts: unresolved}
+	}
+	return emit(op)
+}
+
+// known reports whether every drift was found before in target.
+func (c *pgSchemaCheck) known(target string, drifts []SchemaDrift) bool {
+	for _, drift := range drifts {
+		if !c.drifts[target][drift] {
+			return false
+		}
+	}
+	return true
+}
+
+// forget drops the catalog and drifts of target, after it has changed.
+func (c *pgSchemaCheck) forget(target string) {
+	delete(c.tables, target)
+	delete(c.drifts, target)
+}
+
+func (c *pgSchemaCheck) check(op *ReplicationOperation, reload bool) ([]SchemaDrift, error) {
+	table, ok := c.tables[op.Target]
+	if !ok || reload {
+		var err error
+		if table, err = c.load(op.Target); err != nil {
+			return nil, err
+		}
+		c.tables[op.Target] = table
+	}
+
+	if table == nil {
+		return []SchemaDrift{{Kind: DriftMissingTable, Target: op.Target}}, nil
+	}
+
+	var drifts []SchemaDrift
+	seen := make(map[string]bool)
+
+	compare := func(columns, types []string) {
+		for i, name := range columns {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+
+			var typ string
+			if i < len(types) {
+				typ = types[i]
+			}
+
+			if column, ok := table[name]; !ok {
+				drifts = append(drifts, SchemaDrift{Kind: DriftMissingColumn, Target: op.Target, Column: name, SourceType: typ})
+			} else if typ != `` && !pgCompatibleTypes(typ, column.typ) {
+				drifts = append(drifts, SchemaDrift{Kind: DriftTypeMismatch, Target: op.Target, Column: name, SourceType: typ, TargetType: column.typ})
+			}
+		}
+	}
+
+	compare(op.NewColumns, op.NewTypes)
+	compare(op.OldColumns, op.OldTypes)
+
+	if op.Operation == `INSERT` || op.Operation == `READ` {
+		for name, column := range table {
+			if column.notNull && !column.hasDefault && !seen[name] {
+				drifts = append(drifts, SchemaDrift{Kind: DriftNotNullColumn, Target: op.Target, Column: name, TargetType: column.typ})
+			}
+		}
+	}
+
+	return drifts, nil
+}
+
+// pgCompatibleTypes reports whether a target column of type target can hold
+// values of type source. Text fits in a target of its length or longer, and
+// numbers in a target of as many digits before and after the point. A source
+// type without a length, as test_decoding prints them, fits any length.
+func pgCompatibleTypes(source, target string) bool {
+	if source == target {
+		return true
+	}
+
+	// base returns typ without its modifiers, e.g. 10 and 2 of numeric(10,2)
+	base := func(typ string) (string, []int) {
+		i := strings.IndexByte(typ, '(')
+		j := strings.IndexByte(typ, ')')
+		if i < 0 || j < i {
+			return typ, nil
+		}
+		var modifiers []int
+		for _, m := range strings.Split(typ[i+1:j], `,`) {
+			n, err := strconv.Atoi(strings.TrimSpace(m))
+			if err != nil {
+				return typ, nil
+			}
+			modifiers = append(modifiers, n)
+		}
+		return strings.TrimSpace(typ[:i]) + typ[j+1:], modifiers
+	}
+	source, sourceModifiers := base(source)
+	target, targetModifiers := base(target)
+
+	// digits returns the digits of a numeric before and after the point
+	digits := func(modifiers []int) (int, int) {
+		switch len(modifiers) {
+		case 1:
+			return modifiers[0], 0
+		case 2:
+			return modifiers[0] - modifiers[1], modifiers[1]
+		}
+		return -1, -1
+	}
+
+	integers := map[string]int{`smallint`: 5, `integer`: 10, `bigint`: 19}
+	if s, ok := integers[source]; ok {
+		if t, ok := integers[target]; ok {
+			return s <= t
+		}
+		whole, _ := digits(targetModifiers)
+		return target == `numeric` && (whole < 0 || s <= whole)
+	}
+
+	if source == `numeric` && target == `numeric` {
+		sourceWhole, sourceFraction := digits(sourceModifiers)
+		targetWhole, targetFraction := digits(targetModifiers)
+		return sourceWhole < 0 || targetWhole < 0 ||
+			(sourceWhole <= targetWhole && sourceFraction <= targetFraction)
+	}
+
+	texts := map[string]bool{`text`: true, `character varying`: true, `character`: true}
+	if texts[source] && texts[target] {
+		return len(sourceModifiers) == 0 || len(targetModifiers) == 0 || sourceModifiers[0] <= targetModifiers[0]
+	}
+
+	return source == target
+}
+
+func pgRemoveColumn(columns, values, types *[]string, name string) {
+	for i := 0; i < len(*columns); i++ {
+		if (*columns)[i] != name {
+			continue
+		}
+
+		*columns = append((*columns)[:i:i], (*columns)[i+1:]...)
+		if i < len(*values) {
+			*values = append((*values)[:i:i], (*values)[i+1:]...)
+		}
+		if i < len(*types) {
+			*types = append((*types)[:i:i], (*types)[i+1:]...)
+		}
+		i--
+	}
+}
@@ -0,0 +1,188 @@
+package pgbarrel
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPostgreSQLCompatibleTypes(t *testing.T) {
+	for _, tt := range []struct {
+		source, target string
+		compatible     bool
+	}{
+		{`integer`, `integer`, true},
+		{`integer`, `bigint`, true},
+		{`bigint`, `integer`, false},
+		{`smallint`, `numeric(10,0)`, true},
+		{`text`, `character varying(20)`, true},
+		{`character varying(10)`, `text`, true},
+		{`character varying(10)`, `character varying(20)`, true},
+		{`character varying(20)`, `character varying(10)`, false},
+		{`character varying`, `character varying(10)`, true},
+		{`character varying`, `character(10)`, true},
+		{`character(3)`, `character varying(5)`, true},
+		{`character`, `character(1)`, true},
+		{`numeric(10,2)`, `numeric`, true},
+		{`numeric`, `numeric(10,2)`, true},
+		{`numeric(10,2)`, `numeric(12,2)`, true},
+		{`numeric(10,2)`, `numeric(10,3)`, false},
+		{`numeric(10,2)`, `numeric(8,2)`, false},
+		{`numeric(10,2)`, `numeric(9,1)`, false},
+		{`numeric(5)`, `numeric(7,2)`, true},
+		{`integer`, `numeric(5,0)`, false},
+		{`bigint`, `numeric(19)`, true},
+		{`timestamp(3) with time zone`, `timestamp with time zone`, true},
+		{`timestamp with time zone`, `timestamp without time zone`, false},
+		{`text`, `integer`, false},
+		{`integer[]`, `integer[]`, true},
+	} {
+		if result := pgCompatibleTypes(tt.source, tt.target); result != tt.compatible {
+			t.Errorf("Expected `%s` into `%s` to be %v, got %v", tt.source, tt.target, tt.compatible, result)
+		}
+	}
+}
+
+type testCatalog struct {
+	tables map[string]map[string]pgTargetColumn
+	loads  []string
+	execs  []string
+}
+
+func (c *testCatalog) check(policy SchemaDriftPolicy) *pgSchemaCheck {
+	return &pgSchemaCheck{
+		policy: policy,
+		tables: make(map[string]map[string]pgTargetColumn),
+		drifts: make(map[string]map[SchemaDrift]bool),
+		load: func(target string) (map[string]pgTargetColumn, error) {
+			c.loads = append(c.loads, target)
+			return c.tables[target], nil
+		},
+		exec: func(sql string) error {
+			c.execs = append(c.execs, sql)
+			return nil
+		},
+	}
+}
+
+func TestPostgreSQLSchemaCheck(t *testing.T) {
+	insert := func() *ReplicationOperation {
+		return &ReplicationOperation{Position: `0/10`, Operation: `INSERT`, Target: `public.normal`,
+			NewColumns: []string{`id`, `value`, `note`},
+			NewValues:  []string{`1`, `'a'`, `'b'`},
+			NewTypes:   []string{`integer`, `text`, `text`}}
+	}
+
+	var emitted []*ReplicationOperation
+	emit := func(op *ReplicationOperation) error {
+		emitted = append(emitted, op)
+		return nil
+	}
+
+	t.Run("Match", func(t *testing.T) {
+		catalog := &testCatalog{tables: map[string]map[string]pgTargetColumn{`public.normal`: {
+			`id`: {typ: `bigint`, notNull: true}, `value`: {typ: `text`}, `note`: {typ: `character varying(10)`},
+		}}}
+		check := catalog.check(DriftStop)
+
+		emitted = nil
+		assert.NoError(t, check.Transform(context.Background(), insert(), emit))
+		assert.NoError(t, check.Transform(context.Background(), insert(), emit))
+		assert.NoError(t, check.Transform(context.Background(), &ReplicationOperation{Operation: `COMMIT`}, emit))
+		assert.Len(t, emitted, 3)
+		assert.Equal(t, []string{`public.normal`}, catalog.loads, "Expected the catalog to be cached")
+	})
+
+	t.Run("Refresh", func(t *testing.T) {
+		catalog := &testCatalog{tables: map[string]map[string]pgTargetColumn{`public.normal`: {
+			`id`: {typ: `integer`}, `value`: {typ: `text`},
+		}}}
+		check := catalog.check(DriftStop)
+
+		assert.NoError(t, check.Transform(context.Background(), &ReplicationOperation{Operation: `DELETE`, Target: `public.normal`,
+			OldColumns: []string{`id`}, OldValues: []string{`1`}, OldTypes: []string{`integer`}}, emit))
+
+		catalog.tables[`public.normal`] = map[string]pgTargetColumn{
+			`id`: {typ: `integer`}, `value`: {typ: `text`}, `note`: {typ: `text`},
+		}
+		assert.NoError(t, check.Transform(context.Background(), insert(), emit))
+		assert.Equal(t, []string{`public.normal`, `public.normal`}, catalog.loads)
+	})
+
+	t.Run("Stop", func(t *testing.T) {
+		catalog := &testCatalog{tables: map[string]map[string]pgTargetColumn{`public.normal`: {
+			`id`: {typ: `smallint`}, `value`: {typ: `text`}, `extra`: {typ: `text`, notNull: true},
+			`defaulted`: {typ: `text`, notNull: true, hasDefault: true},
+		}}}
+		check := catalog.check(DriftStop)
+
+		var reported []SchemaDrift
+		check.OnDrift(func(d SchemaDrift) { reported = append(reported, d) })
+
+		emitted = nil
+		err := check.Transform(context.Background(), insert(), emit)
+		require.IsType(t, &SchemaDriftError{}, err)
+		assert.Empty(t, emitted)
+
+		drifts := err.(*SchemaDriftError).Drifts
+		assert.ElementsMatch(t, []SchemaDrift{
+			{Kind: DriftTypeMismatch, Target: `public.normal`, Column: `id`, SourceType: `integer`, TargetType: `smallint`},
+			{Kind: DriftMissingColumn, Target: `public.normal`, Column: `note`, SourceType: `text`},
+			{Kind: DriftNotNullColumn, Target: `public.normal`, Column: `extra`, TargetType: `text`},
+		}, drifts)
+		assert.ElementsMatch(t, drifts, reported)
+		assert.Contains(t, err.Error(), `column note of public.normal (text) is missing on the target`)
+
+		err = check.Transform(context.Background(), &ReplicationOperation{Operation: `INSERT`, Target: `public.missing`}, emit)
+		require.IsType(t, &SchemaDriftError{}, err)
+		assert.Equal(t, []SchemaDrift{{Kind: DriftMissingTable, Target: `public.missing`}}, err.(*SchemaDriftError).Drifts)
+	})
+
+	t.Run("SkipColumn", func(t *testing.T) {
+		catalog := &testCatalog{tables: map[string]map[string]pgTargetColumn{`public.normal`: {
+			`id`: {typ: `integer`}, `value`: {typ: `integer`},
+		}}}
+		check := catalog.check(DriftSkipColumn)
+
+		var reported []SchemaDrift
+		check.OnDrift(func(d SchemaDrift) { reported = append(reported, d) })
+
+		emitted = nil
+		for i := 0; i < 3; i++ {
+			assert.NoError(t, check.Transform(context.Background(), insert(), emit))
+		}
+		require.Len(t, emitted, 3)
+		assert.Equal(t, []string{`id`}, emitted[0].NewColumns)
+		assert.Equal(t, []string{`1`}, emitted[0].NewValues)
+		assert.Equal(t, []string{`integer`}, emitted[0].NewTypes)
+		assert.Len(t, reported, 2, "Expected each drift to be reported once")
+		assert.Equal(t, []string{`public.normal`, `public.normal`}, catalog.loads,
+			"Expected the catalog to be reloaded once for the drifts")
+
+		assert.NoError(t, check.Transform(context.Background(), &ReplicationOperation{Operation: `DDL`, Target: `public.other`}, emit))
+		assert.NoError(t, check.Transform(context.Background(), insert(), emit))
+		assert.Len(t, reported, 2, "Expected DDL on another table to change nothing")
+
+		assert.NoError(t, check.Transform(context.Background(), &ReplicationOperation{Operation: `DDL`, Target: `public.other, public.normal`}, emit))
+		assert.NoError(t, check.Transform(context.Background(), insert(), emit))
+		assert.Len(t, reported, 4, "Expected drifts to be found again after DDL on each of its tables")
+	})
+
+	t.Run("AddColumn", func(t *testing.T) {
+		catalog := &testCatalog{tables: map[string]map[string]pgTargetColumn{`public.normal`: {
+			`id`: {typ: `integer`}, `value`: {typ: `text`},
+		}}}
+		check := catalog.check(DriftAddColumn)
+
+		emitted = nil
+		assert.NoError(t, check.Transform(context.Background(), insert(), emit))
+		assert.Len(t, emitted, 1)
+		assert.Equal(t, []string{`ALTER TABLE public.normal ADD COLUMN note text`}, catalog.execs)
+
+		catalog.tables[`public.normal`][`note`] = pgTargetColumn{typ: `text`}
+		assert.NoError(t, check.Transform(context.Background(), insert(), emit))
+		assert.Len(t, catalog.execs, 1)
+	})
+}
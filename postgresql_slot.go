@@ -0,0 +1,112 @@
+package pgbarrel
+
+import (
+	"github.com/jackc/pgx"
+	"github.com/pkg/errors"
+)
+
+// PostgreSQLSlot describes a logical replication slot and how far its
+// consumer is behind the server.
+type PostgreSQLSlot struct {
+	Name, Plugin, Database string
+	Active                 bool
+
+	// RestartPosition is the oldest WAL the slot retains; AppliedPosition is
+	// the last position acknowledged by its consumer.
+	RestartPosition, AppliedPosition string
+
+	// LagBytes is the amount of WAL written since AppliedPosition.
+	LagBytes uint64
+}
+
+func CreatePostgreSQLSlot(conn string, slot, plugin string) error {
+	if _, ok := pgDecoders[plugin]; !ok {
+		return errors.Errorf("Unknown PostgreSQL logical decoding output plugin: %q", plugin)
+	}
+
+	cfg, err := pgx.ParseConnectionString(conn)
+	if err != nil {
+		return err
+	}
+
+	rc, err := pgx.ReplicationConnect(cfg)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	return rc.CreateReplicationSlot(slot, plugin)
+}
+
+func DropPostgreSQLSlot(conn string, slot string) error {
+	cfg, err := pgx.ParseConnectionString(conn)
+	if err != nil {
+		return err
+	}
+
+	rc, err := pgx.ReplicationConnect(cfg)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	return rc.DropReplicationSlot(slot)
+}
+
+// ListPostgreSQLSlots returns the logical replication slots of the server.
+func ListPostgreSQLSlots(conn string) ([]PostgreSQLSlot, error) {
+	cfg, err := pgx.ParseConnectionString(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := pgx.Connect(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	var version int32
+	if err = c.QueryRow(`SELECT current_setting('server_version_num')::int`).Scan(&version); err != nil {
+		return nil, err
+	}
+
+	// functions were renamed from "xlog" to "wal" in PostgreSQL 10
+	current := `pg_current_wal_lsn()`
+	if version < 100000 {
+		current = `pg_current_xlog_location()`
+	}
+
+	rows, err := c.Query(`
+		SELECT slot_name::text, plugin::text, database::text, active,
+		       coalesce(restart_lsn::text, ''), coalesce(confirmed_flush_lsn::text, ''),
+		       coalesce(` + current + `::text, '')
+		  FROM pg_replication_slots
+		 WHERE slot_type = 'logical'
+		 ORDER BY slot_name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var slots []PostgreSQLSlot
+	for rows.Next() {
+		var slot PostgreSQLSlot
+		var position string
+
+		if err = rows.Scan(&slot.Name, &slot.Plugin, &slot.Database, &slot.Active,
+			&slot.RestartPosition, &slot.AppliedPosition, &position); err != nil {
+			return nil, err
+		}
+
+		if current, err := pgx.ParseLSN(position); err == nil {
+			if applied, err := pgx.ParseLSN(slot.AppliedPosition); err == nil && current > applied {
+				slot.LagBytes = current - applied
+			}
+		}
+
+		slots = append(slots, slot)
+	}
+
+	return slots, rows.Err()
+}
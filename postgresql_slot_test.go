@@ -0,0 +1,34 @@
+package pgbarrel
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPostgreSQLSlots(t *testing.T) {
+	s := new(pgserver)
+	s.start(t)
+	defer s.stop(t)
+
+	conn := "host=" + s.directory + " dbname=postgres"
+
+	assert.Error(t, CreatePostgreSQLSlot(conn, "pgbarrel_test", "unknown"))
+	require.NoError(t, CreatePostgreSQLSlot(conn, "pgbarrel_test", "test_decoding"))
+
+	slots, err := ListPostgreSQLSlots(conn)
+	require.NoError(t, err)
+	require.Len(t, slots, 1)
+	assert.Equal(t, "pgbarrel_test", slots[0].Name)
+	assert.Equal(t, "test_decoding", slots[0].Plugin)
+	assert.Equal(t, "postgres", slots[0].Database)
+	assert.False(t, slots[0].Active)
+	assert.NotEmpty(t, slots[0].AppliedPosition)
+
+	require.NoError(t, DropPostgreSQLSlot(conn, "pgbarrel_test"))
+
+	slots, err = ListPostgreSQLSlots(conn)
+	require.NoError(t, err)
+	assert.Empty(t, slots)
+}
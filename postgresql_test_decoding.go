@@ -3,6 +3,8 @@ package pgbarrel
 import (
 	"bytes"
 	"regexp"
+	"strings"
+	"time"
 )
 
 type pgTestDecoding struct{}
@@ -16,6 +18,8 @@ func (p pgTestDecoding) Parse(input []byte, output *ReplicationOperation) error
 	output.NewColumns = output.NewColumns[:0]
 	output.OldValues = output.OldValues[:0]
 	output.NewValues = output.NewValues[:0]
+	output.OldTypes = output.OldTypes[:0]
+	output.NewTypes = output.NewTypes[:0]
 
 	if len(input) < 1 {
 		panic(`FIXME`)
@@ -39,6 +43,18 @@ func (p pgTestDecoding) Parse(input []byte, output *ReplicationOperation) error
 
 	current, target := pgParseIdentifier(input[6:])
 
+	// TRUNCATE lists every table truncated together
+	for bytes.HasPrefix(current, []byte(`, `)) {
+		current, _ = pgParseIdentifier(current[2:])
+		target = input[6 : len(input)-len(current)]
+	}
+
+	if bytes.HasPrefix(current, []byte(`: TRUNCATE:`)) {
+		output.Target = string(target)
+		output.Operation = `TRUNCATE`
+		return nil
+	}
+
 	if !bytes.HasPrefix(current, []byte(`: `)) {
 		panic(`FIXME`)
 	}
@@ -70,7 +86,7 @@ func (p pgTestDecoding) Parse(input []byte, output *ReplicationOperation) error
 	return nil
 }
 
-func (pgTestDecoding) parseColumn(src []byte) (remaining, name, value []byte, err error) {
+func (pgTestDecoding) parseColumn(src []byte) (remaining, name, typ, value []byte, err error) {
 	src, name = pgParseIdentifier(src)
 
 	match := pgTestDecodingTypeRegexp.Find(src)
@@ -78,26 +94,28 @@ func (pgTestDecoding) parseColumn(src []byte) (remaining, name, value []byte, er
 		panic(`FIXME`)
 	}
 
+	typ = match[1 : len(match)-2]
 	src, value = pgParseConstant(src[len(match):])
 
 	if len(src) > 0 && src[0] == ' ' {
 		src = src[1:]
 	}
 
-	return src, name, value, nil
+	return src, name, typ, value, nil
 }
 
 func (p pgTestDecoding) parseDelete(input []byte, output *ReplicationOperation) error {
 	var err error
-	var name, value []byte
+	var name, typ, value []byte
 
 	for len(input) > 0 {
-		if input, name, value, err = p.parseColumn(input); err != nil {
+		if input, name, typ, value, err = p.parseColumn(input); err != nil {
 			return err
 		}
 
 		output.OldColumns = append(output.OldColumns, string(name))
 		output.OldValues = append(output.OldValues, string(value))
+		output.OldTypes = append(output.OldTypes, string(typ))
 	}
 
 	return nil
@@ -105,15 +123,16 @@ func (p pgTestDecoding) parseDelete(input []byte, output *ReplicationOperation)
 
 func (p pgTestDecoding) parseInsert(input []byte, output *ReplicationOperation) error {
 	var err error
-	var name, value []byte
+	var name, typ, value []byte
 
 	for len(input) > 0 {
-		if input, name, value, err = p.parseColumn(input); err != nil {
+		if input, name, typ, value, err = p.parseColumn(input); err != nil {
 			return err
 		}
 
 		output.NewColumns = append(output.NewColumns, string(name))
 		output.NewValues = append(output.NewValues, string(value))
+		output.NewTypes = append(output.NewTypes, string(typ))
 	}
 
 	return nil
@@ -121,18 +140,19 @@ func (p pgTestDecoding) parseInsert(input []byte, output *ReplicationOperation)
 
 func (p pgTestDecoding) parseUpdate(input []byte, output *ReplicationOperation) error {
 	var err error
-	var name, value []byte
+	var name, typ, value []byte
 
 	if bytes.HasPrefix(input, []byte(`old-key: `)) {
 		input = input[9:]
 
 		for len(input) > 0 {
-			if input, name, value, err = p.parseColumn(input); err != nil {
+			if input, name, typ, value, err = p.parseColumn(input); err != nil {
 				return err
 			}
 
 			output.OldColumns = append(output.OldColumns, string(name))
 			output.OldValues = append(output.OldValues, string(value))
+			output.OldTypes = append(output.OldTypes, string(typ))
 
 			if bytes.HasPrefix(input, []byte(`new-tuple: `)) {
 				input = input[11:]
@@ -142,13 +162,25 @@ func (p pgTestDecoding) parseUpdate(input []byte, output *ReplicationOperation)
 	}
 
 	for len(input) > 0 {
-		if input, name, value, err = p.parseColumn(input); err != nil {
+		if input, name, typ, value, err = p.parseColumn(input); err != nil {
 			return err
 		}
 
 		output.NewColumns = append(output.NewColumns, string(name))
 		output.NewValues = append(output.NewValues, string(value))
+		output.NewTypes = append(output.NewTypes, string(typ))
 	}
 
 	return nil
 }
+
+// pgCommitTime returns the time of a COMMIT decoded with include-timestamp,
+// e.g. "553 (at 2017-05-01 12:00:00.123456+00)".
+func pgCommitTime(target string) (time.Time, bool) {
+	i := strings.Index(target, " (at ")
+	if i < 0 || !strings.HasSuffix(target, ")") {
+		return time.Time{}, false
+	}
+	t, err := pgParseTimestamp(target[i+5:len(target)-1], true)
+	return t, err == nil
+}
@@ -20,18 +20,30 @@ func TestPostgreSQLTestDecodingParse(t *testing.T) {
 			Target:    `553`,
 		}},
 
+		// Truncate
+		{`table public.contents: TRUNCATE: (no-flags)`, ReplicationOperation{
+			Operation: `TRUNCATE`,
+			Target:    `public.contents`,
+		}},
+		{`table public.contents, public."sp ace": TRUNCATE: restart_seqs cascade`, ReplicationOperation{
+			Operation: `TRUNCATE`,
+			Target:    `public.contents, public."sp ace"`,
+		}},
+
 		// Insert unary ID
 		{`table public.contents: INSERT: id[integer]:1 value[text]:'a'`, ReplicationOperation{
 			Operation:  `INSERT`,
 			Target:     `public.contents`,
 			NewColumns: []string{`id`, `value`},
 			NewValues:  []string{`1`, `'a'`},
+			NewTypes:   []string{`integer`, `text`},
 		}},
 		{`table public."from": INSERT: id[integer]:2 value[text]:'b'`, ReplicationOperation{
 			Operation:  `INSERT`,
 			Target:     `public."from"`,
 			NewColumns: []string{`id`, `value`},
 			NewValues:  []string{`2`, `'b'`},
+			NewTypes:   []string{`integer`, `text`},
 		}},
 
 		// Insert binary ID
@@ -40,6 +52,7 @@ func TestPostgreSQLTestDecodingParse(t *testing.T) {
 			Target:     `public."sp ace"`,
 			NewColumns: []string{`id1`, `id2`, `value`},
 			NewValues:  []string{`3`, `92`, `'c'`},
+			NewTypes:   []string{`integer`, `integer`, `text`},
 		}},
 
 		// Update unary ID
@@ -48,16 +61,20 @@ func TestPostgreSQLTestDecodingParse(t *testing.T) {
 			Target:     `public.contents`,
 			OldColumns: []string{`id`},
 			OldValues:  []string{`1`},
+			OldTypes:   []string{`integer`},
 			NewColumns: []string{`id`, `value`},
 			NewValues:  []string{`11`, `'m'`},
+			NewTypes:   []string{`integer`, `text`},
 		}},
 		{`table public."from": UPDATE: old-key: id[integer]:2 new-tuple: id[integer]:12 value[text]:'b'`, ReplicationOperation{
 			Operation:  `UPDATE`,
 			Target:     `public."from"`,
 			OldColumns: []string{`id`},
 			OldValues:  []string{`2`},
+			OldTypes:   []string{`integer`},
 			NewColumns: []string{`id`, `value`},
 			NewValues:  []string{`12`, `'b'`},
+			NewTypes:   []string{`integer`, `text`},
 		}},
 
 		// Update binary ID
@@ -66,8 +83,10 @@ func TestPostgreSQLTestDecodingParse(t *testing.T) {
 			Target:     `public."sp ace"`,
 			OldColumns: []string{`id1`, `id2`},
 			OldValues:  []string{`3`, `92`},
+			OldTypes:   []string{`integer`, `integer`},
 			NewColumns: []string{`id1`, `id2`, `value`},
 			NewValues:  []string{`13`, `92`, `'c'`},
+			NewTypes:   []string{`integer`, `integer`, `text`},
 		}},
 
 		// Delete unary ID
@@ -76,12 +95,14 @@ func TestPostgreSQLTestDecodingParse(t *testing.T) {
 			Target:     `public.contents`,
 			OldColumns: []string{`id`},
 			OldValues:  []string{`1`},
+			OldTypes:   []string{`integer`},
 		}},
 		{`table public."from": DELETE: id[integer]:2`, ReplicationOperation{
 			Operation:  `DELETE`,
 			Target:     `public."from"`,
 			OldColumns: []string{`id`},
 			OldValues:  []string{`2`},
+			OldTypes:   []string{`integer`},
 		}},
 
 		// Delete binary ID
@@ -90,6 +111,16 @@ func TestPostgreSQLTestDecodingParse(t *testing.T) {
 			Target:     `public."sp ace"`,
 			OldColumns: []string{`id1`, `id2`},
 			OldValues:  []string{`3`, `92`},
+			OldTypes:   []string{`integer`, `integer`},
+		}},
+
+		// Types
+		{`table public.flags: INSERT: id[bigint]:4 enabled[boolean]:true at[timestamp with time zone]:'2017-06-27 12:00:00+00'`, ReplicationOperation{
+			Operation:  `INSERT`,
+			Target:     `public.flags`,
+			NewColumns: []string{`id`, `enabled`, `at`},
+			NewValues:  []string{`4`, `true`, `'2017-06-27 12:00:00+00'`},
+			NewTypes:   []string{`bigint`, `boolean`, `timestamp with time zone`},
 		}},
 
 		// Escaping
@@ -98,12 +129,14 @@ func TestPostgreSQLTestDecodingParse(t *testing.T) {
 			Target:     `"from"." : DELETE: "`,
 			NewColumns: []string{`" key[] "`, `arr`},
 			NewValues:  []string{`5`, `'{1,2,3}'`},
+			NewTypes:   []string{`integer`, `integer[]`},
 		}},
 		{`table "from"." tbl[] ": INSERT: " : DELETE: "[integer]:5 arr[integer[]]:'{1,2,3}'`, ReplicationOperation{
 			Operation:  `INSERT`,
 			Target:     `"from"." tbl[] "`,
 			NewColumns: []string{`" : DELETE: "`, `arr`},
 			NewValues:  []string{`5`, `'{1,2,3}'`},
+			NewTypes:   []string{`integer`, `integer[]`},
 		}},
 	} {
 		var result ReplicationOperation
@@ -121,6 +154,8 @@ func TestPostgreSQLTestDecodingParse(t *testing.T) {
 			OldValues:  make([]string, 5),
 			NewColumns: make([]string, 5),
 			NewValues:  make([]string, 5),
+			OldTypes:   make([]string, 5),
+			NewTypes:   make([]string, 5),
 		}
 
 		if err := new(pgTestDecoding).Parse([]byte(tt.message), &result); err != nil {
@@ -139,6 +174,12 @@ func TestPostgreSQLTestDecodingParse(t *testing.T) {
 		if len(result.NewValues) == 0 {
 			result.NewValues = nil
 		}
+		if len(result.OldTypes) == 0 {
+			result.OldTypes = nil
+		}
+		if len(result.NewTypes) == 0 {
+			result.NewTypes = nil
+		}
 
 		if !reflect.DeepEqual(result, tt.expected) {
 			t.Errorf("Expected initialized `%s` to be %v, got %v", tt.message, tt.expected, result)
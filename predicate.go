@@ -0,0 +1,546 @@
+package pgbarrel
+
+import (
+	"bytes"
+	"math/big"
+	"path"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// A Predicate is a boolean expression over the columns of a row, such as
+// `tenant_id = 42 AND status <> 'draft'`. Columns are compared by the type
+// reported by the decoder: numerically for numeric types and as text
+// otherwise. NULL follows SQL's three-valued logic.
+//
+// Supported are the comparisons =, <>, !=, <, <=, >, >=, IS [NOT] NULL and
+// [NOT] IN (...), combined with AND, OR, NOT and parentheses.
+type Predicate struct {
+	expression string
+	root       predicateNode
+}
+
+const (
+	predicateNull = iota
+	predicateBool
+	predicateNumber
+	predicateText
+)
+
+type predicateValue struct {
+	kind   int
+	truth  bool
+	number float64
+	text   string
+}
+
+type predicateRow struct {
+	columns, values, types []string
+	complete               bool
+}
+
+type predicateNode func(*predicateRow) predicateValue
+
+func CompilePredicate(expression string) (*Predicate, error) {
+	p := predicateParser{expression: expression, src: []byte(expression)}
+
+	root, err := p.parseOr()
+	if err == nil && len(p.skipSpace()) > 0 {
+		err = p.unexpected()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Predicate{expression: expression, root: root}, nil
+}
+
+func (p *Predicate) String() string { return p.expression }
+
+// Eval reports whether the row satisfies p. A NULL result does not satisfy p.
+// When the result depends on a column that is not in the row, complete is
+// false.
+func (p *Predicate) Eval(columns, values, types []string) (match, complete bool) {
+	row := predicateRow{columns: columns, values: values, types: types, complete: true}
+	result := p.root(&row)
+	return result.kind == predicateBool && result.truth, row.complete
+}
+
+func (r *predicateRow) lookup(column string) predicateValue {
+	for i := range r.columns {
+		if r.columns[i] != column {
+			continue
+		}
+
+		value, null := pgUnquoteConstant(r.values[i])
+		if null {
+			return predicateValue{}
+		}
+
+		var typ string
+		if i < len(r.types) {
+			typ = r.types[i]
+		}
+
+		if typ == `boolean` {
+			return predicateValue{kind: predicateBool, truth: strings.EqualFold(value, `true`), text: value}
+		}
+		if pgIsNumericType(typ) {
+			if n, err := strconv.ParseFloat(value, 64); err == nil {
+				return predicateValue{kind: predicateNumber, number: n, text: value}
+			}
+		}
+		return predicateValue{kind: predicateText, text: value}
+	}
+
+	r.complete = false
+	return predicateValue{}
+}
+
+func predicateDecimal(text string) (*big.Rat, bool) {
+	if strings.IndexByte(text, '/') >= 0 {
+		return nil, false
+	}
+	return new(big.Rat).SetString(text)
+}
+
+func predicateCompare(a, b predicateValue) (int, bool) {
+	if a.kind == predicateNull || b.kind == predicateNull {
+		return 0, false
+	}
+
+	if a.kind == predicateNumber || b.kind == predicateNumber {
+		// Decimals compare exactly, so that integers beyond the precision
+		// of float64 are told apart.
+		if x, ok := predicateDecimal(a.text); ok {
+			if y, ok := predicateDecimal(b.text); ok {
+				return x.Cmp(y), true
+			}
+		}
+
+		x, y := a.number, b.number
+		if a.kind != predicateNumber {
+			if n, err := strconv.ParseFloat(a.text, 64); err == nil {
+				x = n
+			} else {
+				return strings.Compare(a.text, b.text), true
+			}
+		}
+		if b.kind != predicateNumber {
+			if n, err := strconv.ParseFloat(b.text, 64); err == nil {
+				y = n
+			} else {
+				return strings.Compare(a.text, b.text), true
+			}
+		}
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	}
+
+	if a.kind == predicateBool && b.kind == predicateBool {
+		switch {
+		case a.truth == b.truth:
+			return 0, true
+		case b.truth:
+			return -1, true
+		}
+		return 1, true
+	}
+
+	return strings.Compare(a.text, b.text), true
+}
+
+func predicateTruth(truth bool) predicateValue {
+	return predicateValue{kind: predicateBool, truth: truth}
+}
+
+type predicateParser struct {
+	expression string
+	src        []byte
+}
+
+func (p *predicateParser) unexpected() error {
+	if len(p.src) == 0 {
+		return errors.Errorf("Unexpected end of predicate %q", p.expression)
+	}
+	return errors.Errorf("Unexpected %q in predicate %q", p.src, p.expression)
+}
+
+func (p *predicateParser) skipSpace() []byte {
+	p.src = bytes.TrimLeft(p.src, " \t\r\n")
+	return p.src
+}
+
+func (p *predicateParser) keyword(word string) bool {
+	src := p.skipSpace()
+
+	if !pgHasKeyword(src, word) {
+		return false
+	}
+	if c, _ := utf8.DecodeRune(src[len(word):]); len(src) > len(word) && pgIsIdentifier(c) {
+		return false
+	}
+
+	p.src = src[len(word):]
+	return true
+}
+
+func (p *predicateParser) symbol(symbol string) bool {
+	if bytes.HasPrefix(p.skipSpace(), []byte(symbol)) {
+		p.src = p.src[len(symbol):]
+		return true
+	}
+	return false
+}
+
+func (p *predicateParser) parseOr() (predicateNode, error) {
+	left, err := p.parseAnd()
+
+	for err == nil && p.keyword(`or`) {
+		var right predicateNode
+		if right, err = p.parseAnd(); err == nil {
+			left = predicateOr(left, right)
+		}
+	}
+
+	return left, err
+}
+
+func (p *predicateParser) parseAnd() (predicateNode, error) {
+	left, err := p.parseNot()
+
+	for err == nil && p.keyword(`and`) {
+		var right predicateNode
+		if right, err = p.parseNot(); err == nil {
+			left = predicateAnd(left, right)
+		}
+	}
+
+	return left, err
+}
+
+func (p *predicateParser) parseNot() (predicateNode, error) {
+	if p.keyword(`not`) {
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return func(r *predicateRow) predicateValue {
+			v := operand(r)
+			if v.kind != predicateBool {
+				return predicateValue{}
+			}
+			return predicateTruth(!v.truth)
+		}, nil
+	}
+
+	return p.parseComparison()
+}
+
+func (p *predicateParser) parseComparison() (predicateNode, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.keyword(`is`) {
+		negate := p.keyword(`not`)
+		if !p.keyword(`null`) {
+			return nil, p.unexpected()
+		}
+		return func(r *predicateRow) predicateValue {
+			return predicateTruth((left(r).kind == predicateNull) != negate)
+		}, nil
+	}
+
+	if negate := p.keyword(`not`); negate || p.keyword(`in`) {
+		if negate && !p.keyword(`in`) {
+			return nil, p.unexpected()
+		}
+		return p.parseIn(left, negate)
+	}
+
+	for _, op := range []string{`<=`, `>=`, `<>`, `!=`, `=`, `<`, `>`} {
+		if !p.symbol(op) {
+			continue
+		}
+
+		right, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+
+		test := map[string]func(int) bool{
+			`<=`: func(c int) bool { return c <= 0 },
+			`>=`: func(c int) bool { return c >= 0 },
+			`<>`: func(c int) bool { return c != 0 },
+			`!=`: func(c int) bool { return c != 0 },
+			`=`:  func(c int) bool { return c == 0 },
+			`<`:  func(c int) bool { return c < 0 },
+			`>`:  func(c int) bool { return c > 0 },
+		}[op]
+
+		return func(r *predicateRow) predicateValue {
+			if c, ok := predicateCompare(left(r), right(r)); ok {
+				return predicateTruth(test(c))
+			}
+			return predicateValue{}
+		}, nil
+	}
+
+	return left, nil
+}
+
+func (p *predicateParser) parseIn(left predicateNode, negate bool) (predicateNode, error) {
+	var list []predicateNode
+
+	if !p.symbol(`(`) {
+		return nil, p.unexpected()
+	}
+	for {
+		item, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, item)
+
+		if p.symbol(`)`) {
+			break
+		}
+		if !p.symbol(`,`) {
+			return nil, p.unexpected()
+		}
+	}
+
+	return func(r *predicateRow) predicateValue {
+		value, unknown := left(r), false
+
+		for _, item := range list {
+			c, ok := predicateCompare(value, item(r))
+			if ok && c == 0 {
+				return predicateTruth(!negate)
+			}
+			unknown = unknown || !ok
+		}
+
+		if unknown {
+			return predicateValue{}
+		}
+		return predicateTruth(negate)
+	}, nil
+}
+
+func (p *predicateParser) parseOperand() (predicateNode, error) {
+	if p.symbol(`(`) {
+		node, err := p.parseOr()
+		if err == nil && !p.symbol(`)`) {
+			err = p.unexpected()
+		}
+		return node, err
+	}
+
+	for _, keyword := range []string{`null`, `true`, `false`} {
+		if p.keyword(keyword) {
+			value := predicateValue{kind: predicateBool, truth: keyword == `true`, text: keyword}
+			if keyword == `null` {
+				value = predicateValue{}
+			}
+			return func(*predicateRow) predicateValue { return value }, nil
+		}
+	}
+
+	src := p.skipSpace()
+	if c, _ := utf8.DecodeRune(src); c == '\'' || c == '-' || c == '+' || c == '.' || ('0' <= c && c <= '9') {
+		remaining, constant := pgParseConstant(src)
+		if constant == nil {
+			return nil, p.unexpected()
+		}
+		p.src = remaining
+
+		value := predicateValue{kind: predicateText}
+		value.text, _ = pgUnquoteConstant(string(constant))
+		if c != '\'' {
+			if n, err := strconv.ParseFloat(value.text, 64); err == nil {
+				value.kind, value.number = predicateNumber, n
+			}
+		}
+		return func(*predicateRow) predicateValue { return value }, nil
+	}
+
+	remaining, identifier := pgParseIdentifier(src)
+	if identifier == nil {
+		return nil, p.unexpected()
+	}
+	p.src = remaining
+
+	// unquoted identifiers fold to lower case
+	column := string(identifier)
+	if !bytes.ContainsRune(identifier, '"') {
+		column = strings.ToLower(column)
+	}
+	return func(r *predicateRow) predicateValue { return r.lookup(column) }, nil
+}
+
+func predicateAnd(left, right predicateNode) predicateNode {
+	return func(r *predicateRow) predicateValue {
+		a, b := left(r), right(r)
+		switch {
+		case a.kind == predicateBool && !a.truth, b.kind == predicateBool && !b.truth:
+			return predicateTruth(false)
+		case a.kind == predicateBool && b.kind == predicateBool:
+			return predicateTruth(true)
+		}
+		return predicateValue{}
+	}
+}
+
+func predicateOr(left, right predicateNode) predicateNode {
+	return func(r *predicateRow) predicateValue {
+		a, b := left(r), right(r)
+		switch {
+		case a.kind == predicateBool && a.truth, b.kind == predicateBool && b.truth:
+			return predicateTruth(true)
+		case a.kind == predicateBool && b.kind == predicateBool:
+			return predicateTruth(false)
+		}
+		return predicateValue{}
+	}
+}
+
+// A RowFilter passes only the rows of each table that satisfy the predicate
+// for that table, so the target holds a correct subset of the source.
+// Operations on other tables pass unchanged.
+type RowFilter struct {
+	// Keys names the key columns of each target. The DELETE of a row that
+	// leaves the filter, when its UPDATE has no old values, has only these
+	// columns of the new row, or none when the target has no keys.
+	Keys map[string][]string
+
+	predicates map[string]*Predicate
+}
+
+// NewRowFilter compiles one predicate for each target, e.g. "public.orders".
+func NewRowFilter(predicates map[string]string) (*RowFilter, error) {
+	f := RowFilter{predicates: make(map[string]*Predicate, len(predicates))}
+
+	for target, expression := range predicates {
+		p, err := CompilePredicate(expression)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid filter for %s", target)
+		}
+		f.predicates[target] = p
+	}
+
+	return &f, nil
+}
+
+// Filter reports whether op should reach the target. An UPDATE that moves a
+// row into the filter becomes an INSERT and one that moves a row out of the
+// filter becomes a DELETE.
+//
+// The old values of an UPDATE are known only for columns of the replica
+// identity. When the predicate depends on other columns, the target may or
+// may not have the row: the UPDATE becomes an INSERT, which a Sink should
+// write as an upsert by the keys of the target, when its new values match and
+// a DELETE by those keys otherwise. When its key changed as well, Transform
+// deletes the row under the old key first.
+func (f *RowFilter) Filter(op *ReplicationOperation) bool {
+	pass, _ := f.filter(op)
+	return pass
+}
+
+// filter is Filter that also returns a DELETE to emit before op, if any.
+func (f *RowFilter) filter(op *ReplicationOperation) (bool, *ReplicationOperation) {
+	p, ok := f.predicates[op.Target]
+	if !ok {
+		return true, nil
+	}
+
+	switch op.Operation {
+	case `INSERT`, `READ`:
+		match, _ := p.Eval(op.NewColumns, op.NewValues, op.NewTypes)
+		return match, nil
+
+	case `DELETE`:
+		match, complete := p.Eval(op.OldColumns, op.OldValues, op.OldTypes)
+		return match || !complete, nil
+
+	case `UPDATE`:
+		was, complete := p.Eval(op.OldColumns, op.OldValues, op.OldTypes)
+		is, _ := p.Eval(op.NewColumns, op.NewValues, op.NewTypes)
+
+		switch {
+		case is && was:
+			return true, nil
+
+		case is:
+			var before *ReplicationOperation
+			if !complete && len(op.OldColumns) > 0 {
+				before = &ReplicationOperation{Position: op.Position, Operation: `DELETE`, Target: op.Target,
+					OldColumns: op.OldColumns, OldValues: op.OldValues, OldTypes: op.OldTypes}
+			}
+			op.Operation = `INSERT`
+			op.OldColumns, op.OldValues, op.OldTypes = nil, nil, nil
+			return true, before
+
+		case was || !complete:
+			op.Operation = `DELETE`
+			if len(op.OldColumns) == 0 {
+				// the key did not change, but other columns may have
+				for _, key := range f.Keys[op.Target] {
+					for i, name := range op.NewColumns {
+						if name == pgQuoteIdentifier(key) && i < len(op.NewValues) {
+							op.OldColumns = append(op.OldColumns, name)
+							op.OldValues = append(op.OldValues, op.NewValues[i])
+							if i < len(op.NewTypes) {
+								op.OldTypes = append(op.OldTypes, op.NewTypes[i])
+							}
+						}
+					}
+				}
+			}
+			op.NewColumns, op.NewValues, op.NewTypes = nil, nil, nil
+			return true, nil
+		}
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// A TableFilter passes operations on targets that match any pattern of
+// Include, or every target when Include is empty, and no pattern of Exclude.
+// Patterns are those of path.Match, e.g. "public.*". BEGIN, COMMIT and DDL,
+// and operations without a target, always pass.
+type TableFilter struct {
+	Include, Exclude []string
+}
+
+func (f TableFilter) Filter(op *ReplicationOperation) bool {
+	switch op.Operation {
+	case `BEGIN`, `COMMIT`, `DDL`:
+		return true
+	}
+	if op.Target == `` {
+		return true
+	}
+
+	matches := func(patterns []string) bool {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, op.Target); ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	return (len(f.Include) == 0 || matches(f.Include)) && !matches(f.Exclude)
+}
@@ -0,0 +1,243 @@
+package pgbarrel
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestPredicateEval(t *testing.T) {
+	var (
+		columns = []string{`id`, `tenant_id`, `status`, `score`, `active`, `note`, `" key "`, `big`}
+		values  = []string{`7`, `42`, `'draft'`, `1.5`, `true`, `null`, `'it''s'`, `9007199254740993`}
+		types   = []string{`integer`, `bigint`, `text`, `numeric`, `boolean`, `text`, `text`, `bigint`}
+	)
+
+	for _, tt := range []struct {
+		expression      string
+		match, complete bool
+	}{
+		{`tenant_id = 42`, true, true},
+		{`tenant_id = 42.0`, true, true},
+		{`tenant_id = '42'`, true, true},
+		{`tenant_id <> 42`, false, true},
+		{`tenant_id != 41`, true, true},
+		{`Tenant_ID >= 42`, true, true},
+		{`id < 10`, true, true},
+		{`id > 10`, false, true},
+		{`score <= 1.5`, true, true},
+		{`score > -2`, true, true},
+		{`score = 1.50`, true, true},
+		{`big = 9007199254740993`, true, true},
+		{`big = 9007199254740992`, false, true},
+		{`big < 9007199254740994`, true, true},
+		{`big IN (9007199254740992, 9007199254740994)`, false, true},
+
+		{`status = 'draft'`, true, true},
+		{`status <> 'draft'`, false, true},
+		{`status < 'e'`, true, true},
+		{`" key " = 'it''s'`, true, true},
+
+		{`active`, true, true},
+		{`NOT active`, false, true},
+		{`active = true`, true, true},
+		{`active = FALSE`, false, true},
+
+		{`note = 'x'`, false, true},
+		{`NOT note = 'x'`, false, true},
+		{`note IS NULL`, true, true},
+		{`note IS NOT NULL`, false, true},
+		{`status IS NOT NULL`, true, true},
+
+		{`status IN ('draft', 'final')`, true, true},
+		{`status NOT IN ('draft', 'final')`, false, true},
+		{`id IN (1, 2, 3)`, false, true},
+		{`id NOT IN (1, 2, 3)`, true, true},
+		{`id IN (1, null)`, false, true},
+		{`id NOT IN (1, null)`, false, true},
+
+		{`tenant_id = 42 AND status <> 'draft'`, false, true},
+		{`tenant_id = 42 OR status <> 'draft'`, true, true},
+		{`note = 'x' OR id = 7`, true, true},
+		{`NOT (note = 'x' AND id = 8)`, true, true},
+		{`(id = 1 OR id = 7) AND (active)`, true, true},
+		{`id = 1 OR id = 2 AND active`, false, true},
+
+		{`missing = 1`, false, false},
+		{`id = 7 OR missing = 1`, true, false},
+	} {
+		p, err := CompilePredicate(tt.expression)
+		if err != nil {
+			t.Fatalf("Got %q for `%s`", err, tt.expression)
+		}
+
+		match, complete := p.Eval(columns, values, types)
+
+		if match != tt.match {
+			t.Errorf("Expected `%s` to match %v, got %v", tt.expression, tt.match, match)
+		}
+		if complete != tt.complete {
+			t.Errorf("Expected `%s` to be complete %v, got %v", tt.expression, tt.complete, complete)
+		}
+	}
+}
+
+func TestPredicateCompileError(t *testing.T) {
+	for _, tt := range []string{
+		``,
+		`id =`,
+		`id = 1 AND`,
+		`(id = 1`,
+		`id = 1)`,
+		`id IS 1`,
+		`id NOT 1`,
+		`id IN 1`,
+		`id IN (1 2)`,
+		`'unterminated`,
+		`[`,
+	} {
+		if _, err := CompilePredicate(tt); err == nil {
+			t.Errorf("Expected `%s` to fail", tt)
+		}
+	}
+}
+
+func TestRowFilter(t *testing.T) {
+	f, err := NewRowFilter(map[string]string{`public.orders`: `tenant_id = 42`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Keys = map[string][]string{`public.orders`: {`id`}}
+
+	for _, tt := range []struct {
+		input, expected ReplicationOperation
+		pass            bool
+	}{
+		// Other tables and transactions
+		{ReplicationOperation{Operation: `BEGIN`, Target: `553`},
+			ReplicationOperation{Operation: `BEGIN`, Target: `553`}, true},
+		{ReplicationOperation{Operation: `INSERT`, Target: `public.other`, NewColumns: []string{`tenant_id`}, NewValues: []string{`1`}},
+			ReplicationOperation{Operation: `INSERT`, Target: `public.other`, NewColumns: []string{`tenant_id`}, NewValues: []string{`1`}}, true},
+
+		// Insert
+		{ReplicationOperation{Operation: `INSERT`, Target: `public.orders`,
+			NewColumns: []string{`id`, `tenant_id`}, NewValues: []string{`1`, `42`}, NewTypes: []string{`integer`, `integer`}},
+			ReplicationOperation{Operation: `INSERT`, Target: `public.orders`,
+				NewColumns: []string{`id`, `tenant_id`}, NewValues: []string{`1`, `42`}, NewTypes: []string{`integer`, `integer`}}, true},
+		{ReplicationOperation{Operation: `INSERT`, Target: `public.orders`,
+			NewColumns: []string{`id`, `tenant_id`}, NewValues: []string{`2`, `7`}, NewTypes: []string{`integer`, `integer`}},
+			ReplicationOperation{}, false},
+		{ReplicationOperation{Operation: `READ`, Target: `public.orders`,
+			NewColumns: []string{`id`, `tenant_id`}, NewValues: []string{`3`, `7`}, NewTypes: []string{`integer`, `integer`}},
+			ReplicationOperation{}, false},
+
+		// Delete by key without the predicate column
+		{ReplicationOperation{Operation: `DELETE`, Target: `public.orders`,
+			OldColumns: []string{`id`}, OldValues: []string{`1`}, OldTypes: []string{`integer`}},
+			ReplicationOperation{Operation: `DELETE`, Target: `public.orders`,
+				OldColumns: []string{`id`}, OldValues: []string{`1`}, OldTypes: []string{`integer`}}, true},
+		{ReplicationOperation{Operation: `DELETE`, Target: `public.orders`,
+			OldColumns: []string{`id`, `tenant_id`}, OldValues: []string{`1`, `7`}, OldTypes: []string{`integer`, `integer`}},
+			ReplicationOperation{}, false},
+
+		// Update within the filter
+		{ReplicationOperation{Operation: `UPDATE`, Target: `public.orders`,
+			OldColumns: []string{`id`, `tenant_id`}, OldValues: []string{`1`, `42`}, OldTypes: []string{`integer`, `integer`},
+			NewColumns: []string{`id`, `tenant_id`}, NewValues: []string{`2`, `42`}, NewTypes: []string{`integer`, `integer`}},
+			ReplicationOperation{Operation: `UPDATE`, Target: `public.orders`,
+				OldColumns: []string{`id`, `tenant_id`}, OldValues: []string{`1`, `42`}, OldTypes: []string{`integer`, `integer`},
+				NewColumns: []string{`id`, `tenant_id`}, NewValues: []string{`2`, `42`}, NewTypes: []string{`integer`, `integer`}}, true},
+
+		// Update entering the filter
+		{ReplicationOperation{Operation: `UPDATE`, Target: `public.orders`,
+			OldColumns: []string{`id`, `tenant_id`}, OldValues: []string{`1`, `7`}, OldTypes: []string{`integer`, `integer`},
+			NewColumns: []string{`id`, `tenant_id`}, NewValues: []string{`1`, `42`}, NewTypes: []string{`integer`, `integer`}},
+			ReplicationOperation{Operation: `INSERT`, Target: `public.orders`,
+				NewColumns: []string{`id`, `tenant_id`}, NewValues: []string{`1`, `42`}, NewTypes: []string{`integer`, `integer`}}, true},
+
+		// Update leaving the filter
+		{ReplicationOperation{Operation: `UPDATE`, Target: `public.orders`,
+			OldColumns: []string{`id`, `tenant_id`}, OldValues: []string{`1`, `42`}, OldTypes: []string{`integer`, `integer`},
+			NewColumns: []string{`id`, `tenant_id`}, NewValues: []string{`1`, `7`}, NewTypes: []string{`integer`, `integer`}},
+			ReplicationOperation{Operation: `DELETE`, Target: `public.orders`,
+				OldColumns: []string{`id`, `tenant_id`}, OldValues: []string{`1`, `42`}, OldTypes: []string{`integer`, `integer`}}, true},
+
+		// Update outside the filter
+		{ReplicationOperation{Operation: `UPDATE`, Target: `public.orders`,
+			OldColumns: []string{`id`, `tenant_id`}, OldValues: []string{`1`, `6`}, OldTypes: []string{`integer`, `integer`},
+			NewColumns: []string{`id`, `tenant_id`}, NewValues: []string{`1`, `7`}, NewTypes: []string{`integer`, `integer`}},
+			ReplicationOperation{}, false},
+
+		// Update without old values
+		{ReplicationOperation{Operation: `UPDATE`, Target: `public.orders`,
+			NewColumns: []string{`id`, `tenant_id`}, NewValues: []string{`1`, `42`}, NewTypes: []string{`integer`, `integer`}},
+			ReplicationOperation{Operation: `INSERT`, Target: `public.orders`,
+				NewColumns: []string{`id`, `tenant_id`}, NewValues: []string{`1`, `42`}, NewTypes: []string{`integer`, `integer`}}, true},
+		{ReplicationOperation{Operation: `UPDATE`, Target: `public.orders`,
+			OldColumns: []string{`id`}, OldValues: []string{`1`}, OldTypes: []string{`integer`},
+			NewColumns: []string{`id`, `tenant_id`}, NewValues: []string{`2`, `42`}, NewTypes: []string{`integer`, `integer`}},
+			ReplicationOperation{Operation: `INSERT`, Target: `public.orders`,
+				NewColumns: []string{`id`, `tenant_id`}, NewValues: []string{`2`, `42`}, NewTypes: []string{`integer`, `integer`}}, true},
+		{ReplicationOperation{Operation: `UPDATE`, Target: `public.orders`,
+			NewColumns: []string{`id`, `tenant_id`}, NewValues: []string{`1`, `7`}, NewTypes: []string{`integer`, `integer`}},
+			ReplicationOperation{Operation: `DELETE`, Target: `public.orders`,
+				OldColumns: []string{`id`}, OldValues: []string{`1`}, OldTypes: []string{`integer`}}, true},
+	} {
+		op := tt.input
+
+		if pass := f.Filter(&op); pass != tt.pass {
+			t.Errorf("Expected %v to pass %v, got %v", tt.input, tt.pass, pass)
+		} else if pass && !reflect.DeepEqual(op, tt.expected) {
+			t.Errorf("Expected %v to be %v, got %v", tt.input, tt.expected, op)
+		}
+	}
+}
+
+func TestRowFilterNoKeys(t *testing.T) {
+	f, err := NewRowFilter(map[string]string{`public.orders`: `tenant_id = 42`})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	op := ReplicationOperation{Operation: `UPDATE`, Target: `public.orders`,
+		NewColumns: []string{`id`, `tenant_id`}, NewValues: []string{`1`, `7`}, NewTypes: []string{`integer`, `integer`}}
+	if !f.Filter(&op) {
+		t.Fatalf("Expected %v to pass", op)
+	}
+	if expected := (ReplicationOperation{Operation: `DELETE`, Target: `public.orders`}); !reflect.DeepEqual(op, expected) {
+		t.Errorf("Expected a DELETE without values that may not match, got %v", op)
+	}
+}
+
+func TestRowFilterTransform(t *testing.T) {
+	f, err := NewRowFilter(map[string]string{`public.orders`: `tenant_id = 42`})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var emitted []string
+	emit := func(op *ReplicationOperation) error {
+		emitted = append(emitted, op.String())
+		return nil
+	}
+
+	// Update of the key without the predicate column
+	if err := f.Transform(context.Background(), &ReplicationOperation{Position: `0/10`, Operation: `UPDATE`, Target: `public.orders`,
+		OldColumns: []string{`id`}, OldValues: []string{`1`}, OldTypes: []string{`integer`},
+		NewColumns: []string{`id`, `tenant_id`}, NewValues: []string{`2`, `42`}, NewTypes: []string{`integer`, `integer`}}, emit); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []string{
+		`0/10 DELETE public.orders old: id[integer]:1`,
+		`0/10 INSERT public.orders new: id[integer]:2 tenant_id[integer]:42`,
+	}; !reflect.DeepEqual(emitted, expected) {
+		t.Errorf("Expected %q, got %q", expected, emitted)
+	}
+}
+
+func TestRowFilterError(t *testing.T) {
+	if _, err := NewRowFilter(map[string]string{`public.orders`: `tenant_id =`}); err == nil {
+		t.Error("Expected an invalid predicate to fail")
+	}
+}
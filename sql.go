@@ -0,0 +1,364 @@
+package pgbarrel
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/jackc/pgx"
+	"github.com/pkg/errors"
+)
+
+// A Dialect is the SQL of a database that NewSQLSink applies operations to.
+type Dialect interface {
+	// QuoteIdentifier returns name as an identifier.
+	QuoteIdentifier(name string) string
+	// Placeholder returns the parameter of the nth argument, from 1.
+	Placeholder(n int) string
+	// Upsert returns a statement that inserts columns into table, or updates
+	// the row with the same keys. Its arguments are the values of columns.
+	// Table, columns and keys are quoted.
+	Upsert(table string, columns, keys []string) string
+
+	// Table returns the table of a target, quoted.
+	Table(target string) string
+	// Columns returns a query of the names of the columns of table.
+	Columns(table string) (query string, args []interface{})
+
+	// Type returns the column type of values of the PostgreSQL type typ.
+	Type(typ string) string
+	// Value returns a value of the PostgreSQL type typ as an argument.
+	Value(typ, value string) (interface{}, error)
+}
+
+// A DDLDialect is a Dialect that can replay the DDL of the source, such as
+// that of PostgreSQL.
+type DDLDialect interface {
+	Dialect
+	// DDL returns the statement that replays command, a DDL command of the
+	// source.
+	DDL(command string) string
+}
+
+type SQLOptions struct {
+	// Keys names the key columns of each target. They are the PRIMARY KEY of
+	// tables created on the target, make INSERT an upsert, and find the rows
+	// of an UPDATE that has no old columns, as when the key did not change.
+	Keys map[string][]string
+}
+
+type sqlSink struct {
+	options SQLOptions
+	dialect Dialect
+	db      *sql.DB
+	log     Logger
+	applied uint64
+
+	tx      *sql.Tx
+	xid     string
+	columns map[string]map[string]bool
+}
+
+// NewSQLSink returns a Sink that applies operations to db in dialect. Each
+// transaction is applied in a transaction that records its position in the
+// table pgbarrel_position, and those at or before that position are rolled
+// back, so streaming may resume from it. DDL is replayed when dialect is a
+// DDLDialect and skipped otherwise.
+//
+// Tables and their columns are created from the types in the stream as they
+// first appear. TRUNCATE deletes every row. READ, a row copied again, is
+// written as INSERT.
+func NewSQLSink(db *sql.DB, dialect Dialect, options SQLOptions) (*sqlSink, error) {
+	s := &sqlSink{options: options, dialect: dialect, db: db, log: discardLogger{}, columns: make(map[string]map[string]bool)}
+
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS pgbarrel_position (id INTEGER PRIMARY KEY CHECK (id = 1), lsn TEXT NOT NULL)`)
+	if err != nil {
+		return nil, err
+	}
+
+	position, err := s.Position()
+	if err == nil && position != "" {
+		s.applied, err = pgx.ParseLSN(position)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Position returns the position of the last transaction applied, or "".
+func (s *sqlSink) Position() (string, error) {
+	var position string
+	err := s.db.QueryRow(`SELECT lsn FROM pgbarrel_position WHERE id = 1`).Scan(&position)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return position, err
+}
+
+// SetLogger records the transactions and tables s applies in l.
+func (s *sqlSink) SetLogger(l Logger) {
+	s.log = orDiscard(l)
+}
+
+// Ping reports whether the database is reachable.
+func (s *sqlSink) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *sqlSink) Write(ctx context.Context, op *ReplicationOperation) error {
+	var err error
+
+	switch op.Operation {
+	case `BEGIN`:
+		if s.tx != nil {
+			s.log.Warn("Rolled back an unfinished transaction", "xid", s.xid)
+			s.tx.Rollback()
+		}
+		s.xid = op.Target
+		s.tx, err = s.db.BeginTx(ctx, nil)
+		return err
+
+	case `COMMIT`:
+		if s.tx == nil {
+			return nil
+		}
+		tx := s.tx
+		s.tx = nil
+
+		lsn, err := pgx.ParseLSN(op.Position)
+		if err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "Invalid position: %q", op.Position)
+		}
+		if lsn <= s.applied {
+			s.log.Info("Skipped a transaction already applied", "lsn", op.Position, "xid", s.xid)
+			return tx.Rollback()
+		}
+
+		id, position := s.dialect.QuoteIdentifier("id"), s.dialect.QuoteIdentifier("lsn")
+		upsert := s.dialect.Upsert(`pgbarrel_position`, []string{id, position}, []string{id})
+		if _, err = tx.ExecContext(ctx, upsert, 1, op.Position); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err = tx.Commit(); err == nil {
+			s.applied = lsn
+			s.log.Debug("Applied transaction", "lsn", op.Position, "xid", s.xid)
+		}
+		return err
+
+	case `DDL`:
+		command, ok := DDLCommand(op)
+		dialect, replay := s.dialect.(DDLDialect)
+		if !ok || !replay {
+			return nil
+		}
+		if s.tx == nil {
+			return errors.Errorf("DDL of %s outside a transaction", op.Target)
+		}
+
+		// The DDL may change any table, so look at their columns again.
+		s.columns = make(map[string]map[string]bool)
+		_, err = s.tx.ExecContext(ctx, dialect.DDL(command))
+		return errors.Wrapf(err, "Unable to replay DDL at %s", op.Position)
+
+	case `INSERT`, `UPDATE`, `DELETE`, `TRUNCATE`, `READ`:
+		if s.tx == nil {
+			return errors.Errorf("%s of %s outside a transaction", op.Operation, op.Target)
+		}
+	default:
+		return nil
+	}
+
+	table := s.dialect.Table(op.Target)
+	if err = s.prepare(ctx, op, table); err != nil {
+		return err
+	}
+
+	var statement string
+	var args []interface{}
+
+	switch op.Operation {
+	case `INSERT`, `READ`:
+		columns := s.quote(op.NewColumns)
+		if keys := s.options.Keys[op.Target]; len(keys) > 0 {
+			statement = s.dialect.Upsert(table, columns, s.quote(keys))
+		} else {
+			placeholders := make([]string, len(columns))
+			for i := range placeholders {
+				placeholders[i] = s.dialect.Placeholder(i + 1)
+			}
+			statement = `INSERT INTO ` + table + ` (` + strings.Join(columns, `, `) + `) VALUES (` + strings.Join(placeholders, `, `) + `)`
+		}
+		if args, err = s.values(op.NewValues, op.NewTypes); err != nil {
+			return errors.Wrapf(err, "Invalid value of %s", op.Target)
+		}
+
+	case `UPDATE`:
+		sets := s.quote(op.NewColumns)
+		for i := range sets {
+			sets[i] += ` = ` + s.dialect.Placeholder(i+1)
+		}
+		if args, err = s.values(op.NewValues, op.NewTypes); err != nil {
+			return errors.Wrapf(err, "Invalid value of %s", op.Target)
+		}
+
+		where, key, err := s.where(op, len(args))
+		if err != nil {
+			return err
+		}
+		statement = `UPDATE ` + table + ` SET ` + strings.Join(sets, `, `) + where
+		args = append(args, key...)
+
+	case `DELETE`:
+		where, key, err := s.where(op, 0)
+		if err != nil {
+			return err
+		}
+		statement, args = `DELETE FROM `+table+where, key
+
+	case `TRUNCATE`:
+		statement = `DELETE FROM ` + table
+	}
+
+	_, err = s.tx.ExecContext(ctx, statement, args...)
+	return err
+}
+
+// where returns the condition that finds the row of an UPDATE or DELETE, its
+// old columns or else its key columns in the new row, and its arguments
+// after the first n.
+func (s *sqlSink) where(op *ReplicationOperation, n int) (string, []interface{}, error) {
+	columns, values, types := op.OldColumns, op.OldValues, op.OldTypes
+	if len(columns) == 0 {
+		for _, key := range s.options.Keys[op.Target] {
+			for i, name := range op.NewColumns {
+				if name == pgQuoteIdentifier(key) && i < len(op.NewValues) {
+					columns = append(columns, name)
+					values = append(values, op.NewValues[i])
+					if i < len(op.NewTypes) {
+						types = append(types, op.NewTypes[i])
+					}
+				}
+			}
+		}
+	}
+	if len(columns) == 0 {
+		return "", nil, errors.Errorf("No key to %s %s; set its keys", op.Operation, op.Target)
+	}
+
+	all, err := s.values(values, types)
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "Invalid value of %s", op.Target)
+	}
+
+	var args []interface{}
+	conditions := s.quote(columns)
+	for i := range conditions {
+		if i >= len(all) || all[i] == nil {
+			conditions[i] += ` IS NULL`
+			continue
+		}
+		args = append(args, all[i])
+		conditions[i] += ` = ` + s.dialect.Placeholder(n+len(args))
+	}
+	return ` WHERE ` + strings.Join(conditions, ` AND `), args, nil
+}
+
+// quote returns the columns of an operation, or key names, as identifiers of
+// the dialect.
+func (s *sqlSink) quote(names []string) []string {
+	quoted := make([]string, len(names))
+	for i := range names {
+		quoted[i] = s.dialect.QuoteIdentifier(pgUnquoteIdentifier(names[i]))
+	}
+	return quoted
+}
+
+// values returns constants of types as arguments, with nil as NULL.
+func (s *sqlSink) values(constants, types []string) ([]interface{}, error) {
+	args := make([]interface{}, len(constants))
+	for i, constant := range constants {
+		value, null := pgUnquoteConstant(constant)
+		if null {
+			continue
+		}
+
+		var typ string
+		if i < len(types) {
+			typ = types[i]
+		}
+
+		var err error
+		if args[i], err = s.dialect.Value(typ, value); err != nil {
+			return nil, err
+		}
+	}
+	return args, nil
+}
+
+// prepare creates the table of op, or the columns it lacks.
+func (s *sqlSink) prepare(ctx context.Context, op *ReplicationOperation, table string) error {
+	columns, ok := s.columns[table]
+	if !ok {
+		query, args := s.dialect.Columns(table)
+		rows, err := s.tx.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		columns = make(map[string]bool)
+		for rows.Next() {
+			var name string
+			if err = rows.Scan(&name); err != nil {
+				rows.Close()
+				return err
+			}
+			columns[s.dialect.QuoteIdentifier(name)] = true
+		}
+		if err = rows.Close(); err != nil {
+			return err
+		}
+		s.columns[table] = columns
+	}
+
+	var definitions []string
+	add := func(names, types []string) {
+		for i, name := range s.quote(names) {
+			if !columns[name] {
+				var typ string
+				if i < len(types) {
+					typ = types[i]
+				}
+				columns[name] = true
+				definitions = append(definitions, name+` `+s.dialect.Type(typ))
+			}
+		}
+	}
+
+	existed := len(columns) > 0
+	add(op.NewColumns, op.NewTypes)
+	add(op.OldColumns, op.OldTypes)
+
+	if !existed {
+		if keys := s.options.Keys[op.Target]; len(keys) > 0 {
+			definitions = append(definitions, `PRIMARY KEY (`+strings.Join(s.quote(keys), `, `)+`)`)
+		}
+		if len(definitions) == 0 {
+			return nil
+		}
+		_, err := s.tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS `+table+` (`+strings.Join(definitions, `, `)+`)`)
+		if err == nil {
+			s.log.Info("Created table", "lsn", op.Position, "xid", s.xid, "table", op.Target)
+		}
+		return err
+	}
+
+	for _, definition := range definitions {
+		if _, err := s.tx.ExecContext(ctx, `ALTER TABLE `+table+` ADD COLUMN `+definition); err != nil {
+			return err
+		}
+		s.log.Info("Added column", "lsn", op.Position, "xid", s.xid, "table", op.Target, "column", definition)
+	}
+	return nil
+}
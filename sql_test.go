@@ -0,0 +1,342 @@
+package pgbarrel
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testSQLDatabase is a database/sql driver that logs the statements of
+// committed transactions. It answers the queries of the SQL sink in the
+// SQLite dialect from its position and tables, and reads of whole tables
+// from rows.
+type testSQLDatabase struct {
+	log      []string
+	position string
+	tables   map[string][]string
+	rows     map[string][]map[string]driver.Value
+	fail     string
+	queries  []string // of rows
+}
+
+func (d *testSQLDatabase) Open(string) (driver.Conn, error)             { return &testSQLConn{db: d}, nil }
+func (d *testSQLDatabase) Connect(context.Context) (driver.Conn, error) { return d.Open("") }
+func (d *testSQLDatabase) Driver() driver.Driver                        { return d }
+
+type testSQLConn struct {
+	db      *testSQLDatabase
+	pending []string
+	tx      bool
+}
+
+func (c *testSQLConn) Prepare(query string) (driver.Stmt, error) { return &testSQLStmt{c, query}, nil }
+func (c *testSQLConn) Close() error                              { return nil }
+func (c *testSQLConn) Begin() (driver.Tx, error)                 { c.tx = true; return c, nil }
+
+func (c *testSQLConn) Commit() error {
+	c.db.log = append(c.db.log, c.pending...)
+	c.pending, c.tx = nil, false
+	return nil
+}
+
+func (c *testSQLConn) Rollback() error {
+	c.db.log = append(c.db.log, fmt.Sprintf("ROLLBACK %d", len(c.pending)))
+	c.pending, c.tx = nil, false
+	return nil
+}
+
+type testSQLStmt struct {
+	conn  *testSQLConn
+	query string
+}
+
+func (s *testSQLStmt) Close() error  { return nil }
+func (s *testSQLStmt) NumInput() int { return -1 }
+
+func (s *testSQLStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if s.conn.db.fail != "" && strings.HasPrefix(s.query, s.conn.db.fail) {
+		return nil, fmt.Errorf("failed: %s", s.query)
+	}
+
+	statement := s.query
+	for _, arg := range args {
+		statement += fmt.Sprintf(" [%#v]", arg)
+	}
+	if !s.conn.tx {
+		s.conn.db.log = append(s.conn.db.log, statement)
+		return driver.RowsAffected(0), nil
+	}
+	if strings.HasPrefix(s.query, `INSERT INTO pgbarrel_position`) {
+		s.conn.db.position = args[1].(string)
+	}
+	s.conn.pending = append(s.conn.pending, statement)
+	return driver.RowsAffected(1), nil
+}
+
+func (s *testSQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	switch {
+	case strings.HasPrefix(s.query, `SELECT lsn FROM pgbarrel_position`):
+		if s.conn.db.position == "" {
+			return &testSQLRows{}, nil
+		}
+		return &testSQLRows{values: []string{s.conn.db.position}}, nil
+	case strings.HasPrefix(s.query, `SELECT name FROM pragma_table_info`):
+		return &testSQLRows{values: s.conn.db.tables[args[0].(string)]}, nil
+	case strings.HasPrefix(s.query, `SELECT `) && strings.Contains(s.query, ` FROM `):
+		i := strings.Index(s.query, ` FROM `)
+		table, where := s.query[i+len(` FROM `):], ``
+		if j := strings.Index(table, ` WHERE `); j >= 0 {
+			table, where = table[:j], table[j+len(` WHERE `):]
+		}
+		s.conn.db.queries = append(s.conn.db.queries, s.query)
+
+		rows := &testSQLRows{columns: strings.Split(s.query[len(`SELECT `):i], `, `)}
+		for _, row := range s.conn.db.rows[pgUnquoteIdentifier(table)] {
+			if where != `` && !testSQLWhere(where, args, row) {
+				continue
+			}
+			values := make([]driver.Value, len(rows.columns))
+			for j, column := range rows.columns {
+				values[j] = row[pgUnquoteIdentifier(column)]
+			}
+			rows.rows = append(rows.rows, values)
+		}
+		return rows, nil
+	}
+	return nil, fmt.Errorf("unexpected query: %s", s.query)
+}
+
+// testSQLWhere evaluates a condition of ANDs and ORs of comparisons of
+// quoted columns with placeholders, as the verifier writes them, on row.
+func testSQLWhere(where string, args []driver.Value, row map[string]driver.Value) bool {
+	tokens := strings.Fields(strings.NewReplacer(`(`, ` ( `, `)`, ` ) `).Replace(where))
+	var n int
+
+	var or func() bool
+	factor := func() bool {
+		if tokens[0] == `(` {
+			tokens = tokens[1:]
+			result := or()
+			tokens = tokens[1:] // )
+			return result
+		}
+		column, operator := pgUnquoteIdentifier(tokens[0]), tokens[1]
+		tokens = tokens[3:] // ?
+		a, b := fmt.Sprint(row[column]), fmt.Sprint(args[n])
+		n++
+
+		compare := strings.Compare(a, b)
+		x, errA := strconv.ParseFloat(a, 64)
+		y, errB := strconv.ParseFloat(b, 64)
+		if errA == nil && errB == nil {
+			switch {
+			case x < y:
+				compare = -1
+			case x > y:
+				compare = 1
+			default:
+				compare = 0
+			}
+		}
+		switch operator {
+		case `=`:
+			return compare == 0
+		case `<`:
+			return compare < 0
+		case `<=`:
+			return compare <= 0
+		case `>`:
+			return compare > 0
+		}
+		return compare >= 0
+	}
+	and := func() bool {
+		result := factor()
+		for len(tokens) > 0 && tokens[0] == `AND` {
+			tokens = tokens[1:]
+			result = factor() && result
+		}
+		return result
+	}
+	or = func() bool {
+		result := and()
+		for len(tokens) > 0 && tokens[0] == `OR` {
+			tokens = tokens[1:]
+			result = and() || result
+		}
+		return result
+	}
+	return or()
+}
+
+// testSQLRows are values of one column, or rows of columns.
+type testSQLRows struct {
+	values  []string
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *testSQLRows) Close() error { return nil }
+
+func (r *testSQLRows) Columns() []string {
+	if r.columns != nil {
+		return r.columns
+	}
+	return []string{"value"}
+}
+
+func (r *testSQLRows) Next(dest []driver.Value) error {
+	if r.columns != nil {
+		if len(r.rows) == 0 {
+			return io.EOF
+		}
+		copy(dest, r.rows[0])
+		r.rows = r.rows[1:]
+		return nil
+	}
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	dest[0], r.values = r.values[0], r.values[1:]
+	return nil
+}
+
+func TestSQLSink(t *testing.T) {
+	ctx := context.Background()
+	database := &testSQLDatabase{tables: map[string][]string{"other.existing": {"id"}}}
+	db := sql.OpenDB(database)
+	defer db.Close()
+
+	s, err := NewSQLSink(db, SQLiteDialect{}, SQLOptions{Keys: map[string][]string{`public.t`: {`id`}}})
+	require.NoError(t, err)
+	logger := &testLogger{}
+	s.SetLogger(logger)
+
+	for _, op := range []*ReplicationOperation{
+		{Position: `0/10`, Operation: `BEGIN`, Target: `553`},
+		{Position: `0/10`, Operation: `INSERT`, Target: `public.t`,
+			NewColumns: []string{`id`, `"Note"`, `ok`, `f`, `n`, `bin`},
+			NewValues:  []string{`1`, `'it''s'`, `true`, `1.5`, `12.30`, `'\x0102'`},
+			NewTypes:   []string{`integer`, `text`, `boolean`, `double precision`, `numeric(5,2)`, `bytea`}},
+		{Position: `0/10`, Operation: `UPDATE`, Target: `public.t`,
+			NewColumns: []string{`id`, `"Note"`}, NewValues: []string{`1`, `null`}, NewTypes: []string{`integer`, `text`}},
+		{Position: `0/10`, Operation: `UPDATE`, Target: `public.t`,
+			OldColumns: []string{`id`}, OldValues: []string{`1`}, OldTypes: []string{`integer`},
+			NewColumns: []string{`id`}, NewValues: []string{`2`}, NewTypes: []string{`integer`}},
+		{Position: `0/10`, Operation: `INSERT`, Target: `other.existing`,
+			NewColumns: []string{`id`, `at`}, NewValues: []string{`1`, `'2017-05-01 12:00:00+00'`},
+			NewTypes: []string{`integer`, `timestamp with time zone`}},
+		{Position: `0/10`, Operation: `DELETE`, Target: `public.t`,
+			OldColumns: []string{`id`}, OldValues: []string{`2`}, OldTypes: []string{`integer`}},
+		{Position: `0/10`, Operation: `DELETE`, Target: `public.t`,
+			OldColumns: []string{`id`}, OldValues: []string{`null`}, OldTypes: []string{`integer`}},
+		{Position: `0/10`, Operation: `READ`, Target: `public.t`,
+			NewColumns: []string{`id`, `"Note"`}, NewValues: []string{`3`, `'read'`}, NewTypes: []string{`integer`, `text`}},
+		{Position: `0/10`, Operation: `TRUNCATE`, Target: `public.t`},
+		{Position: `0/10`, Operation: `DDL`, Target: `public.t`},
+		{Position: `0/18`, Operation: `COMMIT`, Target: `553`},
+	} {
+		require.NoError(t, s.Write(ctx, op), "%v", op)
+	}
+
+	assert.Equal(t, []string{
+		`CREATE TABLE IF NOT EXISTS pgbarrel_position (id INTEGER PRIMARY KEY CHECK (id = 1), lsn TEXT NOT NULL)`,
+		`CREATE TABLE IF NOT EXISTS "t" ("id" INTEGER, "Note" TEXT, "ok" INTEGER, "f" REAL, "n" NUMERIC, "bin" BLOB, PRIMARY KEY ("id"))`,
+		`INSERT INTO "t" ("id", "Note", "ok", "f", "n", "bin") VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT ("id") DO UPDATE SET ` +
+			`"Note" = excluded."Note", "ok" = excluded."ok", "f" = excluded."f", "n" = excluded."n", "bin" = excluded."bin"` +
+			` [1] ["it's"] [true] [1.5] ["12.30"] [[]byte{0x1, 0x2}]`,
+		`UPDATE "t" SET "id" = ?, "Note" = ? WHERE "id" = ? [1] [<nil>] [1]`,
+		`UPDATE "t" SET "id" = ? WHERE "id" = ? [2] [1]`,
+		`ALTER TABLE "other.existing" ADD COLUMN "at" TEXT`,
+		`INSERT INTO "other.existing" ("id", "at") VALUES (?, ?) [1] ["2017-05-01 12:00:00+00"]`,
+		`DELETE FROM "t" WHERE "id" = ? [2]`,
+		`DELETE FROM "t" WHERE "id" IS NULL`,
+		`INSERT INTO "t" ("id", "Note") VALUES (?, ?) ON CONFLICT ("id") DO UPDATE SET "Note" = excluded."Note" [3] ["read"]`,
+		`DELETE FROM "t"`,
+		`INSERT INTO pgbarrel_position ("id", "lsn") VALUES (?, ?) ON CONFLICT ("id") DO UPDATE SET "lsn" = excluded."lsn" [1] ["0/18"]`,
+	}, database.log)
+	assert.Equal(t, []string{
+		`INFO Created table lsn=0/10 xid=553 table=public.t`,
+		`INFO Added column lsn=0/10 xid=553 table=other.existing column="at" TEXT`,
+		`DEBUG Applied transaction lsn=0/18 xid=553`,
+	}, logger.events)
+
+	position, err := s.Position()
+	require.NoError(t, err)
+	assert.Equal(t, `0/18`, position)
+
+	t.Run("Replay", func(t *testing.T) {
+		database.log = nil
+		s, err := NewSQLSink(db, SQLiteDialect{}, SQLOptions{})
+		require.NoError(t, err)
+
+		for _, op := range []*ReplicationOperation{
+			{Position: `0/10`, Operation: `BEGIN`, Target: `553`},
+			{Position: `0/10`, Operation: `DELETE`, Target: `public.t`,
+				OldColumns: []string{`id`}, OldValues: []string{`2`}, OldTypes: []string{`integer`}},
+			{Position: `0/18`, Operation: `COMMIT`, Target: `553`},
+		} {
+			require.NoError(t, s.Write(ctx, op))
+		}
+		assert.Equal(t, []string{
+			`CREATE TABLE IF NOT EXISTS pgbarrel_position (id INTEGER PRIMARY KEY CHECK (id = 1), lsn TEXT NOT NULL)`,
+			`ROLLBACK 2`,
+		}, database.log, "Expected an applied transaction to be rolled back")
+	})
+
+	t.Run("DDL", func(t *testing.T) {
+		database := &testSQLDatabase{}
+		db := sql.OpenDB(database)
+		defer db.Close()
+
+		s, err := NewSQLSink(db, PostgreSQLDialect{}, SQLOptions{})
+		require.NoError(t, err)
+		s.columns[`public.t`] = map[string]bool{`"id"`: true}
+
+		for _, op := range []*ReplicationOperation{
+			{Position: `0/20`, Operation: `BEGIN`, Target: `554`},
+			{Position: `0/20`, Operation: `DDL`, Target: `public.t`,
+				NewColumns: []string{`command_tag`, `command`}, NewValues: []string{`'ALTER TABLE'`, `'ALTER TABLE t ADD v text'`}},
+			{Position: `0/28`, Operation: `COMMIT`, Target: `554`},
+		} {
+			require.NoError(t, s.Write(ctx, op))
+		}
+		assert.Equal(t, []string{
+			`CREATE TABLE IF NOT EXISTS pgbarrel_position (id INTEGER PRIMARY KEY CHECK (id = 1), lsn TEXT NOT NULL)`,
+			`ALTER TABLE t ADD v text`,
+			`INSERT INTO pgbarrel_position (id, lsn) VALUES ($1, $2) ON CONFLICT (id) DO UPDATE SET lsn = EXCLUDED.lsn [1] ["0/28"]`,
+		}, database.log)
+		assert.Empty(t, s.columns, "Expected columns to be looked at again")
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		s, err := NewSQLSink(db, SQLiteDialect{}, SQLOptions{})
+		require.NoError(t, err)
+
+		err = s.Write(ctx, &ReplicationOperation{Operation: `INSERT`, Target: `public.t`})
+		assert.EqualError(t, err, "INSERT of public.t outside a transaction")
+
+		require.NoError(t, s.Write(ctx, &ReplicationOperation{Position: `0/20`, Operation: `BEGIN`, Target: `554`}))
+		err = s.Write(ctx, &ReplicationOperation{Operation: `UPDATE`, Target: `public.u`,
+			NewColumns: []string{`v`}, NewValues: []string{`1`}, NewTypes: []string{`integer`}})
+		assert.EqualError(t, err, "No key to UPDATE public.u; set its keys")
+
+		err = s.Write(ctx, &ReplicationOperation{Operation: `INSERT`, Target: `public.u`,
+			NewColumns: []string{`v`}, NewValues: []string{`'x'`}, NewTypes: []string{`integer`}})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "Invalid value of public.u")
+
+		database.fail = `INSERT INTO "u"`
+		err = s.Write(ctx, &ReplicationOperation{Operation: `INSERT`, Target: `public.u`,
+			NewColumns: []string{`v`}, NewValues: []string{`1`}, NewTypes: []string{`integer`}})
+		assert.EqualError(t, err, `failed: INSERT INTO "u" ("v") VALUES (?)`)
+	})
+}
@@ -0,0 +1,64 @@
+package pgbarrel
+
+import (
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+// SQLiteDialect applies operations to SQLite, opened with any driver. A
+// target schema.table is the table "schema.table", or table for the public
+// schema. Integers and booleans are INTEGER, floating point is REAL, numeric
+// is NUMERIC, bytea is BLOB and the rest is TEXT.
+type SQLiteDialect struct{}
+
+func (SQLiteDialect) QuoteIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+func (SQLiteDialect) Placeholder(n int) string { return `?` }
+
+func (d SQLiteDialect) Upsert(table string, columns, keys []string) string {
+	return sqlUpsert(d, table, columns, keys, `excluded`)
+}
+
+func (d SQLiteDialect) Table(target string) string {
+	schema, table := pgSplitTarget(target)
+	if schema != `public` && schema != `` {
+		table = schema + `.` + table
+	}
+	return d.QuoteIdentifier(table)
+}
+
+func (SQLiteDialect) Columns(table string) (string, []interface{}) {
+	return `SELECT name FROM pragma_table_info(?)`, []interface{}{pgUnquoteIdentifier(table)}
+}
+
+func (SQLiteDialect) Type(typ string) string {
+	switch {
+	case typ == `smallint`, typ == `integer`, typ == `bigint`, typ == `oid`, typ == `boolean`:
+		return `INTEGER`
+	case typ == `real`, typ == `double precision`:
+		return `REAL`
+	case typ == `numeric`, strings.HasPrefix(typ, `numeric(`):
+		return `NUMERIC`
+	case typ == `bytea`:
+		return `BLOB`
+	}
+	return `TEXT`
+}
+
+func (d SQLiteDialect) Value(typ, value string) (interface{}, error) {
+	switch d.Type(typ) {
+	case `INTEGER`:
+		if typ == `boolean` {
+			return strconv.ParseBool(value)
+		}
+		return strconv.ParseInt(value, 10, 64)
+	case `REAL`:
+		return strconv.ParseFloat(value, 64)
+	case `BLOB`:
+		return hex.DecodeString(strings.TrimPrefix(value, `\x`))
+	}
+	return value, nil
+}
@@ -0,0 +1,107 @@
+package pgbarrel
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLiteDialect(t *testing.T) {
+	d := SQLiteDialect{}
+
+	assert.Equal(t, `"select"`, d.QuoteIdentifier(`select`))
+	assert.Equal(t, `"a""b"`, d.QuoteIdentifier(`a"b`))
+	assert.Equal(t, `?`, d.Placeholder(2))
+
+	assert.Equal(t, `"t"`, d.Table(`public.t`))
+	assert.Equal(t, `"other.My Table"`, d.Table(`other."My Table"`))
+
+	query, args := d.Columns(`"other.My Table"`)
+	assert.Equal(t, `SELECT name FROM pragma_table_info(?)`, query)
+	assert.Equal(t, []interface{}{`other.My Table`}, args)
+
+	assert.Equal(t, `INSERT INTO "t" ("a", "b") VALUES (?, ?) ON CONFLICT ("a") DO UPDATE SET "b" = excluded."b"`,
+		d.Upsert(`"t"`, []string{`"a"`, `"b"`}, []string{`"a"`}))
+	assert.Equal(t, `INSERT INTO "t" ("a") VALUES (?) ON CONFLICT ("a") DO NOTHING`,
+		d.Upsert(`"t"`, []string{`"a"`}, []string{`"a"`}))
+
+	for _, tt := range []struct {
+		typ, value, column string
+		expected           interface{}
+	}{
+		{`integer`, `-1`, `INTEGER`, int64(-1)},
+		{`bigint`, `9007199254740993`, `INTEGER`, int64(9007199254740993)},
+		{`boolean`, `true`, `INTEGER`, true},
+		{`double precision`, `1.5`, `REAL`, 1.5},
+		{`numeric(5,2)`, `12.30`, `NUMERIC`, `12.30`},
+		{`bytea`, `\x0102`, `BLOB`, []byte{1, 2}},
+		{`timestamp with time zone`, `2017-05-01 12:00:00+00`, `TEXT`, `2017-05-01 12:00:00+00`},
+		{``, `x`, `TEXT`, `x`},
+	} {
+		assert.Equal(t, tt.column, d.Type(tt.typ), "%q", tt.typ)
+
+		value, err := d.Value(tt.typ, tt.value)
+		require.NoError(t, err)
+		assert.Equal(t, tt.expected, value, "%q", tt.typ)
+	}
+
+	_, err := d.Value(`integer`, `x`)
+	assert.Error(t, err)
+}
+
+func TestSQLiteSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), `test.db`)
+	db, err := sql.Open(`sqlite3`, path)
+	require.NoError(t, err)
+	defer db.Close()
+
+	sink, err := NewSQLSink(db, SQLiteDialect{}, SQLOptions{Keys: map[string][]string{`public.t`: {`id`}}})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	for _, op := range []*ReplicationOperation{
+		{Position: `0/10`, Operation: `BEGIN`, Target: `553`},
+		{Position: `0/10`, Operation: `INSERT`, Target: `public.t`,
+			NewColumns: []string{`id`, `v`}, NewValues: []string{`1`, `'a'`}, NewTypes: []string{`integer`, `text`}},
+		{Position: `0/11`, Operation: `INSERT`, Target: `public.t`,
+			NewColumns: []string{`id`, `v`}, NewValues: []string{`2`, `'b'`}, NewTypes: []string{`integer`, `text`}},
+		{Position: `0/18`, Operation: `COMMIT`, Target: `553`},
+
+		{Position: `0/20`, Operation: `BEGIN`, Target: `554`},
+		{Position: `0/20`, Operation: `INSERT`, Target: `public.t`,
+			NewColumns: []string{`id`, `v`, `"Note"`}, NewValues: []string{`1`, `'c'`, `'x'`}, NewTypes: []string{`integer`, `text`, `text`}},
+		{Position: `0/21`, Operation: `UPDATE`, Target: `public.t`,
+			OldColumns: []string{`id`}, OldValues: []string{`2`}, OldTypes: []string{`integer`},
+			NewColumns: []string{`id`, `v`}, NewValues: []string{`3`, `'d'`}, NewTypes: []string{`integer`, `text`}},
+		{Position: `0/22`, Operation: `DELETE`, Target: `public.t`,
+			OldColumns: []string{`id`}, OldValues: []string{`4`}, OldTypes: []string{`integer`}},
+		{Position: `0/28`, Operation: `COMMIT`, Target: `554`},
+	} {
+		require.NoError(t, sink.Write(ctx, op), "%v", op)
+	}
+
+	rows, err := db.Query(`SELECT id, v, "Note" FROM t ORDER BY id`)
+	require.NoError(t, err)
+	defer rows.Close()
+
+	var got []string
+	for rows.Next() {
+		var id int64
+		var v string
+		var note sql.NullString
+		require.NoError(t, rows.Scan(&id, &v, &note))
+		got = append(got, fmt.Sprintf("%d %s %v", id, v, note.String))
+	}
+	require.NoError(t, rows.Err())
+	assert.Equal(t, []string{`1 c x`, `3 d `}, got, "Expected an upsert, an added column and an update")
+
+	position, err := sink.Position()
+	require.NoError(t, err)
+	assert.Equal(t, `0/28`, position)
+}
@@ -0,0 +1,21 @@
+package pgbarrel
+
+import (
+	"context"
+	"io"
+)
+
+type textSink struct {
+	w io.Writer
+}
+
+// NewTextSink returns a Sink that writes each operation to w on its own line,
+// as formatted by ReplicationOperation.String.
+func NewTextSink(w io.Writer) Sink {
+	return textSink{w: w}
+}
+
+func (s textSink) Write(ctx context.Context, op *ReplicationOperation) error {
+	_, err := io.WriteString(s.w, op.String()+"\n")
+	return err
+}
@@ -0,0 +1,32 @@
+package pgbarrel
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestTextSink(t *testing.T) {
+	var b bytes.Buffer
+	sink := NewTextSink(&b)
+
+	for _, op := range []*ReplicationOperation{
+		{Position: `0/16B3748`, Operation: `BEGIN`, Target: `553`},
+		{Position: `0/16B3748`, Operation: `UPDATE`, Target: `public.t`,
+			OldColumns: []string{`id`}, OldValues: []string{`1`}, OldTypes: []string{`integer`},
+			NewColumns: []string{`id`, `v`}, NewValues: []string{`2`, `'a'`}, NewTypes: []string{`integer`, `text`}},
+		{Operation: `DELETE`, Target: `public.t`, OldColumns: []string{`id`}, OldValues: []string{`2`}},
+	} {
+		if err := sink.Write(context.Background(), op); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := "0/16B3748 BEGIN 553\n" +
+		"0/16B3748 UPDATE public.t old: id[integer]:1 new: id[integer]:2 v[text]:'a'\n" +
+		"DELETE public.t old: id:2\n"
+
+	if b.String() != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, b.String())
+	}
+}
@@ -0,0 +1,506 @@
+package pgbarrel
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// This is a decoder for the subset of TOML used by configuration files:
+// tables, arrays of tables, dotted and quoted keys, basic and literal strings
+// (including multi-line), integers, floats, booleans, arrays and inline tables.
+// Dates are not supported. Every value remembers where it was written so that
+// errors can point at it.
+
+type tomlPosition struct {
+	line, column int
+}
+
+func (p tomlPosition) String() string { return fmt.Sprintf("%d:%d", p.line, p.column) }
+
+type tomlValue struct {
+	tomlPosition
+	value interface{} // string, int64, float64, bool, []*tomlValue or *tomlTable
+}
+
+type tomlTable struct {
+	tomlPosition
+	keys    []string
+	values  map[string]*tomlValue
+	defined bool
+}
+
+type tomlError struct {
+	tomlPosition
+	message string
+}
+
+func (e *tomlError) Error() string { return e.tomlPosition.String() + ": " + e.message }
+
+func newTOMLTable(pos tomlPosition) *tomlTable {
+	return &tomlTable{tomlPosition: pos, values: make(map[string]*tomlValue)}
+}
+
+func (t *tomlTable) set(key string, value *tomlValue) bool {
+	if _, ok := t.values[key]; ok {
+		return false
+	}
+	t.keys = append(t.keys, key)
+	t.values[key] = value
+	return true
+}
+
+type tomlParser struct {
+	src string
+	i   int
+	tomlPosition
+}
+
+func parseTOML(src string) (*tomlTable, error) {
+	p := tomlParser{src: src, tomlPosition: tomlPosition{line: 1, column: 1}}
+	root := newTOMLTable(p.tomlPosition)
+	current := root
+
+	for {
+		p.skip(true)
+		if p.eof() {
+			return root, nil
+		}
+
+		var err error
+		if p.peek() == '[' {
+			current, err = p.parseHeader(root)
+		} else {
+			err = p.parseKeyValue(current)
+		}
+		if err == nil {
+			err = p.endOfLine()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *tomlParser) eof() bool { return p.i >= len(p.src) }
+
+func (p *tomlParser) peek() rune {
+	c, _ := utf8.DecodeRuneInString(p.src[p.i:])
+	return c
+}
+
+func (p *tomlParser) next() rune {
+	c, w := utf8.DecodeRuneInString(p.src[p.i:])
+	p.i += w
+	if c == '\n' {
+		p.line, p.column = p.line+1, 1
+	} else {
+		p.column++
+	}
+	return c
+}
+
+func (p *tomlParser) errorf(format string, args ...interface{}) error {
+	return &tomlError{tomlPosition: p.tomlPosition, message: fmt.Sprintf(format, args...)}
+}
+
+// skip passes over whitespace and comments, and newlines when asked.
+func (p *tomlParser) skip(newlines bool) {
+	for !p.eof() {
+		switch c := p.peek(); {
+		case c == ' ' || c == '\t' || c == '\r':
+			p.next()
+		case c == '\n' && newlines:
+			p.next()
+		case c == '#':
+			for !p.eof() && p.peek() != '\n' {
+				p.next()
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (p *tomlParser) endOfLine() error {
+	p.skip(false)
+	if p.eof() || p.peek() == '\n' {
+		return nil
+	}
+	return p.errorf("expected end of line, found %q", p.peek())
+}
+
+func (p *tomlParser) parseHeader(root *tomlTable) (*tomlTable, error) {
+	pos := p.tomlPosition
+	p.next()
+	array := !p.eof() && p.peek() == '['
+	if array {
+		p.next()
+	}
+
+	p.skip(false)
+	keys, err := p.parseKey()
+	if err != nil {
+		return nil, err
+	}
+
+	closing := `]`
+	if array {
+		closing = `]]`
+	}
+
+	p.skip(false)
+	for _, c := range closing {
+		if p.eof() || p.next() != c {
+			return nil, p.errorf("expected %q to close table header", closing)
+		}
+	}
+
+	parent, err := p.descend(root, keys[:len(keys)-1], pos)
+	if err != nil {
+		return nil, err
+	}
+	last := keys[len(keys)-1]
+	existing, ok := parent.values[last]
+
+	if array {
+		if !ok {
+			existing = &tomlValue{tomlPosition: pos, value: []*tomlValue{}}
+			parent.set(last, existing)
+		}
+		elements, isArray := existing.value.([]*tomlValue)
+		if !isArray {
+			return nil, &tomlError{pos, fmt.Sprintf("key %q is already defined at %v", last, existing.tomlPosition)}
+		}
+		table := newTOMLTable(pos)
+		table.defined = true
+		existing.value = append(elements, &tomlValue{tomlPosition: pos, value: table})
+		return table, nil
+	}
+
+	if !ok {
+		table := newTOMLTable(pos)
+		table.defined = true
+		parent.set(last, &tomlValue{tomlPosition: pos, value: table})
+		return table, nil
+	}
+	if table, isTable := existing.value.(*tomlTable); isTable && !table.defined {
+		table.defined = true
+		return table, nil
+	}
+	return nil, &tomlError{pos, fmt.Sprintf("table %q is already defined at %v", strings.Join(keys, "."), existing.tomlPosition)}
+}
+
+// descend finds or creates the table at keys below table.
+func (p *tomlParser) descend(table *tomlTable, keys []string, pos tomlPosition) (*tomlTable, error) {
+	for _, key := range keys {
+		value, ok := table.values[key]
+		if !ok {
+			value = &tomlValue{tomlPosition: pos, value: newTOMLTable(pos)}
+			table.set(key, value)
+		}
+
+		switch v := value.value.(type) {
+		case *tomlTable:
+			table = v
+		case []*tomlValue:
+			if len(v) == 0 {
+				return nil, &tomlError{pos, fmt.Sprintf("key %q is not a table", key)}
+			}
+			if table, ok = v[len(v)-1].value.(*tomlTable); !ok {
+				return nil, &tomlError{pos, fmt.Sprintf("key %q is not a table", key)}
+			}
+		default:
+			return nil, &tomlError{pos, fmt.Sprintf("key %q is already defined at %v", key, value.tomlPosition)}
+		}
+	}
+	return table, nil
+}
+
+func (p *tomlParser) parseKey() ([]string, error) {
+	var keys []string
+
+	for {
+		p.skip(false)
+		if p.eof() {
+			return nil, p.errorf("expected a key")
+		}
+
+		switch c := p.peek(); {
+		case c == '"':
+			key, err := p.parseBasicString()
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		case c == '\'':
+			key, err := p.parseLiteralString()
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		default:
+			start := p.i
+			for !p.eof() && tomlIsBareKey(p.peek()) {
+				p.next()
+			}
+			if start == p.i {
+				return nil, p.errorf("unexpected %q, expected a key", c)
+			}
+			keys = append(keys, p.src[start:p.i])
+		}
+
+		p.skip(false)
+		if p.eof() || p.peek() != '.' {
+			return keys, nil
+		}
+		p.next()
+	}
+}
+
+func tomlIsBareKey(c rune) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') || c == '_' || c == '-'
+}
+
+func (p *tomlParser) parseKeyValue(table *tomlTable) error {
+	pos := p.tomlPosition
+	keys, err := p.parseKey()
+	if err != nil {
+		return err
+	}
+
+	p.skip(false)
+	if p.eof() || p.next() != '=' {
+		return p.errorf("expected %q after key", '=')
+	}
+	p.skip(false)
+
+	value, err := p.parseValue()
+	if err != nil {
+		return err
+	}
+	value.tomlPosition = pos
+
+	if table, err = p.descend(table, keys[:len(keys)-1], pos); err != nil {
+		return err
+	}
+	if last := keys[len(keys)-1]; !table.set(last, value) {
+		return &tomlError{pos, fmt.Sprintf("key %q is already defined at %v", last, table.values[last].tomlPosition)}
+	}
+	return nil
+}
+
+func (p *tomlParser) parseValue() (*tomlValue, error) {
+	pos := p.tomlPosition
+	if p.eof() {
+		return nil, p.errorf("expected a value")
+	}
+
+	switch c := p.peek(); {
+	case c == '"':
+		s, err := p.parseBasicString()
+		return &tomlValue{pos, s}, err
+	case c == '\'':
+		s, err := p.parseLiteralString()
+		return &tomlValue{pos, s}, err
+	case c == '[':
+		return p.parseArray()
+	case c == '{':
+		return p.parseInlineTable()
+	case strings.HasPrefix(p.src[p.i:], `true`):
+		p.i, p.column = p.i+4, p.column+4
+		return &tomlValue{pos, true}, nil
+	case strings.HasPrefix(p.src[p.i:], `false`):
+		p.i, p.column = p.i+5, p.column+5
+		return &tomlValue{pos, false}, nil
+	}
+
+	start := p.i
+	for !p.eof() && strings.ContainsRune(`+-_.0123456789eE`, p.peek()) {
+		p.next()
+	}
+	text := strings.Replace(p.src[start:p.i], `_`, ``, -1)
+	if text == `` {
+		return nil, &tomlError{pos, fmt.Sprintf("unexpected %q, expected a value", p.peek())}
+	}
+	if n, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return &tomlValue{pos, n}, nil
+	}
+	if f, err := strconv.ParseFloat(text, 64); err == nil {
+		return &tomlValue{pos, f}, nil
+	}
+	return nil, &tomlError{pos, fmt.Sprintf("invalid number %q", text)}
+}
+
+func (p *tomlParser) parseArray() (*tomlValue, error) {
+	result := &tomlValue{p.tomlPosition, []*tomlValue{}}
+	p.next()
+
+	for {
+		p.skip(true)
+		if p.eof() {
+			return nil, p.errorf("expected %q to close array", ']')
+		}
+		if p.peek() == ']' {
+			p.next()
+			return result, nil
+		}
+
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		result.value = append(result.value.([]*tomlValue), value)
+
+		p.skip(true)
+		if !p.eof() && p.peek() == ',' {
+			p.next()
+		} else if p.eof() || p.peek() != ']' {
+			return nil, p.errorf("expected %q or %q in array", ',', ']')
+		}
+	}
+}
+
+func (p *tomlParser) parseInlineTable() (*tomlValue, error) {
+	table := newTOMLTable(p.tomlPosition)
+	table.defined = true
+	p.next()
+
+	p.skip(false)
+	if !p.eof() && p.peek() == '}' {
+		p.next()
+		return &tomlValue{table.tomlPosition, table}, nil
+	}
+
+	for {
+		p.skip(false)
+		if err := p.parseKeyValue(table); err != nil {
+			return nil, err
+		}
+
+		p.skip(false)
+		if p.eof() {
+			return nil, p.errorf("expected %q to close inline table", '}')
+		}
+		switch p.next() {
+		case '}':
+			return &tomlValue{table.tomlPosition, table}, nil
+		case ',':
+		default:
+			return nil, p.errorf("expected %q or %q in inline table", ',', '}')
+		}
+	}
+}
+
+func (p *tomlParser) parseBasicString() (string, error) {
+	multiline := strings.HasPrefix(p.src[p.i:], `"""`)
+	if multiline {
+		p.next()
+		p.next()
+	}
+	p.next()
+	if multiline && !p.eof() && p.peek() == '\n' {
+		p.next()
+	} else if multiline && strings.HasPrefix(p.src[p.i:], "\r\n") {
+		p.next()
+		p.next()
+	}
+
+	var b strings.Builder
+	for {
+		if p.eof() {
+			return ``, p.errorf("unterminated string")
+		}
+		if multiline && strings.HasPrefix(p.src[p.i:], `"""`) {
+			p.next()
+			p.next()
+			p.next()
+			return b.String(), nil
+		}
+
+		switch c := p.next(); {
+		case c == '"' && !multiline:
+			return b.String(), nil
+		case c == '\n' && !multiline:
+			return ``, p.errorf("unterminated string")
+		case c == '\\':
+			if p.eof() {
+				return ``, p.errorf("unterminated string")
+			}
+			switch e := p.next(); e {
+			case 'b':
+				b.WriteByte('\b')
+			case 't':
+				b.WriteByte('\t')
+			case 'n':
+				b.WriteByte('\n')
+			case 'f':
+				b.WriteByte('\f')
+			case 'r':
+				b.WriteByte('\r')
+			case '"', '\\':
+				b.WriteRune(e)
+			case 'u', 'U':
+				n := map[rune]int{'u': 4, 'U': 8}[e]
+				if p.i+n > len(p.src) {
+					return ``, p.errorf("invalid unicode escape")
+				}
+				code, err := strconv.ParseUint(p.src[p.i:p.i+n], 16, 32)
+				if err != nil || !utf8.ValidRune(rune(code)) {
+					return ``, p.errorf("invalid unicode escape")
+				}
+				p.i, p.column = p.i+n, p.column+n
+				b.WriteRune(rune(code))
+			case '\n':
+				if !multiline {
+					return ``, p.errorf("invalid escape")
+				}
+				p.skip(true)
+			default:
+				return ``, p.errorf("invalid escape %q", e)
+			}
+		default:
+			b.WriteRune(c)
+		}
+	}
+}
+
+func (p *tomlParser) parseLiteralString() (string, error) {
+	multiline := strings.HasPrefix(p.src[p.i:], `'''`)
+	if multiline {
+		p.next()
+		p.next()
+	}
+	p.next()
+	if multiline && !p.eof() && p.peek() == '\n' {
+		p.next()
+	}
+
+	start := p.i
+	for {
+		if p.eof() {
+			return ``, p.errorf("unterminated string")
+		}
+		if multiline && strings.HasPrefix(p.src[p.i:], `'''`) {
+			s := p.src[start:p.i]
+			p.next()
+			p.next()
+			p.next()
+			return s, nil
+		}
+		switch p.peek() {
+		case '\'':
+			if !multiline {
+				s := p.src[start:p.i]
+				p.next()
+				return s, nil
+			}
+		case '\n':
+			if !multiline {
+				return ``, p.errorf("unterminated string")
+			}
+		}
+		p.next()
+	}
+}
@@ -0,0 +1,114 @@
+package pgbarrel
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// plain converts parsed TOML into maps and slices for comparison.
+func (v *tomlValue) plain() interface{} {
+	switch value := v.value.(type) {
+	case []*tomlValue:
+		result := make([]interface{}, len(value))
+		for i := range value {
+			result[i] = value[i].plain()
+		}
+		return result
+	case *tomlTable:
+		return value.plain()
+	}
+	return v.value
+}
+
+func (t *tomlTable) plain() map[string]interface{} {
+	result := make(map[string]interface{}, len(t.keys))
+	for _, key := range t.keys {
+		result[key] = t.values[key].plain()
+	}
+	return result
+}
+
+func TestParseTOML(t *testing.T) {
+	root, err := parseTOML(`
+# comment
+title = "basic \"string\"\t\u00e9" # trailing
+path = 'C:\literal'
+lines = """
+one
+two"""
+raw = '''
+a\b'''
+n = 1_000
+neg = -5
+f = 2.5
+yes = true
+list = [1, 2,
+  3, ] # trailing comma
+a.b."c.d" = 'dotted'
+inline = { x = 1, y = { z = "deep" } }
+
+[table]
+key = "value"
+
+[table.sub]
+other = false
+
+[[items]]
+name = "first"
+
+[[items]]
+name = "second"
+`)
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]interface{}{
+		"title": "basic \"string\"\t\u00e9",
+		"path":  `C:\literal`,
+		"lines": "one\ntwo",
+		"raw":   `a\b`,
+		"n":     int64(1000),
+		"neg":   int64(-5),
+		"f":     2.5,
+		"yes":   true,
+		"list":  []interface{}{int64(1), int64(2), int64(3)},
+		"a":     map[string]interface{}{"b": map[string]interface{}{"c.d": "dotted"}},
+		"inline": map[string]interface{}{
+			"x": int64(1), "y": map[string]interface{}{"z": "deep"},
+		},
+		"table": map[string]interface{}{
+			"key": "value",
+			"sub": map[string]interface{}{"other": false},
+		},
+		"items": []interface{}{
+			map[string]interface{}{"name": "first"},
+			map[string]interface{}{"name": "second"},
+		},
+	}, root.plain())
+
+	// values are positioned at their keys
+	assert.Equal(t, tomlPosition{line: 3, column: 1}, root.values["title"].tomlPosition)
+	assert.Equal(t, tomlPosition{line: 20, column: 1}, root.values["table"].value.(*tomlTable).values["key"].tomlPosition)
+}
+
+func TestParseTOMLError(t *testing.T) {
+	for _, tt := range []struct {
+		src      string
+		position tomlPosition
+	}{
+		{"a = 1\na = 2", tomlPosition{2, 1}},
+		{"a = ", tomlPosition{1, 5}},
+		{"a = \"open", tomlPosition{1, 10}},
+		{"a = 1 b = 2", tomlPosition{1, 7}},
+		{"[t]\n[t]", tomlPosition{2, 1}},
+		{"a = [1, 2", tomlPosition{1, 10}},
+		{"x = 1.2.3", tomlPosition{1, 5}},
+		{"= 1", tomlPosition{1, 1}},
+	} {
+		_, err := parseTOML(tt.src)
+		if assert.Error(t, err, "%q", tt.src) && assert.IsType(t, &tomlError{}, err, "%q", tt.src) {
+			assert.Equal(t, tt.position, err.(*tomlError).tomlPosition, "%q: %v", tt.src, err)
+		}
+	}
+}
@@ -0,0 +1,429 @@
+package pgbarrel
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A Span is a timed part of the work on one transaction. Its ParentID is zero
+// for the span of the whole transaction.
+type Span struct {
+	TraceID    [16]byte
+	ID         [8]byte
+	ParentID   [8]byte
+	Name       string
+	Start, End time.Time
+
+	// Attributes are string, int64, float64 or bool.
+	Attributes map[string]interface{}
+	// Error is the failure of the work, if any.
+	Error string
+}
+
+// A SpanExporter sends the spans of a transaction somewhere.
+type SpanExporter interface {
+	ExportSpans(ctx context.Context, spans []*Span) error
+}
+
+// A MemorySpanExporter keeps spans in memory.
+type MemorySpanExporter struct {
+	mutex sync.Mutex
+	spans []*Span
+}
+
+func NewMemorySpanExporter() *MemorySpanExporter { return &MemorySpanExporter{} }
+
+func (e *MemorySpanExporter) ExportSpans(ctx context.Context, spans []*Span) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+// Spans returns the spans exported so far.
+func (e *MemorySpanExporter) Spans() []*Span {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return append([]*Span(nil), e.spans...)
+}
+
+// A Tracer makes a trace of each transaction that passes through a Pipeline.
+// The root span covers the transaction from the receipt of its BEGIN to the
+// write of its COMMIT, and carries its xid, LSN, tables, operation counts,
+// and the time spent in decode and transforms. Its children are "receive",
+// from BEGIN to COMMIT at the receiver, one "apply" span for each run of
+// operations of the same kind on the same table written to the Sink, and
+// "commit".
+type Tracer struct {
+	exporter SpanExporter
+	now      func() time.Time
+
+	mutex    sync.Mutex
+	received map[string]*tracerReceipt
+
+	// touched only by the receiver
+	receipt *tracerReceipt
+
+	// touched only by the Pipeline
+	tx *tracerTransaction
+}
+
+type tracerReceipt struct {
+	begin, start, end time.Time
+	decode            time.Duration
+	messages, bytes   int64
+}
+
+type tracerTransaction struct {
+	root     *Span
+	spans    []*Span
+	batch    *Span
+	applying time.Duration
+	running  time.Duration
+	counts   map[string]int64
+	tables   map[string]bool
+}
+
+func NewTracer(exporter SpanExporter) *Tracer {
+	return &Tracer{exporter: exporter, now: time.Now, received: make(map[string]*tracerReceipt)}
+}
+
+// receive records a message of size bytes, received at arrived and decoded
+// into op in decode.
+func (t *Tracer) receive(op *ReplicationOperation, arrived time.Time, decode time.Duration, size int) {
+	if t == nil {
+		return
+	}
+	if op.Operation == `BEGIN` {
+		t.receipt = &tracerReceipt{begin: arrived, start: arrived}
+		t.mutex.Lock()
+		t.received[op.Position] = t.receipt
+		t.mutex.Unlock()
+	}
+	if t.receipt == nil {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.receipt.decode += decode
+	t.receipt.messages++
+	t.receipt.bytes += int64(size)
+	if op.Operation == `COMMIT` {
+		t.receipt.end = t.now()
+		t.receipt = nil
+	}
+}
+
+// apply records the write of op to a Sink from start.
+func (t *Tracer) apply(op *ReplicationOperation, start time.Time, err error) {
+	if t == nil || t.tx == nil {
+		return
+	}
+	tx, end := t.tx, t.now()
+	tx.applying += end.Sub(start)
+
+	if op.Operation == `BEGIN` {
+		return
+	}
+	if tx.batch != nil && (op.Operation == `COMMIT` ||
+		tx.batch.Attributes["operation"] != op.Operation || tx.batch.Attributes["table"] != op.Target) {
+		tx.spans = append(tx.spans, tx.batch)
+		tx.batch = nil
+	}
+
+	if op.Operation == `COMMIT` {
+		span := t.child("commit", start)
+		span.End = end
+		if err != nil {
+			span.Error = err.Error()
+		}
+		tx.spans = append(tx.spans, span)
+		return
+	}
+
+	if tx.batch == nil {
+		tx.batch = t.child("apply", start)
+		tx.batch.Attributes["operation"] = op.Operation
+		tx.batch.Attributes["table"] = op.Target
+		tx.batch.Attributes["operations"] = int64(0)
+	}
+	tx.batch.End = end
+	tx.batch.Attributes["operations"] = tx.batch.Attributes["operations"].(int64) + 1
+	if err != nil {
+		tx.batch.Error = err.Error()
+	}
+
+	tx.counts[op.Operation]++
+	tx.tables[op.Target] = true
+}
+
+// run records op from the Source, carried through the Pipeline from start.
+// The spans of a transaction are exported after its COMMIT, or a failure.
+func (t *Tracer) run(ctx context.Context, op *ReplicationOperation, start time.Time, err error) error {
+	if t == nil {
+		return nil
+	}
+
+	if op.Operation == `BEGIN` {
+		t.mutex.Lock()
+		receipt := t.received[op.Position]
+		delete(t.received, op.Position)
+		t.mutex.Unlock()
+
+		t.tx = &tracerTransaction{counts: make(map[string]int64), tables: make(map[string]bool)}
+		t.tx.root = &Span{Name: "transaction", Start: start, Attributes: map[string]interface{}{
+			"xid": op.Target, "begin_lsn": op.Position,
+		}}
+		rand.Read(t.tx.root.TraceID[:])
+		rand.Read(t.tx.root.ID[:])
+
+		if receipt != nil {
+			t.tx.root.Start = receipt.start
+			span := t.child("receive", receipt.start)
+			t.mutex.Lock()
+			span.End = receipt.end
+			span.Attributes["decode.seconds"] = receipt.decode.Seconds()
+			span.Attributes["messages"] = receipt.messages
+			span.Attributes["bytes"] = receipt.bytes
+			t.mutex.Unlock()
+			t.tx.spans = append(t.tx.spans, span)
+		}
+	}
+	if t.tx == nil {
+		return nil
+	}
+
+	tx := t.tx
+	tx.running += t.now().Sub(start)
+	if err == nil && op.Operation != `COMMIT` {
+		return nil
+	}
+	t.tx = nil
+
+	if tx.batch != nil {
+		tx.spans = append(tx.spans, tx.batch)
+	}
+
+	root := tx.root
+	root.End = t.now()
+	root.Attributes["lsn"] = op.Position
+	root.Attributes["transform.seconds"] = (tx.running - tx.applying).Seconds()
+	var total int64
+	for operation, n := range tx.counts {
+		root.Attributes["operations."+operation] = n
+		total += n
+	}
+	root.Attributes["operations"] = total
+	tables := make([]string, 0, len(tx.tables))
+	for table := range tx.tables {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	root.Attributes["tables"] = strings.Join(tables, ",")
+	if err != nil {
+		root.Error = err.Error()
+	}
+
+	return t.exporter.ExportSpans(ctx, append([]*Span{root}, tx.spans...))
+}
+
+// child returns a span of the current transaction from start.
+func (t *Tracer) child(name string, start time.Time) *Span {
+	span := &Span{TraceID: t.tx.root.TraceID, ParentID: t.tx.root.ID, Name: name, Start: start,
+		Attributes: make(map[string]interface{})}
+	rand.Read(span.ID[:])
+	return span
+}
+
+// An OTLPExporter sends spans to an OpenTelemetry collector with OTLP/HTTP in
+// JSON. It sends them in the background in batches of 512 spans, or every 5
+// seconds, and drops spans while 4096 are waiting; Close sends the rest.
+type OTLPExporter struct {
+	url, service string
+	client       *http.Client
+	interval     time.Duration
+
+	mutex   sync.Mutex
+	pending []*Span
+	err     error // of the last batch sent in the background
+
+	start, closing sync.Once
+	full           chan struct{}
+	stop, done     chan struct{}
+}
+
+const (
+	otlpBatch = 512
+	otlpQueue = 4096
+)
+
+// NewOTLPExporter returns an OTLPExporter that sends to url, e.g.
+// "http://collector:4318/v1/traces", as service. It uses client, or one that
+// times out after 10 seconds when client is nil.
+func NewOTLPExporter(url, service string, client *http.Client) *OTLPExporter {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &OTLPExporter{url: url, service: service, client: client, interval: 5 * time.Second,
+		full: make(chan struct{}, 1), stop: make(chan struct{}), done: make(chan struct{})}
+}
+
+// ExportSpans queues spans without waiting for the collector. It returns the
+// error of the last batch sent, or of spans it dropped.
+func (e *OTLPExporter) ExportSpans(ctx context.Context, spans []*Span) error {
+	e.start.Do(func() { go e.run() })
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	var dropped int
+	if room := otlpQueue - len(e.pending); len(spans) > room {
+		spans, dropped = spans[:room], len(spans)-room
+	}
+	e.pending = append(e.pending, spans...)
+	if len(e.pending) >= otlpBatch {
+		select {
+		case e.full <- struct{}{}:
+		default:
+		}
+	}
+
+	err := e.err
+	e.err = nil
+	if dropped > 0 {
+		err = errors.Errorf("OTLP queue is full; dropped %d spans", dropped)
+	}
+	return err
+}
+
+// run sends the waiting spans whenever a batch is full or interval passes.
+func (e *OTLPExporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.stop:
+			return
+		case <-e.full:
+		case <-ticker.C:
+		}
+
+		if err := e.send(context.Background()); err != nil {
+			e.mutex.Lock()
+			e.err = err
+			e.mutex.Unlock()
+		}
+	}
+}
+
+func (e *OTLPExporter) Close() error {
+	e.start.Do(func() { close(e.done) })
+	e.closing.Do(func() { close(e.stop) })
+	<-e.done
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return e.send(ctx)
+}
+
+// send posts the waiting spans.
+func (e *OTLPExporter) send(ctx context.Context) error {
+	e.mutex.Lock()
+	spans := e.pending
+	e.pending = nil
+	e.mutex.Unlock()
+
+	if len(spans) == 0 {
+		return nil
+	}
+
+	request, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(otlpEncode(e.service, spans)))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := e.client.Do(request.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+		return errors.Errorf("OTLP collector answered %d: %s", response.StatusCode, body)
+	}
+	return nil
+}
+
+// otlpEncode returns spans as an ExportTraceServiceRequest in JSON.
+func otlpEncode(service string, spans []*Span) []byte {
+	type object = map[string]interface{}
+
+	attributes := func(values map[string]interface{}) []object {
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		result := make([]object, 0, len(keys))
+		for _, key := range keys {
+			var value object
+			switch v := values[key].(type) {
+			case int64:
+				value = object{"intValue": fmt.Sprint(v)}
+			case float64:
+				value = object{"doubleValue": v}
+			case bool:
+				value = object{"boolValue": v}
+			default:
+				value = object{"stringValue": fmt.Sprint(v)}
+			}
+			result = append(result, object{"key": key, "value": value})
+		}
+		return result
+	}
+
+	encoded := make([]object, len(spans))
+	for i, span := range spans {
+		s := object{
+			"traceId":           hex.EncodeToString(span.TraceID[:]),
+			"spanId":            hex.EncodeToString(span.ID[:]),
+			"name":              span.Name,
+			"kind":              1, // internal
+			"startTimeUnixNano": fmt.Sprint(span.Start.UnixNano()),
+			"endTimeUnixNano":   fmt.Sprint(span.End.UnixNano()),
+			"attributes":        attributes(span.Attributes),
+		}
+		if span.ParentID != [8]byte{} {
+			s["parentSpanId"] = hex.EncodeToString(span.ParentID[:])
+		}
+		if span.Error != "" {
+			s["status"] = object{"code": 2, "message": span.Error}
+		}
+		encoded[i] = s
+	}
+
+	b, _ := json.Marshal(object{"resourceSpans": []object{{
+		"resource":   object{"attributes": attributes(map[string]interface{}{"service.name": service})},
+		"scopeSpans": []object{{"scope": object{"name": "pgbarrel"}, "spans": encoded}},
+	}}})
+	return b
+}
@@ -0,0 +1,198 @@
+package pgbarrel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTracer(t *testing.T) {
+	exporter := NewMemorySpanExporter()
+	tracer := NewTracer(exporter)
+
+	source := &testSource{}
+	source.ops = append(source.ops, testTransaction(`0/10`,
+		&ReplicationOperation{Operation: `INSERT`, Target: `public.a`},
+		&ReplicationOperation{Operation: `INSERT`, Target: `public.a`},
+		&ReplicationOperation{Operation: `UPDATE`, Target: `public.b`})...)
+	source.ops[0].Target = `553`
+	source.ops = append(source.ops, testTransaction(`0/20`,
+		&ReplicationOperation{Operation: `DELETE`, Target: `public.a`})...)
+
+	// as the receiver would
+	arrived := time.Now().Add(-time.Second)
+	for _, op := range source.ops[:5] {
+		tracer.receive(op, arrived, time.Millisecond, 10)
+	}
+
+	expected := errors.New("boom")
+	sink := &testSink{write: func(op *ReplicationOperation) error {
+		if op.Operation == `DELETE` {
+			return expected
+		}
+		return nil
+	}}
+	assert.Equal(t, expected, NewPipeline(source, sink).SetTracer(tracer).Run(context.Background()))
+
+	spans := exporter.Spans()
+	require.Len(t, spans, 7)
+
+	root := spans[0]
+	assert.Equal(t, "transaction", root.Name)
+	assert.Equal(t, [8]byte{}, root.ParentID)
+	assert.Equal(t, arrived, root.Start, "Expected the trace to start at receipt")
+	assert.True(t, root.End.After(root.Start))
+	assert.Empty(t, root.Error)
+	assert.Equal(t, `553`, root.Attributes["xid"])
+	assert.Equal(t, `0/10`, root.Attributes["begin_lsn"])
+	assert.Equal(t, `0/10`, root.Attributes["lsn"])
+	assert.Equal(t, `public.a,public.b`, root.Attributes["tables"])
+	assert.Equal(t, int64(3), root.Attributes["operations"])
+	assert.Equal(t, int64(2), root.Attributes["operations.INSERT"])
+	assert.Equal(t, int64(1), root.Attributes["operations.UPDATE"])
+	assert.Contains(t, root.Attributes, "transform.seconds")
+
+	var names []string
+	for _, span := range spans[1:5] {
+		assert.Equal(t, root.TraceID, span.TraceID)
+		assert.Equal(t, root.ID, span.ParentID)
+		assert.NotEqual(t, root.ID, span.ID)
+		names = append(names, span.Name)
+	}
+	assert.Equal(t, []string{"receive", "apply", "apply", "commit"}, names)
+
+	assert.Equal(t, map[string]interface{}{
+		"decode.seconds": 0.005, "messages": int64(5), "bytes": int64(50),
+	}, spans[1].Attributes)
+	assert.Equal(t, map[string]interface{}{
+		"operation": `INSERT`, "table": `public.a`, "operations": int64(2),
+	}, spans[2].Attributes, "Expected one span for both inserts")
+	assert.Equal(t, map[string]interface{}{
+		"operation": `UPDATE`, "table": `public.b`, "operations": int64(1),
+	}, spans[3].Attributes)
+
+	failed := spans[5]
+	assert.Equal(t, "transaction", failed.Name)
+	assert.NotEqual(t, root.TraceID, failed.TraceID)
+	assert.Equal(t, "boom", failed.Error)
+	assert.Equal(t, int64(1), failed.Attributes["operations.DELETE"])
+	assert.Equal(t, "apply", spans[6].Name)
+	assert.Equal(t, "boom", spans[6].Error)
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var requests []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		var request map[string]interface{}
+		require.NoError(t, json.Unmarshal(body, &request))
+		requests = append(requests, request)
+	}))
+	defer server.Close()
+
+	e := NewOTLPExporter(server.URL+"/v1/traces", "barrel", nil)
+	start := time.Unix(1, 5)
+	root := &Span{TraceID: [16]byte{1}, ID: [8]byte{2}, Name: "transaction", Start: start, End: start.Add(time.Second),
+		Attributes: map[string]interface{}{"xid": "553", "operations": int64(3), "ok": true, "seconds": 0.5}}
+	child := &Span{TraceID: [16]byte{1}, ID: [8]byte{3}, ParentID: [8]byte{2}, Name: "commit", Start: start, End: start,
+		Error: "boom"}
+
+	require.NoError(t, e.ExportSpans(context.Background(), []*Span{root, child}))
+	assert.Empty(t, requests, "Expected spans to be batched")
+	require.NoError(t, e.Close())
+	require.Len(t, requests, 1)
+
+	expected := `{"resourceSpans":[{
+		"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"barrel"}}]},
+		"scopeSpans":[{"scope":{"name":"pgbarrel"},"spans":[
+			{"traceId":"01000000000000000000000000000000","spanId":"0200000000000000","name":"transaction","kind":1,
+			 "startTimeUnixNano":"1000000005","endTimeUnixNano":"2000000005","attributes":[
+				{"key":"ok","value":{"boolValue":true}},
+				{"key":"operations","value":{"intValue":"3"}},
+				{"key":"seconds","value":{"doubleValue":0.5}},
+				{"key":"xid","value":{"stringValue":"553"}}]},
+			{"traceId":"01000000000000000000000000000000","spanId":"0300000000000000","parentSpanId":"0200000000000000",
+			 "name":"commit","kind":1,"startTimeUnixNano":"1000000005","endTimeUnixNano":"1000000005","attributes":[],
+			 "status":{"code":2,"message":"boom"}}]}]}]}`
+	actual, err := json.Marshal(requests[0])
+	require.NoError(t, err)
+	assert.JSONEq(t, expected, string(actual))
+
+	require.NoError(t, e.Close())
+	assert.Len(t, requests, 1, "Expected nothing to send")
+
+	t.Run("Error", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "nope", http.StatusBadRequest)
+		}))
+		defer server.Close()
+
+		e := NewOTLPExporter(server.URL, "barrel", nil)
+		require.NoError(t, e.ExportSpans(context.Background(), []*Span{root}))
+		assert.EqualError(t, e.Close(), "OTLP collector answered 400: nope\n")
+	})
+
+	t.Run("Background", func(t *testing.T) {
+		sizes := make(chan int, 10)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var request struct {
+				ResourceSpans []struct {
+					ScopeSpans []struct{ Spans []interface{} }
+				}
+			}
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+			sizes <- len(request.ResourceSpans[0].ScopeSpans[0].Spans)
+		}))
+		defer server.Close()
+
+		receive := func() int {
+			select {
+			case size := <-sizes:
+				return size
+			case <-time.After(5 * time.Second):
+				t.Fatal("Expected spans to be sent")
+			}
+			return 0
+		}
+
+		e := NewOTLPExporter(server.URL, "barrel", nil)
+		e.interval = 20 * time.Millisecond
+		require.NoError(t, e.ExportSpans(context.Background(), []*Span{root}))
+		assert.Equal(t, 1, receive(), "Expected spans to be sent after the interval")
+		require.NoError(t, e.Close())
+
+		e = NewOTLPExporter(server.URL, "barrel", nil)
+		e.interval = time.Hour
+		batch := make([]*Span, otlpBatch)
+		for i := range batch {
+			batch[i] = child
+		}
+		require.NoError(t, e.ExportSpans(context.Background(), batch))
+		assert.Equal(t, otlpBatch, receive(), "Expected a full batch to be sent")
+		require.NoError(t, e.Close())
+	})
+
+	t.Run("Full", func(t *testing.T) {
+		e := NewOTLPExporter("http://127.0.0.1:1", "barrel", nil)
+		e.start.Do(func() { close(e.done) }) // nothing sends
+
+		spans := make([]*Span, otlpQueue+3)
+		for i := range spans {
+			spans[i] = child
+		}
+		assert.EqualError(t, e.ExportSpans(context.Background(), spans), "OTLP queue is full; dropped 3 spans")
+		assert.Len(t, e.pending, otlpQueue)
+	})
+}
@@ -0,0 +1,739 @@
+package pgbarrel
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx"
+	"github.com/pkg/errors"
+)
+
+type VerifyOptions struct {
+	// Tables selects the tables of the source to verify.
+	Tables TableFilter
+	// Internal names the schemas of pgbarrel on the source, such as that of
+	// the resync watermark, whose tables are not verified. It defaults to
+	// "pgbarrel".
+	Internal []string
+	// Keys names the key columns of targets that have no primary key.
+	Keys map[string][]string
+	// ChunkSize is the number of rows of each hash. It defaults to 1000.
+	ChunkSize int
+	// Repair, when set, is written one transaction of the operations that
+	// make the target match the source.
+	Repair Sink
+}
+
+// A VerifyReport compares the tables of a source and a target.
+type VerifyReport struct {
+	// Position is the WAL position of the snapshot of the source. Rows
+	// changed after it differ until the target applies them.
+	Position string
+	// Applied is the position of the last transaction applied to the
+	// target, when it is known.
+	Applied string
+	Tables  []VerifyTable
+}
+
+// OK reports whether every table matches.
+func (r *VerifyReport) OK() bool {
+	for i := range r.Tables {
+		if !r.Tables[i].OK() {
+			return false
+		}
+	}
+	return true
+}
+
+// A VerifyTable compares one table in chunks of rows ordered by key.
+type VerifyTable struct {
+	Table                  string
+	SourceRows, TargetRows int
+	Chunks                 int
+
+	// Mismatches are the chunks whose hashes differ.
+	Mismatches []VerifyMismatch
+	// Extra is the number of target rows that are not in the source.
+	Extra int
+	// MissingColumns are the columns of the source not in the target.
+	MissingColumns []string
+}
+
+func (t *VerifyTable) OK() bool {
+	return len(t.Mismatches) == 0 && t.Extra == 0 && len(t.MissingColumns) == 0
+}
+
+// A VerifyMismatch is a range of keys, e.g. "(1)" to "(1000)", where the
+// source and target differ.
+type VerifyMismatch struct {
+	First, Last string
+	SourceHash  string
+	TargetHash  string
+
+	// Missing rows are not in the target; Different rows are not equal.
+	Missing, Different int
+}
+
+// verifySource reads the rows of one table of the source in key order, as
+// the text of their values.
+type verifySource struct {
+	target         string
+	columns, types []string
+	keys           []int
+	next           func() ([]*string, error)
+}
+
+// Verify compares the rows of tables in source, read in one snapshot, with
+// those applied to target in dialect by NewSQLSink. Rows are hashed in
+// chunks ordered by key, after their values are brought to a common form,
+// so that e.g. a boolean stored as 1 equals true. The target is read in the
+// key range of each chunk, and numerics compare as exact decimals.
+func Verify(ctx context.Context, source *pgx.Conn, target *sql.DB, dialect Dialect, options VerifyOptions) (*VerifyReport, error) {
+	tx, err := source.BeginEx(ctx, &pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	report := new(VerifyReport)
+	if err = tx.QueryRowEx(ctx, `SELECT pg_current_wal_lsn()::text`, nil).Scan(&report.Position); err != nil {
+		return nil, err
+	}
+
+	if options.Internal == nil {
+		options.Internal = []string{`pgbarrel`}
+	}
+	tables, err := pgTables(ctx, tx, options.Internal)
+	if err != nil {
+		return nil, err
+	}
+
+	v := verifier{options: options, db: target, dialect: dialect}
+	if v.options.ChunkSize <= 0 {
+		v.options.ChunkSize = 1000
+	}
+	if v.options.Repair != nil {
+		begin := &ReplicationOperation{Position: report.Position, Operation: `BEGIN`}
+		if err = v.options.Repair.Write(ctx, begin); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, table := range tables {
+		if !options.Tables.Filter(&ReplicationOperation{Operation: `INSERT`, Target: table}) {
+			continue
+		}
+		s, err := pgVerifySource(ctx, tx, table, options.Keys[table])
+		if err != nil {
+			return nil, err
+		}
+		result, err := v.table(ctx, s)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Unable to verify %s", table)
+		}
+		report.Tables = append(report.Tables, result)
+	}
+
+	if v.options.Repair != nil {
+		commit := &ReplicationOperation{Position: report.Position, Operation: `COMMIT`}
+		if err = v.options.Repair.Write(ctx, commit); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// pgTables returns the tables of the database as targets, except those of
+// the system and of the schemas in exclude.
+func pgTables(ctx context.Context, tx *pgx.Tx, exclude []string) ([]string, error) {
+	rows, err := tx.QueryEx(ctx, `
+		SELECT quote_ident(n.nspname) || '.' || quote_ident(c.relname)
+		FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind IN ('r', 'p') AND n.nspname <> 'information_schema' AND n.nspname NOT LIKE 'pg\_%'
+		  AND n.nspname <> ALL ($1::text[])
+		ORDER BY 1`, nil, exclude)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err = rows.Scan(&table); err != nil {
+			return nil, err
+		}
+		tables = append(tables, table)
+	}
+	return tables, rows.Err()
+}
+
+// pgQuerier is a *pgx.Conn or *pgx.Tx.
+type pgQuerier interface {
+	QueryEx(ctx context.Context, sql string, options *pgx.QueryExOptions, args ...interface{}) (*pgx.Rows, error)
+}
+
+// pgKeyedColumns returns the columns of target, quoted, their types, and the
+// indexes of its primary key columns, or keys.
+func pgKeyedColumns(ctx context.Context, q pgQuerier, target string, keys []string) (columns, types []string, indexes []int, err error) {
+	rows, err := q.QueryEx(ctx, `
+		SELECT quote_ident(a.attname), format_type(a.atttypid, a.atttypmod)
+		FROM pg_attribute a
+		WHERE a.attrelid = $1::regclass AND a.attnum > 0 AND NOT a.attisdropped
+		ORDER BY a.attnum`, nil, target)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for rows.Next() {
+		var column, typ string
+		if err = rows.Scan(&column, &typ); err != nil {
+			rows.Close()
+			return nil, nil, nil, err
+		}
+		columns, types = append(columns, column), append(types, typ)
+	}
+	if rows.Close(); rows.Err() != nil {
+		return nil, nil, nil, rows.Err()
+	}
+
+	if len(keys) == 0 {
+		rows, err = q.QueryEx(ctx, `
+			SELECT a.attname
+			FROM pg_index i
+			CROSS JOIN unnest(i.indkey::int2[]) WITH ORDINALITY k (attnum, n)
+			JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = k.attnum
+			WHERE i.indrelid = $1::regclass AND i.indisprimary
+			ORDER BY k.n`, nil, target)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		for rows.Next() {
+			var key string
+			if err = rows.Scan(&key); err != nil {
+				rows.Close()
+				return nil, nil, nil, err
+			}
+			keys = append(keys, key)
+		}
+		if rows.Close(); rows.Err() != nil {
+			return nil, nil, nil, rows.Err()
+		}
+	}
+	if len(keys) == 0 {
+		return nil, nil, nil, errors.Errorf("No key of %s; set its keys", target)
+	}
+
+	for _, key := range keys {
+		i := indexOf(columns, pgQuoteIdentifier(key))
+		if i < 0 {
+			return nil, nil, nil, errors.Errorf("No column %q in %s", key, target)
+		}
+		indexes = append(indexes, i)
+	}
+	return columns, types, indexes, nil
+}
+
+// pgVerifySource reads the columns of target in the order of its primary
+// key, or keys.
+func pgVerifySource(ctx context.Context, tx *pgx.Tx, target string, keys []string) (*verifySource, error) {
+	s := &verifySource{target: target}
+
+	var err error
+	if s.columns, s.types, s.keys, err = pgKeyedColumns(ctx, tx, target, keys); err != nil {
+		return nil, err
+	}
+
+	var selects, orders []string
+	for _, column := range s.columns {
+		selects = append(selects, column+`::text`)
+	}
+	for _, i := range s.keys {
+		orders = append(orders, s.columns[i])
+	}
+
+	data, err := tx.QueryEx(ctx, `SELECT `+strings.Join(selects, `, `)+` FROM `+target+` ORDER BY `+strings.Join(orders, `, `), nil)
+	if err != nil {
+		return nil, err
+	}
+	s.next = func() ([]*string, error) {
+		if !data.Next() {
+			data.Close()
+			if err := data.Err(); err != nil {
+				return nil, err
+			}
+			return nil, io.EOF
+		}
+		values, err := data.Values()
+		if err != nil {
+			data.Close()
+			return nil, err
+		}
+		row := make([]*string, len(values))
+		for i, value := range values {
+			if text, ok := value.(string); ok {
+				row[i] = &text
+			}
+		}
+		return row, nil
+	}
+	return s, nil
+}
+
+func indexOf(names []string, name string) int {
+	for i := range names {
+		if names[i] == name {
+			return i
+		}
+	}
+	return -1
+}
+
+type verifier struct {
+	options VerifyOptions
+	db      *sql.DB
+	dialect Dialect
+}
+
+// table compares the rows of s with those of its table in the target. It
+// reads the target in the key range of each chunk of the source, so only a
+// chunk of each is held, and writes repairs as it finds them.
+func (v *verifier) table(ctx context.Context, s *verifySource) (VerifyTable, error) {
+	result := VerifyTable{Table: s.target}
+	table := v.dialect.Table(s.target)
+
+	query, args := v.dialect.Columns(table)
+	names, err := v.strings(ctx, query, args...)
+	if err != nil {
+		return result, err
+	}
+	existing := make(map[string]bool)
+	for _, name := range names {
+		existing[v.dialect.QuoteIdentifier(name)] = true
+	}
+
+	// the columns in both, by their index in s; all when the table is missing
+	var both []int
+	for i, column := range s.columns {
+		if len(existing) == 0 || existing[v.dialect.QuoteIdentifier(pgUnquoteIdentifier(column))] {
+			both = append(both, i)
+		} else {
+			result.MissingColumns = append(result.MissingColumns, pgUnquoteIdentifier(column))
+		}
+	}
+
+	// a table without some columns is not repaired, as its rows would not match
+	repair := func(operation string, row []*string) error {
+		if v.options.Repair == nil || len(result.MissingColumns) > 0 {
+			return nil
+		}
+		return v.options.Repair.Write(ctx, verifyRepair(s, operation, row))
+	}
+
+	t := verifyTarget{verifier: v, source: s, table: table, both: both, exists: len(existing) > 0,
+		strays: make(map[string][]*string), claimed: make(map[string]bool)}
+
+	// compare hashes chunk, the source rows after the key lower, and the
+	// target rows after lower and up to its last key; to the end when last.
+	var lower []*string
+	compare := func(chunk [][]*string, last bool) error {
+		var upper []*string
+		if !last {
+			upper = chunk[len(chunk)-1]
+		}
+		found, err := t.read(ctx, lower, upper)
+		if err != nil {
+			return err
+		}
+
+		mismatch := VerifyMismatch{First: verifyDisplay(s, chunk[0]), Last: verifyDisplay(s, chunk[len(chunk)-1])}
+		sourceHash, targetHash := sha256.New(), sha256.New()
+		for _, raw := range chunk {
+			row := make([]*string, len(raw))
+			for _, i := range both {
+				row[i] = verifyValue(s.types[i], raw[i])
+			}
+			key := verifyKey(s.keys, row)
+			encoded := mustJSON(row)
+			sourceHash.Write(append(encoded, '\n'))
+
+			other, ok := found[key]
+			delete(found, key)
+			if !ok {
+				if other, err = t.find(ctx, key, raw); err != nil {
+					return err
+				}
+			}
+			switch {
+			case other == nil:
+				mismatch.Missing++
+				err = repair(`INSERT`, raw)
+			case !bytes.Equal(mustJSON(other), encoded):
+				mismatch.Different++
+				targetHash.Write(append(mustJSON(other), '\n'))
+				err = repair(`UPDATE`, raw)
+			default:
+				targetHash.Write(append(encoded, '\n'))
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		// rows of the range not in the chunk may be in a later one
+		t.stray(found)
+
+		result.Chunks++
+		mismatch.SourceHash = hex.EncodeToString(sourceHash.Sum(nil))
+		mismatch.TargetHash = hex.EncodeToString(targetHash.Sum(nil))
+		if mismatch.SourceHash != mismatch.TargetHash {
+			result.Mismatches = append(result.Mismatches, mismatch)
+		}
+		lower = upper
+		return nil
+	}
+
+	chunk := make([][]*string, 0, v.options.ChunkSize)
+	for {
+		raw, err := s.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return result, err
+		}
+		result.SourceRows++
+
+		if len(chunk) == v.options.ChunkSize {
+			if err = compare(chunk, false); err != nil {
+				return result, err
+			}
+			chunk = chunk[:0]
+		}
+		chunk = append(chunk, raw)
+	}
+	if len(chunk) > 0 {
+		err = compare(chunk, true)
+	} else {
+		var found map[string][]*string
+		if found, err = t.read(ctx, lower, nil); err == nil {
+			t.stray(found)
+		}
+	}
+	if err != nil {
+		return result, err
+	}
+	result.TargetRows = t.count
+
+	// the rows left are not in the source
+	for _, key := range t.order {
+		if row, ok := t.strays[key]; ok {
+			result.Extra++
+			if err := repair(`DELETE`, row); err != nil {
+				return result, err
+			}
+		}
+	}
+	return result, nil
+}
+
+// verifyTarget reads the rows of one table of the target, in common form.
+type verifyTarget struct {
+	*verifier
+	source *verifySource
+	table  string
+	both   []int
+	exists bool
+	count  int // of rows read by range
+
+	// rows read that matched no source row yet, in order, and the keys of
+	// rows matched before they were read
+	strays  map[string][]*string
+	order   []string
+	claimed map[string]bool
+}
+
+// read returns the rows with keys after lower and up to upper, either of
+// which may be nil for no bound, except those matched already.
+func (t *verifyTarget) read(ctx context.Context, lower, upper []*string) (map[string][]*string, error) {
+	found := make(map[string][]*string)
+	if !t.exists {
+		return found, nil
+	}
+
+	var conditions []string
+	var args []interface{}
+	for _, bound := range []struct {
+		key       []*string
+		op, final string
+	}{{lower, `>`, `>`}, {upper, `<`, `<=`}} {
+		if bound.key == nil {
+			continue
+		}
+		condition, err := t.bound(bound.key, bound.op, bound.final, &args)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, condition)
+	}
+
+	var where string
+	if len(conditions) > 0 {
+		where = ` WHERE ` + strings.Join(conditions, ` AND `)
+	}
+	err := t.rows(ctx, where, args, func(key string, row []*string) {
+		t.count++
+		if t.claimed[key] {
+			delete(t.claimed, key)
+		} else {
+			found[key] = row
+		}
+	})
+	return found, err
+}
+
+// bound returns the condition that the key of a row sorts after, with op
+// ">", or before, with op "<", the key of the source row values. The last
+// key column compares with final.
+func (t *verifyTarget) bound(values []*string, op, final string, args *[]interface{}) (string, error) {
+	var alternatives []string
+	for n := range t.source.keys {
+		var conditions []string
+		for j, i := range t.source.keys[:n+1] {
+			operator := `=`
+			if j == n {
+				operator = op
+				if n == len(t.source.keys)-1 {
+					operator = final
+				}
+			}
+			arg, err := t.dialect.Value(t.source.types[i], *values[i])
+			if err != nil {
+				return "", errors.Wrapf(err, "Invalid key of %s", t.source.target)
+			}
+			*args = append(*args, arg)
+			conditions = append(conditions, t.column(i)+` `+operator+` `+t.dialect.Placeholder(len(*args)))
+		}
+		alternatives = append(alternatives, `(`+strings.Join(conditions, ` AND `)+`)`)
+	}
+	return `(` + strings.Join(alternatives, ` OR `) + `)`, nil
+}
+
+// find returns the row with the key of raw, a source row, that the target
+// sorts outside its range, or nil.
+func (t *verifyTarget) find(ctx context.Context, key string, raw []*string) ([]*string, error) {
+	if row, ok := t.strays[key]; ok {
+		delete(t.strays, key)
+		return row, nil
+	}
+	if !t.exists {
+		return nil, nil
+	}
+
+	var conditions []string
+	var args []interface{}
+	for _, i := range t.source.keys {
+		arg, err := t.dialect.Value(t.source.types[i], *raw[i])
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid key of %s", t.source.target)
+		}
+		args = append(args, arg)
+		conditions = append(conditions, t.column(i)+` = `+t.dialect.Placeholder(len(args)))
+	}
+
+	var found []*string
+	err := t.rows(ctx, ` WHERE `+strings.Join(conditions, ` AND `), args, func(key string, row []*string) {
+		found = row
+	})
+	if found != nil {
+		t.claimed[key] = true
+	}
+	return found, err
+}
+
+// stray keeps rows that matched no source row of their range.
+func (t *verifyTarget) stray(rows map[string][]*string) {
+	for key, row := range rows {
+		t.strays[key] = row
+		t.order = append(t.order, key)
+	}
+	sort.Strings(t.order[len(t.order)-len(rows):])
+}
+
+// rows calls fn with each row of the table that matches where.
+func (t *verifyTarget) rows(ctx context.Context, where string, args []interface{}, fn func(key string, row []*string)) error {
+	quoted := make([]string, len(t.both))
+	for j, i := range t.both {
+		quoted[j] = t.column(i)
+	}
+	rows, err := t.db.QueryContext(ctx, `SELECT `+strings.Join(quoted, `, `)+` FROM `+t.table+where, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	values := make([]interface{}, len(t.both))
+	pointers := make([]interface{}, len(t.both))
+	for j := range values {
+		pointers[j] = &values[j]
+	}
+	for rows.Next() {
+		if err = rows.Scan(pointers...); err != nil {
+			return err
+		}
+		row := make([]*string, len(t.source.columns))
+		for j, i := range t.both {
+			row[i] = verifyValue(t.source.types[i], values[j])
+		}
+		fn(verifyKey(t.source.keys, row), row)
+	}
+	return rows.Err()
+}
+
+// column returns the ith column of the source as an identifier of the target.
+func (t *verifyTarget) column(i int) string {
+	return t.dialect.QuoteIdentifier(pgUnquoteIdentifier(t.source.columns[i]))
+}
+
+func (v *verifier) strings(ctx context.Context, query string, args ...interface{}) ([]string, error) {
+	rows, err := v.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var values []string
+	for rows.Next() {
+		var value string
+		if err = rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+func mustJSON(v interface{}) []byte {
+	b, _ := json.Marshal(v)
+	return b
+}
+
+// verifyKey returns the key columns of row as one string.
+func verifyKey(keys []int, row []*string) string {
+	values := make([]*string, len(keys))
+	for j, i := range keys {
+		values[j] = row[i]
+	}
+	return string(mustJSON(values))
+}
+
+// verifyDisplay returns the key of a source row as constants, e.g. "(1, 'a')".
+func verifyDisplay(s *verifySource, row []*string) string {
+	constants := make([]string, len(s.keys))
+	for j, i := range s.keys {
+		constants[j] = pgConstant(s.types[i], row[i])
+	}
+	return `(` + strings.Join(constants, `, `) + `)`
+}
+
+// verifyRepair returns an operation of a row of s: INSERT or UPDATE of the
+// source row, or DELETE of the key of a target row.
+func verifyRepair(s *verifySource, operation string, row []*string) *ReplicationOperation {
+	op := &ReplicationOperation{Operation: operation, Target: s.target}
+	if operation != `INSERT` {
+		for _, i := range s.keys {
+			op.OldColumns = append(op.OldColumns, s.columns[i])
+			op.OldTypes = append(op.OldTypes, s.types[i])
+			op.OldValues = append(op.OldValues, pgConstant(s.types[i], row[i]))
+		}
+	}
+	if operation != `DELETE` {
+		for i := range s.columns {
+			op.NewColumns = append(op.NewColumns, s.columns[i])
+			op.NewTypes = append(op.NewTypes, s.types[i])
+			op.NewValues = append(op.NewValues, pgConstant(s.types[i], row[i]))
+		}
+	}
+	return op
+}
+
+// verifyValue returns a value of the PostgreSQL type typ, from the source as
+// text or the target as a driver returns it, in a form common to both.
+func verifyValue(typ string, value interface{}) *string {
+	var s string
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case *string:
+		if v == nil {
+			return nil
+		}
+		s = *v
+	case string:
+		s = v
+	case []byte:
+		if typ == `bytea` {
+			s = `\x` + hex.EncodeToString(v)
+		} else {
+			s = string(v)
+		}
+	case bool:
+		s = strconv.FormatBool(v)
+	case int64:
+		if typ == `boolean` {
+			s = strconv.FormatBool(v != 0)
+		} else {
+			s = strconv.FormatInt(v, 10)
+		}
+	case float64:
+		s = strconv.FormatFloat(v, 'g', -1, 64)
+	case time.Time:
+		s = v.UTC().Format(time.RFC3339Nano)
+	default:
+		s = fmt.Sprint(v)
+	}
+
+	switch {
+	case typ == `boolean`:
+		switch strings.ToLower(s) {
+		case `t`, `true`, `1`:
+			s = `true`
+		case `f`, `false`, `0`:
+			s = `false`
+		}
+	case typ == `real`, typ == `double precision`:
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			s = strconv.FormatFloat(f, 'g', -1, 64)
+		}
+	case typ == `numeric`, strings.HasPrefix(typ, `numeric(`):
+		if r, ok := predicateDecimal(s); ok {
+			s = verifyDecimal(r)
+		}
+	case strings.HasPrefix(typ, `timestamp`):
+		if t, err := pgParseTimestamp(s, strings.HasSuffix(typ, `with time zone`)); err == nil {
+			s = t.UTC().Format(time.RFC3339Nano)
+		}
+	}
+	return &s
+}
+
+// verifyDecimal returns r in decimal with the fewest digits that are exact,
+// e.g. "12.3" for 12.30.
+func verifyDecimal(r *big.Rat) string {
+	scaled := new(big.Rat).Set(r)
+	var digits int
+	for ten := big.NewRat(10, 1); !scaled.IsInt() && digits < 1000; digits++ {
+		scaled.Mul(scaled, ten)
+	}
+	return r.FloatString(digits)
+}
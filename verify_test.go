@@ -0,0 +1,255 @@
+package pgbarrel
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testVerifySource returns a verifySource of public.t with rows of id, v, ok
+// and n, keyed by id.
+func testVerifySource(rows ...[]*string) *verifySource {
+	return &verifySource{
+		target:  `public.t`,
+		columns: []string{`id`, `v`, `ok`, `n`},
+		types:   []string{`integer`, `text`, `boolean`, `numeric(5,2)`},
+		keys:    []int{0},
+		next: func() ([]*string, error) {
+			if len(rows) == 0 {
+				return nil, io.EOF
+			}
+			row := rows[0]
+			rows = rows[1:]
+			return row, nil
+		},
+	}
+}
+
+func testVerifyRow(values ...string) []*string {
+	row := make([]*string, len(values))
+	for i := range values {
+		if values[i] != `NULL` {
+			row[i] = &values[i]
+		}
+	}
+	return row
+}
+
+func TestVerifier(t *testing.T) {
+	ctx := context.Background()
+	database := &testSQLDatabase{
+		tables: map[string][]string{"t": {"id", "v", "ok", "n"}},
+		rows: map[string][]map[string]driver.Value{"t": {
+			{"id": int64(9), "v": "extra", "ok": int64(0), "n": nil},
+			{"id": int64(1), "v": "a", "ok": int64(1), "n": 1.5},
+			{"id": int64(3), "v": "x", "ok": int64(0), "n": nil},
+			{"id": int64(4), "v": []byte("d"), "ok": int64(0), "n": 4.0},
+			{"id": int64(5), "v": nil, "ok": int64(1), "n": 0.25},
+		}},
+	}
+	db := sql.OpenDB(database)
+	defer db.Close()
+
+	repair := &testSink{}
+	v := verifier{options: VerifyOptions{ChunkSize: 2, Repair: repair}, db: db, dialect: SQLiteDialect{}}
+	result, err := v.table(ctx, testVerifySource(
+		testVerifyRow(`1`, `a`, `t`, `1.50`),
+		testVerifyRow(`2`, `b`, `false`, `NULL`),
+		testVerifyRow(`3`, `c`, `false`, `NULL`),
+		testVerifyRow(`4`, `d`, `f`, `4.00`),
+		testVerifyRow(`5`, `NULL`, `t`, `0.25`),
+	))
+	require.NoError(t, err)
+
+	assert.Equal(t, `public.t`, result.Table)
+	assert.Equal(t, 5, result.SourceRows)
+	assert.Equal(t, 5, result.TargetRows)
+	assert.Equal(t, 3, result.Chunks)
+	assert.Equal(t, 1, result.Extra)
+	assert.Empty(t, result.MissingColumns)
+	assert.False(t, result.OK())
+
+	require.Len(t, result.Mismatches, 2)
+	assert.Equal(t, `(1)`, result.Mismatches[0].First)
+	assert.Equal(t, `(2)`, result.Mismatches[0].Last)
+	assert.Equal(t, 1, result.Mismatches[0].Missing)
+	assert.Equal(t, 0, result.Mismatches[0].Different)
+	assert.NotEqual(t, result.Mismatches[0].SourceHash, result.Mismatches[0].TargetHash)
+	assert.Equal(t, `(3)`, result.Mismatches[1].First)
+	assert.Equal(t, `(4)`, result.Mismatches[1].Last)
+	assert.Equal(t, 0, result.Mismatches[1].Missing)
+	assert.Equal(t, 1, result.Mismatches[1].Different)
+
+	assert.Equal(t, []string{
+		`SELECT "id", "v", "ok", "n" FROM "t" WHERE (("id" <= ?))`,
+		`SELECT "id", "v", "ok", "n" FROM "t" WHERE "id" = ?`,
+		`SELECT "id", "v", "ok", "n" FROM "t" WHERE (("id" > ?)) AND (("id" <= ?))`,
+		`SELECT "id", "v", "ok", "n" FROM "t" WHERE (("id" > ?))`,
+	}, database.queries, "Expected the target to be read in the ranges of chunks")
+
+	var repairs []string
+	for _, op := range repair.ops {
+		repairs = append(repairs, op.String())
+	}
+	assert.Equal(t, []string{
+		`INSERT public.t new: id[integer]:2 v[text]:'b' ok[boolean]:false n[numeric(5,2)]:null`,
+		`UPDATE public.t old: id[integer]:3 new: id[integer]:3 v[text]:'c' ok[boolean]:false n[numeric(5,2)]:null`,
+		`DELETE public.t old: id[integer]:9`,
+	}, repairs)
+
+	t.Run("Match", func(t *testing.T) {
+		database.rows["t"] = database.rows["t"][1:2]
+		result, err := v.table(ctx, testVerifySource(testVerifyRow(`1`, `a`, `true`, `1.5`)))
+		require.NoError(t, err)
+		assert.True(t, result.OK())
+		assert.Equal(t, 1, result.Chunks)
+	})
+
+	t.Run("Order", func(t *testing.T) {
+		// the target sorts "b" before "a"
+		database.tables["k"] = []string{"id", "v"}
+		database.rows["k"] = []map[string]driver.Value{
+			{"id": "a", "v": "1"}, {"id": "B", "v": "2"}, {"id": "c", "v": "3"},
+		}
+		source := func(rows ...[]*string) *verifySource {
+			s := testVerifySource(rows...)
+			s.target, s.columns, s.types = `public.k`, []string{`id`, `v`}, []string{`text`, `text`}
+			return s
+		}
+
+		repair.ops = nil
+		result, err := v.table(ctx, source(testVerifyRow(`a`, `1`), testVerifyRow(`B`, `2`), testVerifyRow(`c`, `3`)))
+		require.NoError(t, err)
+		assert.True(t, result.OK(), "%+v", result)
+		assert.Equal(t, 3, result.TargetRows)
+		assert.Empty(t, repair.ops)
+
+		result, err = v.table(ctx, source(testVerifyRow(`B`, `2`), testVerifyRow(`a`, `1`), testVerifyRow(`c`, `3`)))
+		require.NoError(t, err)
+		assert.True(t, result.OK(), "%+v", result)
+		assert.Equal(t, 3, result.TargetRows)
+		assert.Empty(t, repair.ops)
+	})
+
+	t.Run("MissingColumns", func(t *testing.T) {
+		database.tables["t"] = []string{"id", "v"}
+		repair.ops = nil
+		result, err := v.table(ctx, testVerifySource(testVerifyRow(`1`, `a`, `true`, `1.5`)))
+		require.NoError(t, err)
+		assert.Equal(t, []string{`ok`, `n`}, result.MissingColumns)
+		assert.Empty(t, result.Mismatches)
+		assert.False(t, result.OK())
+		assert.Empty(t, repair.ops, "Expected no repair of a table without some columns")
+	})
+
+	t.Run("MissingTable", func(t *testing.T) {
+		delete(database.tables, "t")
+		delete(database.rows, "t")
+		repair.ops = nil
+		result, err := v.table(ctx, testVerifySource(testVerifyRow(`1`, `a`, `t`, `1.50`), testVerifyRow(`2`, `b`, `f`, `NULL`)))
+		require.NoError(t, err)
+		assert.Equal(t, 0, result.TargetRows)
+		require.Len(t, result.Mismatches, 1)
+		assert.Equal(t, 2, result.Mismatches[0].Missing)
+		assert.Len(t, repair.ops, 2)
+	})
+}
+
+func TestVerifyValue(t *testing.T) {
+	null := (*string)(nil)
+	for _, test := range []struct {
+		typ      string
+		value    interface{}
+		expected interface{}
+	}{
+		{`integer`, nil, null},
+		{`integer`, null, null},
+		{`integer`, int64(12), `12`},
+		{`integer`, `12`, `12`},
+		{`text`, []byte(`it's`), `it's`},
+		{`boolean`, `t`, `true`},
+		{`boolean`, int64(0), `false`},
+		{`boolean`, true, `true`},
+		{`numeric(5,2)`, `12.30`, `12.3`},
+		{`numeric`, 12.3, `12.3`},
+		{`numeric`, `-0.0`, `0`},
+		{`numeric`, `12345678901234567890.123456789`, `12345678901234567890.123456789`},
+		{`numeric`, int64(1200), `1200`},
+		{`numeric`, `NaN`, `NaN`},
+		{`double precision`, `1e+06`, `1e+06`},
+		{`double precision`, float64(1000000), `1e+06`},
+		{`bytea`, `\x0102`, `\x0102`},
+		{`bytea`, []byte{1, 2}, `\x0102`},
+		{`timestamp without time zone`, `2020-01-02 03:04:05.5`, `2020-01-02T03:04:05.5Z`},
+		{`timestamp with time zone`, `2020-01-02 03:04:05+02`, `2020-01-02T01:04:05Z`},
+		{`timestamp with time zone`, time.Date(2020, 1, 2, 1, 4, 5, 0, time.UTC), `2020-01-02T01:04:05Z`},
+	} {
+		actual := verifyValue(test.typ, test.value)
+		if test.expected == null {
+			assert.Nil(t, actual, "%s %#v", test.typ, test.value)
+		} else if assert.NotNil(t, actual, "%s %#v", test.typ, test.value) {
+			assert.Equal(t, test.expected, *actual, "%s %#v", test.typ, test.value)
+		}
+	}
+}
+
+func TestPostgreSQLVerify(t *testing.T) {
+	s := new(pgserver)
+	s.start(t)
+	defer s.stop(t)
+
+	c := s.mustConnect(t, "postgres")
+	defer c.Close()
+
+	require.NoError(t, InstallPostgreSQLResync(c, "pgbarrel"))
+	for _, sql := range []string{
+		`CREATE SCHEMA other`,
+		`CREATE TABLE public.t (a int, b text, n numeric, PRIMARY KEY (b, a))`,
+		`CREATE TABLE other."My Table" (id int)`,
+		`INSERT INTO public.t VALUES (2, 'x', 1.50), (1, 'y', NULL), (1, 'x', 12345678901234567890.1)`,
+	} {
+		_, err := c.Exec(sql)
+		require.NoError(t, err, sql)
+	}
+
+	ctx := context.Background()
+	tx, err := c.BeginEx(ctx, &pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	require.NoError(t, err)
+	defer tx.Rollback()
+
+	tables, err := pgTables(ctx, tx, []string{`pgbarrel`})
+	require.NoError(t, err)
+	assert.Equal(t, []string{`other."My Table"`, `public.t`}, tables, "Expected no tables of pgbarrel")
+
+	source, err := pgVerifySource(ctx, tx, `public.t`, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{`a`, `b`, `n`}, source.columns)
+	assert.Equal(t, []string{`integer`, `text`, `numeric`}, source.types)
+	assert.Equal(t, []int{1, 0}, source.keys)
+
+	var rows []string
+	for {
+		row, err := source.next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		rows = append(rows, verifyDisplay(source, row)+` `+pgConstant(`numeric`, row[2]))
+	}
+	assert.Equal(t, []string{`('x', 1) 12345678901234567890.1`, `('x', 2) 1.50`, `('y', 1) null`}, rows)
+
+	_, err = pgVerifySource(ctx, tx, `other."My Table"`, nil)
+	assert.EqualError(t, err, `No key of other."My Table"; set its keys`)
+
+	source, err = pgVerifySource(ctx, tx, `other."My Table"`, []string{`id`})
+	require.NoError(t, err)
+	_, err = source.next()
+	assert.Equal(t, io.EOF, err)
+}
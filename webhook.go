@@ -0,0 +1,363 @@
+package pgbarrel
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type WebhookOptions struct {
+	// URLs are the endpoints of each target. Those of "*" receive every
+	// target without endpoints of its own.
+	URLs map[string][]string
+
+	// Secret signs each request with the HMAC-SHA256 of its body in the
+	// X-Pgbarrel-Signature header, e.g. "sha256=5d7e...".
+	Secret []byte
+
+	// Encoder writes each event; the default is NewJSONEncoder.
+	Encoder Encoder
+
+	// BatchSize is how many events an endpoint may be waiting for before
+	// they are sent at a COMMIT. The default sends each transaction.
+	BatchSize int
+	// MaxWait is the longest a committed event waits for its batch to fill
+	// before it is sent anyway. Zero means one second and negative means no
+	// limit, when only BatchSize and Flush send a batch.
+	MaxWait time.Duration
+
+	// Retries is how many times a request is sent again after a 5xx, 429 or
+	// network error, 5 by default. Backoff is the wait before the first
+	// retry, doubling after each, 1 second by default.
+	Retries int
+	Backoff time.Duration
+
+	// DeadLetter is a file to which a batch is appended when an endpoint
+	// refuses it or retries are exhausted. Without it, the sink fails.
+	DeadLetter string
+
+	Client *http.Client
+}
+
+type webhookSink struct {
+	options WebhookOptions
+	durable func(position string)
+	sleep   func(ctx context.Context, d time.Duration) error
+
+	mutex       sync.Mutex
+	deadLetters sync.Mutex
+	pending     map[string][]json.RawMessage
+	count       int
+	commit      string
+	since       time.Time   // of the first event waiting
+	timer       *time.Timer // sends the batch after MaxWait
+	err         error       // of sending a batch after MaxWait
+
+	inTransaction bool // between BEGIN and COMMIT
+
+	// events of the transaction being written, for a CommitEncoder
+	transaction []webhookPlace
+}
+
+type webhookPlace struct {
+	url   string
+	index int
+}
+
+// NewWebhookSink returns a BufferedSink that POSTs batches of events to the
+// endpoints of their targets as JSON arrays. A batch is durable once every
+// endpoint has answered 2xx or the batch is in the dead letter file.
+func NewWebhookSink(options WebhookOptions) *webhookSink {
+	if options.Encoder == nil {
+		options.Encoder = NewJSONEncoder()
+	}
+	if options.BatchSize < 1 {
+		options.BatchSize = 1
+	}
+	if options.MaxWait == 0 {
+		options.MaxWait = time.Second
+	}
+	if options.Retries == 0 {
+		options.Retries = 5
+	}
+	if options.Backoff == 0 {
+		options.Backoff = time.Second
+	}
+	if options.Client == nil {
+		options.Client = http.DefaultClient
+	}
+
+	return &webhookSink{
+		options: options,
+		pending: make(map[string][]json.RawMessage),
+		sleep: func(ctx context.Context, d time.Duration) error {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(d):
+				return nil
+			}
+		},
+	}
+}
+
+func (s *webhookSink) OnDurable(durable func(position string)) { s.durable = durable }
+
+func (s *webhookSink) Write(ctx context.Context, op *ReplicationOperation) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+
+	event, err := s.options.Encoder.Encode(op)
+	if err != nil {
+		return err
+	}
+
+	switch op.Operation {
+	case `BEGIN`:
+		s.inTransaction = true
+		s.transaction = s.transaction[:0]
+		return nil
+	case `COMMIT`:
+		if err = s.committed(op); err != nil {
+			return err
+		}
+		s.inTransaction = false
+		s.commit = op.Position
+		switch {
+		case s.count == 0:
+			// nothing of this transaction or those before it is waiting
+			if s.durable != nil {
+				s.durable(s.commit)
+			}
+		case s.count >= s.options.BatchSize,
+			s.options.MaxWait > 0 && time.Since(s.since) >= s.options.MaxWait:
+			return s.send(ctx)
+		}
+		return nil
+	}
+
+	if event == nil {
+		return nil
+	}
+
+	urls, ok := s.options.URLs[op.Target]
+	if !ok {
+		urls = s.options.URLs["*"]
+	}
+	_, stamp := s.options.Encoder.(CommitEncoder)
+	for _, url := range urls {
+		if stamp {
+			s.transaction = append(s.transaction, webhookPlace{url, len(s.pending[url])})
+		}
+		s.pending[url] = append(s.pending[url], event)
+	}
+	if s.count == 0 {
+		s.since = time.Now()
+		if s.options.MaxWait > 0 {
+			s.timer = time.AfterFunc(s.options.MaxWait, s.expire)
+		}
+	}
+	s.count++
+	return nil
+}
+
+// expire sends the waiting batch after MaxWait unless a transaction is
+// open; its COMMIT sends the batch instead.
+func (s *webhookSink) expire() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.inTransaction || s.count == 0 || s.err != nil {
+		return
+	}
+	s.err = s.send(context.Background())
+}
+
+// committed passes the events of the transaction ending at commit to a
+// CommitEncoder.
+func (s *webhookSink) committed(commit *ReplicationOperation) error {
+	encoder, ok := s.options.Encoder.(CommitEncoder)
+	if !ok {
+		return nil
+	}
+	for _, place := range s.transaction {
+		event, err := encoder.Commit(s.pending[place.url][place.index], commit)
+		if err != nil {
+			return err
+		}
+		s.pending[place.url][place.index] = event
+	}
+	s.transaction = s.transaction[:0]
+	return nil
+}
+
+// Flush sends every batch that is waiting.
+func (s *webhookSink) Flush(ctx context.Context) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+	return s.send(ctx)
+}
+
+// send delivers every batch that is waiting. A batch an endpoint has taken is
+// not sent to it again when another endpoint fails.
+func (s *webhookSink) send(ctx context.Context) error {
+	var (
+		wait      sync.WaitGroup
+		mutex     sync.Mutex
+		first     error
+		delivered []string
+	)
+
+	for url, events := range s.pending {
+		wait.Add(1)
+		go func(url string, events []json.RawMessage) {
+			defer wait.Done()
+			err := s.deliver(ctx, url, events)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err == nil {
+				delivered = append(delivered, url)
+			} else if first == nil {
+				first = err
+			}
+		}(url, events)
+	}
+	wait.Wait()
+
+	for _, url := range delivered {
+		delete(s.pending, url)
+	}
+	if first != nil {
+		return first
+	}
+
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.pending = make(map[string][]json.RawMessage)
+	s.count = 0
+	s.transaction = s.transaction[:0]
+	if s.durable != nil && s.commit != "" {
+		s.durable(s.commit)
+	}
+	return nil
+}
+
+// deliver POSTs events to url until it answers 2xx, they are dead letters,
+// or it fails.
+func (s *webhookSink) deliver(ctx context.Context, url string, events []json.RawMessage) error {
+	body, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+
+	var status int
+	backoff := s.options.Backoff
+	for attempt := 0; ; attempt++ {
+		status, err = s.post(ctx, url, body)
+
+		switch {
+		case err == nil && status >= 200 && status < 300:
+			return nil
+		case err == nil && status < 500 && status != http.StatusTooManyRequests:
+			// the endpoint refused the batch
+		case attempt < s.options.Retries:
+			if err := s.sleep(ctx, backoff); err != nil {
+				return err
+			}
+			backoff *= 2
+			continue
+		}
+		break
+	}
+
+	if err == nil {
+		err = errors.Errorf("Webhook %s answered %d", url, status)
+	}
+	if s.options.DeadLetter == "" {
+		return err
+	}
+	return s.deadLetter(url, status, err, body)
+}
+
+func (s *webhookSink) post(ctx context.Context, url string, body []byte) (int, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Pgbarrel-Position", s.commit)
+	if len(s.options.Secret) > 0 {
+		request.Header.Set("X-Pgbarrel-Signature", "sha256="+WebhookSignature(s.options.Secret, body))
+	}
+
+	response, err := s.options.Client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+
+	return response.StatusCode, nil
+}
+
+// deadLetter appends a batch to the dead letter file, one JSON object per
+// line.
+func (s *webhookSink) deadLetter(url string, status int, cause error, body []byte) error {
+	line, err := json.Marshal(struct {
+		URL      string          `json:"url"`
+		Position string          `json:"position"`
+		Status   int             `json:"status,omitempty"`
+		Error    string          `json:"error"`
+		Events   json.RawMessage `json:"events"`
+	}{url, s.commit, status, cause.Error(), body})
+	if err != nil {
+		return err
+	}
+
+	// deliveries run concurrently
+	s.deadLetters.Lock()
+	defer s.deadLetters.Unlock()
+
+	f, err := os.OpenFile(s.options.DeadLetter, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(line, '\n')); err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// WebhookSignature returns the hex HMAC-SHA256 of body that endpoints can
+// compare with the X-Pgbarrel-Signature header.
+func WebhookSignature(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,229 @@
+package pgbarrel
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testWebhook struct {
+	*httptest.Server
+
+	mutex    sync.Mutex
+	statuses []int // answered before 200
+	bodies   []string
+	headers  []http.Header
+}
+
+func newTestWebhook(t *testing.T, statuses ...int) *testWebhook {
+	w := &testWebhook{statuses: statuses}
+	w.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, http.MethodPost, r.Method)
+
+		w.mutex.Lock()
+		defer w.mutex.Unlock()
+
+		if len(w.statuses) > 0 {
+			rw.WriteHeader(w.statuses[0])
+			w.statuses = w.statuses[1:]
+			return
+		}
+		w.bodies = append(w.bodies, string(body))
+		w.headers = append(w.headers, r.Header)
+	}))
+	t.Cleanup(w.Close)
+	return w
+}
+
+// testJSONEncoder encodes the message of testEncoder as a JSON string.
+type testJSONEncoder struct{ testEncoder }
+
+func (e testJSONEncoder) Encode(op *ReplicationOperation) ([]byte, error) {
+	message, err := e.testEncoder.Encode(op)
+	if message == nil || err != nil {
+		return message, err
+	}
+	return json.Marshal(string(message))
+}
+
+func TestWebhookSink(t *testing.T) {
+	ctx := context.Background()
+	orders := newTestWebhook(t, http.StatusServiceUnavailable, http.StatusBadGateway)
+	everything := newTestWebhook(t)
+
+	sink := NewWebhookSink(WebhookOptions{
+		URLs: map[string][]string{
+			`public.orders`: {orders.URL, everything.URL},
+			`*`:             {everything.URL},
+		},
+		Secret:  []byte(`secret`),
+		Encoder: testJSONEncoder{},
+		MaxWait: -1,
+	})
+
+	var sleeps []time.Duration
+	sink.sleep = func(ctx context.Context, d time.Duration) error {
+		sleeps = append(sleeps, d)
+		return nil
+	}
+
+	var durable []string
+	sink.OnDurable(func(position string) { durable = append(durable, position) })
+
+	write := func(ops ...*ReplicationOperation) error {
+		for _, op := range ops {
+			if err := sink.Write(ctx, op); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	require.NoError(t, write(
+		&ReplicationOperation{Position: `0/10`, Operation: `BEGIN`, Target: `1`},
+		&ReplicationOperation{Position: `0/10`, Operation: `INSERT`, Target: `public.orders`},
+		&ReplicationOperation{Position: `0/11`, Operation: `INSERT`, Target: `public.users`},
+		&ReplicationOperation{Position: `0/12`, Operation: `COMMIT`, Target: `1`},
+	))
+
+	assert.Equal(t, []string{`0/12`}, durable)
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second}, sleeps, "Expected backoff on 5xx")
+
+	assert.Equal(t, []string{`["INSERT 0/10"]`}, orders.bodies)
+	assert.Equal(t, []string{`["INSERT 0/10","INSERT 0/11"]`}, everything.bodies)
+
+	header := everything.headers[0]
+	assert.Equal(t, `application/json`, header.Get(`Content-Type`))
+	assert.Equal(t, `0/12`, header.Get(`X-Pgbarrel-Position`))
+	assert.Equal(t, `sha256=`+WebhookSignature([]byte(`secret`), []byte(everything.bodies[0])), header.Get(`X-Pgbarrel-Signature`))
+
+	t.Run("Batch", func(t *testing.T) {
+		sink.options.BatchSize = 2
+
+		require.NoError(t, write(
+			&ReplicationOperation{Position: `0/20`, Operation: `BEGIN`, Target: `2`},
+			&ReplicationOperation{Position: `0/20`, Operation: `INSERT`, Target: `public.users`},
+			&ReplicationOperation{Position: `0/21`, Operation: `COMMIT`, Target: `2`},
+		))
+		assert.Len(t, durable, 1, "Expected the batch to wait")
+
+		require.NoError(t, write(
+			&ReplicationOperation{Position: `0/30`, Operation: `BEGIN`, Target: `3`},
+			&ReplicationOperation{Position: `0/30`, Operation: `DELETE`, Target: `public.users`},
+			&ReplicationOperation{Position: `0/31`, Operation: `COMMIT`, Target: `3`},
+		))
+		assert.Equal(t, []string{`0/12`, `0/31`}, durable)
+		assert.Equal(t, `["INSERT 0/20","DELETE 0/30"]`, everything.bodies[1])
+	})
+
+	t.Run("NoEvents", func(t *testing.T) {
+		require.NoError(t, write(
+			&ReplicationOperation{Position: `0/32`, Operation: `BEGIN`, Target: `5`},
+			&ReplicationOperation{Position: `0/33`, Operation: `COMMIT`, Target: `5`},
+		))
+		assert.Equal(t, []string{`0/12`, `0/31`, `0/33`}, durable, "Expected nothing waiting to be durable")
+		durable = durable[:2]
+	})
+
+	t.Run("Failure", func(t *testing.T) {
+		sink.options.BatchSize = 1
+		orders.statuses = []int{500, 500, 500, 500, 500, 500}
+
+		err := write(
+			&ReplicationOperation{Position: `0/40`, Operation: `BEGIN`, Target: `4`},
+			&ReplicationOperation{Position: `0/40`, Operation: `INSERT`, Target: `public.orders`},
+			&ReplicationOperation{Position: `0/41`, Operation: `COMMIT`, Target: `4`},
+		)
+		assert.EqualError(t, err, `Webhook `+orders.URL+` answered 500`)
+		assert.Len(t, durable, 2, "Expected no acknowledgement")
+	})
+
+	t.Run("DeadLetter", func(t *testing.T) {
+		sink.options.DeadLetter = filepath.Join(t.TempDir(), "dead.jsonl")
+		orders.statuses = []int{http.StatusBadRequest}
+
+		require.NoError(t, sink.Flush(ctx))
+		assert.Equal(t, []string{`0/12`, `0/31`, `0/41`}, durable)
+		assert.Equal(t, []string{`["INSERT 0/40"]`}, everything.bodies[2:],
+			"Expected the endpoint that took the batch not to receive it again")
+
+		data, err := os.ReadFile(sink.options.DeadLetter)
+		require.NoError(t, err)
+
+		var letter map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(strings.TrimSpace(string(data))), &letter))
+		assert.Equal(t, map[string]interface{}{
+			"url": orders.URL, "position": "0/41", "status": float64(400),
+			"error":  "Webhook " + orders.URL + " answered 400",
+			"events": []interface{}{"INSERT 0/40"},
+		}, letter)
+	})
+}
+
+func TestWebhookSinkCommitEncoder(t *testing.T) {
+	ctx := context.Background()
+	endpoint := newTestWebhook(t)
+
+	encoder := NewDebeziumEncoder(DebeziumOptions{}).(*debeziumEncoder)
+	encoder.now = func() time.Time { return time.Unix(1500000000, 0) }
+	sink := NewWebhookSink(WebhookOptions{URLs: map[string][]string{`*`: {endpoint.URL}}, Encoder: encoder})
+
+	for _, op := range []*ReplicationOperation{
+		{Position: `0/10`, Operation: `BEGIN`, Target: `553`},
+		{Position: `0/10`, Operation: `INSERT`, Target: `public.t`,
+			NewColumns: []string{`id`}, NewValues: []string{`1`}, NewTypes: []string{`integer`}},
+		{Position: `0/18`, Operation: `COMMIT`, Target: `553 (at 2017-05-01 12:00:00+00)`},
+	} {
+		require.NoError(t, sink.Write(ctx, op))
+	}
+
+	require.Len(t, endpoint.bodies, 1)
+	assert.Contains(t, endpoint.bodies[0], `"name":"pgbarrel","ts_ms":1493640000000,`)
+	assert.Contains(t, endpoint.bodies[0], `"op":"c","ts_ms":1500000000000,`)
+}
+
+func TestWebhookSinkMaxWait(t *testing.T) {
+	ctx := context.Background()
+	endpoint := newTestWebhook(t)
+	sink := NewWebhookSink(WebhookOptions{
+		URLs:      map[string][]string{`*`: {endpoint.URL}},
+		Encoder:   testJSONEncoder{},
+		BatchSize: 10,
+		MaxWait:   20 * time.Millisecond,
+	})
+
+	durable := make(chan string, 1)
+	sink.OnDurable(func(position string) { durable <- position })
+
+	for _, op := range []*ReplicationOperation{
+		{Position: `0/10`, Operation: `BEGIN`, Target: `1`},
+		{Position: `0/10`, Operation: `INSERT`, Target: `public.t`},
+		{Position: `0/18`, Operation: `COMMIT`, Target: `1`},
+	} {
+		require.NoError(t, sink.Write(ctx, op))
+	}
+
+	select {
+	case position := <-durable:
+		assert.Equal(t, `0/18`, position)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the batch to be sent after MaxWait")
+	}
+
+	endpoint.mutex.Lock()
+	defer endpoint.mutex.Unlock()
+	assert.Equal(t, []string{`["INSERT 0/10"]`}, endpoint.bodies)
+}
@@ -0,0 +1,381 @@
+package pgbarrel
+
+import (
+	"encoding/binary"
+	"io"
+	"math/bits"
+)
+
+// A zstdWriter writes a Zstandard frame, RFC 8878. Each block of input is
+// compressed on its own by greedy matching of four bytes or more; literals
+// are stored raw and sequences coded with the predefined FSE tables, so no
+// tables or Huffman trees are written. It compresses less than zstd itself,
+// but the repetition of JSON Lines compresses well enough.
+type zstdWriter struct {
+	w      io.Writer
+	buffer []byte
+	header bool
+	err    error
+
+	// scratch for compressing a block
+	table     []int32
+	literals  []byte
+	sequences []zstdSequence
+	out       []byte
+}
+
+const (
+	zstdBlockSize    = 1 << 17 // also the window
+	zstdMinMatch     = 4
+	zstdHashLog      = 14
+	zstdBlockRaw     = 0
+	zstdBlockCompact = 2
+)
+
+type zstdSequence struct {
+	literals, offset, match uint32
+}
+
+func newZstdWriter(w io.Writer) *zstdWriter {
+	return &zstdWriter{w: w, table: make([]int32, 1<<zstdHashLog)}
+}
+
+func (z *zstdWriter) Write(p []byte) (int, error) {
+	if z.err != nil {
+		return 0, z.err
+	}
+	n := len(p)
+	for len(p) > 0 {
+		room := zstdBlockSize - len(z.buffer)
+		if room > len(p) {
+			room = len(p)
+		}
+		z.buffer = append(z.buffer, p[:room]...)
+		p = p[room:]
+
+		if len(z.buffer) == zstdBlockSize {
+			if z.err = z.block(false); z.err != nil {
+				return 0, z.err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Close writes the last block. It does not close the underlying writer.
+func (z *zstdWriter) Close() error {
+	if z.err == nil {
+		z.err = z.block(true)
+	}
+	return z.err
+}
+
+// block writes the buffered input as one block.
+func (z *zstdWriter) block(last bool) error {
+	out := z.out[:0]
+	if !z.header {
+		// Frame_Header_Descriptor without content size, checksum or
+		// dictionary, then a Window_Descriptor of 2^17 bytes.
+		out = append(out, 0x28, 0xB5, 0x2F, 0xFD, 0, (17-10)<<3)
+		z.header = true
+	}
+
+	start := len(out)
+	out = append(out, 0, 0, 0)
+	out = z.compress(out)
+
+	typ, size := zstdBlockCompact, len(out)-start-3
+	if len(z.buffer) == 0 || size >= len(z.buffer) {
+		typ, size = zstdBlockRaw, len(z.buffer)
+		out = append(out[:start+3], z.buffer...)
+	}
+
+	header := uint32(size)<<3 | uint32(typ)<<1
+	if last {
+		header |= 1
+	}
+	out[start], out[start+1], out[start+2] = byte(header), byte(header>>8), byte(header>>16)
+
+	z.out, z.buffer = out, z.buffer[:0]
+	_, err := z.w.Write(out)
+	return err
+}
+
+// compress appends the buffered input as the content of a compressed block.
+func (z *zstdWriter) compress(out []byte) []byte {
+	src := z.buffer
+	z.literals, z.sequences = z.literals[:0], z.sequences[:0]
+	for i := range z.table {
+		z.table[i] = -1
+	}
+
+	hash := func(i int) uint32 {
+		return (binary.LittleEndian.Uint32(src[i:]) * 2654435761) >> (32 - zstdHashLog)
+	}
+
+	anchor := 0
+	for i := 0; i+8 <= len(src); {
+		h := hash(i)
+		candidate := int(z.table[h])
+		z.table[h] = int32(i)
+
+		if candidate < 0 || binary.LittleEndian.Uint32(src[candidate:]) != binary.LittleEndian.Uint32(src[i:]) {
+			i++
+			continue
+		}
+
+		// extend the match backward over literals and forward
+		for i > anchor && candidate > 0 && src[i-1] == src[candidate-1] {
+			i, candidate = i-1, candidate-1
+		}
+		length := zstdMinMatch
+		for i+length < len(src) && src[i+length] == src[candidate+length] {
+			length++
+		}
+
+		z.literals = append(z.literals, src[anchor:i]...)
+		z.sequences = append(z.sequences, zstdSequence{
+			literals: uint32(i - anchor),
+			offset:   uint32(i - candidate),
+			match:    uint32(length),
+		})
+		i += length
+		anchor = i
+	}
+	z.literals = append(z.literals, src[anchor:]...)
+
+	// Literals_Section of Raw_Literals_Block
+	switch n := len(z.literals); {
+	case n < 1<<5:
+		out = append(out, byte(n<<3))
+	case n < 1<<12:
+		out = append(out, byte(1<<2|n<<4), byte(n>>4))
+	default:
+		out = append(out, byte(3<<2|n<<4), byte(n>>4), byte(n>>12))
+	}
+	out = append(out, z.literals...)
+
+	// Sequences_Section_Header with the predefined mode of each table
+	switch n := len(z.sequences); {
+	case n == 0:
+		return append(out, 0)
+	case n < 0x80:
+		out = append(out, byte(n))
+	case n < 0x7F00:
+		out = append(out, byte(n>>8)+0x80, byte(n))
+	default:
+		out = append(out, 0xFF, byte(n-0x7F00), byte((n-0x7F00)>>8))
+	}
+	out = append(out, 0)
+
+	return z.encode(out)
+}
+
+// encode appends the bitstream of the sequences. The decoder reads it from
+// the end, so the last sequence is written first.
+func (z *zstdWriter) encode(out []byte) []byte {
+	b := zstdBits{out: out}
+	codes := func(s zstdSequence) (ll, ml, of zstdCode) {
+		return zstdCodeOf(zstdLiteralCodes, s.literals), zstdCodeOf(zstdMatchCodes, s.match),
+			zstdOffsetCode(s.offset + 3)
+	}
+
+	last := z.sequences[len(z.sequences)-1]
+	ll, ml, of := codes(last)
+	llState := zstdLiteralTable.begin(ll.code)
+	mlState := zstdMatchTable.begin(ml.code)
+	ofState := zstdOffsetTable.begin(of.code)
+	b.add(ll.extra, ll.bits)
+	b.add(ml.extra, ml.bits)
+	b.add(of.extra, of.bits)
+
+	for n := len(z.sequences) - 2; n >= 0; n-- {
+		ll, ml, of := codes(z.sequences[n])
+		zstdOffsetTable.encode(&b, &ofState, of.code)
+		zstdMatchTable.encode(&b, &mlState, ml.code)
+		zstdLiteralTable.encode(&b, &llState, ll.code)
+		b.add(ll.extra, ll.bits)
+		b.add(ml.extra, ml.bits)
+		b.add(of.extra, of.bits)
+	}
+
+	b.add(mlState, zstdMatchTable.log)
+	b.add(ofState, zstdOffsetTable.log)
+	b.add(llState, zstdLiteralTable.log)
+	return b.close()
+}
+
+// zstdBits writes a bitstream from the least significant bit.
+type zstdBits struct {
+	out       []byte
+	container uint64
+	count     uint
+}
+
+func (b *zstdBits) add(value uint32, n uint) {
+	b.container |= uint64(value) & (1<<n - 1) << b.count
+	b.count += n
+	for b.count >= 8 {
+		b.out = append(b.out, byte(b.container))
+		b.container >>= 8
+		b.count -= 8
+	}
+}
+
+// close ends the stream with a 1 bit and pads it to a byte.
+func (b *zstdBits) close() []byte {
+	b.add(1, 1)
+	if b.count > 0 {
+		b.out = append(b.out, byte(b.container))
+	}
+	return b.out
+}
+
+// A zstdCode is the code of a value and the extra bits beyond its baseline.
+type zstdCode struct {
+	code, extra uint32
+	bits        uint
+}
+
+// zstdBaseline is the first value of a code and its number of extra bits.
+type zstdBaseline struct {
+	value uint32
+	bits  uint
+}
+
+var (
+	// RFC 8878, 3.1.1.3.2.1.1
+	zstdLiteralCodes = zstdBaselines(0, 16, []zstdBaseline{
+		{16, 1}, {18, 1}, {20, 1}, {22, 1}, {24, 2}, {28, 2}, {32, 3}, {40, 3},
+		{48, 4}, {64, 6}, {128, 7}, {256, 8}, {512, 9}, {1024, 10}, {2048, 11},
+		{4096, 12}, {8192, 13}, {16384, 14}, {32768, 15}, {65536, 16},
+	})
+	zstdMatchCodes = zstdBaselines(3, 32, []zstdBaseline{
+		{35, 1}, {37, 1}, {39, 1}, {41, 1}, {43, 2}, {47, 2}, {51, 3}, {59, 3},
+		{67, 4}, {83, 4}, {99, 5}, {131, 7}, {259, 8}, {515, 9}, {1027, 10},
+		{2051, 11}, {4099, 12}, {8195, 13}, {16387, 14}, {32771, 15}, {65539, 16},
+	})
+)
+
+// zstdBaselines returns n codes of the values from first without extra bits,
+// then the rest.
+func zstdBaselines(first uint32, n int, rest []zstdBaseline) []zstdBaseline {
+	baselines := make([]zstdBaseline, n, n+len(rest))
+	for i := range baselines {
+		baselines[i].value = first + uint32(i)
+	}
+	return append(baselines, rest...)
+}
+
+func zstdCodeOf(baselines []zstdBaseline, value uint32) zstdCode {
+	code := len(baselines) - 1
+	for baselines[code].value > value {
+		code--
+	}
+	return zstdCode{code: uint32(code), extra: value - baselines[code].value, bits: baselines[code].bits}
+}
+
+// zstdOffsetCode codes an Offset_Value, which is the offset plus 3.
+func zstdOffsetCode(value uint32) zstdCode {
+	n := uint(bits.Len32(value) - 1)
+	return zstdCode{code: uint32(n), extra: value - 1<<n, bits: n}
+}
+
+// A zstdTable encodes symbols of a normalized distribution, as
+// FSE_buildCTable does in the reference implementation.
+type zstdTable struct {
+	log       uint
+	states    []uint32
+	symbols   []zstdTransform
+	tableSize uint32
+}
+
+type zstdTransform struct {
+	deltaBits  uint32
+	deltaState int32
+}
+
+// RFC 8878, 3.1.1.3.2.2
+var (
+	zstdLiteralTable = newZstdTable(6, []int16{
+		4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1,
+		-1, -1, -1, -1,
+	})
+	zstdMatchTable = newZstdTable(6, []int16{
+		1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1,
+		-1, -1, -1, -1, -1,
+	})
+	zstdOffsetTable = newZstdTable(5, []int16{
+		1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1,
+	})
+)
+
+func newZstdTable(log uint, distribution []int16) *zstdTable {
+	size := uint32(1) << log
+	t := &zstdTable{log: log, tableSize: size, states: make([]uint32, size), symbols: make([]zstdTransform, len(distribution))}
+
+	// spread the symbols over the states, those of probability -1 last
+	spread := make([]int, size)
+	cumulative := make([]uint32, len(distribution)+1)
+	high := size - 1
+	for s, p := range distribution {
+		if p == -1 {
+			cumulative[s+1] = cumulative[s] + 1
+			spread[high] = s
+			high--
+		} else {
+			cumulative[s+1] = cumulative[s] + uint32(p)
+		}
+	}
+	step, mask, position := size>>1+size>>3+3, size-1, uint32(0)
+	for s, p := range distribution {
+		for i := int16(0); i < p; i++ {
+			spread[position] = s
+			for position = (position + step) & mask; position > high; {
+				position = (position + step) & mask
+			}
+		}
+	}
+
+	next := append([]uint32(nil), cumulative...)
+	for u := uint32(0); u < size; u++ {
+		s := spread[u]
+		t.states[next[s]] = size + u
+		next[s]++
+	}
+
+	var total int32
+	for s, p := range distribution {
+		switch p {
+		case 0:
+		case -1, 1:
+			t.symbols[s] = zstdTransform{deltaBits: uint32(log)<<16 - size, deltaState: total - 1}
+			total++
+		default:
+			out := uint32(log) - uint32(bits.Len32(uint32(p)-1)-1)
+			t.symbols[s] = zstdTransform{deltaBits: out<<16 - uint32(p)<<out, deltaState: total - int32(p)}
+			total += int32(p)
+		}
+	}
+	return t
+}
+
+// begin returns the first state, that of symbol.
+func (t *zstdTable) begin(symbol uint32) uint32 {
+	tt := t.symbols[symbol]
+	out := (tt.deltaBits + 1<<15) >> 16
+	value := out<<16 - tt.deltaBits
+	return t.states[int32(value>>out)+tt.deltaState]
+}
+
+// encode writes the bits of state that move it to symbol.
+func (t *zstdTable) encode(b *zstdBits, state *uint32, symbol uint32) {
+	tt := t.symbols[symbol]
+	out := (*state + tt.deltaBits) >> 16
+	b.add(*state, uint(out))
+	*state = t.states[int32(*state>>out)+tt.deltaState]
+}
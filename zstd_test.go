@@ -0,0 +1,61 @@
+package pgbarrel
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestZstdWriter(t *testing.T) {
+	if _, err := exec.LookPath("zstd"); err != nil {
+		t.Skip("zstd is not installed")
+	}
+
+	var lines bytes.Buffer
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&lines, `{"position":"0/%X","operation":"INSERT","target":"public.t","new":{"id":%d}}`+"\n", i*16, i)
+	}
+	random := make([]byte, 200000)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	for _, tt := range []struct {
+		name  string
+		input []byte
+	}{
+		{"empty", []byte{}},
+		{"short", []byte("abc")},
+		{"repeated", bytes.Repeat([]byte("pgbarrel "), 100)},
+		{"lines", lines.Bytes()},
+		{"random", random},
+	} {
+		var compressed bytes.Buffer
+		w := newZstdWriter(&compressed)
+		for input := tt.input; len(input) > 0; {
+			n := 1000
+			if n > len(input) {
+				n = len(input)
+			}
+			_, err := w.Write(input[:n])
+			require.NoError(t, err)
+			input = input[n:]
+		}
+		require.NoError(t, w.Close())
+
+		cmd := exec.Command("zstd", "--decompress", "--stdout")
+		cmd.Stdin = &compressed
+		output, err := cmd.Output()
+		require.NoError(t, err, tt.name)
+		assert.Equal(t, tt.input, output, tt.name)
+	}
+
+	var compressed bytes.Buffer
+	w := newZstdWriter(&compressed)
+	w.Write(lines.Bytes())
+	w.Close()
+	assert.Less(t, compressed.Len(), lines.Len()/4, "Expected lines to compress")
+}